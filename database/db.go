@@ -41,6 +41,23 @@ func initModels() error {
 		&model.Node{},
 		&model.MultiSubscription{},
 		&model.NodeStats{},
+		&model.NodeStatsRollup{},
+		&model.NodeStatusEvent{},
+		&model.NodeUptimeRollup{},
+		&model.NodeInboundSpec{},
+		&model.GlobalClient{},
+		&model.GlobalClientTraffic{},
+		&model.ApiKey{},
+		&model.ApiKeyAudit{},
+		&model.RateLimitBucket{},
+		&model.SubscriptionAccess{},
+		&model.SubscriptionToken{},
+		&model.SubscriptionTokenDevice{},
+		&model.SubscriptionPolicy{},
+		&model.ClientTrafficBucket{},
+		&model.TrafficBucket{},
+		&model.Plan{},
+		&model.ClientPlanHistory{},
 	}
 	for _, model := range models {
 		if err := db.AutoMigrate(model); err != nil {
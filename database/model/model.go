@@ -2,8 +2,14 @@
 package model
 
 import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"net"
+	"strings"
 
+	"github.com/mhsanaei/3x-ui/v2/util/common"
 	"github.com/mhsanaei/3x-ui/v2/util/json_util"
 	"github.com/mhsanaei/3x-ui/v2/xray"
 )
@@ -118,6 +124,12 @@ type Client struct {
 	Reset      int    `json:"reset" form:"reset"`           // Reset period in days
 	CreatedAt  int64  `json:"created_at,omitempty"`         // Creation timestamp
 	UpdatedAt  int64  `json:"updated_at,omitempty"`         // Last update timestamp
+
+	ResetSchedule string `json:"resetSchedule,omitempty"` // Traffic reset schedule: "daily", "weekly", "monthly" or "cron"
+	ResetDay      int    `json:"resetDay,omitempty"`      // Weekday (0 = Sunday) or billing day of month (0 = day of creation)
+	ResetCron     string `json:"resetCron,omitempty"`     // Standard cron expression for the "cron" schedule
+	PlanId        int    `json:"planId,omitempty"`        // Billing plan last applied to the client
+	Group         string `json:"group,omitempty"`         // Client group for bulk actions
 }
 
 // NodeStatus represents the status of a node
@@ -136,6 +148,9 @@ type Node struct {
 	Host        string     `json:"host" form:"host"`                                                    // IP address or domain
 	Port        int        `json:"port" form:"port"`                                                    // API port
 	ApiKey      string     `json:"apiKey" form:"apiKey"`                                                // API key for authentication
+	AuthMode    string     `json:"authMode" form:"authMode" gorm:"default:key"`                         // key, hmac or mtls
+	ClientCert  string     `json:"clientCert" form:"clientCert"`                                        // PEM client certificate for mtls
+	ClientKey   string     `json:"clientKey" form:"clientKey"`                                          // PEM client private key for mtls
 	Protocol    string     `json:"protocol" form:"protocol" gorm:"default:https"`                       // http or https
 	Location    string     `json:"location" form:"location"`                                            // Location name (e.g., "Moscow")
 	Country     string     `json:"country" form:"country"`                                              // Country code (ISO 3166-1 alpha-2)
@@ -146,10 +161,34 @@ type Node struct {
 	Status      NodeStatus `json:"status" form:"status" gorm:"default:offline"`                         // Node status: online, offline, error
 	LastCheck   int64      `json:"lastCheck" form:"lastCheck" gorm:"default:0"`                         // Last status check timestamp
 	Remark      string     `json:"remark" form:"remark"`                                                // Remark/notes
+	Managed     bool       `json:"managed" form:"managed" gorm:"default:false"`                         // Whether inbounds are reconciled against NodeInboundSpec records
+	Endpoints   string     `json:"endpoints" form:"endpoints"`                                          // JSON array of NodeEndpoint, client-facing addresses of the node
 	CreatedAt   int64      `json:"createdAt" form:"createdAt" gorm:"autoCreateTime"`                    // Creation timestamp
 	UpdatedAt   int64      `json:"updatedAt" form:"updatedAt" gorm:"autoUpdateTime"`                    // Last update timestamp
 }
 
+// NodeEndpoint is an address clients use to reach a node when it differs from the API host,
+// e.g. a public domain, a CDN front or another IP.
+type NodeEndpoint struct {
+	Address string `json:"address"` // Client-facing domain or IP, empty for the node host
+	Port    int    `json:"port"`    // Port override, 0 keeps the inbound port
+	Sni     string `json:"sni"`     // TLS server name override
+	Host    string `json:"host"`    // Host header override for transports that send one
+	Remark  string `json:"remark"`  // Added to the link remark
+}
+
+// GetEndpoints parses the client-facing endpoints of the node.
+func (n *Node) GetEndpoints() ([]NodeEndpoint, error) {
+	if strings.TrimSpace(n.Endpoints) == "" {
+		return nil, nil
+	}
+	var endpoints []NodeEndpoint
+	if err := json.Unmarshal([]byte(n.Endpoints), &endpoints); err != nil {
+		return nil, err
+	}
+	return endpoints, nil
+}
+
 // MultiSubscription represents a subscription that combines multiple nodes.
 type MultiSubscription struct {
 	Id        int    `json:"id" form:"id" gorm:"primaryKey;autoIncrement"`     // Unique identifier
@@ -177,5 +216,372 @@ type NodeStats struct {
 	XrayStatus  string  `json:"xrayStatus" form:"xrayStatus" gorm:"default:stop"`       // Xray status: running, stop, error
 	Clients     int     `json:"clients" form:"clients" gorm:"default:0"`                // Number of active clients
 	Inbounds    int     `json:"inbounds" form:"inbounds" gorm:"default:0"`              // Number of inbounds
-	CollectedAt int64   `json:"collectedAt" form:"collectedAt" gorm:"autoCreateTime"`   // Statistics collection timestamp
+	CollectedAt int64   `json:"collectedAt" form:"collectedAt" gorm:"autoCreateTime;index"` // Statistics collection timestamp
+}
+
+// NodeStatsRollup aggregates NodeStats samples of a node over an hour or a day.
+type NodeStatsRollup struct {
+	Id          int     `json:"id" gorm:"primaryKey;autoIncrement"`                             // Unique identifier
+	NodeId      int     `json:"nodeId" gorm:"uniqueIndex:idx_node_stats_rollup,priority:1"`     // Node ID
+	Resolution  string  `json:"resolution" gorm:"uniqueIndex:idx_node_stats_rollup,priority:2"` // hour or day
+	BucketStart int64   `json:"time" gorm:"uniqueIndex:idx_node_stats_rollup,priority:3;index"` // Start of the bucket, UTC aligned
+	Samples     int     `json:"samples"`                                                        // Number of raw samples aggregated
+	CpuMin      float64 `json:"cpuMin"`
+	CpuMax      float64 `json:"cpuMax"`
+	CpuAvg      float64 `json:"cpuAvg"`
+	MemMin      float64 `json:"memMin"`
+	MemMax      float64 `json:"memMax"`
+	MemAvg      float64 `json:"memAvg"`
+	MemTotal    uint64  `json:"memTotal"`
+	DiskMin     float64 `json:"diskMin"`
+	DiskMax     float64 `json:"diskMax"`
+	DiskAvg     float64 `json:"diskAvg"`
+	DiskTotal   uint64  `json:"diskTotal"`
+	NetUpMin    float64 `json:"netUpMin"`
+	NetUpMax    float64 `json:"netUpMax"`
+	NetUpAvg    float64 `json:"netUpAvg"`
+	NetDownMin  float64 `json:"netDownMin"`
+	NetDownMax  float64 `json:"netDownMax"`
+	NetDownAvg  float64 `json:"netDownAvg"`
+	ClientsMin  float64 `json:"clientsMin"`
+	ClientsMax  float64 `json:"clientsMax"`
+	ClientsAvg  float64 `json:"clientsAvg"`
+}
+
+// NodeStatusEvent records the outcome of a single node status check.
+// Transition is set when the status differs from the one recorded before the check.
+type NodeStatusEvent struct {
+	Id         int        `json:"id" gorm:"primaryKey;autoIncrement"`                            // Unique identifier
+	NodeId     int        `json:"nodeId" gorm:"index:idx_node_status_event,priority:1"`          // Node ID
+	Status     NodeStatus `json:"status"`                                                        // Status reported by the check
+	PrevStatus NodeStatus `json:"prevStatus"`                                                    // Status before the check
+	Transition bool       `json:"transition" gorm:"default:false"`                               // Whether the status changed
+	LatencyMs  int64      `json:"latencyMs" gorm:"default:0"`                                    // Round trip of the check in milliseconds
+	Error      string     `json:"error"`                                                         // Check error, if any
+	CheckedAt  int64      `json:"checkedAt" gorm:"index;index:idx_node_status_event,priority:2"` // Check timestamp
+}
+
+// NodeUptimeRollup sums the status checks of a node over an hour, so uptime reports do not
+// walk every check.
+type NodeUptimeRollup struct {
+	Id          int   `json:"id" gorm:"primaryKey;autoIncrement"`                              // Unique identifier
+	NodeId      int   `json:"nodeId" gorm:"uniqueIndex:idx_node_uptime_rollup,priority:1"`     // Node ID
+	BucketStart int64 `json:"time" gorm:"uniqueIndex:idx_node_uptime_rollup,priority:2;index"` // Start of the hour
+	Monitored   int64 `json:"monitored"`                                                       // Seconds covered by checks
+	Downtime    int64 `json:"downtime"`                                                        // Seconds the node was not online
+	Checks      int   `json:"checks"`                                                          // Number of checks
+	Failures    int   `json:"failures"`                                                        // Checks that did not find the node online
+	LatencyMs   int64 `json:"latencyMs"`                                                       // Summed round trip of checks that reached the node
+	Reachable   int   `json:"reachable"`                                                       // Checks that reached the node
+}
+
+// NodeInboundSpec declares an inbound that should exist on a managed node.
+// The reconciler matches specs to remote inbounds by listen address and port.
+type NodeInboundSpec struct {
+	Id             int      `json:"id" form:"id" gorm:"primaryKey;autoIncrement"`     // Unique identifier
+	NodeId         int      `json:"nodeId" form:"nodeId" gorm:"index"`                // Node ID
+	Remark         string   `json:"remark" form:"remark"`                             // Inbound remark
+	Enable         bool     `json:"enable" form:"enable"`                             // Whether the inbound is enabled
+	Listen         string   `json:"listen" form:"listen"`                             // Listen address
+	Port           int      `json:"port" form:"port"`                                 // Listen port
+	Protocol       Protocol `json:"protocol" form:"protocol"`                         // Inbound protocol
+	Settings       string   `json:"settings" form:"settings"`                         // Protocol settings including clients
+	StreamSettings string   `json:"streamSettings" form:"streamSettings"`             // Stream settings
+	Sniffing       string   `json:"sniffing" form:"sniffing"`                         // Sniffing settings
+	CreatedAt      int64    `json:"createdAt" form:"createdAt" gorm:"autoCreateTime"` // Creation timestamp
+	UpdatedAt      int64    `json:"updatedAt" form:"updatedAt" gorm:"autoUpdateTime"` // Last update timestamp
+}
+
+// ToInbound builds the inbound that should exist on the node for this spec.
+func (s *NodeInboundSpec) ToInbound() *Inbound {
+	return &Inbound{
+		Remark:         s.Remark,
+		Enable:         s.Enable,
+		Listen:         s.Listen,
+		Port:           s.Port,
+		Protocol:       s.Protocol,
+		Settings:       s.Settings,
+		StreamSettings: s.StreamSettings,
+		Sniffing:       s.Sniffing,
+	}
+}
+
+// GlobalClient is a client identity owned by the master panel. It is attached to a
+// multi-subscription and provisioned on the chosen inbound of every listed node.
+type GlobalClient struct {
+	Id           int    `json:"id" form:"id" gorm:"primaryKey;autoIncrement"`     // Unique identifier
+	MultiSubId   int    `json:"multiSubId" form:"multiSubId" gorm:"uniqueIndex"`  // Multi-subscription ID
+	Email        string `json:"email" form:"email" gorm:"uniqueIndex"`            // Client email, the identity on every node
+	UUID         string `json:"uuid" form:"uuid"`                                 // Client ID for VLESS and VMess inbounds
+	Password     string `json:"password" form:"password"`                         // Password for Trojan and Shadowsocks inbounds
+	Flow         string `json:"flow" form:"flow"`                                 // Flow control (XTLS)
+	LimitIP      int    `json:"limitIp" form:"limitIp"`                           // IP limit for this client
+	TotalGB      int64  `json:"totalGB" form:"totalGB"`                           // Total traffic limit in bytes
+	ExpiryTime   int64  `json:"expiryTime" form:"expiryTime"`                     // Expiration timestamp in milliseconds
+	Enable       bool   `json:"enable" form:"enable"`                             // Whether the client is enabled
+	TgID         int64  `json:"tgId" form:"tgId"`                                 // Telegram user ID for notifications
+	Comment      string `json:"comment" form:"comment"`                           // Client comment
+	Up           int64  `json:"up" form:"up"`                                     // Upload traffic summed over all nodes
+	Down         int64  `json:"down" form:"down"`                                 // Download traffic summed over all nodes
+	Depleted     bool   `json:"depleted" form:"depleted"`                         // Whether the cluster-wide quota or expiry disabled the client
+	NodeInbounds string `json:"nodeInbounds" form:"nodeInbounds"`                 // JSON object mapping node ID to inbound ID on that node
+	CreatedAt    int64  `json:"createdAt" form:"createdAt" gorm:"autoCreateTime"` // Creation timestamp
+	UpdatedAt    int64  `json:"updatedAt" form:"updatedAt" gorm:"autoUpdateTime"` // Last update timestamp
+}
+
+// IsDepleted reports whether the combined traffic or the expiry time (in milliseconds) is exhausted.
+func (g *GlobalClient) IsDepleted(now int64) bool {
+	return (g.TotalGB > 0 && g.Up+g.Down >= g.TotalGB) || (g.ExpiryTime > 0 && g.ExpiryTime <= now)
+}
+
+// ToClient builds the inbound client that represents this identity on a node. method is the
+// cipher of a Shadowsocks inbound.
+func (g *GlobalClient) ToClient(protocol Protocol, method string, subId string) Client {
+	client := Client{
+		Email:      g.Email,
+		Flow:       g.Flow,
+		LimitIP:    g.LimitIP,
+		TotalGB:    g.TotalGB,
+		ExpiryTime: g.ExpiryTime,
+		Enable:     g.Enable && !g.Depleted,
+		TgID:       g.TgID,
+		SubID:      subId,
+		Comment:    g.Comment,
+	}
+	switch protocol {
+	case Trojan:
+		client.Password = g.Password
+	case Shadowsocks:
+		client.Password = shadowsocksKey(g.Password, method)
+	default:
+		client.ID = g.UUID
+	}
+	if protocol != VLESS {
+		client.Flow = ""
+	}
+	return client
+}
+
+// shadowsocksKey returns the client password for a Shadowsocks cipher. Shadowsocks 2022 ciphers
+// take a base64 key of their key length: it is cut from the password when that is a long enough
+// base64 key and derived from it otherwise, so every node gets the same key for the same cipher.
+func shadowsocksKey(password string, method string) string {
+	var size int
+	switch method {
+	case "2022-blake3-aes-128-gcm":
+		size = 16
+	case "2022-blake3-aes-256-gcm", "2022-blake3-chacha20-poly1305":
+		size = 32
+	default:
+		return password
+	}
+	key, err := base64.StdEncoding.DecodeString(password)
+	if err != nil || len(key) < size {
+		sum := sha256.Sum256([]byte(password))
+		key = sum[:]
+	}
+	return base64.StdEncoding.EncodeToString(key[:size])
+}
+
+// GlobalClientTraffic stores the traffic a global client used on one node.
+type GlobalClientTraffic struct {
+	Id             int   `json:"id" gorm:"primaryKey;autoIncrement"`                       // Unique identifier
+	GlobalClientId int   `json:"globalClientId" gorm:"uniqueIndex:idx_global_client_node"` // Global client ID
+	NodeId         int   `json:"nodeId" gorm:"uniqueIndex:idx_global_client_node"`         // Node ID
+	Up             int64 `json:"up"`                                                       // Upload traffic on the node
+	Down           int64 `json:"down"`                                                     // Download traffic on the node
+	UpdatedAt      int64 `json:"updatedAt" gorm:"autoUpdateTime"`                          // Last sync timestamp
+}
+
+// External API key scopes. The admin scope grants every other scope.
+const (
+	ApiScopeReadStatus   = "read-status"
+	ApiScopeReadInbounds = "read-inbounds"
+	ApiScopeWriteClients = "write-clients"
+	ApiScopeAdmin        = "admin"
+)
+
+// ApiScopes lists every scope an external API key can be granted.
+var ApiScopes = []string{ApiScopeReadStatus, ApiScopeReadInbounds, ApiScopeWriteClients, ApiScopeAdmin}
+
+// ApiKey is a named external API key with its own scopes, expiry and source address restrictions.
+type ApiKey struct {
+	Id           int    `json:"id" form:"id" gorm:"primaryKey;autoIncrement"`                 // Unique identifier
+	Name         string `json:"name" form:"name" gorm:"uniqueIndex"`                          // Key name
+	Key          string `json:"-" gorm:"uniqueIndex"`                                         // Secret, only returned on creation
+	Prefix       string `json:"prefix"`                                                       // First characters of the key, to tell keys apart
+	Scopes       string `json:"scopes" form:"scopes"`                                         // Comma-separated scopes
+	AllowedCIDRs string `json:"allowedCidrs" form:"allowedCidrs" gorm:"column:allowed_cidrs"` // Comma-separated CIDRs or IPs, empty allows any address
+	ExpiresAt    int64  `json:"expiresAt" form:"expiresAt"`                                   // Expiry timestamp in seconds, 0 for never
+	RateLimit    int    `json:"rateLimit" form:"rateLimit"`                                   // Requests per minute, 0 for the panel default
+	Enable       bool   `json:"enable" form:"enable"`                                         // Whether the key is accepted
+	LastUsedAt   int64  `json:"lastUsedAt"`                                                   // Timestamp of the last request
+	LastUsedIP   string `json:"lastUsedIp"`                                                   // Source address of the last request
+	CreatedAt    int64  `json:"createdAt" form:"createdAt" gorm:"autoCreateTime"`             // Creation timestamp
+	UpdatedAt    int64  `json:"updatedAt" form:"updatedAt" gorm:"autoUpdateTime"`             // Last update timestamp
+}
+
+// GetScopes returns the scopes granted to the key.
+func (k *ApiKey) GetScopes() []string {
+	var scopes []string
+	for _, scope := range strings.Split(k.Scopes, ",") {
+		if scope = strings.TrimSpace(scope); scope != "" {
+			scopes = append(scopes, scope)
+		}
+	}
+	return scopes
+}
+
+// HasScope reports whether the key grants the scope, directly or through the admin scope.
+func (k *ApiKey) HasScope(scope string) bool {
+	for _, granted := range k.GetScopes() {
+		if granted == scope || granted == ApiScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// IsExpired reports whether the key has expired at the given time in seconds.
+func (k *ApiKey) IsExpired(now int64) bool {
+	return k.ExpiresAt > 0 && k.ExpiresAt <= now
+}
+
+// GetAllowedNets parses the allowed CIDR list.
+func (k *ApiKey) GetAllowedNets() ([]*net.IPNet, error) {
+	return common.ParseCIDRList(k.AllowedCIDRs)
+}
+
+// AllowsIP reports whether requests from ip may use the key.
+func (k *ApiKey) AllowsIP(ip string) bool {
+	nets, err := k.GetAllowedNets()
+	if err != nil {
+		return false
+	}
+	return len(nets) == 0 || common.IPInNets(ip, nets)
+}
+
+// ApiKeyAudit records one use of an external API key.
+type ApiKeyAudit struct {
+	Id        int    `json:"id" gorm:"primaryKey;autoIncrement"`    // Unique identifier
+	ApiKeyId  int    `json:"apiKeyId" gorm:"index"`                 // Key ID, 0 for the panel-wide key or a client certificate
+	KeyName   string `json:"keyName"`                               // Key name at the time of the request
+	Method    string `json:"method"`                                // HTTP method
+	Path      string `json:"path"`                                  // Request path
+	IP        string `json:"ip"`                                    // Source address
+	Status    int    `json:"status"`                                // Response status code
+	CreatedAt int64  `json:"createdAt" gorm:"autoCreateTime;index"` // Request timestamp
+}
+
+// RateLimitBucket is the stored state of a rate limiter token bucket, shared by every panel
+// process that uses the same database.
+type RateLimitBucket struct {
+	Bucket     string  `json:"bucket" gorm:"primaryKey"` // Bucket key
+	Tokens     float64 `json:"tokens"`                   // Tokens left at LastRefill
+	LastRefill int64   `json:"lastRefill"`               // Time of the last refill in microseconds
+	FullAt     int64   `json:"fullAt" gorm:"index"`      // Time the bucket is full again in milliseconds
+	Version    int64   `json:"version"`                  // Incremented on every update, guards concurrent updates
+}
+
+// SubscriptionAccess records one fetch of a subscription from the subscription server.
+type SubscriptionAccess struct {
+	Id        int    `json:"id" gorm:"primaryKey;autoIncrement"`    // Unique identifier
+	SubId     string `json:"subId" gorm:"index"`                    // Subscription identifier
+	IP        string `json:"ip"`                                    // Client address
+	UserAgent string `json:"userAgent"`                             // Client User-Agent
+	Family    string `json:"family"`                                // Client family of the matching User-Agent rule, empty when none matched
+	Format    string `json:"format"`                                // Served format: links, json, clash, singbox or html
+	Status    int    `json:"status"`                                // Response status code
+	CreatedAt int64  `json:"createdAt" gorm:"autoCreateTime;index"` // Fetch timestamp
+}
+
+// SubscriptionToken is an opaque, revocable token a subscription can be fetched through instead of its subId.
+type SubscriptionToken struct {
+	Id          int    `json:"id" form:"id" gorm:"primaryKey;autoIncrement"`     // Unique identifier
+	Token       string `json:"token" gorm:"uniqueIndex"`                         // Token used in the subscription URL
+	SubId       string `json:"subId" form:"subId" gorm:"index"`                  // Subscription the token serves
+	Remark      string `json:"remark" form:"remark"`                             // Token description
+	ExpiresAt   int64  `json:"expiresAt" form:"expiresAt"`                       // Expiry timestamp in seconds, 0 for never
+	IPLimit     int    `json:"ipLimit" form:"ipLimit"`                           // Distinct addresses allowed to fetch, 0 for unlimited
+	DeviceLimit int    `json:"deviceLimit" form:"deviceLimit"`                   // Distinct client User-Agents allowed to fetch, 0 for unlimited
+	Enable      bool   `json:"enable" form:"enable"`                             // Whether the token is accepted
+	RotatedAt   int64  `json:"rotatedAt"`                                        // Timestamp of the last rotation
+	CreatedAt   int64  `json:"createdAt" form:"createdAt" gorm:"autoCreateTime"` // Creation timestamp
+	UpdatedAt   int64  `json:"updatedAt" form:"updatedAt" gorm:"autoUpdateTime"` // Last update timestamp
+}
+
+// IsExpired reports whether the token has expired at the given time in seconds.
+func (t *SubscriptionToken) IsExpired(now int64) bool {
+	return t.ExpiresAt > 0 && t.ExpiresAt <= now
+}
+
+// SubscriptionTokenDevice is an address and client application that fetched a subscription through a token.
+// The IP and device limits of a token count these.
+type SubscriptionTokenDevice struct {
+	Id        int    `json:"id" gorm:"primaryKey;autoIncrement"`                // Unique identifier
+	TokenId   int    `json:"tokenId" gorm:"uniqueIndex:idx_sub_token_device"`   // Token ID
+	IP        string `json:"ip" gorm:"uniqueIndex:idx_sub_token_device"`        // Client address
+	UserAgent string `json:"userAgent" gorm:"uniqueIndex:idx_sub_token_device"` // Client User-Agent
+	LastSeen  int64  `json:"lastSeen"`                                          // Timestamp of the last fetch
+	CreatedAt int64  `json:"createdAt" gorm:"autoCreateTime"`                   // First fetch timestamp
+}
+
+// SubscriptionPolicy holds access settings of a single subscription.
+type SubscriptionPolicy struct {
+	Id         int    `json:"id" gorm:"primaryKey;autoIncrement"`               // Unique identifier
+	SubId      string `json:"subId" gorm:"uniqueIndex"`                         // Subscription identifier
+	SignedOnly bool   `json:"signedOnly"`                                       // Whether the subscription is only served through signed URLs
+	UpdatedAt  int64  `json:"updatedAt" form:"updatedAt" gorm:"autoUpdateTime"` // Last update timestamp
+}
+
+// ClientTrafficBucket holds the traffic of a client over an hour, a day or a month.
+type ClientTrafficBucket struct {
+	Id          int    `json:"id" gorm:"primaryKey;autoIncrement"`                                 // Unique identifier
+	Email       string `json:"email" gorm:"uniqueIndex:idx_client_traffic_bucket,priority:1"`      // Client email
+	Resolution  string `json:"resolution" gorm:"uniqueIndex:idx_client_traffic_bucket,priority:2"` // hour, day or month
+	BucketStart int64  `json:"time" gorm:"uniqueIndex:idx_client_traffic_bucket,priority:3;index"` // Start of the bucket, UTC aligned
+	Up          int64  `json:"up"`                                                                 // Uploaded bytes
+	Down        int64  `json:"down"`                                                               // Downloaded bytes
+}
+
+// TrafficBucket holds the traffic of an inbound or outbound tag over an hour, a day or a month.
+type TrafficBucket struct {
+	Id          int    `json:"id" gorm:"primaryKey;autoIncrement"`                          // Unique identifier
+	Kind        string `json:"kind" gorm:"uniqueIndex:idx_traffic_bucket,priority:1"`       // inbound or outbound
+	Tag         string `json:"tag" gorm:"uniqueIndex:idx_traffic_bucket,priority:2"`        // Inbound or outbound tag
+	Resolution  string `json:"resolution" gorm:"uniqueIndex:idx_traffic_bucket,priority:3"` // hour, day or month
+	BucketStart int64  `json:"time" gorm:"uniqueIndex:idx_traffic_bucket,priority:4;index"` // Start of the bucket, UTC aligned
+	Up          int64  `json:"up"`                                                          // Uploaded bytes
+	Down        int64  `json:"down"`                                                        // Downloaded bytes
+}
+
+// Plan is a billing package, such as 50 GB for 30 days, applied to clients to set their quota, expiry and limits.
+type Plan struct {
+	Id            int    `json:"id" form:"id" gorm:"primaryKey;autoIncrement"`     // Unique identifier
+	Name          string `json:"name" form:"name" gorm:"uniqueIndex"`              // Plan name
+	TotalGB       int64  `json:"totalGB" form:"totalGB"`                           // Traffic quota in bytes, 0 for unlimited
+	Days          int    `json:"days" form:"days"`                                 // Duration in days, 0 for no expiry
+	LimitIP       int    `json:"limitIp" form:"limitIp"`                           // IP limit, 0 for unlimited
+	ResetSchedule string `json:"resetSchedule" form:"resetSchedule"`               // Client traffic reset schedule, empty for none
+	ResetDay      int    `json:"resetDay" form:"resetDay"`                         // Weekday or billing day of the reset schedule
+	ResetCron     string `json:"resetCron" form:"resetCron"`                       // Cron expression of the "cron" reset schedule
+	InboundIds    string `json:"inboundIds" form:"inboundIds"`                     // JSON array of inbound IDs the plan may be applied in, empty for any
+	Remark        string `json:"remark" form:"remark"`                             // Remark/notes
+	CreatedAt     int64  `json:"createdAt" form:"createdAt" gorm:"autoCreateTime"` // Creation timestamp
+	UpdatedAt     int64  `json:"updatedAt" form:"updatedAt" gorm:"autoUpdateTime"` // Last update timestamp
+}
+
+// ClientPlanHistory records a plan being applied to or renewed for a client.
+type ClientPlanHistory struct {
+	Id             int    `json:"id" gorm:"primaryKey;autoIncrement"`    // Unique identifier
+	Email          string `json:"email" gorm:"index"`                    // Client email
+	PlanId         int    `json:"planId"`                                // Plan ID
+	PlanName       string `json:"planName"`                              // Plan name at the time of the change
+	Action         string `json:"action"`                                // apply or renew
+	PrevTotalGB    int64  `json:"prevTotalGB"`                           // Traffic quota before the change
+	PrevExpiryTime int64  `json:"prevExpiryTime"`                        // Expiry before the change
+	TotalGB        int64  `json:"totalGB"`                               // Traffic quota set by the change
+	ExpiryTime     int64  `json:"expiryTime"`                            // Expiry set by the change, 0 for none
+	Actor          string `json:"actor"`                                 // Who made the change, such as panel:admin or tgbot:<chat ID>
+	CreatedAt      int64  `json:"createdAt" gorm:"autoCreateTime;index"` // Change timestamp
 }
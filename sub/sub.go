@@ -81,6 +81,12 @@ func (s *Server) initRouter() (*gin.Engine, error) {
 		engine.Use(middleware.DomainValidatorMiddleware(subDomain))
 	}
 
+	// Throttle subscription fetches per client address when a limit is configured
+	if subRateLimit, err := s.settingService.GetSubRateLimit(); err == nil && subRateLimit > 0 {
+		limiter := middleware.NewRateLimiter()
+		engine.Use(middleware.IPRateLimit(limiter, "sub", middleware.PerMinute(subRateLimit), middleware.LoadTrustedProxies()))
+	}
+
 	LinksPath, err := s.settingService.GetSubPath()
 	if err != nil {
 		return nil, err
@@ -97,6 +103,28 @@ func (s *Server) initRouter() (*gin.Engine, error) {
 		return nil, err
 	}
 
+	ClashPath, err := s.settingService.GetSubClashPath()
+	if err != nil {
+		return nil, err
+	}
+
+	// Determine if Clash subscription endpoint is enabled
+	subClashEnable, err := s.settingService.GetSubClashEnable()
+	if err != nil {
+		return nil, err
+	}
+
+	SingboxPath, err := s.settingService.GetSubSingboxPath()
+	if err != nil {
+		return nil, err
+	}
+
+	// Determine if sing-box subscription endpoint is enabled
+	subSingboxEnable, err := s.settingService.GetSubSingboxEnable()
+	if err != nil {
+		return nil, err
+	}
+
 	// Set base_path based on LinksPath for template rendering
 	// Ensure LinksPath ends with "/" for proper asset URL generation
 	basePath := LinksPath
@@ -153,6 +181,11 @@ func (s *Server) initRouter() (*gin.Engine, error) {
 		SubTitle = ""
 	}
 
+	SubUserAgentRules, err := s.settingService.GetSubUserAgentRules()
+	if err != nil {
+		SubUserAgentRules = ""
+	}
+
 	// set per-request localizer from headers/cookies
 	engine.Use(locale.LocalizerMiddleware())
 
@@ -230,8 +263,8 @@ func (s *Server) initRouter() (*gin.Engine, error) {
 	g := engine.Group("/")
 
 	s.sub = NewSUBController(
-		g, LinksPath, JsonPath, subJsonEnable, Encrypt, ShowInfo, RemarkModel, SubUpdates,
-		SubJsonFragment, SubJsonNoises, SubJsonMux, SubJsonRules, SubTitle)
+		g, LinksPath, JsonPath, subJsonEnable, ClashPath, subClashEnable, SingboxPath, subSingboxEnable, Encrypt, ShowInfo, RemarkModel, SubUpdates,
+		SubJsonFragment, SubJsonNoises, SubJsonMux, SubJsonRules, SubTitle, SubUserAgentRules)
 
 	return engine, nil
 }
@@ -346,6 +379,8 @@ func (s *Server) Stop() error {
 	if s.listener != nil {
 		err2 = s.listener.Close()
 	}
+	// Keep the fetches served before shutting down
+	(&service.SubscriptionAccessService{}).Flush()
 	return common.Combine(err1, err2)
 }
 
@@ -0,0 +1,268 @@
+package sub
+
+import (
+	"cmp"
+	"slices"
+	"strings"
+
+	"github.com/goccy/go-yaml"
+
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+)
+
+const (
+	clashSelectGroup  = "Proxy"
+	clashAutoGroup    = "Auto"
+	clashTestURL      = "https://www.gstatic.com/generate_204"
+	clashTestInterval = 300
+)
+
+// SubClashService generates Clash/Mihomo YAML profiles for subscriptions.
+type SubClashService struct {
+	rules []string
+
+	SubService *SubService
+}
+
+// NewSubClashService creates a Clash subscription service. rules are the xray routing rules of
+// the JSON subscription, translated to Clash rules in front of the final catch-all rule.
+func NewSubClashService(rules string, subService *SubService) *SubClashService {
+	return &SubClashService{
+		rules:      clashRules(rules),
+		SubService: subService,
+	}
+}
+
+// GetClash generates the Clash profile of the given subscription ID and host, along with the
+// subscription user info header. A multi-subscription also includes the clients on its nodes.
+func (s *SubClashService) GetClash(subId string, host string) (string, string, error) {
+	subClients, traffic, err := s.SubService.getSubClients(subId, host)
+	if err != nil {
+		return "", "", err
+	}
+
+	var proxies []yaml.MapSlice
+	var names []string
+	for _, proxy := range s.SubService.getUniqueSubProxies(subClients) {
+		if clashProxy := genClashProxy(proxy); clashProxy != nil {
+			proxies = append(proxies, clashProxy)
+			names = append(names, proxy.Name)
+		}
+	}
+	if len(proxies) == 0 {
+		return "", "", nil
+	}
+
+	profile := yaml.MapSlice{
+		{Key: "mixed-port", Value: 7890},
+		{Key: "allow-lan", Value: false},
+		{Key: "mode", Value: "rule"},
+		{Key: "log-level", Value: "warning"},
+		{Key: "proxies", Value: proxies},
+		{Key: "proxy-groups", Value: []yaml.MapSlice{
+			{
+				{Key: "name", Value: clashSelectGroup},
+				{Key: "type", Value: "select"},
+				{Key: "proxies", Value: append([]string{clashAutoGroup}, names...)},
+			},
+			{
+				{Key: "name", Value: clashAutoGroup},
+				{Key: "type", Value: "url-test"},
+				{Key: "url", Value: clashTestURL},
+				{Key: "interval", Value: clashTestInterval},
+				{Key: "proxies", Value: names},
+			},
+		}},
+		{Key: "rules", Value: slices.Concat(s.rules, []string{"MATCH," + clashSelectGroup})},
+	}
+	result, err := yaml.MarshalWithOptions(profile, yaml.IndentSequence(true))
+	if err != nil {
+		return "", "", err
+	}
+	return string(result), subUserInfo(traffic), nil
+}
+
+// genClashProxy renders a proxy as a Clash proxy. It returns nil for proxies Clash cannot express.
+func genClashProxy(proxy subProxy) yaml.MapSlice {
+	proxyType := string(proxy.Protocol)
+	if proxy.Protocol == model.Shadowsocks {
+		proxyType = "ss"
+	}
+	p := yaml.MapSlice{
+		{Key: "name", Value: proxy.Name},
+		{Key: "type", Value: proxyType},
+		{Key: "server", Value: proxy.Server},
+		{Key: "port", Value: proxy.Port},
+		{Key: "udp", Value: true},
+	}
+
+	switch proxy.Protocol {
+	case model.VMESS:
+		p = append(p,
+			yaml.MapItem{Key: "uuid", Value: proxy.UUID},
+			yaml.MapItem{Key: "alterId", Value: 0},
+			yaml.MapItem{Key: "cipher", Value: cmp.Or(proxy.Cipher, "auto")},
+		)
+	case model.VLESS:
+		p = append(p, yaml.MapItem{Key: "uuid", Value: proxy.UUID})
+		if proxy.Flow != "" {
+			p = append(p, yaml.MapItem{Key: "flow", Value: proxy.Flow})
+		}
+		if proxy.Encryption != "" && proxy.Encryption != "none" {
+			p = append(p, yaml.MapItem{Key: "encryption", Value: proxy.Encryption})
+		}
+	case model.Trojan:
+		p = append(p, yaml.MapItem{Key: "password", Value: proxy.Password})
+	case model.Shadowsocks:
+		// Shadowsocks has no stream settings in Clash without a plugin
+		return append(p,
+			yaml.MapItem{Key: "cipher", Value: proxy.Cipher},
+			yaml.MapItem{Key: "password", Value: proxy.Password},
+		)
+	default:
+		return nil
+	}
+
+	if proxy.Security != "none" {
+		if proxy.Protocol != model.Trojan {
+			p = append(p, yaml.MapItem{Key: "tls", Value: true})
+		}
+		if proxy.SNI != "" {
+			sniKey := "servername"
+			if proxy.Protocol == model.Trojan {
+				sniKey = "sni"
+			}
+			p = append(p, yaml.MapItem{Key: sniKey, Value: proxy.SNI})
+		}
+		if len(proxy.ALPN) > 0 {
+			p = append(p, yaml.MapItem{Key: "alpn", Value: proxy.ALPN})
+		}
+		if proxy.Fingerprint != "" || proxy.Security == "reality" {
+			p = append(p, yaml.MapItem{Key: "client-fingerprint", Value: cmp.Or(proxy.Fingerprint, "chrome")})
+		}
+		if proxy.Insecure {
+			p = append(p, yaml.MapItem{Key: "skip-cert-verify", Value: true})
+		}
+		if proxy.Security == "reality" {
+			p = append(p, yaml.MapItem{Key: "reality-opts", Value: yaml.MapSlice{
+				{Key: "public-key", Value: proxy.PublicKey},
+				{Key: "short-id", Value: proxy.ShortId},
+			}})
+		}
+	}
+
+	switch proxy.Network {
+	case "tcp":
+	case "http":
+		if proxy.Protocol == model.Trojan {
+			return nil
+		}
+		opts := yaml.MapSlice{
+			{Key: "method", Value: "GET"},
+			{Key: "path", Value: []string{cmp.Or(proxy.Path, "/")}},
+		}
+		if proxy.Host != "" {
+			opts = append(opts, yaml.MapItem{Key: "headers", Value: yaml.MapSlice{{Key: "Host", Value: []string{proxy.Host}}}})
+		}
+		p = append(p, yaml.MapItem{Key: "network", Value: "http"}, yaml.MapItem{Key: "http-opts", Value: opts})
+	case "ws", "httpupgrade":
+		opts := yaml.MapSlice{{Key: "path", Value: cmp.Or(proxy.Path, "/")}}
+		if proxy.Host != "" {
+			opts = append(opts, yaml.MapItem{Key: "headers", Value: yaml.MapSlice{{Key: "Host", Value: proxy.Host}}})
+		}
+		if proxy.Network == "httpupgrade" {
+			opts = append(opts, yaml.MapItem{Key: "v2ray-http-upgrade", Value: true})
+		}
+		p = append(p, yaml.MapItem{Key: "network", Value: "ws"}, yaml.MapItem{Key: "ws-opts", Value: opts})
+	case "grpc":
+		p = append(p, yaml.MapItem{Key: "network", Value: "grpc"}, yaml.MapItem{Key: "grpc-opts", Value: yaml.MapSlice{
+			{Key: "grpc-service-name", Value: proxy.ServiceName},
+		}})
+	case "xhttp":
+		// Clash supports xhttp for VLESS only
+		if proxy.Protocol != model.VLESS {
+			return nil
+		}
+		opts := yaml.MapSlice{{Key: "path", Value: cmp.Or(proxy.Path, "/")}}
+		if proxy.Host != "" {
+			opts = append(opts, yaml.MapItem{Key: "host", Value: proxy.Host})
+		}
+		if proxy.Mode != "" {
+			opts = append(opts, yaml.MapItem{Key: "mode", Value: proxy.Mode})
+		}
+		p = append(p, yaml.MapItem{Key: "network", Value: "xhttp"}, yaml.MapItem{Key: "xhttp-opts", Value: opts})
+	default:
+		return nil
+	}
+	return p
+}
+
+// clashRules translates the JSON subscription rules to Clash rules.
+func clashRules(rules string) []string {
+	var result []string
+	for _, rule := range parseSubRules(rules) {
+		target := clashSelectGroup
+		switch rule.OutboundTag {
+		case "direct":
+			target = "DIRECT"
+		case "block":
+			target = "REJECT"
+		}
+		for _, domain := range rule.Domain {
+			if r := clashDomainRule(domain); r != "" {
+				result = append(result, r+","+target)
+			}
+		}
+		for _, ip := range rule.IP {
+			if r := clashIPRule(ip); r != "" {
+				result = append(result, r+","+target+",no-resolve")
+			}
+		}
+		for _, port := range rule.Ports {
+			result = append(result, "DST-PORT,"+port+","+target)
+		}
+	}
+	return result
+}
+
+// clashDomainRule translates an xray domain matcher to a Clash rule without its target.
+func clashDomainRule(domain string) string {
+	kind, value, found := strings.Cut(domain, ":")
+	if !found {
+		return "DOMAIN-KEYWORD," + domain
+	}
+	switch kind {
+	case "geosite":
+		return "GEOSITE," + value
+	case "domain":
+		return "DOMAIN-SUFFIX," + value
+	case "full":
+		return "DOMAIN," + value
+	case "keyword":
+		return "DOMAIN-KEYWORD," + value
+	case "regexp":
+		return "DOMAIN-REGEX," + value
+	}
+	return ""
+}
+
+// clashIPRule translates an xray IP matcher to a Clash rule without its target.
+func clashIPRule(ip string) string {
+	if code, ok := strings.CutPrefix(ip, "geoip:"); ok {
+		if strings.HasPrefix(code, "!") {
+			return ""
+		}
+		if code == "private" {
+			return "GEOIP,LAN"
+		}
+		return "GEOIP," + strings.ToUpper(code)
+	}
+	cidr, ok := normalizeCIDR(ip)
+	if !ok {
+		return ""
+	}
+	if strings.Contains(cidr, ":") {
+		return "IP-CIDR6," + cidr
+	}
+	return "IP-CIDR," + cidr
+}
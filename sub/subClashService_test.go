@@ -0,0 +1,189 @@
+package sub
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/goccy/go-yaml"
+
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+)
+
+func TestGenClashProxy(t *testing.T) {
+	tests := []struct {
+		name  string
+		proxy subProxy
+		want  string // YAML of the proxy, empty when Clash cannot express it
+	}{
+		{
+			name: "vless reality",
+			proxy: subProxy{Name: "reality", Protocol: model.VLESS, Server: "a.example.com", Port: 443, UUID: "u", Flow: "xtls-rprx-vision",
+				Encryption: "none", Network: "tcp", Security: "reality", SNI: "www.example.com", PublicKey: "pk", ShortId: "ab"},
+			want: `
+name: reality
+type: vless
+server: a.example.com
+port: 443
+udp: true
+uuid: u
+flow: xtls-rprx-vision
+tls: true
+servername: www.example.com
+client-fingerprint: chrome
+reality-opts:
+  public-key: pk
+  short-id: ab
+`,
+		},
+		{
+			name: "vless xhttp over tls",
+			proxy: subProxy{Name: "xhttp", Protocol: model.VLESS, Server: "a.example.com", Port: 443, UUID: "u", Network: "xhttp", Path: "/x",
+				Host: "h.example.com", Mode: "auto", Security: "tls", SNI: "h.example.com", ALPN: []string{"h2"}, Fingerprint: "firefox", Insecure: true},
+			want: `
+name: xhttp
+type: vless
+server: a.example.com
+port: 443
+udp: true
+uuid: u
+tls: true
+servername: h.example.com
+alpn:
+- h2
+client-fingerprint: firefox
+skip-cert-verify: true
+network: xhttp
+xhttp-opts:
+  path: /x
+  host: h.example.com
+  mode: auto
+`,
+		},
+		{
+			name:  "vmess httpupgrade without tls",
+			proxy: subProxy{Name: "upgrade", Protocol: model.VMESS, Server: "a.example.com", Port: 80, UUID: "u", Network: "httpupgrade", Host: "h.example.com", Security: "none"},
+			want: `
+name: upgrade
+type: vmess
+server: a.example.com
+port: 80
+udp: true
+uuid: u
+alterId: 0
+cipher: auto
+network: ws
+ws-opts:
+  path: /
+  headers:
+    Host: h.example.com
+  v2ray-http-upgrade: true
+`,
+		},
+		{
+			name:  "trojan grpc",
+			proxy: subProxy{Name: "grpc", Protocol: model.Trojan, Server: "a.example.com", Port: 443, Password: "pw", Network: "grpc", ServiceName: "svc", Security: "tls", SNI: "a.example.com"},
+			want: `
+name: grpc
+type: trojan
+server: a.example.com
+port: 443
+udp: true
+password: pw
+sni: a.example.com
+network: grpc
+grpc-opts:
+  grpc-service-name: svc
+`,
+		},
+		{
+			name:  "shadowsocks ignores the transport",
+			proxy: subProxy{Name: "ss", Protocol: model.Shadowsocks, Server: "a.example.com", Port: 8388, Cipher: "aes-128-gcm", Password: "pw", Network: "ws", Security: "none"},
+			want: `
+name: ss
+type: ss
+server: a.example.com
+port: 8388
+udp: true
+cipher: aes-128-gcm
+password: pw
+`,
+		},
+		{
+			name:  "trojan over http is not expressible",
+			proxy: subProxy{Name: "http", Protocol: model.Trojan, Server: "a.example.com", Port: 80, Password: "pw", Network: "http", Security: "none"},
+		},
+		{
+			name:  "vmess over xhttp is not expressible",
+			proxy: subProxy{Name: "xhttp", Protocol: model.VMESS, Server: "a.example.com", Port: 443, UUID: "u", Network: "xhttp", Security: "tls"},
+		},
+		{
+			name:  "unknown protocol",
+			proxy: subProxy{Name: "wg", Protocol: model.WireGuard, Server: "a.example.com", Port: 51820},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := genClashProxy(tt.proxy)
+			if tt.want == "" {
+				if got != nil {
+					t.Fatalf("expected no proxy, got %v", got)
+				}
+				return
+			}
+			out, err := yaml.Marshal(got)
+			if err != nil {
+				t.Fatalf("Marshal failed: %v", err)
+			}
+			if want := strings.TrimPrefix(tt.want, "\n"); string(out) != want {
+				t.Fatalf("unexpected proxy:\n%s\nwant:\n%s", out, want)
+			}
+		})
+	}
+}
+
+func TestClashIPRule(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want string
+	}{
+		{"geoip:ir", "GEOIP,IR"},
+		{"geoip:private", "GEOIP,LAN"},
+		{"geoip:!cn", ""},
+		{"10.0.0.1", "IP-CIDR,10.0.0.1/32"},
+		{"10.0.0.0/8", "IP-CIDR,10.0.0.0/8"},
+		{"10.1.2.3/8", "IP-CIDR,10.0.0.0/8"},
+		{"2001:db8::1", "IP-CIDR6,2001:db8::1/128"},
+		{"2001:db8::/32", "IP-CIDR6,2001:db8::/32"},
+		{"ext:geoip.dat:ru", ""},
+		{"not an ip", ""},
+	}
+	for _, tt := range tests {
+		if got := clashIPRule(tt.ip); got != tt.want {
+			t.Errorf("clashIPRule(%q) = %q, want %q", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestClashRules(t *testing.T) {
+	rules := `[
+		{"outboundTag":"direct","domain":["geosite:private","domain:example.com","full:www.example.org","keyword:ads","regexp:^x\\.","ext:site.dat:a"]},
+		{"outboundTag":"block","ip":["geoip:private","1.1.1.1"]},
+		{"outboundTag":"proxy","port":"443, 8443"},
+		{"outboundTag":"direct","domain":["domain:mixed.com"],"ip":["8.8.8.8"]}
+	]`
+	want := []string{
+		"GEOSITE,private,DIRECT",
+		"DOMAIN-SUFFIX,example.com,DIRECT",
+		"DOMAIN,www.example.org,DIRECT",
+		"DOMAIN-KEYWORD,ads,DIRECT",
+		"DOMAIN-REGEX,^x\\.,DIRECT",
+		"GEOIP,LAN,REJECT,no-resolve",
+		"IP-CIDR,1.1.1.1/32,REJECT,no-resolve",
+		"DST-PORT,443," + clashSelectGroup,
+		"DST-PORT,8443," + clashSelectGroup,
+	}
+	if got := clashRules(rules); !slices.Equal(got, want) {
+		t.Fatalf("unexpected rules:\n%v\nwant:\n%v", got, want)
+	}
+}
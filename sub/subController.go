@@ -1,26 +1,57 @@
 package sub
 
 import (
+	"cmp"
 	"encoding/base64"
-	"fmt"
+	"net"
 	"strings"
 
 	"github.com/mhsanaei/3x-ui/v2/config"
+	"github.com/mhsanaei/3x-ui/v2/logger"
+	"github.com/mhsanaei/3x-ui/v2/util/common"
+	"github.com/mhsanaei/3x-ui/v2/web/middleware"
+	"github.com/mhsanaei/3x-ui/v2/web/service"
 
 	"github.com/gin-gonic/gin"
 )
 
+// Subscription output formats.
+const (
+	subFormatLinks   = "links"
+	subFormatJson    = "json"
+	subFormatClash   = "clash"
+	subFormatSingbox = "singbox"
+	subFormatHtml    = "html"
+)
+
+// Request context keys of the resolved subId and of the expiry of a signed request.
+const (
+	subIdKey     = "subId"
+	subSignedKey = "subSigned"
+)
+
 // SUBController handles HTTP requests for subscription links and JSON configurations.
 type SUBController struct {
 	subTitle       string
 	subPath        string
 	subJsonPath    string
+	subClashPath   string
+	subSingboxPath string
 	jsonEnabled    bool
+	clashEnabled   bool
+	singboxEnabled bool
 	subEncrypt     bool
 	updateInterval string
+	clientRules    []subClientRule
+	trustedProxies []*net.IPNet
 
-	subService     *SubService
-	subJsonService *SubJsonService
+	subService        *SubService
+	subJsonService    *SubJsonService
+	subClashService   *SubClashService
+	subSingboxService *SubSingboxService
+	accessService     service.SubscriptionAccessService
+	tokenService      service.SubscriptionTokenService
+	signService       service.SubscriptionSignService
 }
 
 // NewSUBController creates a new subscription controller with the given configuration.
@@ -29,6 +60,10 @@ func NewSUBController(
 	subPath string,
 	jsonPath string,
 	jsonEnabled bool,
+	clashPath string,
+	clashEnabled bool,
+	singboxPath string,
+	singboxEnabled bool,
 	encrypt bool,
 	showInfo bool,
 	rModel string,
@@ -38,18 +73,27 @@ func NewSUBController(
 	jsonMux string,
 	jsonRules string,
 	subTitle string,
+	userAgentRules string,
 ) *SUBController {
 	sub := NewSubService(showInfo, rModel)
 	a := &SUBController{
 		subTitle:       subTitle,
 		subPath:        subPath,
 		subJsonPath:    jsonPath,
+		subClashPath:   clashPath,
 		jsonEnabled:    jsonEnabled,
+		clashEnabled:   clashEnabled,
+		subSingboxPath: singboxPath,
+		singboxEnabled: singboxEnabled,
 		subEncrypt:     encrypt,
 		updateInterval: update,
+		clientRules:    compileSubClientRules(userAgentRules),
+		trustedProxies: middleware.LoadTrustedProxies(),
 
-		subService:     sub,
-		subJsonService: NewSubJsonService(jsonFragment, jsonNoise, jsonMux, jsonRules, sub),
+		subService:        sub,
+		subJsonService:    NewSubJsonService(jsonFragment, jsonNoise, jsonMux, jsonRules, sub),
+		subClashService:   NewSubClashService(jsonRules, sub),
+		subSingboxService: NewSubSingboxService(jsonRules, sub),
 	}
 	a.initRouter(g)
 	return a
@@ -59,19 +103,45 @@ func NewSUBController(
 // on the provided router group.
 func (a *SUBController) initRouter(g *gin.RouterGroup) {
 	gLink := g.Group(a.subPath)
-	gLink.GET(":subid", a.subs)
+	gLink.GET(":subid", a.resolveSub(""), a.subs)
 	if a.jsonEnabled {
 		gJson := g.Group(a.subJsonPath)
-		gJson.GET(":subid", a.subJsons)
+		gJson.GET(":subid", a.resolveSub(subFormatJson), a.subJsons)
+	}
+	if a.clashEnabled {
+		gClash := g.Group(a.subClashPath)
+		gClash.GET(":subid", a.resolveSub(subFormatClash), a.subClash)
+	}
+	if a.singboxEnabled {
+		gSingbox := g.Group(a.subSingboxPath)
+		gSingbox.GET(":subid", a.resolveSub(subFormatSingbox), a.subSingbox)
 	}
 }
 
 // subs handles HTTP requests for subscription links, returning either HTML page or base64-encoded subscription data.
+// Requests asking for another enabled format, or made by a client application whose User-Agent rule names one, get that format instead.
 func (a *SUBController) subs(c *gin.Context) {
-	subId := c.Param("subid")
+	switch a.subFormat(c) {
+	case subFormatJson:
+		a.subJsons(c)
+		return
+	case subFormatClash:
+		a.subClash(c)
+		return
+	case subFormatSingbox:
+		a.subSingbox(c)
+		return
+	}
+
+	subId := c.GetString(subIdKey)
+	// URLs handed out keep the identifier the subscription was requested with, which may be a token,
+	// and stay signed when the request was
+	urlId := c.Param("subid")
+	signedUntil := c.GetInt64(subSignedKey)
 	scheme, host, hostWithPort, hostHeader := a.subService.ResolveRequest(c)
 	subs, lastOnline, traffic, err := a.subService.GetSubs(subId, host)
 	if err != nil || len(subs) == 0 {
+		a.recordFetch(c, subId, subFormatLinks, 400)
 		c.String(400, "Error!")
 	} else {
 		result := ""
@@ -79,14 +149,24 @@ func (a *SUBController) subs(c *gin.Context) {
 			result += sub + "\n"
 		}
 
-		// If the request expects HTML (e.g., browser) or explicitly asked (?html=1 or ?view=html), render the info page here
+		// If the request expects HTML (e.g., browser) or explicitly asked (?html=1 or ?view=html), render the info page here.
+		// Known client applications always get the subscription itself.
+		rule := a.subClient(c)
 		accept := c.GetHeader("Accept")
-		if strings.Contains(strings.ToLower(accept), "text/html") || c.Query("html") == "1" || strings.EqualFold(c.Query("view"), "html") {
+		if (rule == nil && strings.Contains(strings.ToLower(accept), "text/html")) || c.Query("html") == "1" || strings.EqualFold(c.Query("view"), "html") {
 			// Build page data in service
-			subURL, subJsonURL := a.subService.BuildURLs(scheme, hostWithPort, a.subPath, a.subJsonPath, subId)
+			subURL, subJsonURL := a.subService.BuildURLs(scheme, hostWithPort, a.subPath, a.subJsonPath, urlId, signedUntil)
 			if !a.jsonEnabled {
 				subJsonURL = ""
 			}
+			subClashURL := ""
+			if a.clashEnabled {
+				subClashURL = a.subService.BuildClashURL(scheme, hostWithPort, a.subClashPath, urlId, signedUntil)
+			}
+			subSingboxURL := ""
+			if a.singboxEnabled {
+				subSingboxURL = a.subService.BuildSingboxURL(scheme, hostWithPort, a.subSingboxPath, urlId, signedUntil)
+			}
 			// Get base_path from context (set by middleware)
 			basePath, exists := c.Get("base_path")
 			if !exists {
@@ -95,41 +175,49 @@ func (a *SUBController) subs(c *gin.Context) {
 			// Add subId to base_path for asset URLs
 			basePathStr := basePath.(string)
 			if basePathStr == "/" {
-				basePathStr = "/" + subId + "/"
+				basePathStr = "/" + urlId + "/"
 			} else {
 				// Remove trailing slash if exists, add subId, then add trailing slash
-				basePathStr = strings.TrimRight(basePathStr, "/") + "/" + subId + "/"
+				basePathStr = strings.TrimRight(basePathStr, "/") + "/" + urlId + "/"
 			}
-			page := a.subService.BuildPageData(subId, hostHeader, traffic, lastOnline, subs, subURL, subJsonURL, basePathStr)
+			a.recordFetch(c, subId, subFormatHtml, 200)
+			page := a.subService.BuildPageData(subId, urlId, hostHeader, traffic, lastOnline, subs, subURL, subJsonURL, subClashURL, subSingboxURL, basePathStr)
 			c.HTML(200, "subpage.html", gin.H{
-				"title":        "subscription.title",
-				"cur_ver":      config.GetVersion(),
-				"host":         page.Host,
-				"base_path":    page.BasePath,
-				"sId":          page.SId,
-				"download":     page.Download,
-				"upload":       page.Upload,
-				"total":        page.Total,
-				"used":         page.Used,
-				"remained":     page.Remained,
-				"expire":       page.Expire,
-				"lastOnline":   page.LastOnline,
-				"datepicker":   page.Datepicker,
-				"downloadByte": page.DownloadByte,
-				"uploadByte":   page.UploadByte,
-				"totalByte":    page.TotalByte,
-				"subUrl":       page.SubUrl,
-				"subJsonUrl":   page.SubJsonUrl,
-				"result":       page.Result,
+				"title":         "subscription.title",
+				"cur_ver":       config.GetVersion(),
+				"host":          page.Host,
+				"base_path":     page.BasePath,
+				"sId":           page.SId,
+				"download":      page.Download,
+				"upload":        page.Upload,
+				"total":         page.Total,
+				"used":          page.Used,
+				"remained":      page.Remained,
+				"expire":        page.Expire,
+				"lastOnline":    page.LastOnline,
+				"datepicker":    page.Datepicker,
+				"downloadByte":  page.DownloadByte,
+				"uploadByte":    page.UploadByte,
+				"totalByte":     page.TotalByte,
+				"subUrl":        page.SubUrl,
+				"subJsonUrl":    page.SubJsonUrl,
+				"subClashUrl":   page.SubClashUrl,
+				"subSingboxUrl": page.SubSingboxUrl,
+				"result":        page.Result,
+				"usage":         page.Usage,
 			})
 			return
 		}
 
 		// Add headers
-		header := fmt.Sprintf("upload=%d; download=%d; total=%d; expire=%d", traffic.Up, traffic.Down, traffic.Total, traffic.ExpiryTime/1000)
-		a.ApplyCommonHeaders(c, header, a.updateInterval, a.subTitle)
+		a.ApplyCommonHeaders(c, subUserInfo(traffic), a.updateInterval, a.subTitle)
+		a.recordFetch(c, subId, subFormatLinks, 200)
 
-		if a.subEncrypt {
+		encrypt := a.subEncrypt
+		if rule != nil && rule.Encoding != "" {
+			encrypt = rule.Encoding == "base64"
+		}
+		if encrypt {
 			c.String(200, base64.StdEncoding.EncodeToString([]byte(result)))
 		} else {
 			c.String(200, result)
@@ -137,25 +225,137 @@ func (a *SUBController) subs(c *gin.Context) {
 	}
 }
 
+// resolveSub returns a handler that maps the requested identifier, a subscription token or a subId,
+// to the subId the handlers serve. Requests with an invalid or expired signature, refused tokens and
+// unsigned requests for subscriptions only served signed get a 403 before any subscription is looked up.
+// format is the format of the route, empty for the links path, which negotiates it.
+func (a *SUBController) resolveSub(format string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.Param("subid")
+		ip := middleware.ClientIP(c.Request, a.trustedProxies)
+		refuse := func(subId string, err error) {
+			logger.Infof("sub: refused subscription %s for %s: %v", subId, ip, err)
+			a.recordFetch(c, subId, cmp.Or(format, a.subFormat(c)), 403)
+			c.AbortWithStatus(403)
+		}
+
+		var signedUntil int64
+		expiry, signature := c.Query(service.SubSignExpiryParam), c.Query(service.SubSignSignatureParam)
+		if expiry != "" || signature != "" {
+			var err error
+			if signedUntil, err = a.signService.Verify(id, expiry, signature); err != nil {
+				refuse(id, err)
+				return
+			}
+		}
+
+		subId, err := a.tokenService.ResolveSubId(id, ip, c.GetHeader("User-Agent"))
+		if err != nil {
+			refuse(subId, err)
+			return
+		}
+		if signedUntil == 0 {
+			signedOnly, err := a.signService.IsSignedOnly(subId)
+			if err == nil && signedOnly {
+				err = common.NewError("subscription is only served through signed URLs")
+			}
+			if err != nil {
+				refuse(subId, err)
+				return
+			}
+		}
+		c.Set(subIdKey, subId)
+		c.Set(subSignedKey, signedUntil)
+	}
+}
+
 // subJsons handles HTTP requests for JSON subscription configurations.
 func (a *SUBController) subJsons(c *gin.Context) {
-	subId := c.Param("subid")
+	subId := c.GetString(subIdKey)
 	_, host, _, _ := a.subService.ResolveRequest(c)
 	jsonSub, header, err := a.subJsonService.GetJson(subId, host)
 	if err != nil || len(jsonSub) == 0 {
+		a.recordFetch(c, subId, subFormatJson, 400)
 		c.String(400, "Error!")
 	} else {
 
 		// Add headers
 		a.ApplyCommonHeaders(c, header, a.updateInterval, a.subTitle)
+		a.recordFetch(c, subId, subFormatJson, 200)
 
 		c.String(200, jsonSub)
 	}
 }
 
+// subClash handles HTTP requests for Clash/Mihomo YAML subscription profiles.
+func (a *SUBController) subClash(c *gin.Context) {
+	subId := c.GetString(subIdKey)
+	_, host, _, _ := a.subService.ResolveRequest(c)
+	clashSub, header, err := a.subClashService.GetClash(subId, host)
+	if err != nil || len(clashSub) == 0 {
+		a.recordFetch(c, subId, subFormatClash, 400)
+		c.String(400, "Error!")
+	} else {
+
+		// Add headers
+		a.ApplyCommonHeaders(c, header, a.updateInterval, a.subTitle)
+		a.recordFetch(c, subId, subFormatClash, 200)
+
+		c.Data(200, "text/yaml; charset=utf-8", []byte(clashSub))
+	}
+}
+
+// subSingbox handles HTTP requests for sing-box subscription configurations.
+func (a *SUBController) subSingbox(c *gin.Context) {
+	subId := c.GetString(subIdKey)
+	_, host, _, _ := a.subService.ResolveRequest(c)
+	singboxSub, header, err := a.subSingboxService.GetSingbox(subId, host)
+	if err != nil || len(singboxSub) == 0 {
+		a.recordFetch(c, subId, subFormatSingbox, 400)
+		c.String(400, "Error!")
+	} else {
+
+		// Add headers
+		a.ApplyCommonHeaders(c, header, a.updateInterval, a.subTitle)
+		a.recordFetch(c, subId, subFormatSingbox, 200)
+
+		c.Data(200, "application/json; charset=utf-8", []byte(singboxSub))
+	}
+}
+
+// subFormat returns the format a request to the links path asks for: the format query parameter
+// or, without one, the format of the User-Agent rule matching its client application. Formats
+// that are not enabled fall back to links.
+func (a *SUBController) subFormat(c *gin.Context) string {
+	format := strings.ToLower(c.Query("format"))
+	if format == "" {
+		if rule := a.subClient(c); rule != nil {
+			format = rule.Format
+		}
+	}
+	switch {
+	case format == subFormatJson && a.jsonEnabled,
+		format == subFormatClash && a.clashEnabled,
+		format == subFormatSingbox && a.singboxEnabled:
+		return format
+	}
+	return subFormatLinks
+}
+
 // ApplyCommonHeaders sets common HTTP headers for subscription responses including user info, update interval, and profile title.
+// A matching User-Agent rule can limit them to the user info or drop them for clients that choke on unknown headers.
 func (a *SUBController) ApplyCommonHeaders(c *gin.Context, header, updateInterval, profileTitle string) {
+	headers := subHeadersStandard
+	if rule := a.subClient(c); rule != nil && rule.Headers != "" {
+		headers = rule.Headers
+	}
+	if headers == subHeadersNone {
+		return
+	}
 	c.Writer.Header().Set("Subscription-Userinfo", header)
+	if headers == subHeadersUserinfo {
+		return
+	}
 	c.Writer.Header().Set("Profile-Update-Interval", updateInterval)
 	c.Writer.Header().Set("Profile-Title", "base64:"+base64.StdEncoding.EncodeToString([]byte(profileTitle)))
 }
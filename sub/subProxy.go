@@ -0,0 +1,264 @@
+package sub
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/goccy/go-json"
+
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+	"github.com/mhsanaei/3x-ui/v2/logger"
+	"github.com/mhsanaei/3x-ui/v2/util/random"
+)
+
+// subProxy describes how a client connects to an inbound, independent of the format of the
+// client application. Generators for formats other than share links and xray JSON render it.
+type subProxy struct {
+	Name       string
+	Protocol   model.Protocol
+	Server     string
+	Port       int
+	UUID       string // vmess and vless
+	Flow       string // vless
+	Encryption string // vless
+	Cipher     string // vmess security or shadowsocks method
+	Password   string // trojan and shadowsocks
+
+	Network     string // tcp, ws, grpc, httpupgrade, xhttp or http, which is tcp with an http header
+	Path        string
+	Host        string
+	ServiceName string
+	Mode        string // xhttp mode
+
+	Security    string // none, tls or reality
+	SNI         string
+	ALPN        []string
+	Fingerprint string
+	Insecure    bool
+	PublicKey   string
+	ShortId     string
+}
+
+// subRule is a routing rule of the JSON subscription in the form other formats translate it from.
+type subRule struct {
+	OutboundTag string   `json:"outboundTag"`
+	Domain      []string `json:"domain"`
+	IP          []string `json:"ip"`
+	Port        any      `json:"port"`
+	Ports       []string `json:"-"`
+}
+
+// parseSubRules parses the xray routing rules of the JSON subscription. Xray requires every kind
+// of condition of a rule to match, which other formats cannot express, so rules combining
+// domain, IP and port conditions are dropped.
+func parseSubRules(rules string) []subRule {
+	if rules == "" {
+		return nil
+	}
+	var parsed []subRule
+	if err := json.Unmarshal([]byte(rules), &parsed); err != nil {
+		logger.Warning("sub: invalid JSON subscription rules:", err)
+		return nil
+	}
+
+	result := make([]subRule, 0, len(parsed))
+	for _, rule := range parsed {
+		switch port := rule.Port.(type) {
+		case float64:
+			rule.Ports = []string{fmt.Sprint(port)}
+		case string:
+			for p := range strings.SplitSeq(port, ",") {
+				if p = strings.TrimSpace(p); p != "" {
+					rule.Ports = append(rule.Ports, p)
+				}
+			}
+		}
+		conditions := 0
+		for _, n := range []int{len(rule.Domain), len(rule.IP), len(rule.Ports)} {
+			if n > 0 {
+				conditions++
+			}
+		}
+		if conditions == 1 {
+			result = append(result, rule)
+		}
+	}
+	return result
+}
+
+// getUniqueSubProxies returns the proxies of every client of a subscription. Clash and sing-box
+// refer to proxies by name, so repeated names get a counter appended.
+func (s *SubService) getUniqueSubProxies(subClients []subClient) []subProxy {
+	var proxies []subProxy
+	usedNames := make(map[string]int)
+	for _, sc := range subClients {
+		for _, proxy := range s.getSubProxies(sc) {
+			usedNames[proxy.Name]++
+			if n := usedNames[proxy.Name]; n > 1 {
+				proxy.Name = fmt.Sprintf("%s (%d)", proxy.Name, n)
+			}
+			proxies = append(proxies, proxy)
+		}
+	}
+	return proxies
+}
+
+// getSubProxies returns one proxy per address the client of a subscription can reach its inbound
+// at: the external proxies of the inbound or, without any, host and the inbound port.
+func (s *SubService) getSubProxies(sc subClient) []subProxy {
+	var stream map[string]any
+	json.Unmarshal([]byte(sc.inbound.StreamSettings), &stream)
+
+	base, ok := s.baseSubProxy(sc, stream)
+	if !ok {
+		return nil
+	}
+
+	externalProxies, _ := stream["externalProxy"].([]any)
+	if len(externalProxies) == 0 {
+		base.Name = s.genRemark(sc.inbound, sc.client.Email, "")
+		return []subProxy{base}
+	}
+
+	proxies := make([]subProxy, 0, len(externalProxies))
+	for _, externalProxy := range externalProxies {
+		ep, _ := externalProxy.(map[string]any)
+		proxy := base
+		proxy.Server, _ = ep["dest"].(string)
+		if port, ok := ep["port"].(float64); ok {
+			proxy.Port = int(port)
+		}
+		remark, _ := ep["remark"].(string)
+		proxy.Name = s.genRemark(sc.inbound, sc.client.Email, remark)
+		switch ep["forceTls"] {
+		case "tls":
+			proxy.Security = "tls"
+		case "none":
+			proxy.Security = "none"
+			proxy.SNI, proxy.ALPN, proxy.Fingerprint, proxy.Insecure = "", nil, "", false
+		}
+		proxies = append(proxies, proxy)
+	}
+	return proxies
+}
+
+// baseSubProxy reads the credentials, transport and security of a client's proxy from its inbound.
+// It reports false for protocols and transports other formats cannot express.
+func (s *SubService) baseSubProxy(sc subClient, stream map[string]any) (subProxy, bool) {
+	inbound, client := sc.inbound, sc.client
+	proxy := subProxy{
+		Protocol: inbound.Protocol,
+		Server:   sc.host,
+		Port:     inbound.Port,
+	}
+
+	var settings map[string]any
+	json.Unmarshal([]byte(inbound.Settings), &settings)
+	switch inbound.Protocol {
+	case model.VMESS:
+		proxy.UUID = client.ID
+		proxy.Cipher = client.Security
+	case model.VLESS:
+		proxy.UUID = client.ID
+		proxy.Encryption, _ = settings["encryption"].(string)
+	case model.Trojan:
+		proxy.Password = client.Password
+	case model.Shadowsocks:
+		proxy.Cipher, _ = settings["method"].(string)
+		proxy.Password = client.Password
+		// server password in multi-user 2022 protocols
+		if strings.HasPrefix(proxy.Cipher, "2022") {
+			if serverPassword, ok := settings["password"].(string); ok {
+				proxy.Password = fmt.Sprintf("%s:%s", serverPassword, client.Password)
+			}
+		}
+	default:
+		return proxy, false
+	}
+
+	proxy.Network, _ = stream["network"].(string)
+	switch proxy.Network {
+	case "tcp":
+		tcp, _ := stream["tcpSettings"].(map[string]any)
+		header, _ := tcp["header"].(map[string]any)
+		if header["type"] == "http" {
+			proxy.Network = "http"
+			request, _ := header["request"].(map[string]any)
+			if paths, _ := request["path"].([]any); len(paths) > 0 {
+				proxy.Path, _ = paths[0].(string)
+			}
+			proxy.Host = searchHost(request["headers"])
+		}
+	case "ws", "httpupgrade", "xhttp":
+		transport, _ := stream[proxy.Network+"Settings"].(map[string]any)
+		proxy.Path, _ = transport["path"].(string)
+		if host, ok := transport["host"].(string); ok && len(host) > 0 {
+			proxy.Host = host
+		} else {
+			proxy.Host = searchHost(transport["headers"])
+		}
+		proxy.Mode, _ = transport["mode"].(string)
+	case "grpc":
+		grpc, _ := stream["grpcSettings"].(map[string]any)
+		proxy.ServiceName, _ = grpc["serviceName"].(string)
+		proxy.Host, _ = grpc["authority"].(string)
+	default:
+		return proxy, false
+	}
+
+	proxy.Security, _ = stream["security"].(string)
+	switch proxy.Security {
+	case "tls":
+		tlsSetting, _ := stream["tlsSettings"].(map[string]any)
+		proxy.SNI, _ = tlsSetting["serverName"].(string)
+		alpns, _ := tlsSetting["alpn"].([]any)
+		for _, alpn := range alpns {
+			if alpn, ok := alpn.(string); ok {
+				proxy.ALPN = append(proxy.ALPN, alpn)
+			}
+		}
+		tlsSettings, _ := tlsSetting["settings"].(map[string]any)
+		proxy.Fingerprint, _ = tlsSettings["fingerprint"].(string)
+		proxy.Insecure, _ = tlsSettings["allowInsecure"].(bool)
+	case "reality":
+		realitySetting, _ := stream["realitySettings"].(map[string]any)
+		realitySettings, _ := realitySetting["settings"].(map[string]any)
+		if serverNames, _ := realitySetting["serverNames"].([]any); len(serverNames) > 0 {
+			proxy.SNI, _ = serverNames[random.Num(len(serverNames))].(string)
+		}
+		if shortIds, _ := realitySetting["shortIds"].([]any); len(shortIds) > 0 {
+			proxy.ShortId, _ = shortIds[random.Num(len(shortIds))].(string)
+		}
+		proxy.PublicKey, _ = realitySettings["publicKey"].(string)
+		proxy.Fingerprint, _ = realitySettings["fingerprint"].(string)
+	default:
+		proxy.Security = "none"
+	}
+
+	if inbound.Protocol == model.VLESS && proxy.Network == "tcp" && proxy.Security != "none" {
+		proxy.Flow = client.Flow
+	}
+	return proxy, true
+}
+
+// normalizeCIDR turns an IP address or CIDR of an xray rule into a CIDR. It reports false for
+// anything else, such as geoip and ext matchers.
+func normalizeCIDR(ip string) (string, bool) {
+	if !strings.Contains(ip, "/") {
+		addr := net.ParseIP(ip)
+		if addr == nil {
+			return "", false
+		}
+		if addr.To4() == nil {
+			ip += "/128"
+		} else {
+			ip += "/32"
+		}
+	}
+	_, network, err := net.ParseCIDR(ip)
+	if err != nil {
+		return "", false
+	}
+	return network.String(), true
+}
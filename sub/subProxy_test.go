@@ -0,0 +1,76 @@
+package sub
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/mhsanaei/3x-ui/v2/logger"
+
+	"github.com/op/go-logging"
+)
+
+func TestParseSubRules(t *testing.T) {
+	t.Setenv("XUI_LOG_FOLDER", t.TempDir())
+	logger.InitLogger(logging.ERROR)
+
+	tests := []struct {
+		name  string
+		rules string
+		want  []subRule
+	}{
+		{name: "empty", rules: ""},
+		{name: "invalid JSON", rules: `{"outboundTag":`},
+		{
+			name:  "domain rule",
+			rules: `[{"outboundTag":"direct","domain":["geosite:private"]}]`,
+			want:  []subRule{{OutboundTag: "direct", Domain: []string{"geosite:private"}}},
+		},
+		{
+			name:  "ip rule",
+			rules: `[{"outboundTag":"block","ip":["geoip:private","10.0.0.0/8"]}]`,
+			want:  []subRule{{OutboundTag: "block", IP: []string{"geoip:private", "10.0.0.0/8"}}},
+		},
+		{
+			name:  "numeric port",
+			rules: `[{"outboundTag":"block","port":25}]`,
+			want:  []subRule{{OutboundTag: "block", Port: float64(25), Ports: []string{"25"}}},
+		},
+		{
+			name:  "port list and range",
+			rules: `[{"outboundTag":"direct","port":"80, 443,1000-2000,"}]`,
+			want:  []subRule{{OutboundTag: "direct", Port: "80, 443,1000-2000,", Ports: []string{"80", "443", "1000-2000"}}},
+		},
+		{
+			name:  "domain and ip conditions are dropped",
+			rules: `[{"outboundTag":"direct","domain":["domain:example.com"],"ip":["1.1.1.1"]}]`,
+			want:  []subRule{},
+		},
+		{
+			name:  "ip and port conditions are dropped",
+			rules: `[{"outboundTag":"direct","ip":["1.1.1.1"],"port":"443"}]`,
+			want:  []subRule{},
+		},
+		{
+			name:  "rule without conditions is dropped",
+			rules: `[{"outboundTag":"direct","network":"udp"}]`,
+			want:  []subRule{},
+		},
+		{
+			name: "mixed rules keep their order",
+			rules: `[{"outboundTag":"direct","domain":["full:a.example.com"]},
+				{"outboundTag":"direct","domain":["full:b.example.com"],"port":"443"},
+				{"outboundTag":"block","ip":["8.8.8.8"]}]`,
+			want: []subRule{
+				{OutboundTag: "direct", Domain: []string{"full:a.example.com"}},
+				{OutboundTag: "block", IP: []string{"8.8.8.8"}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseSubRules(tt.rules); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("parseSubRules() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,11 +1,15 @@
 package sub
 
 import (
+	"cmp"
+	"context"
 	"encoding/base64"
 	"fmt"
+	"maps"
 	"net"
 	"net/url"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -20,14 +24,30 @@ import (
 	"github.com/mhsanaei/3x-ui/v2/xray"
 )
 
+// pageUsageDays is how many days of daily usage the subscription page charts.
+const pageUsageDays = 30
+
+// staleRemarkSuffix marks links of nodes that could not be reached and are served from cache.
+const staleRemarkSuffix = " ⚠️stale"
+
 // SubService provides business logic for generating subscription links and managing subscription data.
 type SubService struct {
-	address        string
 	showInfo       bool
 	remarkModel    string
 	datepicker     string
 	inboundService service.InboundService
 	settingService service.SettingService
+	signService    service.SubscriptionSignService
+
+	trafficHistoryService service.ClientTrafficHistoryService
+}
+
+// linkTarget is where generated links point: the address clients connect to and, for a remote
+// node, its client-facing endpoints. It is passed along rather than kept on the shared
+// SubService so that concurrent requests cannot see each other's target.
+type linkTarget struct {
+	address   string
+	endpoints []model.NodeEndpoint
 }
 
 // NewSubService creates a new subscription service with the given configuration.
@@ -41,15 +61,10 @@ func NewSubService(showInfo bool, remarkModel string) *SubService {
 // GetSubs retrieves subscription links for a given subscription ID and host.
 // If the subId is a multi-subscription, it will aggregate data from multiple nodes.
 func (s *SubService) GetSubs(subId string, host string) ([]string, int64, xray.ClientTraffic, error) {
-	s.address = host
-
 	// Check if this is a multi-subscription
-	db := database.GetDB()
-	var multiSub model.MultiSubscription
-	err := db.Where("sub_id = ? AND enable = ?", subId, true).First(&multiSub).Error
-	if err == nil {
+	if multiSub := s.getMultiSub(subId); multiSub != nil {
 		// This is a multi-subscription, get data from multiple nodes
-		return s.getMultiSubs(&multiSub, host)
+		return s.getMultiSubs(multiSub, host)
 	}
 
 	// Regular subscription from local node
@@ -88,7 +103,7 @@ func (s *SubService) GetSubs(subId string, host string) ([]string, int64, xray.C
 		}
 		for _, client := range clients {
 			if client.Enable && client.SubID == subId {
-				link := s.getLink(inbound, client.Email)
+				link := s.getLink(inbound, client.Email, linkTarget{address: host})
 				result = append(result, link)
 				ct := s.getClientTraffics(inbound.ClientStats, client.Email)
 				clientTraffics = append(clientTraffics, ct)
@@ -124,20 +139,44 @@ func (s *SubService) GetSubs(subId string, host string) ([]string, int64, xray.C
 	return result, lastOnline, traffic, nil
 }
 
+// getMultiSub returns the enabled multi-subscription with the given subscription ID, or nil.
+func (s *SubService) getMultiSub(subId string) *model.MultiSubscription {
+	db := database.GetDB()
+	var multiSub model.MultiSubscription
+	if err := db.Where("sub_id = ? AND enable = ?", subId, true).First(&multiSub).Error; err != nil {
+		return nil
+	}
+	return &multiSub
+}
+
+// KnownSub reports whether subId belongs to a multi-subscription or to a client of a local inbound,
+// enabled or not.
+func (s *SubService) KnownSub(subId string) bool {
+	if subId == "" {
+		return false
+	}
+	db := database.GetDB()
+	var count int64
+	if err := db.Model(&model.MultiSubscription{}).Where("sub_id = ?", subId).Count(&count).Error; err == nil && count > 0 {
+		return true
+	}
+	err := db.Raw(`
+		SELECT COUNT(*)
+		FROM inbounds,
+			JSON_EACH(JSON_EXTRACT(inbounds.settings, '$.clients')) AS client
+		WHERE JSON_EXTRACT(client.value, '$.subId') = ?`, subId).Scan(&count).Error
+	return err == nil && count > 0
+}
+
 // getMultiSubs retrieves subscription links from multiple nodes for a multi-subscription.
 func (s *SubService) getMultiSubs(multiSub *model.MultiSubscription, host string) ([]string, int64, xray.ClientTraffic, error) {
 	var allLinks []string
 	var aggregatedTraffic xray.ClientTraffic
 	var maxLastOnline int64
 
-	multiSubService := service.MultiSubscriptionService{}
-	nodes, err := multiSubService.GetNodes(multiSub)
+	nodes, snapshots, globalClient, err := s.fetchMultiSubNodes(multiSub)
 	if err != nil {
-		return nil, 0, aggregatedTraffic, common.NewError("failed to get nodes for multi-subscription: ", err)
-	}
-
-	if len(nodes) == 0 {
-		return nil, 0, aggregatedTraffic, common.NewError("no enabled nodes found for multi-subscription")
+		return nil, 0, aggregatedTraffic, err
 	}
 
 	// Get local node subscriptions first (if any)
@@ -159,23 +198,10 @@ func (s *SubService) getMultiSubs(multiSub *model.MultiSubscription, host string
 		}
 	}
 
-	// Get subscriptions from remote nodes
-	for _, node := range nodes {
-		if node.Status != model.NodeStatusOnline {
-			logger.Debugf("Skipping node %s (id: %d) - status: %s", node.Name, node.Id, node.Status)
-			continue
-		}
-
-		nodeClient := service.NewNodeClient(node)
-		inbounds, err := nodeClient.GetClientsBySubId(multiSub.SubId)
-		if err != nil {
-			logger.Warningf("Failed to get clients from node %s (id: %d): %v", node.Name, node.Id, err)
-			continue
-		}
-
-		// Generate links for each inbound from this node
-		for _, inbound := range inbounds {
-			nodeLinks, lastOnline, traffic, err := s.getSubsFromRemoteInbound(inbound, node)
+	// Generate links for each inbound the nodes returned
+	for i, node := range nodes {
+		for _, inbound := range snapshots[i].Inbounds {
+			nodeLinks, lastOnline, traffic, err := s.getSubsFromRemoteInbound(inbound, node, multiSub.SubId, host, snapshots[i].Stale)
 			if err != nil {
 				logger.Warningf("Failed to generate links from node %s: %v", node.Name, err)
 				continue
@@ -198,7 +224,269 @@ func (s *SubService) getMultiSubs(multiSub *model.MultiSubscription, host string
 		return nil, 0, aggregatedTraffic, common.NewError("no subscription links found for multi-subscription")
 	}
 
-	return allLinks, maxLastOnline, aggregatedTraffic, nil
+	return allLinks, maxLastOnline, applyGlobalClientTraffic(aggregatedTraffic, globalClient), nil
+}
+
+// fetchMultiSubNodes returns the enabled nodes of a multi-subscription, the result of looking
+// its subId up on each of them and its global client, if it has one.
+func (s *SubService) fetchMultiSubNodes(multiSub *model.MultiSubscription) ([]*model.Node, []service.NodeSubSnapshot, *model.GlobalClient, error) {
+	multiSubService := service.MultiSubscriptionService{}
+	nodes, err := multiSubService.GetNodes(multiSub)
+	if err != nil {
+		return nil, nil, nil, common.NewError("failed to get nodes for multi-subscription: ", err)
+	}
+
+	if len(nodes) == 0 {
+		return nil, nil, nil, common.NewError("no enabled nodes found for multi-subscription")
+	}
+
+	globalClientService := service.GlobalClientService{}
+	globalClient, _ := globalClientService.GetGlobalClient(multiSub.Id)
+
+	// Look the subscription up on every node at once; links and configs are generated
+	// afterwards as their generation is not safe for concurrent use
+	snapshots := s.fetchNodeSubs(nodes, multiSub.SubId)
+	for i, node := range nodes {
+		snapshot := snapshots[i]
+		if snapshot.FetchedAt.IsZero() {
+			if snapshot.Err != nil {
+				logger.Warningf("Failed to get clients from node %s (id: %d): %v", node.Name, node.Id, snapshot.Err)
+			}
+			continue
+		}
+		if snapshot.Stale {
+			logger.Warningf("Serving links of node %s (id: %d) cached at %s: %v", node.Name, node.Id,
+				snapshot.FetchedAt.Format(time.DateTime), snapshot.Err)
+		}
+	}
+	return nodes, snapshots, globalClient, nil
+}
+
+// applyGlobalClientTraffic replaces the quota of aggregated traffic with the one of the global
+// client, which applies to the whole cluster rather than per node.
+func applyGlobalClientTraffic(traffic xray.ClientTraffic, globalClient *model.GlobalClient) xray.ClientTraffic {
+	if globalClient != nil {
+		traffic.Total = globalClient.TotalGB
+		traffic.ExpiryTime = globalClient.ExpiryTime
+		traffic.Enable = globalClient.Enable && !globalClient.Depleted
+	}
+	return traffic
+}
+
+// subClient is an enabled client of a subscription together with the inbound it connects
+// through and the host the inbound is reached at.
+type subClient struct {
+	inbound *model.Inbound
+	client  model.Client
+	host    string
+}
+
+// getSubClients returns the enabled clients of subId in the local inbounds and their combined
+// traffic. For a multi-subscription it also returns the clients the nodes hold for subId,
+// with inbounds that point to the node or its client-facing endpoints.
+func (s *SubService) getSubClients(subId string, host string) ([]subClient, xray.ClientTraffic, error) {
+	var subClients []subClient
+	var clientTraffics []xray.ClientTraffic
+	appendClients := func(inbound *model.Inbound, clients []model.Client, add func(client model.Client)) {
+		for _, client := range clients {
+			if client.Enable && client.SubID == subId {
+				clientTraffics = append(clientTraffics, s.getClientTraffics(inbound.ClientStats, client.Email))
+				add(client)
+			}
+		}
+	}
+
+	var nodes []*model.Node
+	var snapshots []service.NodeSubSnapshot
+	var globalClient *model.GlobalClient
+	multiSub := s.getMultiSub(subId)
+	if multiSub != nil {
+		var err error
+		nodes, snapshots, globalClient, err = s.fetchMultiSubNodes(multiSub)
+		if err != nil {
+			return nil, xray.ClientTraffic{}, err
+		}
+	}
+
+	inbounds, err := s.getInboundsBySubId(subId)
+	if err != nil && multiSub == nil {
+		return nil, xray.ClientTraffic{}, err
+	}
+	for _, inbound := range inbounds {
+		clients, err := s.inboundService.GetClients(inbound)
+		if err != nil {
+			logger.Error("SubService - GetClients: Unable to get clients from inbound")
+		}
+		if clients == nil {
+			continue
+		}
+		if len(inbound.Listen) > 0 && inbound.Listen[0] == '@' {
+			listen, port, streamSettings, err := s.getFallbackMaster(inbound.Listen, inbound.StreamSettings)
+			if err == nil {
+				inbound.Listen = listen
+				inbound.Port = port
+				inbound.StreamSettings = streamSettings
+			}
+		}
+		appendClients(inbound, clients, func(client model.Client) {
+			subClients = append(subClients, subClient{inbound, client, host})
+		})
+	}
+
+	for i, node := range nodes {
+		endpoints, err := node.GetEndpoints()
+		if err != nil {
+			logger.Warningf("Invalid endpoints of node %s: %v", node.Name, err)
+		}
+		for _, inbound := range snapshots[i].Inbounds {
+			clients, err := s.inboundService.GetClients(inbound)
+			if err != nil {
+				logger.Warningf("Failed to get clients of inbound %s from node %s: %v", inbound.Remark, node.Name, err)
+				continue
+			}
+			appendClients(inbound, clients, func(client model.Client) {
+				if len(endpoints) == 0 {
+					subClients = append(subClients, subClient{remoteConfigInbound(inbound, snapshots[i].Stale, nil, node.Host), client, node.Host})
+					return
+				}
+				for _, ep := range endpoints {
+					subClients = append(subClients, subClient{remoteConfigInbound(inbound, snapshots[i].Stale, &ep, node.Host), client, node.Host})
+				}
+			})
+		}
+	}
+
+	traffic := aggregateTraffics(clientTraffics)
+	if multiSub != nil {
+		traffic = applyGlobalClientTraffic(traffic, globalClient)
+	}
+	return subClients, traffic, nil
+}
+
+// aggregateTraffics sums the traffic of every client of a subscription.
+func aggregateTraffics(clientTraffics []xray.ClientTraffic) xray.ClientTraffic {
+	var traffic xray.ClientTraffic
+	for index, clientTraffic := range clientTraffics {
+		if index == 0 {
+			traffic.Up = clientTraffic.Up
+			traffic.Down = clientTraffic.Down
+			traffic.Total = clientTraffic.Total
+			if clientTraffic.ExpiryTime > 0 {
+				traffic.ExpiryTime = clientTraffic.ExpiryTime
+			}
+		} else {
+			traffic.Up += clientTraffic.Up
+			traffic.Down += clientTraffic.Down
+			if traffic.Total == 0 || clientTraffic.Total == 0 {
+				traffic.Total = 0
+			} else {
+				traffic.Total += clientTraffic.Total
+			}
+			if clientTraffic.ExpiryTime != traffic.ExpiryTime {
+				traffic.ExpiryTime = 0
+			}
+		}
+	}
+	return traffic
+}
+
+// remoteConfigInbound returns a copy of an inbound a node returned, prepared for getConfig,
+// which modifies its inbound. With an endpoint the stream settings point to the endpoint
+// instead of the node host and carry its SNI and Host overrides.
+func remoteConfigInbound(inbound *model.Inbound, stale bool, ep *model.NodeEndpoint, nodeHost string) *model.Inbound {
+	copied := *inbound
+	if stale {
+		copied.Remark += staleRemarkSuffix
+	}
+	if ep == nil {
+		return &copied
+	}
+
+	var stream map[string]any
+	json.Unmarshal([]byte(inbound.StreamSettings), &stream)
+	if stream == nil {
+		stream = map[string]any{}
+	}
+	stream["externalProxy"] = []any{
+		map[string]any{
+			"forceTls": "same",
+			"dest":     cmp.Or(ep.Address, nodeHost),
+			"port":     float64(cmp.Or(ep.Port, inbound.Port)),
+			"remark":   ep.Remark,
+		},
+	}
+	if ep.Sni != "" && stream["security"] == "tls" {
+		if tlsSettings, ok := stream["tlsSettings"].(map[string]any); ok {
+			tlsSettings["serverName"] = ep.Sni
+		}
+	}
+	if ep.Host != "" {
+		for _, key := range []string{"wsSettings", "httpupgradeSettings", "xhttpSettings"} {
+			if settings, ok := stream[key].(map[string]any); ok {
+				settings["host"] = ep.Host
+			}
+		}
+		tcp, _ := stream["tcpSettings"].(map[string]any)
+		header, _ := tcp["header"].(map[string]any)
+		if request, ok := header["request"].(map[string]any); ok && header["type"] == "http" {
+			headers, _ := request["headers"].(map[string]any)
+			if headers == nil {
+				headers = map[string]any{}
+				request["headers"] = headers
+			}
+			headers["Host"] = []any{ep.Host}
+		}
+	}
+	streamSettings, _ := json.Marshal(stream)
+	copied.StreamSettings = string(streamSettings)
+	return &copied
+}
+
+// subUserInfo formats traffic as the value of the Subscription-Userinfo header.
+func subUserInfo(traffic xray.ClientTraffic) string {
+	return fmt.Sprintf("upload=%d; download=%d; total=%d; expire=%d", traffic.Up, traffic.Down, traffic.Total, traffic.ExpiryTime/1000)
+}
+
+// fetchNodeSubs looks subId up on every node in parallel through the node subscription cache.
+// It returns once every node answered or the subscription node timeout passed; nodes that
+// did not answer in time are left without inbounds. Nodes that are not online are not
+// contacted, their last known inbounds are served as stale. Nodes are only read here; global
+// clients missing on a node are provisioned by the cluster quota job.
+func (s *SubService) fetchNodeSubs(nodes []*model.Node, subId string) []service.NodeSubSnapshot {
+	timeout, err := s.settingService.GetSubNodeTimeout()
+	if err != nil || timeout <= 0 {
+		timeout = 5
+	}
+	ttl, err := s.settingService.GetSubNodeCacheTTL()
+	if err != nil || ttl < 0 {
+		ttl = 60
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Second)
+	defer cancel()
+
+	cache := service.GetNodeSubCache()
+	snapshots := make([]service.NodeSubSnapshot, len(nodes))
+	var wg sync.WaitGroup
+	for i, node := range nodes {
+		if node.Status != model.NodeStatusOnline {
+			if snapshot, ok := cache.Peek(node.Id, subId); ok {
+				snapshot.Err = common.NewErrorf("node status is %s", node.Status)
+				snapshots[i] = snapshot
+			} else {
+				logger.Debugf("Skipping node %s (id: %d) - status: %s", node.Name, node.Id, node.Status)
+			}
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			snapshots[i] = cache.Get(ctx, node.Id, subId, time.Duration(ttl)*time.Second, func(ctx context.Context) ([]*model.Inbound, error) {
+				return service.NewNodeClient(node).WithContext(ctx).GetClientsBySubId(subId)
+			})
+		}()
+	}
+	wg.Wait()
+	return snapshots
 }
 
 // getSubsFromInbounds generates subscription links from local inbounds.
@@ -232,7 +520,7 @@ func (s *SubService) getSubsFromInbounds(inbounds []*model.Inbound, host string)
 		}
 		for _, client := range clients {
 			if client.Enable {
-				link := s.getLink(inbound, client.Email)
+				link := s.getLink(inbound, client.Email, linkTarget{address: host})
 				result = append(result, link)
 				ct := s.getClientTraffics(inbound.ClientStats, client.Email)
 				clientTraffics = append(clientTraffics, ct)
@@ -269,8 +557,9 @@ func (s *SubService) getSubsFromInbounds(inbounds []*model.Inbound, host string)
 	return result, lastOnline, traffic, nil
 }
 
-// getSubsFromRemoteInbound generates subscription links from a remote node's inbound.
-func (s *SubService) getSubsFromRemoteInbound(inbound *model.Inbound, node *model.Node) ([]string, int64, xray.ClientTraffic, error) {
+// getSubsFromRemoteInbound generates subscription links for the clients of subId in a remote
+// node's inbound. Links of a stale inbound carry a marker in their remark.
+func (s *SubService) getSubsFromRemoteInbound(inbound *model.Inbound, node *model.Node, subId string, host string, stale bool) ([]string, int64, xray.ClientTraffic, error) {
 	var result []string
 	var traffic xray.ClientTraffic
 	var lastOnline int64
@@ -287,17 +576,24 @@ func (s *SubService) getSubsFromRemoteInbound(inbound *model.Inbound, node *mode
 	}
 
 	// Use node's host/domain as address for remote nodes
-	remoteAddress := node.Host
-	if node.Host == "" {
-		remoteAddress = s.address
+	target := linkTarget{address: cmp.Or(node.Host, host)}
+
+	// The cached inbound is shared, mark a copy
+	if stale {
+		staleInbound := *inbound
+		staleInbound.Remark += staleRemarkSuffix
+		inbound = &staleInbound
 	}
 
-	// Temporary set address for link generation
-	originalAddress := s.address
-	s.address = remoteAddress
-	defer func() { s.address = originalAddress }()
+	// Links point to the node's client-facing endpoints when it has any
+	endpoints, err := node.GetEndpoints()
+	if err != nil {
+		logger.Warningf("Invalid endpoints of node %s: %v", node.Name, err)
+	}
+	target.endpoints = endpoints
 
 	// Generate links for each client
+	matched := 0
 	for _, clientData := range clients {
 		clientMap, ok := clientData.(map[string]interface{})
 		if !ok {
@@ -308,6 +604,9 @@ func (s *SubService) getSubsFromRemoteInbound(inbound *model.Inbound, node *mode
 		if !enable {
 			continue
 		}
+		if clientSubId, _ := clientMap["subId"].(string); clientSubId != subId {
+			continue
+		}
 
 		email, _ := clientMap["email"].(string)
 		if email == "" {
@@ -331,10 +630,24 @@ func (s *SubService) getSubsFromRemoteInbound(inbound *model.Inbound, node *mode
 			client.Flow = flow
 		}
 
-		link := s.getLink(inbound, client.Email)
+		link := s.getLink(inbound, client.Email, target)
 		if link != "" {
 			result = append(result, link)
 		}
+
+		// The node returns the statistics of the clients it matched
+		ct := s.getClientTraffics(inbound.ClientStats, client.Email)
+		if matched == 0 || (traffic.Total != 0 && ct.Total != 0) {
+			traffic.Total += ct.Total
+		} else {
+			traffic.Total = 0
+		}
+		matched++
+		traffic.Up += ct.Up
+		traffic.Down += ct.Down
+		if ct.LastOnline > lastOnline {
+			lastOnline = ct.LastOnline
+		}
 	}
 
 	return result, lastOnline, traffic, nil
@@ -389,27 +702,27 @@ func (s *SubService) getFallbackMaster(dest string, streamSettings string) (stri
 	return inbound.Listen, inbound.Port, string(modifiedStream), nil
 }
 
-func (s *SubService) getLink(inbound *model.Inbound, email string) string {
+func (s *SubService) getLink(inbound *model.Inbound, email string, target linkTarget) string {
 	switch inbound.Protocol {
 	case "vmess":
-		return s.genVmessLink(inbound, email)
+		return s.genVmessLink(inbound, email, target)
 	case "vless":
-		return s.genVlessLink(inbound, email)
+		return s.genVlessLink(inbound, email, target)
 	case "trojan":
-		return s.genTrojanLink(inbound, email)
+		return s.genTrojanLink(inbound, email, target)
 	case "shadowsocks":
-		return s.genShadowsocksLink(inbound, email)
+		return s.genShadowsocksLink(inbound, email, target)
 	}
 	return ""
 }
 
-func (s *SubService) genVmessLink(inbound *model.Inbound, email string) string {
+func (s *SubService) genVmessLink(inbound *model.Inbound, email string, target linkTarget) string {
 	if inbound.Protocol != model.VMESS {
 		return ""
 	}
 	obj := map[string]any{
 		"v":    "2",
-		"add":  s.address,
+		"add":  target.address,
 		"port": inbound.Port,
 		"type": "none",
 	}
@@ -509,6 +822,25 @@ func (s *SubService) genVmessLink(inbound *model.Inbound, email string) string {
 	obj["id"] = clients[clientIndex].ID
 	obj["scy"] = clients[clientIndex].Security
 
+	if len(target.endpoints) > 0 {
+		links := make([]string, 0, len(target.endpoints))
+		for _, ep := range target.endpoints {
+			newObj := maps.Clone(obj)
+			newObj["add"] = cmp.Or(ep.Address, target.address)
+			newObj["port"] = cmp.Or(ep.Port, inbound.Port)
+			if ep.Sni != "" && security == "tls" {
+				newObj["sni"] = ep.Sni
+			}
+			if _, ok := newObj["host"]; ok && ep.Host != "" {
+				newObj["host"] = ep.Host
+			}
+			newObj["ps"] = s.genRemark(inbound, email, ep.Remark)
+			jsonStr, _ := json.MarshalIndent(newObj, "", "  ")
+			links = append(links, "vmess://"+base64.StdEncoding.EncodeToString(jsonStr))
+		}
+		return strings.Join(links, "\n")
+	}
+
 	externalProxies, _ := stream["externalProxy"].([]any)
 
 	if len(externalProxies) > 0 {
@@ -544,8 +876,8 @@ func (s *SubService) genVmessLink(inbound *model.Inbound, email string) string {
 	return "vmess://" + base64.StdEncoding.EncodeToString(jsonStr)
 }
 
-func (s *SubService) genVlessLink(inbound *model.Inbound, email string) string {
-	address := s.address
+func (s *SubService) genVlessLink(inbound *model.Inbound, email string, target linkTarget) string {
+	address := target.address
 	if inbound.Protocol != model.VLESS {
 		return ""
 	}
@@ -697,6 +1029,10 @@ func (s *SubService) genVlessLink(inbound *model.Inbound, email string) string {
 		params["security"] = "none"
 	}
 
+	if len(target.endpoints) > 0 {
+		return s.genEndpointLinks("vless://"+uuid, inbound, email, port, params, target)
+	}
+
 	externalProxies, _ := stream["externalProxy"].([]any)
 
 	if len(externalProxies) > 0 {
@@ -750,8 +1086,8 @@ func (s *SubService) genVlessLink(inbound *model.Inbound, email string) string {
 	return url.String()
 }
 
-func (s *SubService) genTrojanLink(inbound *model.Inbound, email string) string {
-	address := s.address
+func (s *SubService) genTrojanLink(inbound *model.Inbound, email string, target linkTarget) string {
+	address := target.address
 	if inbound.Protocol != model.Trojan {
 		return ""
 	}
@@ -892,6 +1228,10 @@ func (s *SubService) genTrojanLink(inbound *model.Inbound, email string) string
 		params["security"] = "none"
 	}
 
+	if len(target.endpoints) > 0 {
+		return s.genEndpointLinks("trojan://"+password, inbound, email, port, params, target)
+	}
+
 	externalProxies, _ := stream["externalProxy"].([]any)
 
 	if len(externalProxies) > 0 {
@@ -946,8 +1286,8 @@ func (s *SubService) genTrojanLink(inbound *model.Inbound, email string) string
 	return url.String()
 }
 
-func (s *SubService) genShadowsocksLink(inbound *model.Inbound, email string) string {
-	address := s.address
+func (s *SubService) genShadowsocksLink(inbound *model.Inbound, email string, target linkTarget) string {
+	address := target.address
 	if inbound.Protocol != model.Shadowsocks {
 		return ""
 	}
@@ -1059,6 +1399,10 @@ func (s *SubService) genShadowsocksLink(inbound *model.Inbound, email string) st
 		encPart = fmt.Sprintf("%s:%s:%s", method, inboundPassword, clients[clientIndex].Password)
 	}
 
+	if len(target.endpoints) > 0 {
+		return s.genEndpointLinks("ss://"+base64.StdEncoding.EncodeToString([]byte(encPart)), inbound, email, inbound.Port, params, target)
+	}
+
 	externalProxies, _ := stream["externalProxy"].([]any)
 
 	if len(externalProxies) > 0 {
@@ -1112,6 +1456,32 @@ func (s *SubService) genShadowsocksLink(inbound *model.Inbound, email string) st
 	return url.String()
 }
 
+// genEndpointLinks builds one URL style link per client-facing endpoint of the node being
+// linked. prefix holds the scheme and credentials, the part before '@'.
+func (s *SubService) genEndpointLinks(prefix string, inbound *model.Inbound, email string, port int, params map[string]string, target linkTarget) string {
+	links := make([]string, 0, len(target.endpoints))
+	for _, ep := range target.endpoints {
+		epParams := maps.Clone(params)
+		if ep.Sni != "" && params["security"] == "tls" {
+			epParams["sni"] = ep.Sni
+		}
+		if _, ok := epParams["host"]; ok && ep.Host != "" {
+			epParams["host"] = ep.Host
+		}
+
+		link := fmt.Sprintf("%s@%s:%d", prefix, cmp.Or(ep.Address, target.address), cmp.Or(ep.Port, port))
+		url, _ := url.Parse(link)
+		q := url.Query()
+		for k, v := range epParams {
+			q.Add(k, v)
+		}
+		url.RawQuery = q.Encode()
+		url.Fragment = s.genRemark(inbound, email, ep.Remark)
+		links = append(links, url.String())
+	}
+	return strings.Join(links, "\n")
+}
+
 func (s *SubService) genRemark(inbound *model.Inbound, email string, extra string) string {
 	separationChar := string(s.remarkModel[0])
 	orderChars := s.remarkModel[1:]
@@ -1242,23 +1612,26 @@ func searchHost(headers any) string {
 // PageData is a view model for subpage.html
 // PageData contains data for rendering the subscription information page.
 type PageData struct {
-	Host         string
-	BasePath     string
-	SId          string
-	Download     string
-	Upload       string
-	Total        string
-	Used         string
-	Remained     string
-	Expire       int64
-	LastOnline   int64
-	Datepicker   string
-	DownloadByte int64
-	UploadByte   int64
-	TotalByte    int64
-	SubUrl       string
-	SubJsonUrl   string
-	Result       []string
+	Host          string
+	BasePath      string
+	SId           string
+	Download      string
+	Upload        string
+	Total         string
+	Used          string
+	Remained      string
+	Expire        int64
+	LastOnline    int64
+	Datepicker    string
+	DownloadByte  int64
+	UploadByte    int64
+	TotalByte     int64
+	SubUrl        string
+	SubJsonUrl    string
+	SubClashUrl   string
+	SubSingboxUrl string
+	Result        []string
+	Usage         string // JSON array of daily usage points over the last pageUsageDays days
 }
 
 // ResolveRequest extracts scheme and host info from request/headers consistently.
@@ -1307,76 +1680,43 @@ func (s *SubService) ResolveRequest(c *gin.Context) (scheme string, host string,
 
 // BuildURLs constructs absolute subscription and JSON subscription URLs for a given subscription ID.
 // It prioritizes configured URIs, then individual settings, and finally falls back to request-derived components.
-func (s *SubService) BuildURLs(scheme, hostWithPort, subPath, subJsonPath, subId string) (subURL, subJsonURL string) {
-	// Input validation
-	if subId == "" {
-		return "", ""
-	}
-
-	// Get configured URIs first (highest priority)
+// A positive expiresAt signs both URLs until then.
+func (s *SubService) BuildURLs(scheme, hostWithPort, subPath, subJsonPath, subId string, expiresAt int64) (subURL, subJsonURL string) {
 	configuredSubURI, _ := s.settingService.GetSubURI()
 	configuredSubJsonURI, _ := s.settingService.GetSubJsonURI()
-
-	// Determine base scheme and host (cached to avoid duplicate calls)
-	var baseScheme, baseHostWithPort string
-	if configuredSubURI == "" || configuredSubJsonURI == "" {
-		baseScheme, baseHostWithPort = s.getBaseSchemeAndHost(scheme, hostWithPort)
-	}
-
-	// Build subscription URL
-	subURL = s.buildSingleURL(configuredSubURI, baseScheme, baseHostWithPort, subPath, subId)
-
-	// Build JSON subscription URL
-	subJsonURL = s.buildSingleURL(configuredSubJsonURI, baseScheme, baseHostWithPort, subJsonPath, subId)
-
-	return subURL, subJsonURL
+	subURL = s.buildFormatURL(configuredSubURI, scheme, hostWithPort, subPath, subId, expiresAt)
+	subJsonURL = s.buildFormatURL(configuredSubJsonURI, scheme, hostWithPort, subJsonPath, subId, expiresAt)
+	return
 }
 
-// getBaseSchemeAndHost determines the base scheme and host from settings or falls back to request values
-func (s *SubService) getBaseSchemeAndHost(requestScheme, requestHostWithPort string) (string, string) {
-	subDomain, err := s.settingService.GetSubDomain()
-	if err != nil || subDomain == "" {
-		return requestScheme, requestHostWithPort
-	}
-
-	// Get port and TLS settings
-	subPort, _ := s.settingService.GetSubPort()
-	subKeyFile, _ := s.settingService.GetSubKeyFile()
-	subCertFile, _ := s.settingService.GetSubCertFile()
-
-	// Determine scheme from TLS configuration
-	scheme := "http"
-	if subKeyFile != "" && subCertFile != "" {
-		scheme = "https"
-	}
-
-	// Build host:port, always include port for clarity
-	hostWithPort := fmt.Sprintf("%s:%d", subDomain, subPort)
-
-	return scheme, hostWithPort
+// BuildClashURL constructs the absolute Clash subscription URL for a given subscription ID.
+// A positive expiresAt signs the URL until then.
+func (s *SubService) BuildClashURL(scheme, hostWithPort, subClashPath, subId string, expiresAt int64) string {
+	configuredSubClashURI, _ := s.settingService.GetSubClashURI()
+	return s.buildFormatURL(configuredSubClashURI, scheme, hostWithPort, subClashPath, subId, expiresAt)
 }
 
-// buildSingleURL constructs a single URL using configured URI or base components
-func (s *SubService) buildSingleURL(configuredURI, baseScheme, baseHostWithPort, basePath, subId string) string {
-	if configuredURI != "" {
-		return s.joinPathWithID(configuredURI, subId)
-	}
-
-	baseURL := fmt.Sprintf("%s://%s", baseScheme, baseHostWithPort)
-	return s.joinPathWithID(baseURL+basePath, subId)
+// BuildSingboxURL constructs the absolute sing-box subscription URL for a given subscription ID.
+// A positive expiresAt signs the URL until then.
+func (s *SubService) BuildSingboxURL(scheme, hostWithPort, subSingboxPath, subId string, expiresAt int64) string {
+	configuredSubSingboxURI, _ := s.settingService.GetSubSingboxURI()
+	return s.buildFormatURL(configuredSubSingboxURI, scheme, hostWithPort, subSingboxPath, subId, expiresAt)
 }
 
-// joinPathWithID safely joins a base path with a subscription ID
-func (s *SubService) joinPathWithID(basePath, subId string) string {
-	if strings.HasSuffix(basePath, "/") {
-		return basePath + subId
+// buildFormatURL constructs the URL of a subscription format with the builder the panel uses for
+// the links it hands out, so both point to the same place.
+func (s *SubService) buildFormatURL(configuredURI, scheme, hostWithPort, path, subId string, expiresAt int64) string {
+	subURL, err := s.signService.BuildURL(configuredURI, scheme, hostWithPort, path, subId, expiresAt)
+	if err != nil {
+		logger.Warning("sub: failed to sign subscription URL:", err)
 	}
-	return basePath + "/" + subId
+	return subURL
 }
 
 // BuildPageData parses header and prepares the template view model.
 // BuildPageData constructs page data for rendering the subscription information page.
-func (s *SubService) BuildPageData(subId string, hostHeader string, traffic xray.ClientTraffic, lastOnline int64, subs []string, subURL, subJsonURL string, basePath string) PageData {
+// The page shows urlId, the identifier the subscription was requested with, and charts the daily usage of subId.
+func (s *SubService) BuildPageData(subId string, urlId string, hostHeader string, traffic xray.ClientTraffic, lastOnline int64, subs []string, subURL, subJsonURL, subClashURL, subSingboxURL string, basePath string) PageData {
 	download := common.FormatTraffic(traffic.Down)
 	upload := common.FormatTraffic(traffic.Up)
 	total := "∞"
@@ -1393,24 +1733,42 @@ func (s *SubService) BuildPageData(subId string, hostHeader string, traffic xray
 		datepicker = "gregorian"
 	}
 
+	usage := "[]"
+	loc, err := s.settingService.GetTimeLocation()
+	if err != nil {
+		loc = time.Local
+	}
+	now := time.Now().In(loc)
+	to := now.Unix()
+	from := time.Date(now.Year(), now.Month(), now.Day()+1-pageUsageDays, 0, 0, 0, 0, loc).Unix()
+	history, err := s.trafficHistoryService.GetSubTrafficHistory(subId, from, to, service.TrafficResolutionDay)
+	if err != nil {
+		logger.Warning("SubService - BuildPageData: Unable to get usage history:", err)
+	} else if data, err := json.Marshal(history.Points); err == nil {
+		usage = string(data)
+	}
+
 	return PageData{
-		Host:         hostHeader,
-		BasePath:     basePath,
-		SId:          subId,
-		Download:     download,
-		Upload:       upload,
-		Total:        total,
-		Used:         used,
-		Remained:     remained,
-		Expire:       traffic.ExpiryTime / 1000,
-		LastOnline:   lastOnline,
-		Datepicker:   datepicker,
-		DownloadByte: traffic.Down,
-		UploadByte:   traffic.Up,
-		TotalByte:    traffic.Total,
-		SubUrl:       subURL,
-		SubJsonUrl:   subJsonURL,
-		Result:       subs,
+		Host:          hostHeader,
+		BasePath:      basePath,
+		SId:           urlId,
+		Download:      download,
+		Upload:        upload,
+		Total:         total,
+		Used:          used,
+		Remained:      remained,
+		Expire:        traffic.ExpiryTime / 1000,
+		LastOnline:    lastOnline,
+		Datepicker:    datepicker,
+		DownloadByte:  traffic.Down,
+		UploadByte:    traffic.Up,
+		TotalByte:     traffic.Total,
+		SubUrl:        subURL,
+		SubJsonUrl:    subJsonURL,
+		SubClashUrl:   subClashURL,
+		SubSingboxUrl: subSingboxURL,
+		Result:        subs,
+		Usage:         usage,
 	}
 }
 
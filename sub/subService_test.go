@@ -0,0 +1,133 @@
+package sub
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+)
+
+func TestRemoteConfigInbound(t *testing.T) {
+	const (
+		tlsStream     = `{"network":"ws","security":"tls","tlsSettings":{"serverName":"node.example.com"},"wsSettings":{"path":"/ws","host":"node.example.com"}}`
+		realityStream = `{"network":"tcp","security":"reality","realitySettings":{"serverNames":["www.example.com"]},"tcpSettings":{"header":{"type":"none"}}}`
+		httpStream    = `{"network":"tcp","security":"none","tcpSettings":{"header":{"type":"http","request":{"path":["/"]}}}}`
+	)
+	tests := []struct {
+		name       string
+		stream     string
+		stale      bool
+		ep         *model.NodeEndpoint
+		wantRemark string
+		wantDest   string  // externalProxy destination, empty without an endpoint
+		wantPort   float64 // externalProxy port
+		check      func(t *testing.T, stream map[string]any)
+	}{
+		{
+			name:       "no endpoint keeps the stream",
+			stream:     tlsStream,
+			wantRemark: "in",
+		},
+		{
+			name:       "stale node is marked",
+			stream:     tlsStream,
+			stale:      true,
+			wantRemark: "in" + staleRemarkSuffix,
+		},
+		{
+			name:       "endpoint overrides address, port, sni and host",
+			stream:     tlsStream,
+			ep:         &model.NodeEndpoint{Address: "cdn.example.com", Port: 8443, Remark: "CDN", Sni: "cdn.example.com", Host: "cdn.example.com"},
+			wantRemark: "in",
+			wantDest:   "cdn.example.com",
+			wantPort:   8443,
+			check: func(t *testing.T, stream map[string]any) {
+				if got := stream["tlsSettings"].(map[string]any)["serverName"]; got != "cdn.example.com" {
+					t.Errorf("expected the endpoint SNI, got %v", got)
+				}
+				if got := stream["wsSettings"].(map[string]any)["host"]; got != "cdn.example.com" {
+					t.Errorf("expected the endpoint Host, got %v", got)
+				}
+			},
+		},
+		{
+			name:       "endpoint without address and port uses the node",
+			stream:     tlsStream,
+			ep:         &model.NodeEndpoint{Remark: "direct"},
+			wantRemark: "in",
+			wantDest:   "node.example.com",
+			wantPort:   443,
+			check: func(t *testing.T, stream map[string]any) {
+				if got := stream["tlsSettings"].(map[string]any)["serverName"]; got != "node.example.com" {
+					t.Errorf("expected the inbound SNI to be kept, got %v", got)
+				}
+			},
+		},
+		{
+			name:       "reality keeps its server names",
+			stream:     realityStream,
+			ep:         &model.NodeEndpoint{Address: "1.2.3.4", Sni: "cdn.example.com"},
+			wantRemark: "in",
+			wantDest:   "1.2.3.4",
+			wantPort:   443,
+			check: func(t *testing.T, stream map[string]any) {
+				names := stream["realitySettings"].(map[string]any)["serverNames"].([]any)
+				if len(names) != 1 || names[0] != "www.example.com" {
+					t.Errorf("expected reality server names to be kept, got %v", names)
+				}
+			},
+		},
+		{
+			name:       "tcp http header gets the endpoint host",
+			stream:     httpStream,
+			ep:         &model.NodeEndpoint{Host: "cdn.example.com"},
+			wantRemark: "in",
+			wantDest:   "node.example.com",
+			wantPort:   443,
+			check: func(t *testing.T, stream map[string]any) {
+				request := stream["tcpSettings"].(map[string]any)["header"].(map[string]any)["request"].(map[string]any)
+				host := request["headers"].(map[string]any)["Host"].([]any)
+				if len(host) != 1 || host[0] != "cdn.example.com" {
+					t.Errorf("expected the endpoint Host header, got %v", host)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inbound := &model.Inbound{Remark: "in", Port: 443, StreamSettings: tt.stream}
+			got := remoteConfigInbound(inbound, tt.stale, tt.ep, "node.example.com")
+			if got == inbound {
+				t.Fatalf("expected a copy of the inbound")
+			}
+			if inbound.Remark != "in" || inbound.StreamSettings != tt.stream {
+				t.Fatalf("expected the node inbound to stay unchanged, got %+v", inbound)
+			}
+			if got.Remark != tt.wantRemark {
+				t.Errorf("expected remark %q, got %q", tt.wantRemark, got.Remark)
+			}
+
+			var stream map[string]any
+			if err := json.Unmarshal([]byte(got.StreamSettings), &stream); err != nil {
+				t.Fatalf("invalid stream settings: %v", err)
+			}
+			proxies, _ := stream["externalProxy"].([]any)
+			if tt.wantDest == "" {
+				if len(proxies) != 0 {
+					t.Fatalf("expected no external proxy, got %v", proxies)
+				}
+				return
+			}
+			if len(proxies) != 1 {
+				t.Fatalf("expected one external proxy, got %v", proxies)
+			}
+			proxy := proxies[0].(map[string]any)
+			if proxy["dest"] != tt.wantDest || proxy["port"] != tt.wantPort || proxy["forceTls"] != "same" {
+				t.Errorf("expected external proxy %s:%v, got %v", tt.wantDest, tt.wantPort, proxy)
+			}
+			if tt.check != nil {
+				tt.check(t, stream)
+			}
+		})
+	}
+}
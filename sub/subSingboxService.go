@@ -0,0 +1,289 @@
+package sub
+
+import (
+	"cmp"
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+)
+
+const (
+	singboxSelectTag = "proxy"
+	singboxAutoTag   = "auto"
+	singboxDirectTag = "direct"
+)
+
+// SubSingboxService generates sing-box client configurations for subscriptions.
+type SubSingboxService struct {
+	rules []map[string]any
+
+	SubService *SubService
+}
+
+// NewSubSingboxService creates a sing-box subscription service. rules are the xray routing rules
+// of the JSON subscription, translated to sing-box route rules.
+func NewSubSingboxService(rules string, subService *SubService) *SubSingboxService {
+	return &SubSingboxService{
+		rules:      singboxRules(rules),
+		SubService: subService,
+	}
+}
+
+// GetSingbox generates the sing-box configuration of the given subscription ID and host, along
+// with the subscription user info header. A multi-subscription also includes the clients on its nodes.
+func (s *SubSingboxService) GetSingbox(subId string, host string) (string, string, error) {
+	subClients, traffic, err := s.SubService.getSubClients(subId, host)
+	if err != nil {
+		return "", "", err
+	}
+
+	var proxies []any
+	var tags []string
+	for _, proxy := range s.SubService.getUniqueSubProxies(subClients) {
+		if outbound := genSingboxOutbound(proxy); outbound != nil {
+			proxies = append(proxies, outbound)
+			tags = append(tags, proxy.Name)
+		}
+	}
+	if len(proxies) == 0 {
+		return "", "", nil
+	}
+
+	outbounds := []any{
+		map[string]any{
+			"type":      "selector",
+			"tag":       singboxSelectTag,
+			"outbounds": append([]string{singboxAutoTag}, tags...),
+			"default":   singboxAutoTag,
+		},
+		map[string]any{
+			"type":      "urltest",
+			"tag":       singboxAutoTag,
+			"outbounds": tags,
+			"url":       clashTestURL,
+			"interval":  "5m",
+		},
+	}
+	outbounds = append(outbounds, proxies...)
+	outbounds = append(outbounds, map[string]any{"type": "direct", "tag": singboxDirectTag})
+
+	rules := []any{
+		map[string]any{"action": "sniff"},
+		map[string]any{"protocol": "dns", "action": "hijack-dns"},
+	}
+	for _, rule := range s.rules {
+		rules = append(rules, rule)
+	}
+
+	config := map[string]any{
+		"log": map[string]any{"level": "warn"},
+		"dns": map[string]any{
+			"servers": []any{
+				map[string]any{"type": "tls", "tag": "remote", "server": "8.8.8.8", "detour": singboxSelectTag},
+				map[string]any{"type": "local", "tag": "local"},
+			},
+			"final": "remote",
+		},
+		"inbounds": []any{
+			map[string]any{
+				"type":         "tun",
+				"tag":          "tun-in",
+				"address":      []string{"172.19.0.1/30", "fdfe:dcba:9876::1/126"},
+				"auto_route":   true,
+				"strict_route": true,
+			},
+			map[string]any{
+				"type":        "mixed",
+				"tag":         "mixed-in",
+				"listen":      "127.0.0.1",
+				"listen_port": 2080,
+			},
+		},
+		"outbounds": outbounds,
+		"route": map[string]any{
+			"rules":                   rules,
+			"final":                   singboxSelectTag,
+			"auto_detect_interface":   true,
+			"default_domain_resolver": "local",
+		},
+	}
+	result, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return "", "", err
+	}
+	return string(result), subUserInfo(traffic), nil
+}
+
+// genSingboxOutbound renders a proxy as a sing-box outbound. It returns nil for proxies sing-box
+// cannot express.
+func genSingboxOutbound(proxy subProxy) map[string]any {
+	outbound := map[string]any{
+		"tag":         proxy.Name,
+		"server":      proxy.Server,
+		"server_port": proxy.Port,
+	}
+
+	switch proxy.Protocol {
+	case model.VMESS:
+		outbound["type"] = "vmess"
+		outbound["uuid"] = proxy.UUID
+		outbound["security"] = cmp.Or(proxy.Cipher, "auto")
+		outbound["alter_id"] = 0
+	case model.VLESS:
+		// sing-box has no VLESS encryption
+		if proxy.Encryption != "" && proxy.Encryption != "none" {
+			return nil
+		}
+		outbound["type"] = "vless"
+		outbound["uuid"] = proxy.UUID
+		outbound["packet_encoding"] = "xudp"
+		if proxy.Flow != "" {
+			outbound["flow"] = proxy.Flow
+		}
+	case model.Trojan:
+		outbound["type"] = "trojan"
+		outbound["password"] = proxy.Password
+	case model.Shadowsocks:
+		outbound["type"] = "shadowsocks"
+		outbound["method"] = proxy.Cipher
+		outbound["password"] = proxy.Password
+		return outbound
+	default:
+		return nil
+	}
+
+	if proxy.Security != "none" {
+		tls := map[string]any{"enabled": true}
+		if proxy.SNI != "" {
+			tls["server_name"] = proxy.SNI
+		}
+		if proxy.Insecure {
+			tls["insecure"] = true
+		}
+		if len(proxy.ALPN) > 0 {
+			tls["alpn"] = proxy.ALPN
+		}
+		// Reality requires uTLS
+		if proxy.Fingerprint != "" || proxy.Security == "reality" {
+			tls["utls"] = map[string]any{
+				"enabled":     true,
+				"fingerprint": cmp.Or(proxy.Fingerprint, "chrome"),
+			}
+		}
+		if proxy.Security == "reality" {
+			tls["reality"] = map[string]any{
+				"enabled":    true,
+				"public_key": proxy.PublicKey,
+				"short_id":   proxy.ShortId,
+			}
+		}
+		outbound["tls"] = tls
+	}
+
+	switch proxy.Network {
+	case "tcp":
+	case "http":
+		transport := map[string]any{
+			"type":   "http",
+			"path":   cmp.Or(proxy.Path, "/"),
+			"method": "GET",
+		}
+		if proxy.Host != "" {
+			transport["host"] = []string{proxy.Host}
+		}
+		outbound["transport"] = transport
+	case "ws":
+		transport := map[string]any{
+			"type": "ws",
+			"path": cmp.Or(proxy.Path, "/"),
+		}
+		if proxy.Host != "" {
+			transport["headers"] = map[string]any{"Host": proxy.Host}
+		}
+		outbound["transport"] = transport
+	case "httpupgrade":
+		transport := map[string]any{
+			"type": "httpupgrade",
+			"path": cmp.Or(proxy.Path, "/"),
+		}
+		if proxy.Host != "" {
+			transport["host"] = proxy.Host
+		}
+		outbound["transport"] = transport
+	case "grpc":
+		outbound["transport"] = map[string]any{
+			"type":         "grpc",
+			"service_name": proxy.ServiceName,
+		}
+	default:
+		// sing-box has no xhttp transport
+		return nil
+	}
+	return outbound
+}
+
+// singboxRules translates the JSON subscription rules to sing-box route rules. sing-box only
+// matches geosite and geoip through rule sets, so those conditions are dropped, except for
+// private addresses.
+func singboxRules(rules string) []map[string]any {
+	var result []map[string]any
+	for _, rule := range parseSubRules(rules) {
+		r := map[string]any{}
+		for _, domain := range rule.Domain {
+			kind, value, found := strings.Cut(domain, ":")
+			if !found {
+				kind, value = "keyword", domain
+			}
+			switch kind {
+			case "domain":
+				r["domain_suffix"] = append(stringList(r["domain_suffix"]), value)
+			case "full":
+				r["domain"] = append(stringList(r["domain"]), value)
+			case "keyword":
+				r["domain_keyword"] = append(stringList(r["domain_keyword"]), value)
+			case "regexp":
+				r["domain_regex"] = append(stringList(r["domain_regex"]), value)
+			}
+		}
+		for _, ip := range rule.IP {
+			if ip == "geoip:private" {
+				r["ip_is_private"] = true
+			} else if cidr, ok := normalizeCIDR(ip); ok {
+				r["ip_cidr"] = append(stringList(r["ip_cidr"]), cidr)
+			}
+		}
+		for _, port := range rule.Ports {
+			if strings.Contains(port, "-") {
+				r["port_range"] = append(stringList(r["port_range"]), strings.Replace(port, "-", ":", 1))
+			} else if n, err := strconv.Atoi(port); err == nil {
+				r["port"] = append(intList(r["port"]), n)
+			}
+		}
+		if len(r) == 0 {
+			continue
+		}
+
+		switch rule.OutboundTag {
+		case "direct":
+			r["outbound"] = singboxDirectTag
+		case "block":
+			r["action"] = "reject"
+		default:
+			r["outbound"] = singboxSelectTag
+		}
+		result = append(result, r)
+	}
+	return result
+}
+
+func stringList(v any) []string {
+	list, _ := v.([]string)
+	return list
+}
+
+func intList(v any) []int {
+	list, _ := v.([]int)
+	return list
+}
@@ -0,0 +1,105 @@
+package sub
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+)
+
+func TestGenSingboxOutbound(t *testing.T) {
+	tests := []struct {
+		name  string
+		proxy subProxy
+		want  string // JSON of the outbound with sorted keys, empty when sing-box cannot express it
+	}{
+		{
+			name: "vless reality",
+			proxy: subProxy{Name: "reality", Protocol: model.VLESS, Server: "a.example.com", Port: 443, UUID: "u", Flow: "xtls-rprx-vision",
+				Encryption: "none", Network: "tcp", Security: "reality", SNI: "www.example.com", PublicKey: "pk", ShortId: "ab"},
+			want: `{"flow":"xtls-rprx-vision","packet_encoding":"xudp","server":"a.example.com","server_port":443,"tag":"reality",` +
+				`"tls":{"enabled":true,"reality":{"enabled":true,"public_key":"pk","short_id":"ab"},"server_name":"www.example.com",` +
+				`"utls":{"enabled":true,"fingerprint":"chrome"}},"type":"vless","uuid":"u"}`,
+		},
+		{
+			name: "vmess ws over tls",
+			proxy: subProxy{Name: "ws", Protocol: model.VMESS, Server: "a.example.com", Port: 443, UUID: "u", Cipher: "aes-128-gcm", Network: "ws", Path: "/ws",
+				Host: "h.example.com", Security: "tls", SNI: "h.example.com", ALPN: []string{"h2", "http/1.1"}, Fingerprint: "firefox", Insecure: true},
+			want: `{"alter_id":0,"security":"aes-128-gcm","server":"a.example.com","server_port":443,"tag":"ws",` +
+				`"tls":{"alpn":["h2","http/1.1"],"enabled":true,"insecure":true,"server_name":"h.example.com","utls":{"enabled":true,"fingerprint":"firefox"}},` +
+				`"transport":{"headers":{"Host":"h.example.com"},"path":"/ws","type":"ws"},"type":"vmess","uuid":"u"}`,
+		},
+		{
+			name:  "trojan grpc",
+			proxy: subProxy{Name: "grpc", Protocol: model.Trojan, Server: "a.example.com", Port: 443, Password: "pw", Network: "grpc", ServiceName: "svc", Security: "tls"},
+			want: `{"password":"pw","server":"a.example.com","server_port":443,"tag":"grpc","tls":{"enabled":true},` +
+				`"transport":{"service_name":"svc","type":"grpc"},"type":"trojan"}`,
+		},
+		{
+			name:  "vless httpupgrade without tls",
+			proxy: subProxy{Name: "upgrade", Protocol: model.VLESS, Server: "a.example.com", Port: 80, UUID: "u", Network: "httpupgrade", Host: "h.example.com", Security: "none"},
+			want: `{"packet_encoding":"xudp","server":"a.example.com","server_port":80,"tag":"upgrade",` +
+				`"transport":{"host":"h.example.com","path":"/","type":"httpupgrade"},"type":"vless","uuid":"u"}`,
+		},
+		{
+			name:  "vmess tcp with http header",
+			proxy: subProxy{Name: "http", Protocol: model.VMESS, Server: "a.example.com", Port: 80, UUID: "u", Network: "http", Path: "/p", Host: "h.example.com", Security: "none"},
+			want: `{"alter_id":0,"security":"auto","server":"a.example.com","server_port":80,"tag":"http",` +
+				`"transport":{"host":["h.example.com"],"method":"GET","path":"/p","type":"http"},"type":"vmess","uuid":"u"}`,
+		},
+		{
+			name:  "shadowsocks",
+			proxy: subProxy{Name: "ss", Protocol: model.Shadowsocks, Server: "a.example.com", Port: 8388, Cipher: "2022-blake3-aes-128-gcm", Password: "s:c", Network: "tcp", Security: "none"},
+			want:  `{"method":"2022-blake3-aes-128-gcm","password":"s:c","server":"a.example.com","server_port":8388,"tag":"ss","type":"shadowsocks"}`,
+		},
+		{
+			name:  "vless encryption is not expressible",
+			proxy: subProxy{Name: "enc", Protocol: model.VLESS, Server: "a.example.com", Port: 443, UUID: "u", Encryption: "mlkem768x25519plus", Network: "tcp", Security: "none"},
+		},
+		{
+			name:  "xhttp is not expressible",
+			proxy: subProxy{Name: "xhttp", Protocol: model.VLESS, Server: "a.example.com", Port: 443, UUID: "u", Network: "xhttp", Security: "tls"},
+		},
+		{
+			name:  "unknown protocol",
+			proxy: subProxy{Name: "wg", Protocol: model.WireGuard, Server: "a.example.com", Port: 51820},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := genSingboxOutbound(tt.proxy)
+			if tt.want == "" {
+				if got != nil {
+					t.Fatalf("expected no outbound, got %v", got)
+				}
+				return
+			}
+			out, err := json.Marshal(got)
+			if err != nil {
+				t.Fatalf("Marshal failed: %v", err)
+			}
+			if string(out) != tt.want {
+				t.Fatalf("unexpected outbound:\n%s\nwant:\n%s", out, tt.want)
+			}
+		})
+	}
+}
+
+func TestSingboxRules(t *testing.T) {
+	rules := `[
+		{"outboundTag":"direct","domain":["geosite:private","domain:example.com","full:www.example.org","keyword:ads","regexp:^x","plain"]},
+		{"outboundTag":"block","ip":["geoip:private","1.1.1.1","geoip:cn"]},
+		{"outboundTag":"proxy","port":"443,1000-2000"},
+		{"outboundTag":"direct","domain":["geosite:cn"]}
+	]`
+	want := `[{"domain":["www.example.org"],"domain_keyword":["ads","plain"],"domain_regex":["^x"],"domain_suffix":["example.com"],"outbound":"direct"},` +
+		`{"action":"reject","ip_cidr":["1.1.1.1/32"],"ip_is_private":true},` +
+		`{"outbound":"proxy","port":[443],"port_range":["1000:2000"]}]`
+	out, err := json.Marshal(singboxRules(rules))
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	if string(out) != want {
+		t.Fatalf("unexpected rules:\n%s\nwant:\n%s", out, want)
+	}
+}
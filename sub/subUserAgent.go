@@ -0,0 +1,93 @@
+package sub
+
+import (
+	"cmp"
+	"net/http"
+	"regexp"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+	"github.com/mhsanaei/3x-ui/v2/logger"
+	"github.com/mhsanaei/3x-ui/v2/web/entity"
+	"github.com/mhsanaei/3x-ui/v2/web/middleware"
+)
+
+// Header sets a User-Agent rule can ask for.
+const (
+	subHeadersStandard = "standard"
+	subHeadersUserinfo = "userinfo"
+	subHeadersNone     = "none"
+)
+
+// subClientKey is the request context key the matched User-Agent rule is kept under.
+const subClientKey = "subClient"
+
+// subClientRule is a subscription User-Agent rule with its compiled pattern.
+type subClientRule struct {
+	entity.SubUserAgentRule
+	pattern *regexp.Regexp
+}
+
+// compileSubClientRules compiles the User-Agent rule table. Invalid tables are rejected when
+// the settings are saved, so an error here only drops the rules.
+func compileSubClientRules(rules string) []subClientRule {
+	parsed, err := entity.ParseSubUserAgentRules(rules)
+	if err != nil {
+		logger.Warning("sub: invalid User-Agent rules:", err)
+		return nil
+	}
+	compiled := make([]subClientRule, 0, len(parsed))
+	for _, rule := range parsed {
+		compiled = append(compiled, subClientRule{
+			SubUserAgentRule: rule,
+			pattern:          regexp.MustCompile("(?i)" + rule.Pattern),
+		})
+	}
+	return compiled
+}
+
+// subClient returns the first User-Agent rule matching the request, or nil for unknown clients.
+// The result is kept on the request, as a request to the links path is handed to the handler
+// of the format it asks for.
+func (a *SUBController) subClient(c *gin.Context) *subClientRule {
+	if v, ok := c.Get(subClientKey); ok {
+		rule, _ := v.(*subClientRule)
+		return rule
+	}
+	var match *subClientRule
+	userAgent := c.GetHeader("User-Agent")
+	for i := range a.clientRules {
+		if a.clientRules[i].pattern.MatchString(userAgent) {
+			match = &a.clientRules[i]
+			break
+		}
+	}
+	c.Set(subClientKey, match)
+	return match
+}
+
+// recordFetch logs which client family fetched a subscription in which format and stores the
+// fetch in the subscription access log. Failed fetches of subscriptions the panel does not know
+// are left out, so requests for made-up identifiers cannot fill the log.
+func (a *SUBController) recordFetch(c *gin.Context, subId string, format string, status int) {
+	if status != http.StatusOK && !a.subService.KnownSub(subId) {
+		return
+	}
+	family := ""
+	if rule := a.subClient(c); rule != nil {
+		family = rule.Family
+	}
+	userAgent := c.GetHeader("User-Agent")
+	if status == http.StatusOK {
+		logger.Infof("sub: subscription %s fetched as %s by %s client (%s)", subId, format, cmp.Or(family, "unknown"), userAgent)
+	}
+	a.accessService.Record(&model.SubscriptionAccess{
+		SubId:     subId,
+		IP:        middleware.ClientIP(c.Request, a.trustedProxies),
+		UserAgent: userAgent,
+		Family:    family,
+		Format:    format,
+		Status:    status,
+	})
+}
@@ -0,0 +1,166 @@
+package sub
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/mhsanaei/3x-ui/v2/logger"
+
+	"github.com/op/go-logging"
+)
+
+const testUserAgentRules = `[
+	{"family":"Clash Meta","pattern":"clash[.-]?meta|mihomo","format":"clash","headers":"userinfo"},
+	{"family":"Clash","pattern":"clash","format":"clash"},
+	{"family":"sing-box","pattern":"^sing-box","format":"singbox","headers":"none"},
+	{"family":"v2rayN","pattern":"v2rayn","format":"links","encoding":"plain"},
+	{"family":"Xray","pattern":"xray","format":"json"}
+]`
+
+func newTestUserAgentContext(userAgent, query string) *gin.Context {
+	gin.SetMode(gin.TestMode)
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodGet, "/sub/abc"+query, nil)
+	if userAgent != "" {
+		c.Request.Header.Set("User-Agent", userAgent)
+	}
+	return c
+}
+
+func TestCompileSubClientRules(t *testing.T) {
+	t.Setenv("XUI_LOG_FOLDER", t.TempDir())
+	logger.InitLogger(logging.ERROR)
+
+	if rules := compileSubClientRules(""); len(rules) != 0 {
+		t.Fatalf("expected no rules for an empty table, got %d", len(rules))
+	}
+	for _, invalid := range []string{
+		`{"family":`,
+		`[{"family":"a","pattern":"(","format":"links"}]`,
+		`[{"family":"a","pattern":"a","format":"yaml"}]`,
+	} {
+		if rules := compileSubClientRules(invalid); rules != nil {
+			t.Errorf("expected invalid table %s to be dropped, got %d rules", invalid, len(rules))
+		}
+	}
+
+	rules := compileSubClientRules(testUserAgentRules)
+	if len(rules) != 5 {
+		t.Fatalf("expected 5 rules, got %d", len(rules))
+	}
+	for i, family := range []string{"Clash Meta", "Clash", "sing-box", "v2rayN", "Xray"} {
+		if rules[i].Family != family {
+			t.Errorf("rule %d: expected family %q, got %q", i, family, rules[i].Family)
+		}
+	}
+	if !rules[3].pattern.MatchString("V2RAYN/6.42") {
+		t.Errorf("expected patterns to match case-insensitively")
+	}
+}
+
+func TestSubClient(t *testing.T) {
+	a := &SUBController{clientRules: compileSubClientRules(testUserAgentRules)}
+	tests := []struct {
+		userAgent string
+		want      string // matched family, empty for unknown clients
+	}{
+		{"ClashMeta/1.18.0", "Clash Meta"},
+		{"clash.meta", "Clash Meta"},
+		{"mihomo/1.19.1", "Clash Meta"},
+		{"ClashForAndroid/2.5.12", "Clash"},
+		{"clash-verge/v1.3.8 mihomo", "Clash Meta"},
+		{"SFA/1.10.0 (sing-box 1.10.0)", ""},
+		{"sing-box 1.10.0", "sing-box"},
+		{"v2rayN/6.42", "v2rayN"},
+		{"v2rayNG/1.8.5 Xray", "v2rayN"},
+		{"Xray-core", "Xray"},
+		{"Mozilla/5.0", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.userAgent, func(t *testing.T) {
+			rule := a.subClient(newTestUserAgentContext(tt.userAgent, ""))
+			got := ""
+			if rule != nil {
+				got = rule.Family
+			}
+			if got != tt.want {
+				t.Fatalf("subClient(%q) = %q, want %q", tt.userAgent, got, tt.want)
+			}
+		})
+	}
+
+	// The rule matched first is kept for the rest of the request
+	c := newTestUserAgentContext("mihomo", "")
+	first := a.subClient(c)
+	c.Request.Header.Set("User-Agent", "Xray-core")
+	if again := a.subClient(c); again != first {
+		t.Fatalf("expected the matched rule to be kept on the request, got %+v", again)
+	}
+	c = newTestUserAgentContext("Mozilla/5.0", "")
+	a.subClient(c)
+	c.Request.Header.Set("User-Agent", "Xray-core")
+	if again := a.subClient(c); again != nil {
+		t.Fatalf("expected an unknown client to stay unknown, got %+v", again)
+	}
+}
+
+func TestSubFormat(t *testing.T) {
+	a := &SUBController{
+		clientRules:  compileSubClientRules(testUserAgentRules),
+		jsonEnabled:  true,
+		clashEnabled: true,
+	}
+	tests := []struct {
+		name      string
+		userAgent string
+		query     string
+		want      string
+	}{
+		{"unknown client gets links", "Mozilla/5.0", "", subFormatLinks},
+		{"rule format", "mihomo", "", subFormatClash},
+		{"query overrides the rule", "mihomo", "?format=JSON", subFormatJson},
+		{"query for an unknown client", "", "?format=clash", subFormatClash},
+		{"disabled rule format falls back to links", "sing-box 1.10.0", "", subFormatLinks},
+		{"disabled query format falls back to links", "mihomo", "?format=singbox", subFormatLinks},
+		{"unknown query format falls back to links", "Xray-core", "?format=yaml", subFormatLinks},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := a.subFormat(newTestUserAgentContext(tt.userAgent, tt.query)); got != tt.want {
+				t.Fatalf("subFormat() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyCommonHeaders(t *testing.T) {
+	a := &SUBController{clientRules: compileSubClientRules(testUserAgentRules)}
+	tests := []struct {
+		userAgent string
+		want      []string // headers set on the response
+	}{
+		{"Mozilla/5.0", []string{"Subscription-Userinfo", "Profile-Update-Interval", "Profile-Title"}},
+		{"ClashForAndroid/2.5.12", []string{"Subscription-Userinfo", "Profile-Update-Interval", "Profile-Title"}},
+		{"mihomo", []string{"Subscription-Userinfo"}},
+		{"sing-box 1.10.0", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.userAgent, func(t *testing.T) {
+			c := newTestUserAgentContext(tt.userAgent, "")
+			a.ApplyCommonHeaders(c, "upload=0; download=0", "12", "title")
+			header := c.Writer.Header()
+			if len(header) != len(tt.want) {
+				t.Fatalf("expected headers %v, got %v", tt.want, header)
+			}
+			for _, name := range tt.want {
+				if header.Get(name) == "" {
+					t.Errorf("expected header %s, got %v", name, header)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,52 @@
+package common
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ParseCIDRList parses a comma-separated list of CIDRs. Plain addresses are treated as
+// single-host networks.
+func ParseCIDRList(value string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", entry)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q", entry)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// IPInNets reports whether ip belongs to any of the networks.
+func IPInNets(ip string, nets []*net.IPNet) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, ipNet := range nets {
+		if ipNet.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,59 @@
+package crypto
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"strconv"
+	"strings"
+)
+
+// Headers carrying a signed node-to-node request.
+const (
+	HeaderTimestamp = "X-Node-Timestamp"
+	HeaderNonce     = "X-Node-Nonce"
+	HeaderSignature = "X-Node-Signature"
+)
+
+// SignRequest computes the HMAC-SHA256 signature of a request. The signed payload binds the
+// method, the request URI, the Unix timestamp, the nonce and a SHA-256 hash of the body.
+func SignRequest(secret, method, requestURI string, timestamp int64, nonce string, body []byte) string {
+	bodyHash := sha256.Sum256(body)
+	payload := strings.Join([]string{
+		strings.ToUpper(method),
+		requestURI,
+		strconv.FormatInt(timestamp, 10),
+		nonce,
+		hex.EncodeToString(bodyHash[:]),
+	}, "\n")
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyRequestSignature reports whether signature matches the request, comparing in constant time.
+func VerifyRequestSignature(secret, method, requestURI string, timestamp int64, nonce string, body []byte, signature string) bool {
+	expected := SignRequest(secret, method, requestURI, timestamp, nonce, body)
+	return hmac.Equal([]byte(expected), []byte(strings.ToLower(signature)))
+}
+
+// ConstantTimeEqual compares two secrets without leaking where they differ.
+func ConstantTimeEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// SignSubscription computes the HMAC-SHA256 signature of a subscription URL. The signed payload
+// binds the subscription identifier of the URL and the Unix expiry, so one signature is valid
+// for every format of the subscription.
+func SignSubscription(secret []byte, id string, expiresAt int64) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("sub\n" + id + "\n" + strconv.FormatInt(expiresAt, 10)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifySubscriptionSignature reports whether signature matches the subscription URL, comparing in constant time.
+func VerifySubscriptionSignature(secret []byte, id string, expiresAt int64, signature string) bool {
+	expected := SignSubscription(secret, id, expiresAt)
+	return hmac.Equal([]byte(expected), []byte(strings.ToLower(signature)))
+}
@@ -1799,6 +1799,11 @@ Inbound.VmessSettings.VMESS = class extends XrayCommonClass {
         subId = RandomUtil.randomLowerAndNum(16),
         comment = '',
         reset = 0,
+        resetSchedule = '',
+        resetDay = 0,
+        resetCron = '',
+        planId = 0,
+        group = '',
         created_at = undefined,
         updated_at = undefined
     ) {
@@ -1814,6 +1819,11 @@ Inbound.VmessSettings.VMESS = class extends XrayCommonClass {
         this.subId = subId;
         this.comment = comment;
         this.reset = reset;
+        this.resetSchedule = resetSchedule;
+        this.resetDay = resetDay;
+        this.resetCron = resetCron;
+        this.planId = planId;
+        this.group = group;
         this.created_at = created_at;
         this.updated_at = updated_at;
     }
@@ -1831,6 +1841,11 @@ Inbound.VmessSettings.VMESS = class extends XrayCommonClass {
             json.subId,
             json.comment,
             json.reset,
+            json.resetSchedule,
+            json.resetDay,
+            json.resetCron,
+            json.planId,
+            json.group,
             json.created_at,
             json.updated_at,
         );
@@ -1939,6 +1954,11 @@ Inbound.VLESSSettings.VLESS = class extends XrayCommonClass {
         subId = RandomUtil.randomLowerAndNum(16),
         comment = '',
         reset = 0,
+        resetSchedule = '',
+        resetDay = 0,
+        resetCron = '',
+        planId = 0,
+        group = '',
         created_at = undefined,
         updated_at = undefined
     ) {
@@ -1954,6 +1974,11 @@ Inbound.VLESSSettings.VLESS = class extends XrayCommonClass {
         this.subId = subId;
         this.comment = comment;
         this.reset = reset;
+        this.resetSchedule = resetSchedule;
+        this.resetDay = resetDay;
+        this.resetCron = resetCron;
+        this.planId = planId;
+        this.group = group;
         this.created_at = created_at;
         this.updated_at = updated_at;
     }
@@ -1971,6 +1996,11 @@ Inbound.VLESSSettings.VLESS = class extends XrayCommonClass {
             json.subId,
             json.comment,
             json.reset,
+            json.resetSchedule,
+            json.resetDay,
+            json.resetCron,
+            json.planId,
+            json.group,
             json.created_at,
             json.updated_at,
         );
@@ -2084,6 +2114,11 @@ Inbound.TrojanSettings.Trojan = class extends XrayCommonClass {
         subId = RandomUtil.randomLowerAndNum(16),
         comment = '',
         reset = 0,
+        resetSchedule = '',
+        resetDay = 0,
+        resetCron = '',
+        planId = 0,
+        group = '',
         created_at = undefined,
         updated_at = undefined
     ) {
@@ -2098,6 +2133,11 @@ Inbound.TrojanSettings.Trojan = class extends XrayCommonClass {
         this.subId = subId;
         this.comment = comment;
         this.reset = reset;
+        this.resetSchedule = resetSchedule;
+        this.resetDay = resetDay;
+        this.resetCron = resetCron;
+        this.planId = planId;
+        this.group = group;
         this.created_at = created_at;
         this.updated_at = updated_at;
     }
@@ -2114,6 +2154,11 @@ Inbound.TrojanSettings.Trojan = class extends XrayCommonClass {
             subId: this.subId,
             comment: this.comment,
             reset: this.reset,
+            resetSchedule: this.resetSchedule,
+            resetDay: this.resetDay,
+            resetCron: this.resetCron,
+            planId: this.planId,
+            group: this.group,
             created_at: this.created_at,
             updated_at: this.updated_at,
         };
@@ -2131,6 +2176,11 @@ Inbound.TrojanSettings.Trojan = class extends XrayCommonClass {
             json.subId,
             json.comment,
             json.reset,
+            json.resetSchedule,
+            json.resetDay,
+            json.resetCron,
+            json.planId,
+            json.group,
             json.created_at,
             json.updated_at,
         );
@@ -2253,6 +2303,11 @@ Inbound.ShadowsocksSettings.Shadowsocks = class extends XrayCommonClass {
         subId = RandomUtil.randomLowerAndNum(16),
         comment = '',
         reset = 0,
+        resetSchedule = '',
+        resetDay = 0,
+        resetCron = '',
+        planId = 0,
+        group = '',
         created_at = undefined,
         updated_at = undefined
     ) {
@@ -2268,6 +2323,11 @@ Inbound.ShadowsocksSettings.Shadowsocks = class extends XrayCommonClass {
         this.subId = subId;
         this.comment = comment;
         this.reset = reset;
+        this.resetSchedule = resetSchedule;
+        this.resetDay = resetDay;
+        this.resetCron = resetCron;
+        this.planId = planId;
+        this.group = group;
         this.created_at = created_at;
         this.updated_at = updated_at;
     }
@@ -2285,6 +2345,11 @@ Inbound.ShadowsocksSettings.Shadowsocks = class extends XrayCommonClass {
             subId: this.subId,
             comment: this.comment,
             reset: this.reset,
+            resetSchedule: this.resetSchedule,
+            resetDay: this.resetDay,
+            resetCron: this.resetCron,
+            planId: this.planId,
+            group: this.group,
             created_at: this.created_at,
             updated_at: this.updated_at,
         };
@@ -2303,6 +2368,11 @@ Inbound.ShadowsocksSettings.Shadowsocks = class extends XrayCommonClass {
             json.subId,
             json.comment,
             json.reset,
+            json.resetSchedule,
+            json.resetDay,
+            json.resetCron,
+            json.planId,
+            json.group,
             json.created_at,
             json.updated_at,
         );
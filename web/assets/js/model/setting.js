@@ -22,9 +22,19 @@ class AllSetting {
         this.tgBotBackup = false;
         this.tgBotLoginNotify = true;
         this.tgCpu = 80;
+        this.tgTopTalkers = 0;
         this.tgLang = "en-US";
         this.twoFactorEnable = false;
         this.twoFactorToken = "";
+        this.externalApiKey = "";
+        this.externalApiAuthMode = "key";
+        this.externalApiClientCA = "";
+        this.externalApiRateLimit = 60;
+        this.externalApiIPRateLimit = 120;
+        this.externalApiRestartLimit = 6;
+        this.externalApiRotateLimit = 3;
+        this.trustedProxies = "";
+        this.loginRateLimit = 10;
         this.xrayTemplateConfig = "";
         this.subEnable = true;
         this.subJsonEnable = false;
@@ -39,6 +49,17 @@ class AllSetting {
         this.subCertFile = "";
         this.subKeyFile = "";
         this.subUpdates = 12;
+        this.subRateLimit = 0;
+        this.subNodeTimeout = 5;
+        this.subNodeCacheTTL = 60;
+        this.subClashEnable = false;
+        this.subClashPath = "/clash/";
+        this.subClashURI = "";
+        this.subSingboxEnable = false;
+        this.subSingboxPath = "/singbox/";
+        this.subSingboxURI = "";
+        this.subUserAgentRules = "";
+        this.subTokenRequired = false;
         this.subEncrypt = true;
         this.subShowInfo = true;
         this.subURI = "";
@@ -50,6 +71,15 @@ class AllSetting {
 
         this.timeLocation = "Local";
 
+        // Node monitoring settings
+        this.nodeStatsRetention = 48;
+        this.nodeStatsHourlyRetention = 90;
+        this.nodePollWorkers = 8;
+
+        // Client traffic history settings
+        this.trafficHourlyRetention = 7;
+        this.trafficDailyRetention = 180;
+
         // LDAP settings
         this.ldapEnable = false;
         this.ldapHost = "";
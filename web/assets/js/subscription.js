@@ -9,6 +9,8 @@
     sId: el.getAttribute('data-sid') || '',
     subUrl: el.getAttribute('data-sub-url') || '',
     subJsonUrl: el.getAttribute('data-subjson-url') || '',
+    subClashUrl: el.getAttribute('data-subclash-url') || '',
+    subSingboxUrl: el.getAttribute('data-subsingbox-url') || '',
     download: el.getAttribute('data-download') || '',
     upload: el.getAttribute('data-upload') || '',
     used: el.getAttribute('data-used') || '',
@@ -20,8 +22,21 @@
     uploadByte: parseInt(el.getAttribute('data-uploadbyte') || '0', 10) || 0,
     totalByte: parseInt(el.getAttribute('data-totalbyte') || '0', 10) || 0,
     datepicker: el.getAttribute('data-datepicker') || 'gregorian',
+    usage: parseUsage(el.getAttribute('data-usage')),
   };
 
+  // Days of daily usage charted, matching the range sent by the server
+  const USAGE_DAYS = 30;
+
+  function parseUsage(raw) {
+    try {
+      const points = JSON.parse(raw || '[]');
+      return Array.isArray(points) ? points : [];
+    } catch (e) {
+      return [];
+    }
+  }
+
   // Normalize lastOnline to milliseconds if it looks like seconds
   if (data.lastOnlineMs && data.lastOnlineMs < 10_000_000_000) {
     data.lastOnlineMs *= 1000;
@@ -134,6 +149,9 @@
       v2boxUrl() {
         return `v2box://install-sub?url=${encodeURIComponent(this.app.subUrl)}&name=${encodeURIComponent(this.app.sId)}`;
       },
+      singboxUrl() {
+        return `sing-box://import-remote-profile?url=${encodeURIComponent(this.app.subSingboxUrl)}#${encodeURIComponent(this.app.sId)}`;
+      },
       streisandUrl() {
         return `streisand://import/${encodeURIComponent(this.app.subUrl)}`;
       },
@@ -145,7 +163,28 @@
       },
 	  happUrl() {
 		return `happ://add/${encodeURIComponent(this.app.subUrl)}`;
-	  }
+	  },
+      usageBars() {
+        if (this.app.usage.length === 0) return [];
+        const byDay = new Map(this.app.usage.map(p => [p.time, p]));
+        const today = Math.floor(Date.now() / 86400000) * 86400;
+        const days = [];
+        for (let i = USAGE_DAYS - 1; i >= 0; i--) {
+          const time = today - i * 86400;
+          const point = byDay.get(time) || { up: 0, down: 0 };
+          days.push({ time, up: point.up, down: point.down });
+        }
+        const max = Math.max(1, ...days.map(d => d.up + d.down));
+        const slot = 100 / days.length;
+        const format = this.app.datepicker === 'gregorian' ? 'YYYY-MM-DD' : 'jYYYY/jMM/jDD';
+        return days.map((d, i) => ({
+          time: d.time,
+          x: i * slot + slot * 0.1,
+          width: slot * 0.8,
+          height: (d.up + d.down) / max * 80,
+          title: `${moment.utc(d.time * 1000).format(format)}: ↓ ${SizeFormatter.sizeFormat(d.down)} ↑ ${SizeFormatter.sizeFormat(d.up)}`,
+        }));
+      }
     },
     methods: {
       renderLink,
@@ -57,6 +57,18 @@ func (a *APIController) initRouter(g *gin.RouterGroup) {
 	multiSubscriptions := api.Group("/multi-subscriptions")
 	NewMultiSubscriptionController(multiSubscriptions)
 
+	// Named external API keys
+	apiKeys := api.Group("/api-keys")
+	NewApiKeyController(apiKeys)
+
+	// Subscription tokens
+	subTokens := api.Group("/sub-tokens")
+	NewSubscriptionTokenController(subTokens)
+
+	// Billing plans
+	plans := api.Group("/plans")
+	NewPlanController(plans)
+
 	// Dashboard API
 	dashboard := api.Group("/dashboard")
 	NewDashboardController(dashboard)
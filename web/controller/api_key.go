@@ -0,0 +1,121 @@
+// Package controller provides HTTP request handlers for external API key management.
+package controller
+
+import (
+	"strconv"
+
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+	"github.com/mhsanaei/3x-ui/v2/web/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ApiKeyController handles HTTP requests related to named external API keys.
+type ApiKeyController struct {
+	BaseController
+	apiKeyService service.ApiKeyService
+}
+
+// NewApiKeyController creates a new ApiKeyController and sets up its routes.
+func NewApiKeyController(g *gin.RouterGroup) *ApiKeyController {
+	a := &ApiKeyController{}
+	a.initRouter(g)
+	return a
+}
+
+// initRouter initializes the routes for API key operations.
+func (a *ApiKeyController) initRouter(g *gin.RouterGroup) {
+	g.GET("/", a.getApiKeys)
+	g.GET("/scopes", a.getScopes)
+	g.GET("/audit", a.getAudit)
+	g.GET("/:id/audit", a.getAudit)
+
+	g.POST("/", a.addApiKey)
+	g.POST("/:id", a.updateApiKey)
+	g.POST("/:id/delete", a.deleteApiKey)
+}
+
+// getApiKeys retrieves all named API keys without their secrets.
+func (a *ApiKeyController) getApiKeys(c *gin.Context) {
+	keys, err := a.apiKeyService.GetApiKeys()
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.apiKeys.toasts.getApiKeys"), err)
+		return
+	}
+	jsonObj(c, keys, nil)
+}
+
+// getScopes lists the scopes a key can be granted.
+func (a *ApiKeyController) getScopes(c *gin.Context) {
+	jsonObj(c, model.ApiScopes, nil)
+}
+
+// addApiKey creates a named API key. The secret is only returned in this response.
+func (a *ApiKeyController) addApiKey(c *gin.Context) {
+	// New keys are enabled unless the request says otherwise
+	key := model.ApiKey{Enable: true}
+	if err := c.ShouldBindJSON(&key); err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.apiKeys.toasts.addApiKey"), err)
+		return
+	}
+	secret, err := a.apiKeyService.AddApiKey(&key)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.apiKeys.toasts.addApiKey"), err)
+		return
+	}
+	jsonMsgObj(c, I18nWeb(c, "pages.apiKeys.toasts.addApiKeySuccess"), gin.H{"apiKey": key, "key": secret}, nil)
+}
+
+// updateApiKey updates the name, scopes, restrictions and state of a key.
+func (a *ApiKeyController) updateApiKey(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "get"), err)
+		return
+	}
+	var key model.ApiKey
+	if err := c.ShouldBindJSON(&key); err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.apiKeys.toasts.updateApiKey"), err)
+		return
+	}
+	key.Id = id
+	if err := a.apiKeyService.UpdateApiKey(&key); err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.apiKeys.toasts.updateApiKey"), err)
+		return
+	}
+	jsonMsg(c, I18nWeb(c, "pages.apiKeys.toasts.updateApiKeySuccess"), nil)
+}
+
+// deleteApiKey deletes a named API key.
+func (a *ApiKeyController) deleteApiKey(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "get"), err)
+		return
+	}
+	if err := a.apiKeyService.DeleteApiKey(id); err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.apiKeys.toasts.deleteApiKey"), err)
+		return
+	}
+	jsonMsg(c, I18nWeb(c, "pages.apiKeys.toasts.deleteApiKeySuccess"), nil)
+}
+
+// getAudit returns the latest uses of one key, or of every key when no ID is given.
+func (a *ApiKeyController) getAudit(c *gin.Context) {
+	keyId := 0
+	if c.Param("id") != "" {
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			jsonMsg(c, I18nWeb(c, "get"), err)
+			return
+		}
+		keyId = id
+	}
+	limit, _ := strconv.Atoi(c.Query("limit"))
+	records, err := a.apiKeyService.GetAudit(keyId, limit)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.apiKeys.toasts.getAudit"), err)
+		return
+	}
+	jsonObj(c, records, nil)
+}
@@ -63,7 +63,7 @@ func (a *DashboardController) getNodesForMap(c *gin.Context) {
 
 // syncAllNodesStats synchronizes statistics from all enabled nodes.
 func (a *DashboardController) syncAllNodesStats(c *gin.Context) {
-	err := a.dashboardService.SyncAllNodesStats()
+	err := a.dashboardService.SyncAllNodesStats(c.Request.Context(), true)
 	if err != nil {
 		jsonMsg(c, I18nWeb(c, "pages.dashboard.toasts.syncStats"), err)
 		return
@@ -73,7 +73,7 @@ func (a *DashboardController) syncAllNodesStats(c *gin.Context) {
 
 // checkAllNodesStatus checks the status of all enabled nodes.
 func (a *DashboardController) checkAllNodesStatus(c *gin.Context) {
-	err := a.dashboardService.CheckAllNodesStatus()
+	err := a.dashboardService.CheckAllNodesStatus(c.Request.Context(), true)
 	if err != nil {
 		jsonMsg(c, I18nWeb(c, "pages.dashboard.toasts.checkStatus"), err)
 		return
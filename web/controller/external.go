@@ -1,19 +1,27 @@
 package controller
 
 import (
+	"fmt"
 	"net/http"
+	"strconv"
 	"time"
 
+	"github.com/mhsanaei/3x-ui/v2/database/model"
 	"github.com/mhsanaei/3x-ui/v2/web/middleware"
 	"github.com/mhsanaei/3x-ui/v2/web/service"
 
 	"github.com/gin-gonic/gin"
 )
 
-// ExternalController exposes minimal read-only APIs for node-to-node communication secured by X-API-Key.
+// ExternalController exposes APIs for node-to-node communication secured by X-API-Key.
+// The master panel uses them to read status and to manage inbounds and clients on a node.
+// Named API keys only reach the routes their scopes allow.
 type ExternalController struct {
 	serverService  service.ServerService
 	inboundService service.InboundService
+	xrayService    service.XrayService
+	userService    service.UserService
+	settingService service.SettingService
 }
 
 func NewExternalController(g *gin.RouterGroup) *ExternalController {
@@ -26,9 +34,27 @@ func (a *ExternalController) initRouter(g *gin.RouterGroup) {
 	api := g.Group("/api/external")
 	api.Use(middleware.ExternalAPIKeyMiddleware())
 
-	api.GET("/server/status", a.getStatus)
-	api.GET("/inbounds/list", a.listInbounds)
-	api.GET("/health", a.healthcheck)
+	readStatus := middleware.RequireAPIScope(model.ApiScopeReadStatus)
+	readInbounds := middleware.RequireAPIScope(model.ApiScopeReadInbounds)
+	writeClients := middleware.RequireAPIScope(model.ApiScopeWriteClients)
+	admin := middleware.RequireAPIScope(model.ApiScopeAdmin)
+
+	api.GET("/server/status", readStatus, a.getStatus)
+	api.GET("/inbounds/list", readInbounds, a.listInbounds)
+	api.GET("/inbounds/get/:id", readInbounds, a.getInbound)
+	api.GET("/inbounds/clients", readInbounds, a.getInboundsByClient)
+	api.GET("/health", readStatus, a.healthcheck)
+
+	api.POST("/inbounds/add", admin, a.addInbound)
+	api.POST("/inbounds/update/:id", admin, a.updateInbound)
+	api.POST("/inbounds/del/:id", admin, a.delInbound)
+	api.POST("/inbounds/addClient", writeClients, a.addInboundClient)
+	api.POST("/inbounds/updateClient/:clientId", writeClients, a.updateInboundClient)
+	api.POST("/inbounds/:id/delClient/:clientId", writeClients, a.delInboundClient)
+	api.POST("/inbounds/:id/resetClientTraffic/:email", writeClients, a.resetClientTraffic)
+	api.POST("/inbounds/resetAllClientTraffics/:id", writeClients, a.resetAllClientTraffics)
+	api.POST("/xray/restart", admin, middleware.RouteRateLimit(a.settingService.GetExternalAPIRestartLimit), a.restartXray)
+	api.POST("/auth/rotate", admin, middleware.RouteRateLimit(a.settingService.GetExternalAPIRotateLimit), a.rotateKey)
 }
 
 func (a *ExternalController) getStatus(c *gin.Context) {
@@ -41,6 +67,215 @@ func (a *ExternalController) listInbounds(c *gin.Context) {
 	jsonObj(c, inbounds, err)
 }
 
+func (a *ExternalController) getInbound(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, "invalid inbound id", err)
+		return
+	}
+	inbound, err := a.inboundService.GetInbound(id)
+	jsonObj(c, inbound, err)
+}
+
+// getInboundsByClient returns the inbounds with a client matching the subId and/or email
+// query parameters, stripped down to the matching clients.
+func (a *ExternalController) getInboundsByClient(c *gin.Context) {
+	inbounds, err := a.inboundService.GetInboundsByClient(c.Query("subId"), c.Query("email"))
+	if err != nil {
+		jsonMsg(c, "failed to find client", err)
+		return
+	}
+	jsonObj(c, inbounds, nil)
+}
+
+// addInbound creates an inbound on this node. It is owned by the first panel user
+// so that it shows up in the node's own panel like a locally created inbound.
+func (a *ExternalController) addInbound(c *gin.Context) {
+	inbound := &model.Inbound{}
+	if err := c.ShouldBindJSON(inbound); err != nil {
+		jsonMsg(c, "invalid inbound", err)
+		return
+	}
+	user, err := a.userService.GetFirstUser()
+	if err != nil {
+		jsonMsg(c, "failed to resolve inbound owner", err)
+		return
+	}
+	inbound.Id = 0
+	inbound.UserId = user.Id
+	// Traffic counters belong to the node, start them fresh
+	inbound.ClientStats = nil
+	if inbound.Tag == "" {
+		if inbound.Listen == "" || inbound.Listen == "0.0.0.0" || inbound.Listen == "::" || inbound.Listen == "::0" {
+			inbound.Tag = fmt.Sprintf("inbound-%v", inbound.Port)
+		} else {
+			inbound.Tag = fmt.Sprintf("inbound-%v:%v", inbound.Listen, inbound.Port)
+		}
+	}
+
+	inbound, needRestart, err := a.inboundService.AddInbound(inbound)
+	if err != nil {
+		jsonMsg(c, "failed to add inbound", err)
+		return
+	}
+	jsonObj(c, inbound, nil)
+	if needRestart {
+		a.xrayService.SetToNeedRestart()
+	}
+}
+
+func (a *ExternalController) updateInbound(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, "invalid inbound id", err)
+		return
+	}
+	inbound := &model.Inbound{}
+	if err := c.ShouldBindJSON(inbound); err != nil {
+		jsonMsg(c, "invalid inbound", err)
+		return
+	}
+	inbound.Id = id
+	inbound, needRestart, err := a.inboundService.UpdateInbound(inbound)
+	if err != nil {
+		jsonMsg(c, "failed to update inbound", err)
+		return
+	}
+	jsonObj(c, inbound, nil)
+	if needRestart {
+		a.xrayService.SetToNeedRestart()
+	}
+}
+
+func (a *ExternalController) delInbound(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, "invalid inbound id", err)
+		return
+	}
+	needRestart, err := a.inboundService.DelInbound(id)
+	if err != nil {
+		jsonMsg(c, "failed to delete inbound", err)
+		return
+	}
+	jsonObj(c, id, nil)
+	if needRestart {
+		a.xrayService.SetToNeedRestart()
+	}
+}
+
+// addInboundClient expects an inbound id and settings holding only the new clients.
+func (a *ExternalController) addInboundClient(c *gin.Context) {
+	data := &model.Inbound{}
+	if err := c.ShouldBindJSON(data); err != nil {
+		jsonMsg(c, "invalid client data", err)
+		return
+	}
+	needRestart, err := a.inboundService.AddInboundClient(data)
+	if err != nil {
+		jsonMsg(c, "failed to add client", err)
+		return
+	}
+	jsonMsg(c, "client added", nil)
+	if needRestart {
+		a.xrayService.SetToNeedRestart()
+	}
+}
+
+func (a *ExternalController) updateInboundClient(c *gin.Context) {
+	clientId := c.Param("clientId")
+	data := &model.Inbound{}
+	if err := c.ShouldBindJSON(data); err != nil {
+		jsonMsg(c, "invalid client data", err)
+		return
+	}
+	needRestart, err := a.inboundService.UpdateInboundClient(data, clientId)
+	if err != nil {
+		jsonMsg(c, "failed to update client", err)
+		return
+	}
+	jsonMsg(c, "client updated", nil)
+	if needRestart {
+		a.xrayService.SetToNeedRestart()
+	}
+}
+
+func (a *ExternalController) delInboundClient(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, "invalid inbound id", err)
+		return
+	}
+	needRestart, err := a.inboundService.DelInboundClient(id, c.Param("clientId"))
+	if err != nil {
+		jsonMsg(c, "failed to delete client", err)
+		return
+	}
+	jsonMsg(c, "client deleted", nil)
+	if needRestart {
+		a.xrayService.SetToNeedRestart()
+	}
+}
+
+func (a *ExternalController) resetClientTraffic(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, "invalid inbound id", err)
+		return
+	}
+	needRestart, err := a.inboundService.ResetClientTraffic(id, c.Param("email"))
+	if err != nil {
+		jsonMsg(c, "failed to reset client traffic", err)
+		return
+	}
+	jsonMsg(c, "client traffic reset", nil)
+	if needRestart {
+		a.xrayService.SetToNeedRestart()
+	}
+}
+
+func (a *ExternalController) resetAllClientTraffics(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, "invalid inbound id", err)
+		return
+	}
+	if err := a.inboundService.ResetAllClientTraffics(id); err != nil {
+		jsonMsg(c, "failed to reset client traffics", err)
+		return
+	}
+	a.xrayService.SetToNeedRestart()
+	jsonMsg(c, "client traffics reset", nil)
+}
+
+func (a *ExternalController) restartXray(c *gin.Context) {
+	err := a.xrayService.RestartXray(true)
+	if err != nil {
+		jsonMsg(c, "failed to restart xray", err)
+		return
+	}
+	jsonMsg(c, "xray restarted", nil)
+}
+
+// keyRotationGrace is how long the previous external API key stays valid after a rotation.
+const keyRotationGrace = 10 * time.Minute
+
+// rotateKey replaces the external API key of this node on request of the master panel.
+func (a *ExternalController) rotateKey(c *gin.Context) {
+	var req struct {
+		Key string `json:"key"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		jsonMsg(c, "invalid key", err)
+		return
+	}
+	if err := a.settingService.RotateExternalAPIKey(req.Key, keyRotationGrace); err != nil {
+		jsonMsg(c, "failed to rotate key", err)
+		return
+	}
+	jsonMsg(c, "key rotated", nil)
+}
+
 // healthcheck provides a simple health check endpoint for orchestrators (Kubernetes, Docker, etc.)
 func (a *ExternalController) healthcheck(c *gin.Context) {
 	// Simple health check - just return 200 OK if API key is valid
@@ -1,23 +1,34 @@
 package controller
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/mhsanaei/3x-ui/v2/database"
 	"github.com/mhsanaei/3x-ui/v2/database/model"
-	"github.com/mhsanaei/3x-ui/v2/web/middleware"
+	"github.com/mhsanaei/3x-ui/v2/logger"
 	"github.com/mhsanaei/3x-ui/v2/web/service"
+	"github.com/op/go-logging"
 )
 
 func setupExternalAPITest(t *testing.T) (*gin.Engine, string) {
 	t.Helper()
 	gin.SetMode(gin.TestMode)
 
+	// Service code logs through the global logger, keep its file output inside the test dir
+	t.Setenv("XUI_LOG_FOLDER", t.TempDir())
+	logger.InitLogger(logging.ERROR)
+
 	// Setup test database
 	_ = database.CloseDB()
 	tdb := filepath.Join(t.TempDir(), "external_test.db")
@@ -33,11 +44,9 @@ func setupExternalAPITest(t *testing.T) (*gin.Engine, string) {
 		t.Fatalf("failed to set external api key: %v", err)
 	}
 
-	// Create router with external API
+	// Create router with external API (the controller registers /api/external and its middleware itself)
 	r := gin.New()
-	apiGroup := r.Group("/api/external")
-	apiGroup.Use(middleware.ExternalAPIKeyMiddleware())
-	_ = NewExternalController(apiGroup)
+	_ = NewExternalController(r.Group(""))
 
 	return r, testKey
 }
@@ -117,7 +126,6 @@ func TestExternalAPI_ListInbounds_Success(t *testing.T) {
 		Remark:   "test-inbound",
 		Port:     10000,
 		Protocol: "vmess",
-		Enable:   true,
 		Settings: `{"clients":[]}`,
 	}
 	_, _, err := inboundSvc.AddInbound(testInbound)
@@ -243,3 +251,286 @@ func TestExternalAPI_RateLimit(t *testing.T) {
 		t.Error("expected at least some successful requests")
 	}
 }
+
+func TestExternalAPI_WriteEndpoints_Unauthorized(t *testing.T) {
+	r, _ := setupExternalAPITest(t)
+
+	for _, path := range []string{
+		"/api/external/inbounds/add",
+		"/api/external/inbounds/del/1",
+		"/api/external/inbounds/addClient",
+		"/api/external/xray/restart",
+	} {
+		req := httptest.NewRequest(http.MethodPost, path, nil)
+		req.Header.Set("X-API-Key", "WRONG_KEY")
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusUnauthorized {
+			t.Errorf("%s: expected 401, got %d", path, rec.Code)
+		}
+	}
+}
+
+func TestExternalAPI_AddDeleteInbound(t *testing.T) {
+	r, apiKey := setupExternalAPITest(t)
+
+	send := func(path string, body any) *httptest.ResponseRecorder {
+		t.Helper()
+		payload, _ := json.Marshal(body)
+		req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(payload))
+		// Use a dedicated address so earlier rate limit tests don't affect this one
+		req.RemoteAddr = "192.0.2.10:40000"
+		req.Header.Set("X-API-Key", apiKey)
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d, body: %s", path, rec.Code, rec.Body.String())
+		}
+		return rec
+	}
+
+	rec := send("/api/external/inbounds/add", &model.Inbound{
+		Remark:   "pushed-by-master",
+		Port:     10001,
+		Protocol: model.VLESS,
+		Settings: `{"clients":[{"id":"11111111-1111-1111-1111-111111111111","email":"pushed@node","enable":true}]}`,
+	})
+
+	var created struct {
+		Success bool          `json:"success"`
+		Obj     model.Inbound `json:"obj"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &created); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if !created.Success || created.Obj.Id == 0 {
+		t.Fatalf("expected inbound to be created, got %s", rec.Body.String())
+	}
+	if created.Obj.Tag != "inbound-10001" {
+		t.Errorf("expected generated tag inbound-10001, got %s", created.Obj.Tag)
+	}
+
+	// The inbound must be visible in the node's own panel, i.e. owned by the first user
+	inboundSvc := service.InboundService{}
+	owned, err := inboundSvc.GetInbounds(1)
+	if err != nil {
+		t.Fatalf("GetInbounds failed: %v", err)
+	}
+	if len(owned) != 1 || len(owned[0].ClientStats) != 1 {
+		t.Fatalf("expected inbound with one client stat owned by first user, got %+v", owned)
+	}
+
+	send(fmt.Sprintf("/api/external/inbounds/del/%d", created.Obj.Id), nil)
+	if _, err := inboundSvc.GetInbound(created.Obj.Id); err == nil {
+		t.Fatalf("expected inbound to be deleted")
+	}
+}
+
+func TestExternalAPI_SignedRequestsAndKeyRotation(t *testing.T) {
+	r, apiKey := setupExternalAPITest(t)
+	settingSvc := service.SettingService{}
+	if err := settingSvc.SetExternalAPIAuthMode("hmac"); err != nil {
+		t.Fatalf("failed to set auth mode: %v", err)
+	}
+
+	srv := httptest.NewServer(r)
+	t.Cleanup(srv.Close)
+	u, _ := url.Parse(srv.URL)
+	port, _ := strconv.Atoi(u.Port())
+
+	nodeSvc := service.NodeService{}
+	node := &model.Node{Name: "self", Host: u.Hostname(), Port: port, Protocol: "http", ApiKey: apiKey, AuthMode: "hmac"}
+	if err := nodeSvc.AddNode(node); err != nil {
+		t.Fatalf("failed to add node: %v", err)
+	}
+	if _, err := service.NewNodeClient(node).GetInbounds(); err != nil {
+		t.Fatalf("signed request failed: %v", err)
+	}
+
+	// The plain key is refused once signed requests are required
+	req := httptest.NewRequest(http.MethodGet, "/api/external/inbounds/list", nil)
+	req.Header.Set("X-API-Key", apiKey)
+	req.RemoteAddr = "192.0.2.20:40000"
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for plain key in hmac mode, got %d", rec.Code)
+	}
+
+	if err := nodeSvc.RotateNodeKey(node.Id); err != nil {
+		t.Fatalf("RotateNodeKey failed: %v", err)
+	}
+	rotated, err := nodeSvc.GetNode(node.Id)
+	if err != nil {
+		t.Fatalf("GetNode failed: %v", err)
+	}
+	if rotated.ApiKey == apiKey || len(rotated.ApiKey) < 32 {
+		t.Fatalf("expected a new key to be stored, got %q", rotated.ApiKey)
+	}
+	if _, err := service.NewNodeClient(rotated).GetInbounds(); err != nil {
+		t.Fatalf("request with rotated key failed: %v", err)
+	}
+	// The old key keeps working during the grace period
+	if _, err := service.NewNodeClient(node).GetInbounds(); err != nil {
+		t.Fatalf("request with previous key failed during grace period: %v", err)
+	}
+}
+
+func TestExternalAPI_NamedKeyScopes(t *testing.T) {
+	r, _ := setupExternalAPITest(t)
+	apiKeySvc := service.ApiKeyService{}
+
+	monitoring := &model.ApiKey{Name: "monitoring", Scopes: "read-status,read-inbounds", AllowedCIDRs: "192.0.2.0/24", Enable: true}
+	monitoringKey, err := apiKeySvc.AddApiKey(monitoring)
+	if err != nil {
+		t.Fatalf("AddApiKey failed: %v", err)
+	}
+	expired := &model.ApiKey{Name: "expired", Scopes: "admin", ExpiresAt: time.Now().Add(-time.Hour).Unix(), Enable: true}
+	expiredKey, err := apiKeySvc.AddApiKey(expired)
+	if err != nil {
+		t.Fatalf("AddApiKey failed: %v", err)
+	}
+	if _, err := apiKeySvc.AddApiKey(&model.ApiKey{Name: "bad", Scopes: "everything"}); err == nil {
+		t.Fatalf("expected unknown scope to be rejected")
+	}
+
+	do := func(method, path, key, remote string) int {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("X-API-Key", key)
+		req.RemoteAddr = remote
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := do(http.MethodGet, "/api/external/inbounds/list", monitoringKey, "192.0.2.50:40000"); code != http.StatusOK {
+		t.Fatalf("expected read scope to allow listing inbounds, got %d", code)
+	}
+	if code := do(http.MethodPost, "/api/external/inbounds/addClient", monitoringKey, "192.0.2.50:40000"); code != http.StatusForbidden {
+		t.Fatalf("expected missing write-clients scope to be forbidden, got %d", code)
+	}
+	if code := do(http.MethodPost, "/api/external/xray/restart", monitoringKey, "192.0.2.50:40000"); code != http.StatusForbidden {
+		t.Fatalf("expected missing admin scope to be forbidden, got %d", code)
+	}
+	if code := do(http.MethodGet, "/api/external/inbounds/list", monitoringKey, "198.51.100.7:40000"); code != http.StatusUnauthorized {
+		t.Fatalf("expected address outside the allowed CIDRs to be rejected, got %d", code)
+	}
+	if code := do(http.MethodGet, "/api/external/health", expiredKey, "192.0.2.51:40000"); code != http.StatusUnauthorized {
+		t.Fatalf("expected expired key to be rejected, got %d", code)
+	}
+
+	stored, err := apiKeySvc.GetApiKey(monitoring.Id)
+	if err != nil {
+		t.Fatalf("GetApiKey failed: %v", err)
+	}
+	if stored.LastUsedAt == 0 || stored.LastUsedIP != "198.51.100.7" {
+		t.Fatalf("expected last use to be recorded, got %d %q", stored.LastUsedAt, stored.LastUsedIP)
+	}
+	audit, err := apiKeySvc.GetAudit(monitoring.Id, 0)
+	if err != nil {
+		t.Fatalf("GetAudit failed: %v", err)
+	}
+	if len(audit) != 4 {
+		t.Fatalf("expected 4 audit records for the monitoring key, got %d", len(audit))
+	}
+	if audit[0].Status != http.StatusUnauthorized || audit[1].Status != http.StatusForbidden || audit[3].Status != http.StatusOK {
+		t.Fatalf("unexpected audit statuses: %d %d %d", audit[0].Status, audit[1].Status, audit[3].Status)
+	}
+}
+
+func TestExternalAPI_DisabledNamedKey(t *testing.T) {
+	r, _ := setupExternalAPITest(t)
+	apiKeySvc := service.ApiKeyService{}
+
+	disabled := &model.ApiKey{Name: "disabled", Scopes: "admin", Enable: false}
+	disabledKey, err := apiKeySvc.AddApiKey(disabled)
+	if err != nil {
+		t.Fatalf("AddApiKey failed: %v", err)
+	}
+	stored, err := apiKeySvc.GetApiKey(disabled.Id)
+	if err != nil {
+		t.Fatalf("GetApiKey failed: %v", err)
+	}
+	if stored.Enable {
+		t.Fatalf("expected key created as disabled to be stored disabled")
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/external/health", nil)
+	req.Header.Set("X-API-Key", disabledKey)
+	req.RemoteAddr = "192.0.2.60:40000"
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected disabled key to be rejected, got %d", rec.Code)
+	}
+}
+
+func TestExternalAPI_GetInboundsByClient(t *testing.T) {
+	r, apiKey := setupExternalAPITest(t)
+
+	inboundSvc := service.InboundService{}
+	for i, clients := range []string{
+		`[{"id":"11111111-1111-1111-1111-111111111111","email":"alice","subId":"sub-a","enable":true},
+		  {"id":"22222222-2222-2222-2222-222222222222","email":"bob","subId":"sub-b","enable":true}]`,
+		`[{"id":"33333333-3333-3333-3333-333333333333","email":"bob-2","subId":"sub-b","enable":true}]`,
+	} {
+		inbound := &model.Inbound{
+			Remark:   "inbound-" + strconv.Itoa(i),
+			Tag:      "inbound-" + strconv.Itoa(10100+i),
+			Port:     10100 + i,
+			Protocol: "vless",
+			Settings: `{"clients":` + clients + `,"decryption":"none"}`,
+		}
+		if _, _, err := inboundSvc.AddInbound(inbound); err != nil {
+			t.Fatalf("failed to add test inbound: %v", err)
+		}
+	}
+
+	lookup := func(query string) (bool, []*model.Inbound) {
+		req := httptest.NewRequest(http.MethodGet, "/api/external/inbounds/clients?"+query, nil)
+		req.Header.Set("X-API-Key", apiKey)
+		req.RemoteAddr = "192.0.2.30:40000"
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d, body: %s", rec.Code, rec.Body.String())
+		}
+		var response struct {
+			Success bool             `json:"success"`
+			Obj     []*model.Inbound `json:"obj"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		return response.Success, response.Obj
+	}
+
+	ok, inbounds := lookup("subId=sub-a")
+	if !ok || len(inbounds) != 1 {
+		t.Fatalf("expected one inbound for sub-a, got %d", len(inbounds))
+	}
+	if strings.Contains(inbounds[0].Settings, "bob") || !strings.Contains(inbounds[0].Settings, "alice") {
+		t.Fatalf("expected only the matching client in settings, got %s", inbounds[0].Settings)
+	}
+	if !strings.Contains(inbounds[0].Settings, "decryption") {
+		t.Fatalf("expected other inbound settings to be kept, got %s", inbounds[0].Settings)
+	}
+	if len(inbounds[0].ClientStats) != 1 || inbounds[0].ClientStats[0].Email != "alice" || inbounds[0].ClientStats[0].SubId != "sub-a" {
+		t.Fatalf("expected only the matching client stats, got %+v", inbounds[0].ClientStats)
+	}
+
+	if _, inbounds = lookup("subId=sub-b"); len(inbounds) != 2 {
+		t.Fatalf("expected two inbounds for sub-b, got %d", len(inbounds))
+	}
+	if _, inbounds = lookup("email=BOB"); len(inbounds) != 1 || strings.Contains(inbounds[0].Settings, "alice") {
+		t.Fatalf("expected the inbound of bob only, got %+v", inbounds)
+	}
+	if _, inbounds = lookup("subId=sub-a&email=bob"); len(inbounds) != 0 {
+		t.Fatalf("expected no inbound when the filters do not match the same client, got %d", len(inbounds))
+	}
+	if ok, _ = lookup(""); ok {
+		t.Fatalf("expected a lookup without filters to fail")
+	}
+}
@@ -4,8 +4,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"strconv"
+	"time"
 
 	"github.com/mhsanaei/3x-ui/v2/database/model"
+	"github.com/mhsanaei/3x-ui/v2/logger"
 	"github.com/mhsanaei/3x-ui/v2/web/service"
 	"github.com/mhsanaei/3x-ui/v2/web/session"
 
@@ -14,8 +16,14 @@ import (
 
 // InboundController handles HTTP requests related to Xray inbounds management.
 type InboundController struct {
-	inboundService service.InboundService
-	xrayService    service.XrayService
+	inboundService            service.InboundService
+	xrayService               service.XrayService
+	subscriptionAccessService service.SubscriptionAccessService
+	subscriptionSignService   service.SubscriptionSignService
+
+	clientTrafficHistoryService service.ClientTrafficHistoryService
+	trafficReportService        service.TrafficReportService
+	clientBulkService           service.ClientBulkService
 }
 
 // NewInboundController creates a new InboundController and sets up its routes.
@@ -32,6 +40,13 @@ func (a *InboundController) initRouter(g *gin.RouterGroup) {
 	g.GET("/get/:id", a.getInbound)
 	g.GET("/getClientTraffics/:email", a.getClientTraffics)
 	g.GET("/getClientTrafficsById/:id", a.getClientTrafficsById)
+	g.GET("/trafficHistory/:email", a.getClientTrafficHistory)
+	g.GET("/subTrafficHistory/:subId", a.getSubTrafficHistory)
+	g.GET("/trafficReport", a.getTrafficReport)
+	g.GET("/subStats/:subId", a.getSubStats)
+	g.GET("/subAccessLog/:subId", a.getSubAccessLog)
+	g.GET("/subSignedOnly/:subId", a.getSubSignedOnly)
+	g.GET("/clientGroups", a.getClientGroups)
 
 	g.POST("/add", a.addInbound)
 	g.POST("/del/:id", a.delInbound)
@@ -50,6 +65,9 @@ func (a *InboundController) initRouter(g *gin.RouterGroup) {
 	g.POST("/lastOnline", a.lastOnline)
 	g.POST("/updateClientTraffic/:email", a.updateClientTraffic)
 	g.POST("/:id/delClientByEmail/:email", a.delInboundClientByEmail)
+	g.POST("/subSignedUrl/:subId", a.signSubUrl)
+	g.POST("/subSignedOnly/:subId", a.setSubSignedOnly)
+	g.POST("/bulkClients", a.bulkClients)
 }
 
 // getInbounds retrieves the list of inbounds for the logged-in user.
@@ -100,6 +118,109 @@ func (a *InboundController) getClientTrafficsById(c *gin.Context) {
 	jsonObj(c, clientTraffics, nil)
 }
 
+// getClientTrafficHistory retrieves the usage of a client over a time range.
+func (a *InboundController) getClientTrafficHistory(c *gin.Context) {
+	from, _ := strconv.ParseInt(c.Query("from"), 10, 64)
+	to, _ := strconv.ParseInt(c.Query("to"), 10, 64)
+	history, err := a.clientTrafficHistoryService.GetTrafficHistory(c.Param("email"), from, to, c.Query("resolution"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.trafficGetError"), err)
+		return
+	}
+	jsonObj(c, history, nil)
+}
+
+// getSubTrafficHistory retrieves the combined usage of the clients of a subscription over a time range.
+func (a *InboundController) getSubTrafficHistory(c *gin.Context) {
+	from, _ := strconv.ParseInt(c.Query("from"), 10, 64)
+	to, _ := strconv.ParseInt(c.Query("to"), 10, 64)
+	history, err := a.clientTrafficHistoryService.GetSubTrafficHistory(c.Param("subId"), from, to, c.Query("resolution"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.trafficGetError"), err)
+		return
+	}
+	jsonObj(c, history, nil)
+}
+
+// getTrafficReport retrieves the clients, inbounds and outbounds with the most traffic over a
+// time range, as JSON or, with format=csv, as a CSV download.
+func (a *InboundController) getTrafficReport(c *gin.Context) {
+	from, _ := strconv.ParseInt(c.Query("from"), 10, 64)
+	to, _ := strconv.ParseInt(c.Query("to"), 10, 64)
+	limit, _ := strconv.Atoi(c.Query("limit"))
+	report, err := a.trafficReportService.GetTopTalkers(from, to, limit)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.trafficGetError"), err)
+		return
+	}
+	if c.Query("format") != "csv" {
+		jsonObj(c, report, nil)
+		return
+	}
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Header("Content-Disposition", "attachment; filename=traffic-report.csv")
+	if err := a.trafficReportService.WriteReportCSV(c.Writer, report); err != nil {
+		logger.Warning("Failed to write traffic report:", err)
+	}
+}
+
+// getSubStats retrieves fetch statistics of a subscription from the subscription access log.
+func (a *InboundController) getSubStats(c *gin.Context) {
+	stats, err := a.subscriptionAccessService.GetStats(c.Param("subId"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "get"), err)
+		return
+	}
+	jsonObj(c, stats, nil)
+}
+
+// getSubAccessLog retrieves the latest fetches of a subscription, newest first.
+func (a *InboundController) getSubAccessLog(c *gin.Context) {
+	limit, _ := strconv.Atoi(c.Query("limit"))
+	records, err := a.subscriptionAccessService.GetAccessLog(c.Param("subId"), limit)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "get"), err)
+		return
+	}
+	jsonObj(c, records, nil)
+}
+
+// getSubSignedOnly reports whether a subscription is only served through signed URLs.
+func (a *InboundController) getSubSignedOnly(c *gin.Context) {
+	signedOnly, err := a.subscriptionSignService.IsSignedOnly(c.Param("subId"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "get"), err)
+		return
+	}
+	jsonObj(c, signedOnly, nil)
+}
+
+// signSubUrl builds subscription URLs that stay valid for the given number of hours, 24 by default.
+func (a *InboundController) signSubUrl(c *gin.Context) {
+	hours, _ := strconv.Atoi(c.PostForm("hours"))
+	if hours <= 0 {
+		hours = 24
+	}
+	expiresAt := time.Now().Add(time.Duration(hours) * time.Hour).Unix()
+	subURL, subJsonURL, err := a.subscriptionSignService.BuildURLs(c.Param("subId"), expiresAt)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	jsonObj(c, gin.H{"subUrl": subURL, "subJsonUrl": subJsonURL, "expiresAt": expiresAt}, nil)
+}
+
+// setSubSignedOnly sets whether a subscription is only served through signed URLs.
+func (a *InboundController) setSubSignedOnly(c *gin.Context) {
+	signedOnly, err := strconv.ParseBool(c.PostForm("signedOnly"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	err = a.subscriptionSignService.SetSignedOnly(c.Param("subId"), signedOnly)
+	jsonMsg(c, I18nWeb(c, "pages.settings.toasts.modifySettings"), err)
+}
+
 // addInbound creates a new inbound configuration.
 func (a *InboundController) addInbound(c *gin.Context) {
 	inbound := &model.Inbound{}
@@ -410,3 +531,31 @@ func (a *InboundController) delInboundClientByEmail(c *gin.Context) {
 		a.xrayService.SetToNeedRestart()
 	}
 }
+
+// getClientGroups retrieves the client groups in use with their client counts.
+func (a *InboundController) getClientGroups(c *gin.Context) {
+	groups, err := a.clientBulkService.GetClientGroups()
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.obtain"), err)
+		return
+	}
+	jsonObj(c, groups, nil)
+}
+
+// bulkClients runs an action on the clients matching a filter across inbounds, or previews it on a dry run.
+func (a *InboundController) bulkClients(c *gin.Context) {
+	var req service.BulkClientRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.bulkClients"), err)
+		return
+	}
+	result, needRestart, err := a.clientBulkService.RunBulkAction(&req)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.bulkClients"), err)
+		return
+	}
+	jsonMsgObj(c, I18nWeb(c, "pages.inbounds.toasts.bulkClientsSuccess"), result, nil)
+	if needRestart {
+		a.xrayService.SetToNeedRestart()
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"github.com/mhsanaei/3x-ui/v2/logger"
+	"github.com/mhsanaei/3x-ui/v2/web/middleware"
 	"github.com/mhsanaei/3x-ui/v2/web/service"
 	"github.com/mhsanaei/3x-ui/v2/web/session"
 
@@ -20,6 +21,9 @@ type LoginForm struct {
 	TwoFactorCode string `json:"twoFactorCode" form:"twoFactorCode"`
 }
 
+// loginLimiter throttles login attempts per client address.
+var loginLimiter = middleware.NewRateLimiter()
+
 // IndexController handles the main index and login-related routes.
 type IndexController struct {
 	BaseController
@@ -41,7 +45,11 @@ func (a *IndexController) initRouter(g *gin.RouterGroup) {
 	g.GET("/", a.index)
 	g.GET("/logout", a.logout)
 
-	g.POST("/login", a.login)
+	loginLimit, err := a.settingService.GetLoginRateLimit()
+	if err != nil {
+		loginLimit = 10
+	}
+	g.POST("/login", middleware.IPRateLimit(loginLimiter, "login", middleware.PerMinute(loginLimit), middleware.LoadTrustedProxies()), a.login)
 	g.POST("/getTwoFactorEnable", a.getTwoFactorEnable)
 }
 
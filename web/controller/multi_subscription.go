@@ -14,6 +14,7 @@ import (
 type MultiSubscriptionController struct {
 	BaseController
 	multiSubscriptionService service.MultiSubscriptionService
+	globalClientService      service.GlobalClientService
 }
 
 // NewMultiSubscriptionController creates a new MultiSubscriptionController and sets up its routes.
@@ -36,6 +37,15 @@ func (a *MultiSubscriptionController) initRouter(g *gin.RouterGroup) {
 	g.POST("/:id", a.updateMultiSubscription)
 	g.POST("/:id/delete", a.deleteMultiSubscription)
 	g.POST("/:id/validate", a.validateMultiSubscription)
+
+	// Global client provisioned on every node of the multi-subscription
+	g.GET("/:id/client", a.getGlobalClient)
+	g.POST("/:id/client", a.saveGlobalClient)
+	g.POST("/:id/client/enable", a.enableGlobalClient)
+	g.POST("/:id/client/disable", a.disableGlobalClient)
+	g.POST("/:id/client/sync", a.syncGlobalClient)
+	g.POST("/:id/client/resetTraffic", a.resetGlobalClientTraffic)
+	g.POST("/:id/client/delete", a.deleteGlobalClient)
 }
 
 // getMultiSubscriptions retrieves all multi-subscriptions.
@@ -167,3 +177,113 @@ func (a *MultiSubscriptionController) getSubscriptionURL(c *gin.Context) {
 	jsonObj(c, map[string]string{"url": url}, nil)
 }
 
+// getGlobalClient retrieves the global client of a multi-subscription.
+func (a *MultiSubscriptionController) getGlobalClient(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "get"), err)
+		return
+	}
+	gc, err := a.globalClientService.GetGlobalClient(id)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.multiSubscriptions.toasts.getGlobalClient"), err)
+		return
+	}
+	jsonObj(c, gc, nil)
+}
+
+// saveGlobalClient creates or updates the global client and provisions it on every mapped node.
+func (a *MultiSubscriptionController) saveGlobalClient(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "get"), err)
+		return
+	}
+	// New clients are enabled unless the request says otherwise
+	gc := model.GlobalClient{Enable: true}
+	if err := c.ShouldBindJSON(&gc); err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.multiSubscriptions.toasts.saveGlobalClient"), err)
+		return
+	}
+	gc.MultiSubId = id
+	results, err := a.globalClientService.SaveGlobalClient(&gc)
+	if err != nil {
+		jsonMsgObj(c, I18nWeb(c, "pages.multiSubscriptions.toasts.saveGlobalClient"), results, err)
+		return
+	}
+	jsonMsgObj(c, I18nWeb(c, "pages.multiSubscriptions.toasts.saveGlobalClientSuccess"), results, nil)
+}
+
+// enableGlobalClient enables the global client on every mapped node.
+func (a *MultiSubscriptionController) enableGlobalClient(c *gin.Context) {
+	a.setGlobalClientEnable(c, true)
+}
+
+// disableGlobalClient disables the global client on every mapped node.
+func (a *MultiSubscriptionController) disableGlobalClient(c *gin.Context) {
+	a.setGlobalClientEnable(c, false)
+}
+
+func (a *MultiSubscriptionController) setGlobalClientEnable(c *gin.Context, enable bool) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "get"), err)
+		return
+	}
+	results, err := a.globalClientService.SetEnable(id, enable)
+	if err != nil {
+		jsonMsgObj(c, I18nWeb(c, "pages.multiSubscriptions.toasts.saveGlobalClient"), results, err)
+		return
+	}
+	jsonMsgObj(c, I18nWeb(c, "pages.multiSubscriptions.toasts.saveGlobalClientSuccess"), results, nil)
+}
+
+// syncGlobalClient pushes the global client to every mapped node again.
+func (a *MultiSubscriptionController) syncGlobalClient(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "get"), err)
+		return
+	}
+	gc, err := a.globalClientService.GetGlobalClient(id)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.multiSubscriptions.toasts.getGlobalClient"), err)
+		return
+	}
+	results, err := a.globalClientService.ProvisionGlobalClient(gc)
+	if err != nil {
+		jsonMsgObj(c, I18nWeb(c, "pages.multiSubscriptions.toasts.syncGlobalClient"), results, err)
+		return
+	}
+	jsonMsgObj(c, I18nWeb(c, "pages.multiSubscriptions.toasts.syncGlobalClientSuccess"), results, nil)
+}
+
+// resetGlobalClientTraffic resets the global client traffic on every node and enables it again.
+func (a *MultiSubscriptionController) resetGlobalClientTraffic(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "get"), err)
+		return
+	}
+	results, err := a.globalClientService.ResetGlobalClientTraffic(id)
+	if err != nil {
+		jsonMsgObj(c, I18nWeb(c, "pages.multiSubscriptions.toasts.resetGlobalClientTraffic"), results, err)
+		return
+	}
+	jsonMsgObj(c, I18nWeb(c, "pages.multiSubscriptions.toasts.resetGlobalClientTrafficSuccess"), results, nil)
+}
+
+// deleteGlobalClient removes the global client from every mapped node.
+func (a *MultiSubscriptionController) deleteGlobalClient(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "get"), err)
+		return
+	}
+	results, err := a.globalClientService.DeleteGlobalClient(id)
+	if err != nil {
+		jsonMsgObj(c, I18nWeb(c, "pages.multiSubscriptions.toasts.deleteGlobalClient"), results, err)
+		return
+	}
+	jsonMsgObj(c, I18nWeb(c, "pages.multiSubscriptions.toasts.deleteGlobalClientSuccess"), results, nil)
+}
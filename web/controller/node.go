@@ -4,6 +4,8 @@ package controller
 import (
 	"strconv"
 
+	"github.com/mhsanaei/3x-ui/v2/util/common"
+
 	"github.com/mhsanaei/3x-ui/v2/database/model"
 	"github.com/mhsanaei/3x-ui/v2/web/service"
 
@@ -13,7 +15,9 @@ import (
 // NodeController handles HTTP requests related to node management.
 type NodeController struct {
 	BaseController
-	nodeService service.NodeService
+	nodeService      service.NodeService
+	inboundService   service.InboundService
+	reconcileService service.NodeReconcileService
 }
 
 // NewNodeController creates a new NodeController and sets up its routes.
@@ -30,7 +34,12 @@ func (a *NodeController) initRouter(g *gin.RouterGroup) {
 	g.GET("/", a.getNodes)
 	g.GET("/:id", a.getNode)
 	g.GET("/:id/stats", a.getNodeStats)
+	g.GET("/:id/stats/history", a.getNodeStatsHistory)
 	g.GET("/map", a.getNodesForMap)
+	g.GET("/uptime", a.getNodesUptime)
+	g.GET("/poll", a.getNodePollStates)
+	g.GET("/:id/uptime", a.getNodeUptime)
+	g.GET("/:id/events", a.getNodeStatusEvents)
 
 	g.POST("/", a.addNode)
 	g.POST("/:id", a.updateNode)
@@ -38,6 +47,28 @@ func (a *NodeController) initRouter(g *gin.RouterGroup) {
 	g.POST("/:id/check", a.checkNode)
 	g.POST("/:id/sync", a.syncNode)
 	g.POST("/:id/detect-location", a.detectNodeLocation)
+	g.POST("/:id/rotate-key", a.rotateNodeKey)
+
+	// Remote management through the node external API
+	g.GET("/:id/inbounds", a.getNodeInbounds)
+	g.POST("/:id/inbounds/add", a.addNodeInbound)
+	g.POST("/:id/inbounds/update/:inboundId", a.updateNodeInbound)
+	g.POST("/:id/inbounds/del/:inboundId", a.delNodeInbound)
+	g.POST("/:id/inbounds/addClient", a.addNodeClient)
+	g.POST("/:id/inbounds/updateClient/:clientId", a.updateNodeClient)
+	g.POST("/:id/inbounds/:inboundId/delClient/:clientId", a.delNodeClient)
+	g.POST("/:id/inbounds/:inboundId/resetClientTraffic/:email", a.resetNodeClientTraffic)
+	g.POST("/:id/inbounds/resetAllClientTraffics/:inboundId", a.resetNodeAllClientTraffics)
+	g.POST("/:id/restartXray", a.restartNodeXray)
+
+	// Declared inbound specs and drift reconciliation
+	g.GET("/drift", a.getDriftReports)
+	g.GET("/:id/specs", a.getNodeSpecs)
+	g.POST("/:id/specs", a.saveNodeSpec)
+	g.POST("/:id/specs/:specId", a.saveNodeSpec)
+	g.POST("/:id/specs/:specId/delete", a.deleteNodeSpec)
+	g.GET("/:id/drift", a.getNodeDrift)
+	g.POST("/:id/reconcile", a.reconcileNode)
 }
 
 // getNodes retrieves all nodes.
@@ -128,7 +159,7 @@ func (a *NodeController) checkNode(c *gin.Context) {
 		jsonMsg(c, I18nWeb(c, "pages.nodes.toasts.getNode"), err)
 		return
 	}
-	status, err := a.nodeService.CheckNodeStatus(node)
+	status, err := a.nodeService.CheckNodeStatus(c.Request.Context(), node)
 	if err != nil {
 		jsonMsg(c, I18nWeb(c, "pages.nodes.toasts.checkNode"), err)
 		return
@@ -143,7 +174,7 @@ func (a *NodeController) syncNode(c *gin.Context) {
 		jsonMsg(c, I18nWeb(c, "get"), err)
 		return
 	}
-	err = a.nodeService.SyncNodeStats(id)
+	err = a.nodeService.SyncNodeStats(c.Request.Context(), id)
 	if err != nil {
 		jsonMsg(c, I18nWeb(c, "pages.nodes.toasts.syncNode"), err)
 		return
@@ -151,6 +182,21 @@ func (a *NodeController) syncNode(c *gin.Context) {
 	jsonMsg(c, I18nWeb(c, "pages.nodes.toasts.syncNodeSuccess"), nil)
 }
 
+// rotateNodeKey replaces the API key shared with a node without interrupting it.
+func (a *NodeController) rotateNodeKey(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "get"), err)
+		return
+	}
+	err = a.nodeService.RotateNodeKey(id)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.nodes.toasts.rotateKey"), err)
+		return
+	}
+	jsonMsg(c, I18nWeb(c, "pages.nodes.toasts.rotateKeySuccess"), nil)
+}
+
 // getNodeStats retrieves statistics for a node.
 func (a *NodeController) getNodeStats(c *gin.Context) {
 	id, err := strconv.Atoi(c.Param("id"))
@@ -166,6 +212,23 @@ func (a *NodeController) getNodeStats(c *gin.Context) {
 	jsonObj(c, stats, nil)
 }
 
+// getNodeStatsHistory returns node statistics for a time range at the requested resolution.
+func (a *NodeController) getNodeStatsHistory(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "get"), err)
+		return
+	}
+	from, _ := strconv.ParseInt(c.Query("from"), 10, 64)
+	to, _ := strconv.ParseInt(c.Query("to"), 10, 64)
+	history, err := a.nodeService.GetNodeStatsHistory(id, from, to, c.Query("resolution"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.nodes.toasts.getStatsHistory"), err)
+		return
+	}
+	jsonObj(c, history, nil)
+}
+
 // getNodesForMap retrieves nodes with coordinates for map display.
 func (a *NodeController) getNodesForMap(c *gin.Context) {
 	nodes, err := a.nodeService.GetNodesWithCoordinates()
@@ -176,6 +239,52 @@ func (a *NodeController) getNodesForMap(c *gin.Context) {
 	jsonObj(c, nodes, nil)
 }
 
+// getNodesUptime returns the availability of every node over 24h, 7d and 30d.
+func (a *NodeController) getNodesUptime(c *gin.Context) {
+	reports, err := a.nodeService.GetAllNodesUptime([]string{"24h", "7d", "30d"}, c.Query("outages") == "true")
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.nodes.toasts.getUptime"), err)
+		return
+	}
+	jsonObj(c, reports, nil)
+}
+
+// getNodePollStates returns the duration, last error and backoff of the latest polls of every node.
+func (a *NodeController) getNodePollStates(c *gin.Context) {
+	jsonObj(c, a.nodeService.GetNodePollStates(), nil)
+}
+
+// getNodeUptime returns the availability, outage windows and average latency of a node.
+func (a *NodeController) getNodeUptime(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "get"), err)
+		return
+	}
+	report, err := a.nodeService.GetNodeUptime(id)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.nodes.toasts.getUptime"), err)
+		return
+	}
+	jsonObj(c, report, nil)
+}
+
+// getNodeStatusEvents returns the latest status checks of a node, or only its transitions.
+func (a *NodeController) getNodeStatusEvents(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "get"), err)
+		return
+	}
+	limit, _ := strconv.Atoi(c.Query("limit"))
+	events, err := a.nodeService.GetNodeStatusEvents(id, c.Query("transitions") == "true", limit)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.nodes.toasts.getStatusEvents"), err)
+		return
+	}
+	jsonObj(c, events, nil)
+}
+
 // detectNodeLocation automatically detects the geographical location of a node by its IP address.
 func (a *NodeController) detectNodeLocation(c *gin.Context) {
 	id, err := strconv.Atoi(c.Param("id"))
@@ -220,3 +329,316 @@ func (a *NodeController) detectNodeLocation(c *gin.Context) {
 
 	jsonObj(c, updatedNode, nil)
 }
+
+// getNodeInbounds retrieves all inbounds configured on a remote node.
+func (a *NodeController) getNodeInbounds(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "get"), err)
+		return
+	}
+	inbounds, err := a.nodeService.GetNodeInbounds(id)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.nodes.toasts.getNodeInbounds"), err)
+		return
+	}
+	jsonObj(c, inbounds, nil)
+}
+
+// addNodeInbound creates an inbound on a remote node.
+func (a *NodeController) addNodeInbound(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "get"), err)
+		return
+	}
+	inbound := &model.Inbound{}
+	if err := c.ShouldBind(inbound); err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.nodes.toasts.manageInbound"), err)
+		return
+	}
+	created, err := a.nodeService.AddNodeInbound(id, inbound)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.nodes.toasts.manageInbound"), err)
+		return
+	}
+	jsonMsgObj(c, I18nWeb(c, "pages.nodes.toasts.manageInboundSuccess"), created, nil)
+}
+
+// updateNodeInbound updates an inbound on a remote node.
+func (a *NodeController) updateNodeInbound(c *gin.Context) {
+	id, inboundId, err := nodeAndInboundId(c)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "get"), err)
+		return
+	}
+	inbound := &model.Inbound{}
+	if err := c.ShouldBind(inbound); err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.nodes.toasts.manageInbound"), err)
+		return
+	}
+	inbound.Id = inboundId
+	updated, err := a.nodeService.UpdateNodeInbound(id, inbound)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.nodes.toasts.manageInbound"), err)
+		return
+	}
+	jsonMsgObj(c, I18nWeb(c, "pages.nodes.toasts.manageInboundSuccess"), updated, nil)
+}
+
+// delNodeInbound deletes an inbound from a remote node.
+func (a *NodeController) delNodeInbound(c *gin.Context) {
+	id, inboundId, err := nodeAndInboundId(c)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "get"), err)
+		return
+	}
+	err = a.nodeService.DelNodeInbound(id, inboundId)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.nodes.toasts.manageInbound"), err)
+		return
+	}
+	jsonMsgObj(c, I18nWeb(c, "pages.nodes.toasts.manageInboundSuccess"), inboundId, nil)
+}
+
+// addNodeClient adds clients to an inbound on a remote node.
+// The body has the same shape as the local addClient endpoint: inbound id plus settings with the new clients.
+func (a *NodeController) addNodeClient(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "get"), err)
+		return
+	}
+	data := &model.Inbound{}
+	if err := c.ShouldBind(data); err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.nodes.toasts.manageClient"), err)
+		return
+	}
+	clients, err := a.inboundService.GetClients(data)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.nodes.toasts.manageClient"), err)
+		return
+	}
+	err = a.nodeService.AddNodeClients(id, data.Id, clients)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.nodes.toasts.manageClient"), err)
+		return
+	}
+	jsonMsg(c, I18nWeb(c, "pages.nodes.toasts.manageClientSuccess"), nil)
+}
+
+// updateNodeClient updates a client of an inbound on a remote node.
+func (a *NodeController) updateNodeClient(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "get"), err)
+		return
+	}
+	data := &model.Inbound{}
+	if err := c.ShouldBind(data); err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.nodes.toasts.manageClient"), err)
+		return
+	}
+	clients, err := a.inboundService.GetClients(data)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.nodes.toasts.manageClient"), err)
+		return
+	}
+	if len(clients) != 1 {
+		jsonMsg(c, I18nWeb(c, "pages.nodes.toasts.manageClient"), common.NewError("exactly one client is required"))
+		return
+	}
+	err = a.nodeService.UpdateNodeClient(id, data.Id, c.Param("clientId"), clients[0])
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.nodes.toasts.manageClient"), err)
+		return
+	}
+	jsonMsg(c, I18nWeb(c, "pages.nodes.toasts.manageClientSuccess"), nil)
+}
+
+// delNodeClient removes a client from an inbound on a remote node.
+func (a *NodeController) delNodeClient(c *gin.Context) {
+	id, inboundId, err := nodeAndInboundId(c)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "get"), err)
+		return
+	}
+	err = a.nodeService.DelNodeClient(id, inboundId, c.Param("clientId"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.nodes.toasts.manageClient"), err)
+		return
+	}
+	jsonMsg(c, I18nWeb(c, "pages.nodes.toasts.manageClientSuccess"), nil)
+}
+
+// resetNodeClientTraffic resets traffic of a client on a remote node.
+func (a *NodeController) resetNodeClientTraffic(c *gin.Context) {
+	id, inboundId, err := nodeAndInboundId(c)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "get"), err)
+		return
+	}
+	err = a.nodeService.ResetNodeClientTraffic(id, inboundId, c.Param("email"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.nodes.toasts.manageClient"), err)
+		return
+	}
+	jsonMsg(c, I18nWeb(c, "pages.nodes.toasts.manageClientSuccess"), nil)
+}
+
+// resetNodeAllClientTraffics resets traffic of all clients of an inbound on a remote node.
+func (a *NodeController) resetNodeAllClientTraffics(c *gin.Context) {
+	id, inboundId, err := nodeAndInboundId(c)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "get"), err)
+		return
+	}
+	err = a.nodeService.ResetNodeAllClientTraffics(id, inboundId)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.nodes.toasts.manageClient"), err)
+		return
+	}
+	jsonMsg(c, I18nWeb(c, "pages.nodes.toasts.manageClientSuccess"), nil)
+}
+
+// restartNodeXray restarts xray on a remote node.
+func (a *NodeController) restartNodeXray(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "get"), err)
+		return
+	}
+	err = a.nodeService.RestartNodeXray(id)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.nodes.toasts.restartXray"), err)
+		return
+	}
+	jsonMsg(c, I18nWeb(c, "pages.nodes.toasts.restartXraySuccess"), nil)
+}
+
+// getDriftReports returns the last drift report of every checked node.
+func (a *NodeController) getDriftReports(c *gin.Context) {
+	jsonObj(c, a.reconcileService.GetDriftReports(), nil)
+}
+
+// getNodeSpecs retrieves the inbound specs declared for a node.
+func (a *NodeController) getNodeSpecs(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "get"), err)
+		return
+	}
+	specs, err := a.reconcileService.GetSpecs(id)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.nodes.toasts.getSpecs"), err)
+		return
+	}
+	jsonObj(c, specs, nil)
+}
+
+// saveNodeSpec creates an inbound spec, or updates it when a spec ID is given.
+func (a *NodeController) saveNodeSpec(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "get"), err)
+		return
+	}
+	// New specs are enabled and updated specs keep their state unless the request says otherwise
+	spec := &model.NodeInboundSpec{Enable: true}
+	var existing *model.NodeInboundSpec
+	if param := c.Param("specId"); param != "" {
+		specId, err := strconv.Atoi(param)
+		if err != nil {
+			jsonMsg(c, I18nWeb(c, "get"), err)
+			return
+		}
+		existing, err = a.reconcileService.GetSpec(specId)
+		if err != nil || existing.NodeId != id {
+			jsonMsg(c, I18nWeb(c, "pages.nodes.toasts.saveSpec"), common.NewError("spec not found on this node"))
+			return
+		}
+		spec.Enable = existing.Enable
+	}
+	if err := c.ShouldBind(spec); err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.nodes.toasts.saveSpec"), err)
+		return
+	}
+	spec.Id = 0
+	if existing != nil {
+		spec.Id = existing.Id
+		spec.CreatedAt = existing.CreatedAt
+	}
+	spec.NodeId = id
+	if err := a.reconcileService.SaveSpec(spec); err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.nodes.toasts.saveSpec"), err)
+		return
+	}
+	jsonMsgObj(c, I18nWeb(c, "pages.nodes.toasts.saveSpecSuccess"), spec, nil)
+}
+
+// deleteNodeSpec removes an inbound spec from a node.
+func (a *NodeController) deleteNodeSpec(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "get"), err)
+		return
+	}
+	specId, err := strconv.Atoi(c.Param("specId"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "get"), err)
+		return
+	}
+	spec, err := a.reconcileService.GetSpec(specId)
+	if err != nil || spec.NodeId != id {
+		jsonMsg(c, I18nWeb(c, "pages.nodes.toasts.deleteSpec"), common.NewError("spec not found on this node"))
+		return
+	}
+	if err := a.reconcileService.DeleteSpec(specId); err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.nodes.toasts.deleteSpec"), err)
+		return
+	}
+	jsonMsg(c, I18nWeb(c, "pages.nodes.toasts.deleteSpecSuccess"), nil)
+}
+
+// getNodeDrift compares a node with its declared inbound specs without changing it.
+func (a *NodeController) getNodeDrift(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "get"), err)
+		return
+	}
+	report, err := a.reconcileService.CheckNodeDrift(id)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.nodes.toasts.checkDrift"), err)
+		return
+	}
+	jsonObj(c, report, nil)
+}
+
+// reconcileNode converges a node to its declared inbound specs and returns the remaining drift.
+func (a *NodeController) reconcileNode(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "get"), err)
+		return
+	}
+	report, err := a.reconcileService.ReconcileNode(id)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.nodes.toasts.reconcile"), err)
+		return
+	}
+	jsonMsgObj(c, I18nWeb(c, "pages.nodes.toasts.reconcileSuccess"), report, nil)
+}
+
+// nodeAndInboundId parses the node and remote inbound IDs from the route.
+func nodeAndInboundId(c *gin.Context) (int, int, error) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return 0, 0, err
+	}
+	inboundId, err := strconv.Atoi(c.Param("inboundId"))
+	if err != nil {
+		return 0, 0, err
+	}
+	return id, inboundId, nil
+}
@@ -0,0 +1,144 @@
+package controller
+
+import (
+	"strconv"
+
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+	"github.com/mhsanaei/3x-ui/v2/web/service"
+	"github.com/mhsanaei/3x-ui/v2/web/session"
+
+	"github.com/gin-gonic/gin"
+)
+
+// PlanController handles HTTP requests related to billing plans.
+type PlanController struct {
+	BaseController
+	planService service.PlanService
+	xrayService service.XrayService
+}
+
+// NewPlanController creates a new PlanController and sets up its routes.
+func NewPlanController(g *gin.RouterGroup) *PlanController {
+	a := &PlanController{}
+	a.initRouter(g)
+	return a
+}
+
+// initRouter initializes the routes for plan operations.
+func (a *PlanController) initRouter(g *gin.RouterGroup) {
+	g.GET("/", a.getPlans)
+	g.GET("/history/:email", a.getPlanHistory)
+
+	g.POST("/", a.addPlan)
+	g.POST("/:id", a.updatePlan)
+	g.POST("/:id/delete", a.deletePlan)
+	g.POST("/apply/:email", a.applyPlan)
+	g.POST("/renew/:email", a.renewPlan)
+}
+
+// getPlans retrieves all plans.
+func (a *PlanController) getPlans(c *gin.Context) {
+	plans, err := a.planService.GetPlans()
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.plans.toasts.getPlans"), err)
+		return
+	}
+	jsonObj(c, plans, nil)
+}
+
+// getPlanHistory retrieves the plan changes of a client.
+func (a *PlanController) getPlanHistory(c *gin.Context) {
+	history, err := a.planService.GetPlanHistory(c.Param("email"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.plans.toasts.getPlans"), err)
+		return
+	}
+	jsonObj(c, history, nil)
+}
+
+// addPlan creates a plan.
+func (a *PlanController) addPlan(c *gin.Context) {
+	var plan model.Plan
+	if err := c.ShouldBindJSON(&plan); err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.plans.toasts.addPlan"), err)
+		return
+	}
+	if err := a.planService.AddPlan(&plan); err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.plans.toasts.addPlan"), err)
+		return
+	}
+	jsonMsgObj(c, I18nWeb(c, "pages.plans.toasts.addPlanSuccess"), plan, nil)
+}
+
+// updatePlan updates a plan.
+func (a *PlanController) updatePlan(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "get"), err)
+		return
+	}
+	var plan model.Plan
+	if err := c.ShouldBindJSON(&plan); err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.plans.toasts.updatePlan"), err)
+		return
+	}
+	plan.Id = id
+	if err := a.planService.UpdatePlan(&plan); err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.plans.toasts.updatePlan"), err)
+		return
+	}
+	jsonMsg(c, I18nWeb(c, "pages.plans.toasts.updatePlanSuccess"), nil)
+}
+
+// deletePlan deletes a plan.
+func (a *PlanController) deletePlan(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "get"), err)
+		return
+	}
+	if err := a.planService.DeletePlan(id); err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.plans.toasts.deletePlan"), err)
+		return
+	}
+	jsonMsg(c, I18nWeb(c, "pages.plans.toasts.deletePlanSuccess"), nil)
+}
+
+// applyPlan applies the plan given by the planId form field to a client.
+func (a *PlanController) applyPlan(c *gin.Context) {
+	planId, err := strconv.Atoi(c.PostForm("planId"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.plans.toasts.applyPlan"), err)
+		return
+	}
+	needRestart, err := a.planService.ApplyPlan(c.Param("email"), planId, a.actor(c))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.plans.toasts.applyPlan"), err)
+		return
+	}
+	jsonMsg(c, I18nWeb(c, "pages.plans.toasts.applyPlanSuccess"), nil)
+	if needRestart {
+		a.xrayService.SetToNeedRestart()
+	}
+}
+
+// renewPlan renews the plan of a client.
+func (a *PlanController) renewPlan(c *gin.Context) {
+	needRestart, err := a.planService.RenewPlan(c.Param("email"), a.actor(c))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.plans.toasts.renewPlan"), err)
+		return
+	}
+	jsonMsg(c, I18nWeb(c, "pages.plans.toasts.renewPlanSuccess"), nil)
+	if needRestart {
+		a.xrayService.SetToNeedRestart()
+	}
+}
+
+// actor names the panel user making a plan change in the client plan history.
+func (a *PlanController) actor(c *gin.Context) string {
+	if user := session.GetLoginUser(c); user != nil {
+		return "panel:" + user.Username
+	}
+	return "panel"
+}
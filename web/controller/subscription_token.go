@@ -0,0 +1,123 @@
+package controller
+
+import (
+	"strconv"
+
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+	"github.com/mhsanaei/3x-ui/v2/web/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+// SubscriptionTokenController handles HTTP requests related to subscription tokens.
+type SubscriptionTokenController struct {
+	BaseController
+	tokenService service.SubscriptionTokenService
+}
+
+// NewSubscriptionTokenController creates a new SubscriptionTokenController and sets up its routes.
+func NewSubscriptionTokenController(g *gin.RouterGroup) *SubscriptionTokenController {
+	a := &SubscriptionTokenController{}
+	a.initRouter(g)
+	return a
+}
+
+// initRouter initializes the routes for subscription token operations.
+func (a *SubscriptionTokenController) initRouter(g *gin.RouterGroup) {
+	g.GET("/", a.getTokens)
+	g.GET("/:id/devices", a.getDevices)
+
+	g.POST("/", a.addToken)
+	g.POST("/:id", a.updateToken)
+	g.POST("/:id/rotate", a.rotateToken)
+	g.POST("/:id/delete", a.deleteToken)
+}
+
+// getTokens retrieves the tokens of the subscription given by the subId query, or every token.
+func (a *SubscriptionTokenController) getTokens(c *gin.Context) {
+	tokens, err := a.tokenService.GetTokens(c.Query("subId"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.subTokens.toasts.getTokens"), err)
+		return
+	}
+	jsonObj(c, tokens, nil)
+}
+
+// getDevices retrieves the addresses and client applications counted against the limits of a token.
+func (a *SubscriptionTokenController) getDevices(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "get"), err)
+		return
+	}
+	devices, err := a.tokenService.GetDevices(id)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.subTokens.toasts.getTokens"), err)
+		return
+	}
+	jsonObj(c, devices, nil)
+}
+
+// addToken creates a token for a subscription.
+func (a *SubscriptionTokenController) addToken(c *gin.Context) {
+	// New tokens are enabled unless the request says otherwise
+	token := model.SubscriptionToken{Enable: true}
+	if err := c.ShouldBindJSON(&token); err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.subTokens.toasts.addToken"), err)
+		return
+	}
+	if err := a.tokenService.AddToken(&token); err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.subTokens.toasts.addToken"), err)
+		return
+	}
+	jsonMsgObj(c, I18nWeb(c, "pages.subTokens.toasts.addTokenSuccess"), token, nil)
+}
+
+// updateToken updates the remark, expiry, limits and state of a token.
+func (a *SubscriptionTokenController) updateToken(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "get"), err)
+		return
+	}
+	var token model.SubscriptionToken
+	if err := c.ShouldBindJSON(&token); err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.subTokens.toasts.updateToken"), err)
+		return
+	}
+	token.Id = id
+	if err := a.tokenService.UpdateToken(&token); err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.subTokens.toasts.updateToken"), err)
+		return
+	}
+	jsonMsg(c, I18nWeb(c, "pages.subTokens.toasts.updateTokenSuccess"), nil)
+}
+
+// rotateToken replaces the value of a token and returns it with the new value.
+func (a *SubscriptionTokenController) rotateToken(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "get"), err)
+		return
+	}
+	token, err := a.tokenService.RotateToken(id)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.subTokens.toasts.rotateToken"), err)
+		return
+	}
+	jsonMsgObj(c, I18nWeb(c, "pages.subTokens.toasts.rotateTokenSuccess"), token, nil)
+}
+
+// deleteToken deletes a token.
+func (a *SubscriptionTokenController) deleteToken(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "get"), err)
+		return
+	}
+	if err := a.tokenService.DeleteToken(id); err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.subTokens.toasts.deleteToken"), err)
+		return
+	}
+	jsonMsg(c, I18nWeb(c, "pages.subTokens.toasts.deleteTokenSuccess"), nil)
+}
@@ -3,8 +3,11 @@ package entity
 
 import (
 	"crypto/tls"
+	"encoding/json"
 	"math"
 	"net"
+	"os"
+	"regexp"
 	"strings"
 	"time"
 
@@ -46,13 +49,22 @@ type AllSetting struct {
 	TgBotBackup      bool   `json:"tgBotBackup" form:"tgBotBackup"`           // Enable database backup via Telegram
 	TgBotLoginNotify bool   `json:"tgBotLoginNotify" form:"tgBotLoginNotify"` // Send login notifications
 	TgCpu            int    `json:"tgCpu" form:"tgCpu"`                       // CPU usage threshold for alerts
+	TgTopTalkers     int    `json:"tgTopTalkers" form:"tgTopTalkers"`         // Entries per top-talkers section of the report, 0 disables
 	TgLang           string `json:"tgLang" form:"tgLang"`                     // Telegram bot language
 
 	// Security settings
-	TimeLocation    string `json:"timeLocation" form:"timeLocation"`       // Time zone location
-	TwoFactorEnable bool   `json:"twoFactorEnable" form:"twoFactorEnable"` // Enable two-factor authentication
-	TwoFactorToken  string `json:"twoFactorToken" form:"twoFactorToken"`   // Two-factor authentication token
-	ExternalApiKey  string `json:"externalApiKey" form:"externalApiKey"`   // External API key for node-to-node auth
+	TimeLocation            string `json:"timeLocation" form:"timeLocation"`                       // Time zone location
+	TwoFactorEnable         bool   `json:"twoFactorEnable" form:"twoFactorEnable"`                 // Enable two-factor authentication
+	TwoFactorToken          string `json:"twoFactorToken" form:"twoFactorToken"`                   // Two-factor authentication token
+	ExternalApiKey          string `json:"externalApiKey" form:"externalApiKey"`                   // External API key for node-to-node auth
+	ExternalApiAuthMode     string `json:"externalApiAuthMode" form:"externalApiAuthMode"`         // External API auth mode: key, hmac or mtls
+	ExternalApiClientCA     string `json:"externalApiClientCA" form:"externalApiClientCA"`         // CA file verifying node client certificates
+	ExternalApiRateLimit    int    `json:"externalApiRateLimit" form:"externalApiRateLimit"`       // External API requests per minute per caller
+	ExternalApiIPRateLimit  int    `json:"externalApiIPRateLimit" form:"externalApiIPRateLimit"`   // External API requests per minute per address before authentication, 0 disables
+	ExternalApiRestartLimit int    `json:"externalApiRestartLimit" form:"externalApiRestartLimit"` // External API Xray restarts per minute per caller, 0 disables
+	ExternalApiRotateLimit  int    `json:"externalApiRotateLimit" form:"externalApiRotateLimit"`   // External API key rotations per minute per caller, 0 disables
+	TrustedProxies          string `json:"trustedProxies" form:"trustedProxies"`                   // Proxies whose forwarding headers are trusted
+	LoginRateLimit          int    `json:"loginRateLimit" form:"loginRateLimit"`                   // Login attempts per minute per address, 0 disables
 
 	// Subscription server settings
 	SubEnable                   bool   `json:"subEnable" form:"subEnable"`                                     // Enable subscription server
@@ -65,6 +77,17 @@ type AllSetting struct {
 	SubCertFile                 string `json:"subCertFile" form:"subCertFile"`                                 // SSL certificate file for subscription server
 	SubKeyFile                  string `json:"subKeyFile" form:"subKeyFile"`                                   // SSL private key file for subscription server
 	SubUpdates                  int    `json:"subUpdates" form:"subUpdates"`                                   // Subscription update interval in minutes
+	SubRateLimit                int    `json:"subRateLimit" form:"subRateLimit"`                               // Subscription requests per minute per address, 0 disables
+	SubNodeTimeout              int    `json:"subNodeTimeout" form:"subNodeTimeout"`                           // Seconds a multi-subscription request waits for its nodes
+	SubNodeCacheTTL             int    `json:"subNodeCacheTTL" form:"subNodeCacheTTL"`                         // Seconds node subscription lookups are served from cache
+	SubClashEnable              bool   `json:"subClashEnable" form:"subClashEnable"`                           // Enable Clash/Mihomo YAML subscription endpoint
+	SubClashPath                string `json:"subClashPath" form:"subClashPath"`                               // Path for Clash/Mihomo YAML subscription endpoint
+	SubClashURI                 string `json:"subClashURI" form:"subClashURI"`                                 // Clash/Mihomo YAML subscription server URI
+	SubSingboxEnable            bool   `json:"subSingboxEnable" form:"subSingboxEnable"`                       // Enable sing-box subscription endpoint
+	SubSingboxPath              string `json:"subSingboxPath" form:"subSingboxPath"`                           // Path for sing-box subscription endpoint
+	SubSingboxURI               string `json:"subSingboxURI" form:"subSingboxURI"`                             // sing-box subscription server URI
+	SubUserAgentRules           string `json:"subUserAgentRules" form:"subUserAgentRules"`                     // JSON rules mapping client User-Agents to subscription formats
+	SubTokenRequired            bool   `json:"subTokenRequired" form:"subTokenRequired"`                       // Serve subscriptions that have tokens only through their tokens
 	ExternalTrafficInformEnable bool   `json:"externalTrafficInformEnable" form:"externalTrafficInformEnable"` // Enable external traffic reporting
 	ExternalTrafficInformURI    string `json:"externalTrafficInformURI" form:"externalTrafficInformURI"`       // URI for external traffic reporting
 	SubEncrypt                  bool   `json:"subEncrypt" form:"subEncrypt"`                                   // Encrypt subscription responses
@@ -77,6 +100,15 @@ type AllSetting struct {
 	SubJsonMux                  string `json:"subJsonMux" form:"subJsonMux"`                                   // JSON subscription mux configuration
 	SubJsonRules                string `json:"subJsonRules" form:"subJsonRules"`
 
+	// Node monitoring settings
+	NodeStatsRetention       int `json:"nodeStatsRetention" form:"nodeStatsRetention"`             // Hours raw node statistics samples are kept
+	NodeStatsHourlyRetention int `json:"nodeStatsHourlyRetention" form:"nodeStatsHourlyRetention"` // Days hourly node statistics rollups are kept
+	NodePollWorkers          int `json:"nodePollWorkers" form:"nodePollWorkers"`                   // Nodes polled at the same time
+
+	// Client traffic history settings
+	TrafficHourlyRetention int `json:"trafficHourlyRetention" form:"trafficHourlyRetention"` // Days hourly client traffic history is kept
+	TrafficDailyRetention  int `json:"trafficDailyRetention" form:"trafficDailyRetention"`   // Days daily client traffic history is kept
+
 	// LDAP settings
 	LdapEnable     bool   `json:"ldapEnable" form:"ldapEnable"`
 	LdapHost       string `json:"ldapHost" form:"ldapHost"`
@@ -144,6 +176,58 @@ func (s *AllSetting) CheckValid() error {
 		}
 	}
 
+	switch s.ExternalApiAuthMode {
+	case "", "key", "hmac":
+	case "mtls":
+		if s.ExternalApiClientCA == "" {
+			return common.NewError("external API client CA is required for mtls mode")
+		}
+	default:
+		return common.NewError("external API auth mode is not valid:", s.ExternalApiAuthMode)
+	}
+	if s.ExternalApiClientCA != "" {
+		if _, err := os.ReadFile(s.ExternalApiClientCA); err != nil {
+			return common.NewErrorf("client CA file <%v> invalid: %v", s.ExternalApiClientCA, err)
+		}
+	}
+
+	if s.ExternalApiRateLimit <= 0 {
+		return common.NewError("external API rate limit must be positive:", s.ExternalApiRateLimit)
+	}
+	if s.LoginRateLimit < 0 || s.SubRateLimit < 0 || s.ExternalApiIPRateLimit < 0 || s.ExternalApiRestartLimit < 0 || s.ExternalApiRotateLimit < 0 {
+		return common.NewError("rate limits must not be negative")
+	}
+	if s.SubNodeTimeout < 1 || s.SubNodeTimeout > 60 {
+		return common.NewError("subscription node timeout must be between 1 and 60 seconds:", s.SubNodeTimeout)
+	}
+	if s.SubNodeCacheTTL < 0 {
+		return common.NewError("subscription node cache TTL must not be negative:", s.SubNodeCacheTTL)
+	}
+	if s.NodeStatsRetention < 2 {
+		return common.NewError("node stats retention must be at least 2 hours:", s.NodeStatsRetention)
+	}
+	if s.NodePollWorkers < 1 || s.NodePollWorkers > 256 {
+		return common.NewError("node poll workers must be between 1 and 256:", s.NodePollWorkers)
+	}
+	if s.NodeStatsHourlyRetention < 1 {
+		return common.NewError("node stats hourly retention must be at least 1 day:", s.NodeStatsHourlyRetention)
+	}
+	if s.TgTopTalkers < 0 || s.TgTopTalkers > 100 {
+		return common.NewError("Telegram top talkers must be between 0 and 100:", s.TgTopTalkers)
+	}
+	if s.TrafficHourlyRetention < 2 {
+		return common.NewError("hourly traffic history retention must be at least 2 days:", s.TrafficHourlyRetention)
+	}
+	if s.TrafficDailyRetention < 62 {
+		return common.NewError("daily traffic history retention must be at least 62 days:", s.TrafficDailyRetention)
+	}
+	if _, err := ParseSubUserAgentRules(s.SubUserAgentRules); err != nil {
+		return common.NewError("subscription User-Agent rules are not valid:", err)
+	}
+	if _, err := common.ParseCIDRList(s.TrustedProxies); err != nil {
+		return common.NewError("trusted proxies are not valid:", err)
+	}
+
 	if !strings.HasPrefix(s.WebBasePath, "/") {
 		s.WebBasePath = "/" + s.WebBasePath
 	}
@@ -164,6 +248,20 @@ func (s *AllSetting) CheckValid() error {
 		s.SubJsonPath += "/"
 	}
 
+	if !strings.HasPrefix(s.SubClashPath, "/") {
+		s.SubClashPath = "/" + s.SubClashPath
+	}
+	if !strings.HasSuffix(s.SubClashPath, "/") {
+		s.SubClashPath += "/"
+	}
+
+	if !strings.HasPrefix(s.SubSingboxPath, "/") {
+		s.SubSingboxPath = "/" + s.SubSingboxPath
+	}
+	if !strings.HasSuffix(s.SubSingboxPath, "/") {
+		s.SubSingboxPath += "/"
+	}
+
 	_, err := time.LoadLocation(s.TimeLocation)
 	if err != nil {
 		return common.NewError("time location not exist:", s.TimeLocation)
@@ -171,3 +269,48 @@ func (s *AllSetting) CheckValid() error {
 
 	return nil
 }
+
+// SubUserAgentRule maps subscription clients whose User-Agent matches Pattern to the output they read best.
+type SubUserAgentRule struct {
+	Family   string `json:"family"`   // Client family name used in logs
+	Pattern  string `json:"pattern"`  // Case-insensitive regular expression matched against the User-Agent
+	Format   string `json:"format"`   // links, json, clash or singbox
+	Encoding string `json:"encoding"` // base64 or plain for links, empty keeps the subscription setting
+	Headers  string `json:"headers"`  // standard, userinfo or none, empty means standard
+}
+
+// ParseSubUserAgentRules parses and validates the JSON array of subscription User-Agent rules.
+// An empty string means no rules.
+func ParseSubUserAgentRules(rules string) ([]SubUserAgentRule, error) {
+	if strings.TrimSpace(rules) == "" {
+		return nil, nil
+	}
+	var parsed []SubUserAgentRule
+	if err := json.Unmarshal([]byte(rules), &parsed); err != nil {
+		return nil, err
+	}
+	for i, rule := range parsed {
+		if rule.Family == "" || rule.Pattern == "" {
+			return nil, common.NewErrorf("rule %d: family and pattern are required", i+1)
+		}
+		if _, err := regexp.Compile("(?i)" + rule.Pattern); err != nil {
+			return nil, common.NewErrorf("rule %d: invalid pattern: %v", i+1, err)
+		}
+		switch rule.Format {
+		case "links", "json", "clash", "singbox":
+		default:
+			return nil, common.NewErrorf("rule %d: unknown format %q", i+1, rule.Format)
+		}
+		switch rule.Encoding {
+		case "", "base64", "plain":
+		default:
+			return nil, common.NewErrorf("rule %d: unknown encoding %q", i+1, rule.Encoding)
+		}
+		switch rule.Headers {
+		case "", "standard", "userinfo", "none":
+		default:
+			return nil, common.NewErrorf("rule %d: unknown header set %q", i+1, rule.Headers)
+		}
+	}
+	return parsed, nil
+}
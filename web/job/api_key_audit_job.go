@@ -0,0 +1,33 @@
+package job
+
+import (
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/logger"
+	"github.com/mhsanaei/3x-ui/v2/web/service"
+)
+
+// apiKeyAuditRetention is how long external API key audit records are kept.
+const apiKeyAuditRetention = 30 * 24 * time.Hour
+
+// ApiKeyAuditJob prunes old external API key audit records.
+type ApiKeyAuditJob struct {
+	apiKeyService service.ApiKeyService
+}
+
+// NewApiKeyAuditJob creates a new audit pruning job.
+func NewApiKeyAuditJob() *ApiKeyAuditJob {
+	return &ApiKeyAuditJob{}
+}
+
+// Run deletes audit records older than the retention period.
+func (j *ApiKeyAuditJob) Run() {
+	count, err := j.apiKeyService.PruneAudit(apiKeyAuditRetention)
+	if err != nil {
+		logger.Warning("Failed to prune api key audit:", err)
+		return
+	}
+	if count > 0 {
+		logger.Debugf("Pruned %d api key audit record(s)", count)
+	}
+}
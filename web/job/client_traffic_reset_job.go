@@ -0,0 +1,34 @@
+package job
+
+import (
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/logger"
+	"github.com/mhsanaei/3x-ui/v2/web/service"
+)
+
+// ClientTrafficResetJob resets the traffic of clients that have their own reset schedule.
+type ClientTrafficResetJob struct {
+	clientTrafficResetService service.ClientTrafficResetService
+	xrayService               service.XrayService
+}
+
+// NewClientTrafficResetJob creates a new per-client traffic reset job.
+func NewClientTrafficResetJob() *ClientTrafficResetJob {
+	return &ClientTrafficResetJob{}
+}
+
+// Run resets the clients whose scheduled reset is due.
+func (j *ClientTrafficResetJob) Run() {
+	needRestart, count, err := j.clientTrafficResetService.ResetScheduledClientTraffics(time.Now())
+	if err != nil {
+		logger.Warning("Failed to reset scheduled client traffic:", err)
+		return
+	}
+	if count > 0 {
+		logger.Infof("Scheduled traffic reset completed: %d client(s) reset", count)
+	}
+	if needRestart {
+		j.xrayService.SetToNeedRestart()
+	}
+}
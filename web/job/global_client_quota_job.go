@@ -0,0 +1,29 @@
+package job
+
+import (
+	"github.com/mhsanaei/3x-ui/v2/logger"
+	"github.com/mhsanaei/3x-ui/v2/web/service"
+)
+
+// GlobalClientQuotaJob aggregates multi-subscription client traffic across nodes and
+// enforces the combined quota and expiry on every node.
+type GlobalClientQuotaJob struct {
+	globalClientService service.GlobalClientService
+}
+
+// NewGlobalClientQuotaJob creates a new cluster-wide quota enforcement job.
+func NewGlobalClientQuotaJob() *GlobalClientQuotaJob {
+	return &GlobalClientQuotaJob{}
+}
+
+// Run syncs global client traffic from the nodes and disables or enables clients as needed.
+func (j *GlobalClientQuotaJob) Run() {
+	count, err := j.globalClientService.DisableInvalidGlobalClients()
+	if err != nil {
+		logger.Warning("Failed to enforce cluster quotas:", err)
+		return
+	}
+	if count > 0 {
+		logger.Infof("Cluster quota changed the state of %d client(s)", count)
+	}
+}
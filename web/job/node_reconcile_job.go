@@ -0,0 +1,16 @@
+package job
+
+import (
+	"github.com/mhsanaei/3x-ui/v2/web/service"
+)
+
+// NodeReconcileJob periodically converges managed nodes to their declared inbound specs.
+type NodeReconcileJob struct {
+	reconcileService service.NodeReconcileService
+}
+
+func NewNodeReconcileJob() *NodeReconcileJob { return &NodeReconcileJob{} }
+
+func (j *NodeReconcileJob) Run() {
+	j.reconcileService.ReconcileAllNodes()
+}
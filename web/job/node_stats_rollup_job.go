@@ -0,0 +1,29 @@
+package job
+
+import (
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/logger"
+	"github.com/mhsanaei/3x-ui/v2/web/service"
+)
+
+// NodeStatsRollupJob rolls raw node statistics up into hourly and daily aggregates, and node
+// status checks into hourly uptime totals, and prunes samples and rollups past their retention.
+type NodeStatsRollupJob struct {
+	nodeService service.NodeService
+}
+
+// NewNodeStatsRollupJob creates a new node statistics rollup job.
+func NewNodeStatsRollupJob() *NodeStatsRollupJob {
+	return &NodeStatsRollupJob{}
+}
+
+// Run aggregates completed buckets and applies retention.
+func (j *NodeStatsRollupJob) Run() {
+	if err := j.nodeService.RollupNodeStats(time.Now()); err != nil {
+		logger.Warning("Failed to roll up node stats:", err)
+	}
+	if err := j.nodeService.RollupNodeUptime(time.Now()); err != nil {
+		logger.Warning("Failed to roll up node uptime:", err)
+	}
+}
@@ -0,0 +1,34 @@
+package job
+
+import (
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/logger"
+	"github.com/mhsanaei/3x-ui/v2/web/service"
+)
+
+// nodeStatusEventRetention is how long node status checks are kept. It covers the longest
+// uptime report window plus one day so the status at the window start is still known.
+const nodeStatusEventRetention = 31 * 24 * time.Hour
+
+// NodeStatusEventJob prunes old node status events.
+type NodeStatusEventJob struct {
+	nodeService service.NodeService
+}
+
+// NewNodeStatusEventJob creates a new status event pruning job.
+func NewNodeStatusEventJob() *NodeStatusEventJob {
+	return &NodeStatusEventJob{}
+}
+
+// Run deletes status events older than the retention period.
+func (j *NodeStatusEventJob) Run() {
+	count, err := j.nodeService.PruneNodeStatusEvents(nodeStatusEventRetention)
+	if err != nil {
+		logger.Warning("Failed to prune node status events:", err)
+		return
+	}
+	if count > 0 {
+		logger.Debugf("Pruned %d node status event(s)", count)
+	}
+}
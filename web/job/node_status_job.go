@@ -1,19 +1,28 @@
 package job
 
 import (
+	"context"
+	"time"
+
 	"github.com/mhsanaei/3x-ui/v2/logger"
 	"github.com/mhsanaei/3x-ui/v2/web/service"
 )
 
+// nodeStatusPassTimeout bounds a status pass so it finishes before the next one starts.
+const nodeStatusPassTimeout = 25 * time.Second
+
 // NodeStatusJob periodically checks status of all enabled nodes.
 type NodeStatusJob struct {
+	ctx context.Context
 }
 
-func NewNodeStatusJob() *NodeStatusJob { return &NodeStatusJob{} }
+func NewNodeStatusJob(ctx context.Context) *NodeStatusJob { return &NodeStatusJob{ctx: ctx} }
 
 func (j *NodeStatusJob) Run() {
+	ctx, cancel := context.WithTimeout(j.ctx, nodeStatusPassTimeout)
+	defer cancel()
 	dashboard := service.DashboardService{}
-	if err := dashboard.CheckAllNodesStatus(); err != nil {
+	if err := dashboard.CheckAllNodesStatus(ctx, false); err != nil {
 		logger.Debugf("NodeStatusJob: check error: %v", err)
 	}
 }
@@ -1,19 +1,28 @@
 package job
 
 import (
+	"context"
+	"time"
+
 	"github.com/mhsanaei/3x-ui/v2/logger"
 	"github.com/mhsanaei/3x-ui/v2/web/service"
 )
 
+// nodeSyncPassTimeout bounds a sync pass so it finishes before the next one starts.
+const nodeSyncPassTimeout = 110 * time.Second
+
 // NodeSyncJob periodically synchronizes statistics from all enabled nodes.
 type NodeSyncJob struct {
+	ctx context.Context
 }
 
-func NewNodeSyncJob() *NodeSyncJob { return &NodeSyncJob{} }
+func NewNodeSyncJob(ctx context.Context) *NodeSyncJob { return &NodeSyncJob{ctx: ctx} }
 
 func (j *NodeSyncJob) Run() {
+	ctx, cancel := context.WithTimeout(j.ctx, nodeSyncPassTimeout)
+	defer cancel()
 	dashboard := service.DashboardService{}
-	if err := dashboard.SyncAllNodesStats(); err != nil {
+	if err := dashboard.SyncAllNodesStats(ctx, false); err != nil {
 		logger.Debugf("NodeSyncJob: sync error: %v", err)
 	}
 }
@@ -0,0 +1,48 @@
+package job
+
+import (
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/logger"
+	"github.com/mhsanaei/3x-ui/v2/web/service"
+)
+
+// subscriptionAccessRetention is how long subscription fetch records are kept.
+const subscriptionAccessRetention = 30 * 24 * time.Hour
+
+// SubscriptionAccessJob prunes old subscription fetch records.
+type SubscriptionAccessJob struct {
+	subscriptionAccessService service.SubscriptionAccessService
+}
+
+// NewSubscriptionAccessJob creates a new subscription access log pruning job.
+func NewSubscriptionAccessJob() *SubscriptionAccessJob {
+	return &SubscriptionAccessJob{}
+}
+
+// Run deletes fetch records older than the retention period.
+func (j *SubscriptionAccessJob) Run() {
+	count, err := j.subscriptionAccessService.PruneAccessLog(subscriptionAccessRetention)
+	if err != nil {
+		logger.Warning("Failed to prune subscription access log:", err)
+		return
+	}
+	if count > 0 {
+		logger.Debugf("Pruned %d subscription access record(s)", count)
+	}
+}
+
+// SubscriptionAccessFlushJob writes queued subscription fetches to the access log.
+type SubscriptionAccessFlushJob struct {
+	subscriptionAccessService service.SubscriptionAccessService
+}
+
+// NewSubscriptionAccessFlushJob creates a new subscription access log flush job.
+func NewSubscriptionAccessFlushJob() *SubscriptionAccessFlushJob {
+	return &SubscriptionAccessFlushJob{}
+}
+
+// Run writes the fetches queued since the last run.
+func (j *SubscriptionAccessFlushJob) Run() {
+	j.subscriptionAccessService.Flush()
+}
@@ -0,0 +1,31 @@
+package job
+
+import (
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/logger"
+	"github.com/mhsanaei/3x-ui/v2/web/service"
+)
+
+// TrafficHistoryRollupJob rolls hourly client, inbound and outbound traffic history up into
+// daily and monthly totals and prunes buckets past their retention.
+type TrafficHistoryRollupJob struct {
+	clientTrafficHistoryService service.ClientTrafficHistoryService
+	trafficReportService        service.TrafficReportService
+}
+
+// NewTrafficHistoryRollupJob creates a new client traffic history rollup job.
+func NewTrafficHistoryRollupJob() *TrafficHistoryRollupJob {
+	return &TrafficHistoryRollupJob{}
+}
+
+// Run aggregates buckets and applies retention.
+func (j *TrafficHistoryRollupJob) Run() {
+	now := time.Now()
+	if err := j.clientTrafficHistoryService.RollupTrafficHistory(now); err != nil {
+		logger.Warning("Failed to roll up client traffic history:", err)
+	}
+	if err := j.trafficReportService.RollupTrafficHistory(now); err != nil {
+		logger.Warning("Failed to roll up inbound and outbound traffic history:", err)
+	}
+}
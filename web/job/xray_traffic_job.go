@@ -2,6 +2,7 @@ package job
 
 import (
 	"encoding/json"
+	"time"
 
 	"github.com/mhsanaei/3x-ui/v2/logger"
 	"github.com/mhsanaei/3x-ui/v2/web/service"
@@ -16,6 +17,9 @@ type XrayTrafficJob struct {
 	xrayService     service.XrayService
 	inboundService  service.InboundService
 	outboundService service.OutboundService
+
+	clientTrafficHistoryService service.ClientTrafficHistoryService
+	trafficReportService        service.TrafficReportService
 }
 
 // NewXrayTrafficJob creates a new traffic collection job instance.
@@ -32,9 +36,15 @@ func (j *XrayTrafficJob) Run() {
 	if err != nil {
 		return
 	}
+	now := time.Now()
 	err, needRestart0 := j.inboundService.AddTraffic(traffics, clientTraffics)
 	if err != nil {
 		logger.Warning("add inbound traffic failed:", err)
+	} else if err := j.clientTrafficHistoryService.RecordTraffic(clientTraffics, now); err != nil {
+		logger.Warning("record client traffic history failed:", err)
+	}
+	if err := j.trafficReportService.RecordTraffic(traffics, now); err != nil {
+		logger.Warning("record inbound and outbound traffic history failed:", err)
 	}
 	err, needRestart1 := j.outboundService.AddTraffic(traffics, clientTraffics)
 	if err != nil {
@@ -1,85 +1,241 @@
 package middleware
 
 import (
-	"net"
+	"bytes"
+	"io"
 	"net/http"
+	"strconv"
 	"sync"
 	"time"
 
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+	"github.com/mhsanaei/3x-ui/v2/util/crypto"
 	"github.com/mhsanaei/3x-ui/v2/web/service"
 
 	"github.com/gin-gonic/gin"
 )
 
-// simple token bucket per ip
-var rlStore = struct {
-	sync.Mutex
-	buckets map[string]*rateBucket
-}{buckets: make(map[string]*rateBucket)}
-
-type rateBucket struct {
-	tokens     int
-	lastRefill time.Time
-}
+// apiKeyContextKey holds the named key that authenticated an external API request.
+const apiKeyContextKey = "externalApiKey"
 
-func allow(ip string, ratePerMin int, burst int) bool {
-	rlStore.Lock()
-	defer rlStore.Unlock()
-	b, ok := rlStore.buckets[ip]
-	if !ok {
-		b = &rateBucket{tokens: burst, lastRefill: time.Now()}
-		rlStore.buckets[ip] = b
-	}
-	// refill
-	elapsed := time.Since(b.lastRefill)
-	if elapsed > 0 {
-		added := int(elapsed.Minutes() * float64(ratePerMin))
-		if added > 0 {
-			b.tokens = min(burst, b.tokens+added)
-			b.lastRefill = time.Now()
-		}
-	}
-	if b.tokens > 0 {
-		b.tokens--
-		return true
-	}
-	return false
-}
+// rateLimitIdentityKey holds the bucket key of the caller, shared by the route limits.
+const rateLimitIdentityKey = "externalApiRateIdentity"
 
-func min(a, b int) int { if a < b { return a }; return b }
+// externalLimiter holds the token buckets of external API callers. They are stored in the
+// database, so a restart does not reset them and panel processes sharing the database share them.
+var externalLimiter = NewSharedRateLimiter()
 
-// ExternalAPIKeyMiddleware validates X-API-Key header against saved setting and rate-limits requests.
+// ExternalAPIKeyMiddleware authenticates node-to-node requests and rate-limits them.
+// Depending on the configured mode it accepts a verified client certificate, a request signed
+// with an external API key (see crypto.SignRequest), or the plain X-API-Key header.
+// Besides the panel-wide key, named keys from the ApiKey table are accepted; their expiry and
+// allowed addresses are enforced here and their scopes by RequireAPIScope. Every request made
+// with a recognized key is recorded in the audit log.
+// Every client address is rate-limited before authentication, so guessing keys is throttled
+// too. Once authenticated, named keys are rate-limited per key, other callers per address.
 func ExternalAPIKeyMiddleware() gin.HandlerFunc {
+	setting := service.SettingService{}
+	trusted := LoadTrustedProxies()
 	return func(c *gin.Context) {
-		apiKey := c.GetHeader("X-API-Key")
-		if apiKey == "" {
-			c.AbortWithStatus(http.StatusUnauthorized)
-			return
+		remote := ClientIP(c.Request, trusted)
+		if perMinute, err := setting.GetExternalAPIIPRateLimit(); err == nil && perMinute > 0 {
+			allowed := applyRateLimit(c, externalLimiter, func(*gin.Context) (string, RateLimit) {
+				return "external-ip:" + remote, PerMinute(perMinute)
+			})
+			if !allowed {
+				return
+			}
+		}
+
+		apiKeyService := service.ApiKeyService{}
+		mode, err := setting.GetExternalAPIAuthMode()
+		if err != nil || mode == "" {
+			mode = "key"
 		}
-		setting := service.SettingService{}
-		expected, err := setting.GetExternalAPIKey()
-		if err != nil || expected == "" || expected != apiKey {
+		key, ok := authenticateExternal(c, &setting, &apiKeyService, mode)
+		if ok && key != nil {
+			if key.IsExpired(time.Now().Unix()) || !key.AllowsIP(remote) {
+				apiKeyService.RecordUse(key, remote, c.Request.Method, c.Request.URL.Path, http.StatusUnauthorized)
+				ok = false
+			}
+		}
+		if !ok {
 			c.AbortWithStatus(http.StatusUnauthorized)
 			return
 		}
-		// rate limit per remote ip
-		ip := clientIP(c.Request)
-		if !allow(ip, 60, 30) { // 60 req/min, burst 30
-			c.AbortWithStatus(http.StatusTooManyRequests)
+
+		identity := "ip:" + remote
+		limit := PerMinute(60)
+		limit.Burst = 30
+		if perMinute, err := setting.GetExternalAPIRateLimit(); err == nil && perMinute > 0 {
+			limit = RateLimit{Requests: perMinute, Period: time.Minute, Burst: max(1, perMinute/2)}
+		}
+		if key != nil {
+			c.Set(apiKeyContextKey, key)
+			identity = "key:" + strconv.Itoa(key.Id)
+			if key.RateLimit > 0 {
+				limit = PerMinute(key.RateLimit)
+			}
+		}
+		c.Set(rateLimitIdentityKey, identity)
+		allowed := applyRateLimit(c, externalLimiter, func(*gin.Context) (string, RateLimit) {
+			return "external:" + identity, limit
+		})
+		if !allowed {
+			apiKeyService.RecordUse(key, remote, c.Request.Method, c.Request.URL.Path, http.StatusTooManyRequests)
 			return
 		}
 		c.Next()
+		apiKeyService.RecordUse(key, remote, c.Request.Method, c.Request.URL.Path, c.Writer.Status())
+	}
+}
+
+// RouteRateLimit adds a limit for one external API route on top of the caller's overall limit.
+// It is meant for expensive or disruptive routes such as restarting Xray. perMinute reads the
+// number of requests a caller may make per minute from the settings; 0 disables the limit.
+func RouteRateLimit(perMinute func() (int, error)) gin.HandlerFunc {
+	return RateLimitMiddleware(externalLimiter, func(c *gin.Context) (string, RateLimit) {
+		requests, err := perMinute()
+		if err != nil || requests <= 0 {
+			return "", RateLimit{}
+		}
+		identity := c.GetString(rateLimitIdentityKey)
+		if identity == "" {
+			identity = "ip:" + ClientIP(c.Request, nil)
+		}
+		return "route:" + c.FullPath() + ":" + identity, PerMinute(requests)
+	})
+}
+
+// RequireAPIScope rejects external API requests whose named key lacks the scope.
+// Requests authenticated by the panel-wide key or a client certificate have full access.
+func RequireAPIScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if value, ok := c.Get(apiKeyContextKey); ok {
+			if key, ok := value.(*model.ApiKey); ok && !key.HasScope(scope) {
+				c.AbortWithStatus(http.StatusForbidden)
+				return
+			}
+		}
+		c.Next()
 	}
 }
 
-func clientIP(r *http.Request) string {
-	if ip := r.Header.Get("X-Forwarded-For"); ip != "" {
-		return ip
+// authenticateExternal checks the request credentials. It returns the matching named key,
+// or nil when the panel-wide key or a client certificate was used.
+func authenticateExternal(c *gin.Context, setting *service.SettingService, apiKeyService *service.ApiKeyService, mode string) (*model.ApiKey, bool) {
+	if mode == "mtls" {
+		tlsState := c.Request.TLS
+		return nil, tlsState != nil && len(tlsState.VerifiedChains) > 0
+	}
+
+	keys, err := setting.GetExternalAPIKeys()
+	if err != nil {
+		keys = nil
+	}
+	namedKeys, err := apiKeyService.GetSigningKeys()
+	if err != nil {
+		namedKeys = nil
+	}
+
+	if c.GetHeader(crypto.HeaderSignature) != "" {
+		secrets := make([]string, 0, len(keys)+len(namedKeys))
+		secrets = append(secrets, keys...)
+		for _, key := range namedKeys {
+			secrets = append(secrets, key.Key)
+		}
+		match := verifySignedRequest(c, secrets)
+		switch {
+		case match < 0:
+			return nil, false
+		case match < len(keys):
+			return nil, true
+		default:
+			return namedKeys[match-len(keys)], true
+		}
+	}
+	if mode != "key" {
+		return nil, false
+	}
+	apiKey := c.GetHeader("X-API-Key")
+	if apiKey == "" {
+		return nil, false
+	}
+	for _, key := range keys {
+		if key != "" && crypto.ConstantTimeEqual(key, apiKey) {
+			return nil, true
+		}
+	}
+	if key := apiKeyService.MatchApiKey(apiKey); key != nil {
+		return key, true
+	}
+	return nil, false
+}
+
+// signatureMaxSkew bounds how far a signed request timestamp may drift from the local clock.
+const signatureMaxSkew = 5 * time.Minute
+
+// seen nonces of signed requests, kept until their timestamp leaves the allowed skew window
+var nonceStore = struct {
+	sync.Mutex
+	nonces    map[string]time.Time
+	lastPrune time.Time
+}{nonces: make(map[string]time.Time)}
+
+// verifySignedRequest returns the index of the secret that signed the request, or -1 when
+// the signature, timestamp or nonce is invalid.
+func verifySignedRequest(c *gin.Context, secrets []string) int {
+	timestamp, err := strconv.ParseInt(c.GetHeader(crypto.HeaderTimestamp), 10, 64)
+	if err != nil {
+		return -1
+	}
+	signedAt := time.Unix(timestamp, 0)
+	if skew := time.Since(signedAt); skew > signatureMaxSkew || skew < -signatureMaxSkew {
+		return -1
+	}
+	nonce := c.GetHeader(crypto.HeaderNonce)
+	if len(nonce) < 16 || len(nonce) > 128 {
+		return -1
+	}
+
+	var body []byte
+	if c.Request.Body != nil {
+		body, err = io.ReadAll(c.Request.Body)
+		if err != nil {
+			return -1
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	signature := c.GetHeader(crypto.HeaderSignature)
+	match := -1
+	for i, secret := range secrets {
+		if secret != "" && crypto.VerifyRequestSignature(secret, c.Request.Method, c.Request.URL.RequestURI(), timestamp, nonce, body, signature) && match < 0 {
+			match = i
+		}
+	}
+	if match < 0 || !useNonce(nonce, signedAt) {
+		return -1
+	}
+	return match
+}
+
+// useNonce records a nonce and reports false if it was already used, which means a replay.
+func useNonce(nonce string, signedAt time.Time) bool {
+	nonceStore.Lock()
+	defer nonceStore.Unlock()
+	now := time.Now()
+	if now.Sub(nonceStore.lastPrune) > time.Minute {
+		for n, t := range nonceStore.nonces {
+			if now.Sub(t) > signatureMaxSkew {
+				delete(nonceStore.nonces, n)
+			}
+		}
+		nonceStore.lastPrune = now
 	}
-	if ip := r.Header.Get("X-Real-IP"); ip != "" {
-		return ip
+	if _, ok := nonceStore.nonces[nonce]; ok {
+		return false
 	}
-	h, _, err := net.SplitHostPort(r.RemoteAddr)
-	if err == nil { return h }
-	return r.RemoteAddr
+	nonceStore.nonces[nonce] = signedAt
+	return true
 }
@@ -1,17 +1,31 @@
 package middleware
 
 import (
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/mhsanaei/3x-ui/v2/database"
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+	"github.com/mhsanaei/3x-ui/v2/util/crypto"
 	"github.com/mhsanaei/3x-ui/v2/web/service"
 )
 
 func TestExternalAPIAuthMiddleware(t *testing.T) {
 	gin.SetMode(gin.TestMode)
 
+	_ = database.CloseDB()
+	if err := database.InitDB(filepath.Join(t.TempDir(), "middleware_test.db")); err != nil {
+		t.Fatalf("failed to init test db: %v", err)
+	}
+	t.Cleanup(func() { _ = database.CloseDB() })
+
 	// Prepare settings key
 	settingSvc := service.SettingService{}
 	const testKey = "TEST_EXTERNAL_KEY"
@@ -49,3 +63,125 @@ func TestExternalAPIAuthMiddleware(t *testing.T) {
 		t.Fatalf("expected 200 with correct key, got %d", rec3.Code)
 	}
 }
+
+func TestExternalAPISignedRequests(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	_ = database.CloseDB()
+	if err := database.InitDB(filepath.Join(t.TempDir(), "middleware_signed_test.db")); err != nil {
+		t.Fatalf("failed to init test db: %v", err)
+	}
+	t.Cleanup(func() { _ = database.CloseDB() })
+
+	settingSvc := service.SettingService{}
+	const testKey = "SIGNED_EXTERNAL_KEY"
+	if err := settingSvc.SetExternalAPIKey(testKey); err != nil {
+		t.Fatalf("failed to set external api key: %v", err)
+	}
+	if err := settingSvc.SetExternalAPIAuthMode("hmac"); err != nil {
+		t.Fatalf("failed to set auth mode: %v", err)
+	}
+
+	r := gin.New()
+	r.Use(ExternalAPIKeyMiddleware())
+	r.POST("/api/external/echo", func(c *gin.Context) {
+		body, _ := io.ReadAll(c.Request.Body)
+		c.String(http.StatusOK, string(body))
+	})
+
+	send := func(key string, timestamp int64, nonce, body string, tamper bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/external/echo?x=1", strings.NewReader(body))
+		req.RemoteAddr = "192.0.2.30:40000"
+		signature := crypto.SignRequest(key, http.MethodPost, "/api/external/echo?x=1", timestamp, nonce, []byte(body))
+		if tamper {
+			req = httptest.NewRequest(http.MethodPost, "/api/external/echo?x=1", strings.NewReader(body+"!"))
+			req.RemoteAddr = "192.0.2.30:40000"
+		}
+		req.Header.Set(crypto.HeaderTimestamp, strconv.FormatInt(timestamp, 10))
+		req.Header.Set(crypto.HeaderNonce, nonce)
+		req.Header.Set(crypto.HeaderSignature, signature)
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec
+	}
+
+	now := time.Now().Unix()
+	rec := send(testKey, now, "nonce-0000000001", `{"a":1}`, false)
+	if rec.Code != http.StatusOK || rec.Body.String() != `{"a":1}` {
+		t.Fatalf("expected signed request to pass with body intact, got %d %q", rec.Code, rec.Body.String())
+	}
+	if rec := send(testKey, now, "nonce-0000000001", `{"a":1}`, false); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected replayed nonce to be rejected, got %d", rec.Code)
+	}
+	if rec := send(testKey, now-3600, "nonce-0000000002", `{"a":1}`, false); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected stale timestamp to be rejected, got %d", rec.Code)
+	}
+	if rec := send(testKey, now, "nonce-0000000003", `{"a":1}`, true); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected tampered body to be rejected, got %d", rec.Code)
+	}
+	if rec := send("WRONG", now, "nonce-0000000004", `{"a":1}`, false); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected wrong secret to be rejected, got %d", rec.Code)
+	}
+
+	// Plain keys are not accepted in hmac mode
+	req := httptest.NewRequest(http.MethodPost, "/api/external/echo", nil)
+	req.Header.Set("X-API-Key", testKey)
+	plain := httptest.NewRecorder()
+	r.ServeHTTP(plain, req)
+	if plain.Code != http.StatusUnauthorized {
+		t.Fatalf("expected plain key to be rejected in hmac mode, got %d", plain.Code)
+	}
+
+	// mtls mode requires a verified client certificate
+	if err := settingSvc.SetExternalAPIAuthMode("mtls"); err != nil {
+		t.Fatalf("failed to set auth mode: %v", err)
+	}
+	if rec := send(testKey, now, "nonce-0000000005", `{"a":1}`, false); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected request without client certificate to be rejected, got %d", rec.Code)
+	}
+}
+
+func TestExternalAPIRateLimitBeforeAuth(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	_ = database.CloseDB()
+	if err := database.InitDB(filepath.Join(t.TempDir(), "middleware_preauth_test.db")); err != nil {
+		t.Fatalf("failed to init test db: %v", err)
+	}
+	t.Cleanup(func() { _ = database.CloseDB() })
+
+	settingSvc := service.SettingService{}
+	const testKey = "PREAUTH_EXTERNAL_KEY"
+	if err := settingSvc.SetExternalAPIKey(testKey); err != nil {
+		t.Fatalf("failed to set external api key: %v", err)
+	}
+	if err := database.GetDB().Create(&model.Setting{Key: "externalApiIPRateLimit", Value: "3"}).Error; err != nil {
+		t.Fatalf("failed to set address rate limit: %v", err)
+	}
+
+	r := gin.New()
+	r.Use(ExternalAPIKeyMiddleware())
+	r.GET("/api/external/ping", func(c *gin.Context) { c.String(http.StatusOK, "pong") })
+
+	send := func(key, remote string) int {
+		req := httptest.NewRequest(http.MethodGet, "/api/external/ping", nil)
+		req.Header.Set("X-API-Key", key)
+		req.RemoteAddr = remote
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// Failed guesses use up the address limit, after which even the right key is throttled
+	for i := 0; i < 3; i++ {
+		if code := send("WRONG", "192.0.2.70:40000"); code != http.StatusUnauthorized {
+			t.Fatalf("expected 401 for guess %d, got %d", i, code)
+		}
+	}
+	if code := send(testKey, "192.0.2.70:40000"); code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429 once the address limit is used up, got %d", code)
+	}
+	if code := send(testKey, "192.0.2.71:40000"); code != http.StatusOK {
+		t.Fatalf("expected other addresses to be unaffected, got %d", code)
+	}
+}
@@ -0,0 +1,292 @@
+package middleware
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/logger"
+	"github.com/mhsanaei/3x-ui/v2/util/common"
+	"github.com/mhsanaei/3x-ui/v2/web/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RateLimit is a token bucket: Requests tokens are refilled every Period and at most Burst
+// requests can be made at once. A zero Burst defaults to Requests.
+type RateLimit struct {
+	Requests int
+	Period   time.Duration
+	Burst    int
+}
+
+// PerMinute returns a limit of n requests per minute with a burst of n.
+func PerMinute(n int) RateLimit {
+	return RateLimit{Requests: n, Period: time.Minute}
+}
+
+func (l RateLimit) burst() int {
+	if l.Burst > 0 {
+		return l.Burst
+	}
+	return l.Requests
+}
+
+// ratePerSecond returns how many tokens are refilled per second.
+func (l RateLimit) ratePerSecond() float64 {
+	return float64(l.Requests) / l.Period.Seconds()
+}
+
+// RateLimitResult describes the state of a bucket after a request.
+type RateLimitResult struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	Reset      time.Duration // time until the bucket is full again
+	RetryAfter time.Duration // time until the next request is allowed, zero when allowed
+}
+
+type rateBucket struct {
+	tokens     float64
+	lastRefill time.Time
+	fullAt     time.Time
+}
+
+// RateLimiter keeps token buckets per key in memory. Buckets that have refilled completely
+// hold no state worth keeping, so they are evicted on the next sweep.
+type RateLimiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*rateBucket
+	lastSweep time.Time
+	sweepEach time.Duration
+	now       func() time.Time
+}
+
+// NewRateLimiter creates an empty limiter.
+func NewRateLimiter() *RateLimiter {
+	return &RateLimiter{
+		buckets:   make(map[string]*rateBucket),
+		sweepEach: time.Minute,
+		now:       time.Now,
+	}
+}
+
+// Take consumes a token from the bucket of key and reports whether the request is allowed.
+func (l *RateLimiter) Take(key string, limit RateLimit) RateLimitResult {
+	burst := limit.burst()
+	if limit.Requests <= 0 || limit.Period <= 0 {
+		return RateLimitResult{Allowed: true, Limit: burst, Remaining: burst}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	if now.Sub(l.lastSweep) >= l.sweepEach {
+		for k, b := range l.buckets {
+			if !now.Before(b.fullAt) {
+				delete(l.buckets, k)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &rateBucket{tokens: float64(burst), lastRefill: now}
+		l.buckets[key] = b
+	}
+	var result RateLimitResult
+	b.tokens, b.lastRefill, result = takeToken(b.tokens, b.lastRefill, now, limit)
+	b.fullAt = now.Add(result.Reset)
+	return result
+}
+
+// takeToken refills a bucket holding tokens since lastRefill and takes a token from it when
+// one is left. It returns the tokens left, the new refill time and the result of the request.
+func takeToken(tokens float64, lastRefill, now time.Time, limit RateLimit) (float64, time.Time, RateLimitResult) {
+	burst := limit.burst()
+	rate := limit.ratePerSecond()
+	if elapsed := now.Sub(lastRefill).Seconds(); elapsed > 0 {
+		tokens = math.Min(float64(burst), tokens+elapsed*rate)
+		lastRefill = now
+	}
+
+	result := RateLimitResult{Limit: burst}
+	if tokens >= 1 {
+		tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = time.Duration((1 - tokens) / rate * float64(time.Second))
+	}
+	result.Remaining = int(tokens)
+	result.Reset = time.Duration((float64(burst) - tokens) / rate * float64(time.Second))
+	return tokens, lastRefill, result
+}
+
+// Len returns the number of buckets currently held.
+func (l *RateLimiter) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.buckets)
+}
+
+// SharedRateLimiter keeps token buckets in the database, so they survive restarts and every
+// panel process serving the same database draws from the same buckets. When the database
+// cannot be used, the in-memory buckets of this process take over.
+type SharedRateLimiter struct {
+	service   service.RateLimitService
+	fallback  *RateLimiter
+	mu        sync.Mutex
+	lastPrune time.Time
+	pruneEach time.Duration
+	now       func() time.Time
+}
+
+// NewSharedRateLimiter creates a limiter backed by the database.
+func NewSharedRateLimiter() *SharedRateLimiter {
+	return &SharedRateLimiter{
+		fallback:  NewRateLimiter(),
+		pruneEach: time.Minute,
+		now:       time.Now,
+	}
+}
+
+// Take consumes a token from the stored bucket of key and reports whether the request is allowed.
+func (l *SharedRateLimiter) Take(key string, limit RateLimit) RateLimitResult {
+	burst := limit.burst()
+	if limit.Requests <= 0 || limit.Period <= 0 {
+		return RateLimitResult{Allowed: true, Limit: burst, Remaining: burst}
+	}
+	now := l.now()
+	l.prune(now)
+
+	var result RateLimitResult
+	err := l.service.UpdateBucket(key, float64(burst), now, func(tokens float64, lastRefill time.Time) (float64, time.Time, time.Time) {
+		tokens, lastRefill, result = takeToken(tokens, lastRefill, now, limit)
+		return tokens, lastRefill, now.Add(result.Reset)
+	})
+	if err != nil {
+		logger.Debug("Rate limiting in memory, the shared bucket is not available:", err)
+		return l.fallback.Take(key, limit)
+	}
+	return result
+}
+
+// prune removes the stored buckets that are full again, at most once per pruneEach.
+func (l *SharedRateLimiter) prune(now time.Time) {
+	l.mu.Lock()
+	if now.Sub(l.lastPrune) < l.pruneEach {
+		l.mu.Unlock()
+		return
+	}
+	l.lastPrune = now
+	l.mu.Unlock()
+	if _, err := l.service.PruneBuckets(now); err != nil {
+		logger.Debug("Failed to prune rate limit buckets:", err)
+	}
+}
+
+// Limiter hands out tokens from per-key buckets.
+type Limiter interface {
+	Take(key string, limit RateLimit) RateLimitResult
+}
+
+// RateLimitKeyFunc returns the bucket key and limit for a request. An empty key skips limiting.
+type RateLimitKeyFunc func(c *gin.Context) (string, RateLimit)
+
+// RateLimitMiddleware limits requests with the bucket chosen by keyFunc. It sets the
+// X-RateLimit-Limit, X-RateLimit-Remaining and X-RateLimit-Reset headers on every response
+// and Retry-After when a request is rejected with 429.
+func RateLimitMiddleware(limiter Limiter, keyFunc RateLimitKeyFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !applyRateLimit(c, limiter, keyFunc) {
+			return
+		}
+		c.Next()
+	}
+}
+
+// IPRateLimit limits requests per client address. Forwarding headers are honoured only when
+// the request comes from one of the trusted proxies.
+func IPRateLimit(limiter Limiter, scope string, limit RateLimit, trusted []*net.IPNet) gin.HandlerFunc {
+	return RateLimitMiddleware(limiter, func(c *gin.Context) (string, RateLimit) {
+		return scope + ":" + ClientIP(c.Request, trusted), limit
+	})
+}
+
+// applyRateLimit takes a token and writes the rate limit headers. It aborts the request
+// and returns false when the bucket is empty.
+func applyRateLimit(c *gin.Context, limiter Limiter, keyFunc RateLimitKeyFunc) bool {
+	key, limit := keyFunc(c)
+	if key == "" || limit.Requests <= 0 {
+		return true
+	}
+	result := limiter.Take(key, limit)
+	header := c.Writer.Header()
+	header.Set("X-RateLimit-Limit", strconv.Itoa(result.Limit))
+	header.Set("X-RateLimit-Remaining", strconv.Itoa(result.Remaining))
+	header.Set("X-RateLimit-Reset", strconv.Itoa(ceilSeconds(result.Reset)))
+	if !result.Allowed {
+		header.Set("Retry-After", strconv.Itoa(max(1, ceilSeconds(result.RetryAfter))))
+		c.AbortWithStatus(http.StatusTooManyRequests)
+		return false
+	}
+	return true
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// ClientIP returns the address of the client. X-Forwarded-For and X-Real-IP are only read when
+// the direct peer is a trusted proxy; X-Forwarded-For is walked from the right, skipping trusted
+// proxies, so a client cannot pick its address by prepending entries.
+func ClientIP(r *http.Request, trusted []*net.IPNet) string {
+	peer, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		peer = r.RemoteAddr
+	}
+	if !isTrustedProxy(peer, trusted) {
+		return peer
+	}
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		hops := strings.Split(forwarded, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if net.ParseIP(hop) == nil {
+				break
+			}
+			if i == 0 || !isTrustedProxy(hop, trusted) {
+				return hop
+			}
+		}
+	}
+	if realIP := strings.TrimSpace(r.Header.Get("X-Real-IP")); net.ParseIP(realIP) != nil {
+		return realIP
+	}
+	return peer
+}
+
+func isTrustedProxy(ip string, trusted []*net.IPNet) bool {
+	return len(trusted) > 0 && common.IPInNets(ip, trusted)
+}
+
+// LoadTrustedProxies reads the trusted proxy list from the settings. Invalid entries disable
+// forwarding headers altogether rather than trusting a partial list.
+func LoadTrustedProxies() []*net.IPNet {
+	setting := service.SettingService{}
+	value, err := setting.GetTrustedProxies()
+	if err != nil {
+		return nil
+	}
+	trusted, err := common.ParseCIDRList(value)
+	if err != nil {
+		logger.Warning("Ignoring invalid trusted proxies:", err)
+		return nil
+	}
+	return trusted
+}
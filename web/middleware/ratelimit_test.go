@@ -0,0 +1,156 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mhsanaei/3x-ui/v2/database"
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+	"github.com/mhsanaei/3x-ui/v2/logger"
+	"github.com/mhsanaei/3x-ui/v2/util/common"
+	"github.com/op/go-logging"
+)
+
+func TestRateLimiterBuckets(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	limiter := NewRateLimiter()
+	limiter.now = func() time.Time { return now }
+	limit := RateLimit{Requests: 60, Period: time.Minute, Burst: 2}
+
+	for i := 0; i < 2; i++ {
+		if res := limiter.Take("a", limit); !res.Allowed {
+			t.Fatalf("request %d should be allowed", i)
+		}
+	}
+	res := limiter.Take("a", limit)
+	if res.Allowed || res.RetryAfter <= 0 || res.RetryAfter > time.Second {
+		t.Fatalf("expected rejection with retry within a second, got %+v", res)
+	}
+	if other := limiter.Take("b", limit); !other.Allowed {
+		t.Fatalf("buckets must be independent per key")
+	}
+
+	now = now.Add(time.Second)
+	if res := limiter.Take("a", limit); !res.Allowed {
+		t.Fatalf("a token should be refilled after a second")
+	}
+
+	// Full buckets are dropped on the next sweep
+	now = now.Add(2 * time.Minute)
+	limiter.Take("c", limit)
+	if n := limiter.Len(); n != 1 {
+		t.Fatalf("expected idle buckets to be evicted, %d left", n)
+	}
+}
+
+func TestSharedRateLimiter(t *testing.T) {
+	t.Setenv("XUI_LOG_FOLDER", t.TempDir())
+	logger.InitLogger(logging.ERROR)
+	_ = database.CloseDB()
+	if err := database.InitDB(filepath.Join(t.TempDir(), "ratelimit_test.db")); err != nil {
+		t.Fatalf("failed to init test db: %v", err)
+	}
+	t.Cleanup(func() { _ = database.CloseDB() })
+
+	now := time.Unix(1700000000, 0)
+	newLimiter := func() *SharedRateLimiter {
+		limiter := NewSharedRateLimiter()
+		limiter.now = func() time.Time { return now }
+		return limiter
+	}
+	limit := RateLimit{Requests: 60, Period: time.Minute, Burst: 2}
+
+	// Two panel processes draw from the same bucket
+	a, b := newLimiter(), newLimiter()
+	if !a.Take("k", limit).Allowed || !b.Take("k", limit).Allowed {
+		t.Fatalf("the first two requests should be allowed")
+	}
+	if res := a.Take("k", limit); res.Allowed || res.RetryAfter <= 0 {
+		t.Fatalf("expected the shared bucket to be empty, got %+v", res)
+	}
+
+	// A restarted process keeps the bucket
+	if res := newLimiter().Take("k", limit); res.Allowed {
+		t.Fatalf("expected the bucket to survive a restart, got %+v", res)
+	}
+	now = now.Add(time.Second)
+	if res := b.Take("k", limit); !res.Allowed || res.Remaining != 0 {
+		t.Fatalf("a token should be refilled after a second, got %+v", res)
+	}
+
+	// Full buckets are dropped on the next prune
+	now = now.Add(2 * time.Minute)
+	a.Take("other", limit)
+	var buckets []model.RateLimitBucket
+	database.GetDB().Find(&buckets)
+	if len(buckets) != 1 || buckets[0].Bucket != "other" || buckets[0].Tokens != 1 {
+		t.Fatalf("expected full buckets to be pruned, got %+v", buckets)
+	}
+
+	// Without the database the buckets of the process are used
+	_ = database.CloseDB()
+	if !a.Take("k", limit).Allowed || !a.Take("k", limit).Allowed || a.Take("k", limit).Allowed {
+		t.Fatalf("expected the in-memory buckets to limit requests without the database")
+	}
+}
+
+func TestRateLimitMiddlewareHeaders(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	limiter := NewRateLimiter()
+	r := gin.New()
+	r.GET("/", IPRateLimit(limiter, "test", PerMinute(1), nil), func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	send := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = "203.0.113.5:1234"
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec
+	}
+	first := send()
+	if first.Code != http.StatusOK || first.Header().Get("X-RateLimit-Limit") != "1" || first.Header().Get("X-RateLimit-Remaining") != "0" {
+		t.Fatalf("unexpected first response: %d %v", first.Code, first.Header())
+	}
+	second := send()
+	if second.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429, got %d", second.Code)
+	}
+	if second.Header().Get("Retry-After") == "" || second.Header().Get("X-RateLimit-Reset") == "" {
+		t.Fatalf("expected Retry-After and X-RateLimit-Reset headers, got %v", second.Header())
+	}
+}
+
+func TestClientIPTrustedProxies(t *testing.T) {
+	trusted, err := common.ParseCIDRList("10.0.0.0/8, 192.0.2.1")
+	if err != nil {
+		t.Fatalf("ParseCIDRList failed: %v", err)
+	}
+	cases := []struct {
+		remote, forwarded, realIP, want string
+	}{
+		{"203.0.113.9:1000", "1.1.1.1", "", "203.0.113.9"},             // untrusted peer cannot spoof
+		{"10.1.2.3:1000", "1.1.1.1", "", "1.1.1.1"},                    // trusted proxy
+		{"10.1.2.3:1000", "6.6.6.6, 1.1.1.1, 10.0.0.7", "", "1.1.1.1"}, // spoofed leftmost entry is skipped
+		{"192.0.2.1:1000", "", "8.8.8.8", "8.8.8.8"},                   // X-Real-IP from a trusted proxy
+		{"10.1.2.3:1000", "", "", "10.1.2.3"},                          // no headers
+		{"10.1.2.3:1000", "garbage", "", "10.1.2.3"},                   // unparsable header
+		{"[2001:db8::1]:1000", "1.1.1.1", "", "2001:db8::1"},           // untrusted IPv6 peer
+	}
+	for _, tc := range cases {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = tc.remote
+		if tc.forwarded != "" {
+			req.Header.Set("X-Forwarded-For", tc.forwarded)
+		}
+		if tc.realIP != "" {
+			req.Header.Set("X-Real-IP", tc.realIP)
+		}
+		if got := ClientIP(req, trusted); got != tc.want {
+			t.Errorf("ClientIP(%s, %q, %q) = %s, want %s", tc.remote, tc.forwarded, tc.realIP, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package service
+
+import (
+	"strings"
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/database"
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+	"github.com/mhsanaei/3x-ui/v2/logger"
+	"github.com/mhsanaei/3x-ui/v2/util/common"
+	"github.com/mhsanaei/3x-ui/v2/util/crypto"
+	"github.com/mhsanaei/3x-ui/v2/util/random"
+)
+
+// apiKeyPrefixLen is how many leading characters of a key are kept in clear to identify it.
+const apiKeyPrefixLen = 8
+
+// ApiKeyService manages named external API keys and their audit trail.
+type ApiKeyService struct{}
+
+// GetApiKeys returns every named key. Secrets are never serialized.
+func (s *ApiKeyService) GetApiKeys() ([]*model.ApiKey, error) {
+	var keys []*model.ApiKey
+	err := database.GetDB().Order("id asc").Find(&keys).Error
+	return keys, err
+}
+
+// GetApiKey returns a named key by ID.
+func (s *ApiKeyService) GetApiKey(id int) (*model.ApiKey, error) {
+	var key model.ApiKey
+	if err := database.GetDB().First(&key, id).Error; err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+// AddApiKey creates a named key with a freshly generated secret and returns the secret.
+// It is the only time the secret is handed out.
+func (s *ApiKeyService) AddApiKey(key *model.ApiKey) (string, error) {
+	key.Id = 0
+	if err := s.validateApiKey(key); err != nil {
+		return "", err
+	}
+	secret := random.Seq(48)
+	key.Key = secret
+	key.Prefix = secret[:apiKeyPrefixLen]
+	key.LastUsedAt = 0
+	key.LastUsedIP = ""
+	if err := database.GetDB().Create(key).Error; err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+// UpdateApiKey changes the name, scopes, restrictions and state of a key. The secret is kept.
+func (s *ApiKeyService) UpdateApiKey(key *model.ApiKey) error {
+	if err := s.validateApiKey(key); err != nil {
+		return err
+	}
+	if _, err := s.GetApiKey(key.Id); err != nil {
+		return err
+	}
+	return database.GetDB().Model(&model.ApiKey{}).Where("id = ?", key.Id).Updates(map[string]any{
+		"name":          key.Name,
+		"scopes":        key.Scopes,
+		"allowed_cidrs": key.AllowedCIDRs,
+		"expires_at":    key.ExpiresAt,
+		"rate_limit":    key.RateLimit,
+		"enable":        key.Enable,
+		"updated_at":    time.Now().Unix(),
+	}).Error
+}
+
+// DeleteApiKey removes a key. Its audit records are kept.
+func (s *ApiKeyService) DeleteApiKey(id int) error {
+	return database.GetDB().Delete(&model.ApiKey{}, id).Error
+}
+
+// MatchApiKey returns the enabled named key whose secret equals the given one.
+// Every key is compared in constant time so the lookup does not leak a matching prefix.
+func (s *ApiKeyService) MatchApiKey(secret string) *model.ApiKey {
+	if secret == "" {
+		return nil
+	}
+	keys, err := s.GetSigningKeys()
+	if err != nil {
+		return nil
+	}
+	var match *model.ApiKey
+	for _, key := range keys {
+		if crypto.ConstantTimeEqual(key.Key, secret) {
+			match = key
+		}
+	}
+	return match
+}
+
+// GetSigningKeys returns every enabled named key, including the secrets used to verify signed requests.
+func (s *ApiKeyService) GetSigningKeys() ([]*model.ApiKey, error) {
+	var keys []*model.ApiKey
+	err := database.GetDB().Where("enable = ?", true).Find(&keys).Error
+	return keys, err
+}
+
+// RecordUse stores an audit record for a request and, for named keys, updates the last-used fields.
+// key is nil for requests authenticated by the panel-wide key or a client certificate.
+func (s *ApiKeyService) RecordUse(key *model.ApiKey, ip, method, path string, status int) {
+	db := database.GetDB()
+	audit := &model.ApiKeyAudit{
+		Method: method,
+		Path:   path,
+		IP:     ip,
+		Status: status,
+	}
+	if key != nil {
+		audit.ApiKeyId = key.Id
+		audit.KeyName = key.Name
+		err := db.Model(&model.ApiKey{}).Where("id = ?", key.Id).UpdateColumns(map[string]any{
+			"last_used_at": time.Now().Unix(),
+			"last_used_ip": ip,
+		}).Error
+		if err != nil {
+			logger.Warning("Failed to update api key last use:", err)
+		}
+	}
+	if err := db.Create(audit).Error; err != nil {
+		logger.Warning("Failed to record api key use:", err)
+	}
+}
+
+// GetAudit returns the latest audit records, newest first. keyId 0 returns records of every key.
+func (s *ApiKeyService) GetAudit(keyId int, limit int) ([]*model.ApiKeyAudit, error) {
+	if limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+	query := database.GetDB().Model(&model.ApiKeyAudit{})
+	if keyId > 0 {
+		query = query.Where("api_key_id = ?", keyId)
+	}
+	var records []*model.ApiKeyAudit
+	err := query.Order("id desc").Limit(limit).Find(&records).Error
+	return records, err
+}
+
+// PruneAudit deletes audit records older than the given age.
+func (s *ApiKeyService) PruneAudit(maxAge time.Duration) (int64, error) {
+	result := database.GetDB().Where("created_at < ?", time.Now().Add(-maxAge).Unix()).Delete(&model.ApiKeyAudit{})
+	return result.RowsAffected, result.Error
+}
+
+func (s *ApiKeyService) validateApiKey(key *model.ApiKey) error {
+	key.Name = strings.TrimSpace(key.Name)
+	if key.Name == "" {
+		return common.NewError("api key name is required")
+	}
+	var count int64
+	err := database.GetDB().Model(&model.ApiKey{}).Where("name = ? AND id <> ?", key.Name, key.Id).Count(&count).Error
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return common.NewError("Duplicate api key name:", key.Name)
+	}
+
+	scopes := key.GetScopes()
+	if len(scopes) == 0 {
+		return common.NewError("at least one scope is required")
+	}
+	for _, scope := range scopes {
+		known := false
+		for _, valid := range model.ApiScopes {
+			if scope == valid {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return common.NewErrorf("unknown scope %q", scope)
+		}
+	}
+	key.Scopes = strings.Join(scopes, ",")
+
+	if _, err := key.GetAllowedNets(); err != nil {
+		return common.NewError(err.Error())
+	}
+	if key.ExpiresAt < 0 {
+		return common.NewError("expiry must not be negative")
+	}
+	if key.RateLimit < 0 {
+		return common.NewError("rate limit must not be negative")
+	}
+	return nil
+}
@@ -0,0 +1,437 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/database"
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+	"github.com/mhsanaei/3x-ui/v2/logger"
+	"github.com/mhsanaei/3x-ui/v2/util/common"
+	"github.com/mhsanaei/3x-ui/v2/xray"
+
+	"gorm.io/gorm"
+)
+
+// Bulk client actions.
+const (
+	BulkActionEnable       = "enable"
+	BulkActionDisable      = "disable"
+	BulkActionExtend       = "extend"
+	BulkActionAddQuota     = "addQuota"
+	BulkActionResetTraffic = "resetTraffic"
+	BulkActionSetGroup     = "setGroup"
+	BulkActionMove         = "move"
+	BulkActionDelete       = "delete"
+)
+
+var bulkActions = []string{
+	BulkActionEnable, BulkActionDisable, BulkActionExtend, BulkActionAddQuota,
+	BulkActionResetTraffic, BulkActionSetGroup, BulkActionMove, BulkActionDelete,
+}
+
+// ClientFilter selects clients across all inbounds. A client must match every condition given.
+type ClientFilter struct {
+	Group        string   `json:"group"`        // Client group
+	InboundId    int      `json:"inboundId"`    // Inbound the client belongs to
+	Emails       []string `json:"emails"`       // Client emails
+	Expired      bool     `json:"expired"`      // Clients past their expiry time
+	Depleted     bool     `json:"depleted"`     // Clients that used up their traffic quota
+	Comment      string   `json:"comment"`      // Case-insensitive part of the client comment
+	InactiveDays int      `json:"inactiveDays"` // Clients not online for this many days
+}
+
+func (f *ClientFilter) isEmpty() bool {
+	return f.Group == "" && f.InboundId == 0 && len(f.Emails) == 0 && !f.Expired && !f.Depleted &&
+		f.Comment == "" && f.InactiveDays <= 0
+}
+
+// BulkClientRequest is an action to run on the clients matching a filter.
+type BulkClientRequest struct {
+	Filter    ClientFilter `json:"filter"`
+	Action    string       `json:"action"`
+	Days      int          `json:"days"`      // Days to extend the expiry by
+	Bytes     int64        `json:"bytes"`     // Bytes to add to the traffic quota
+	Group     string       `json:"group"`     // Group to put the clients in, empty to clear it
+	InboundId int          `json:"inboundId"` // Inbound to move the clients to
+	DryRun    bool         `json:"dryRun"`    // Only list the clients the action would change
+}
+
+// BulkClientResult lists the clients a bulk action changed, or would change on a dry run.
+type BulkClientResult struct {
+	Action string   `json:"action"`
+	DryRun bool     `json:"dryRun"`
+	Count  int      `json:"count"`
+	Emails []string `json:"emails"`
+}
+
+// ClientGroup is a client group and the number of clients in it.
+type ClientGroup struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+// ClientBulkService runs actions on many clients across inbounds at once.
+type ClientBulkService struct {
+	inboundService InboundService
+	xrayApi        xray.XrayAPI
+}
+
+// bulkClient is a client matched by a bulk filter.
+type bulkClient struct {
+	inbound *model.Inbound
+	client  map[string]any
+	traffic *xray.ClientTraffic
+}
+
+func (c *bulkClient) email() string {
+	email, _ := c.client["email"].(string)
+	return email
+}
+
+// active reports whether the client is currently added to Xray.
+func (c *bulkClient) active() bool {
+	enable, _ := c.client["enable"].(bool)
+	return enable && (c.traffic == nil || c.traffic.Enable)
+}
+
+// xrayUserOp adds a user to or removes it from an inbound through the Xray API.
+type xrayUserOp struct {
+	remove   bool
+	protocol string
+	tag      string
+	user     map[string]any
+}
+
+// GetClientGroups returns the client groups in use and how many clients each has.
+func (s *ClientBulkService) GetClientGroups() ([]*ClientGroup, error) {
+	groups := []*ClientGroup{}
+	err := database.GetDB().Raw(`
+		SELECT JSON_EXTRACT(client.value, '$.group') AS name, COUNT(*) AS count
+		FROM inbounds, JSON_EACH(JSON_EXTRACT(inbounds.settings, '$.clients')) AS client
+		WHERE COALESCE(JSON_EXTRACT(client.value, '$.group'), '') <> ''
+		GROUP BY name ORDER BY name`).Scan(&groups).Error
+	return groups, err
+}
+
+// RunBulkAction runs an action on every client matching the filter of a request. All changes are
+// made in one transaction and Xray is updated once at the end. On a dry run only the matching
+// clients are returned. It returns whether Xray needs a restart.
+func (s *ClientBulkService) RunBulkAction(req *BulkClientRequest) (*BulkClientResult, bool, error) {
+	if !slices.Contains(bulkActions, req.Action) {
+		return nil, false, common.NewError("unknown bulk action:", req.Action)
+	}
+	if req.Filter.isEmpty() {
+		return nil, false, common.NewError("bulk actions need at least one filter condition")
+	}
+	switch req.Action {
+	case BulkActionExtend:
+		if req.Days <= 0 {
+			return nil, false, common.NewError("days must be > 0")
+		}
+	case BulkActionAddQuota:
+		if req.Bytes <= 0 {
+			return nil, false, common.NewError("bytes must be > 0")
+		}
+	}
+
+	db := database.GetDB()
+	var inbounds []*model.Inbound
+	if err := db.Model(model.Inbound{}).Order("id asc").Find(&inbounds).Error; err != nil {
+		return nil, false, err
+	}
+	var traffics []*xray.ClientTraffic
+	if err := db.Model(xray.ClientTraffic{}).Find(&traffics).Error; err != nil {
+		return nil, false, err
+	}
+	trafficByEmail := make(map[string]*xray.ClientTraffic, len(traffics))
+	for _, traffic := range traffics {
+		trafficByEmail[traffic.Email] = traffic
+	}
+
+	var target *model.Inbound
+	if req.Action == BulkActionMove {
+		idx := slices.IndexFunc(inbounds, func(inbound *model.Inbound) bool { return inbound.Id == req.InboundId })
+		if idx < 0 {
+			return nil, false, common.NewErrorf("inbound with id %d does not exist", req.InboundId)
+		}
+		target = inbounds[idx]
+	}
+
+	now := time.Now()
+	settings := map[int]map[string]any{}
+	var matched []*bulkClient
+	for _, inbound := range inbounds {
+		if req.Filter.InboundId != 0 && inbound.Id != req.Filter.InboundId {
+			continue
+		}
+		var inboundSettings map[string]any
+		if err := json.Unmarshal([]byte(inbound.Settings), &inboundSettings); err != nil {
+			continue
+		}
+		clients, _ := inboundSettings["clients"].([]any)
+		settings[inbound.Id] = inboundSettings
+		for _, c := range clients {
+			client, ok := c.(map[string]any)
+			if !ok {
+				continue
+			}
+			entry := &bulkClient{inbound: inbound, client: client}
+			entry.traffic = trafficByEmail[entry.email()]
+			if target != nil && inbound.Id == target.Id {
+				continue
+			}
+			if s.matches(&req.Filter, entry, now) {
+				matched = append(matched, entry)
+			}
+		}
+	}
+
+	result := &BulkClientResult{Action: req.Action, DryRun: req.DryRun, Count: len(matched), Emails: []string{}}
+	for _, entry := range matched {
+		result.Emails = append(result.Emails, entry.email())
+	}
+
+	if target != nil {
+		var targetSettings map[string]any
+		if err := json.Unmarshal([]byte(target.Settings), &targetSettings); err != nil {
+			return nil, false, err
+		}
+		settings[target.Id] = targetSettings
+		for _, entry := range matched {
+			if entry.inbound.Protocol != target.Protocol {
+				return nil, false, common.NewErrorf("cannot move %s from a %s inbound to a %s inbound", entry.email(), entry.inbound.Protocol, target.Protocol)
+			}
+			if target.Protocol == model.Shadowsocks && settings[entry.inbound.Id]["method"] != targetSettings["method"] {
+				return nil, false, common.NewErrorf("cannot move %s between shadowsocks inbounds with different methods", entry.email())
+			}
+		}
+	}
+
+	if req.DryRun || len(matched) == 0 {
+		return result, false, nil
+	}
+
+	var ops []xrayUserOp
+	nowMs := now.UnixMilli()
+	err := db.Transaction(func(tx *gorm.DB) error {
+		removed := map[int]map[string]bool{}
+		for _, entry := range matched {
+			trafficUpdates := map[string]any{}
+			wasActive := entry.active()
+			switch req.Action {
+			case BulkActionEnable:
+				entry.client["enable"] = true
+				trafficUpdates["enable"] = true
+				if !wasActive {
+					ops = append(ops, s.userOp(false, entry.inbound, settings[entry.inbound.Id], entry.client))
+				}
+			case BulkActionDisable:
+				entry.client["enable"] = false
+				trafficUpdates["enable"] = false
+				if wasActive {
+					ops = append(ops, s.userOp(true, entry.inbound, settings[entry.inbound.Id], entry.client))
+				}
+			case BulkActionExtend:
+				expiryTime := clientInt64(entry.client["expiryTime"])
+				if entry.traffic != nil {
+					expiryTime = entry.traffic.ExpiryTime
+				}
+				switch {
+				case expiryTime < 0:
+					// Not started yet, the expiry holds the duration after first use
+					expiryTime -= int64(req.Days) * 86400000
+				case expiryTime > 0:
+					expiryTime = max(expiryTime, nowMs) + int64(req.Days)*86400000
+				}
+				entry.client["expiryTime"] = expiryTime
+				trafficUpdates["expiry_time"] = expiryTime
+			case BulkActionAddQuota:
+				totalGB := clientInt64(entry.client["totalGB"])
+				if entry.traffic != nil {
+					totalGB = entry.traffic.Total
+				}
+				if totalGB > 0 {
+					totalGB += req.Bytes
+				}
+				entry.client["totalGB"] = totalGB
+				trafficUpdates["total"] = totalGB
+			case BulkActionResetTraffic:
+				trafficUpdates["up"] = 0
+				trafficUpdates["down"] = 0
+			case BulkActionSetGroup:
+				if req.Group == "" {
+					delete(entry.client, "group")
+				} else {
+					entry.client["group"] = req.Group
+				}
+			case BulkActionMove:
+				if removed[entry.inbound.Id] == nil {
+					removed[entry.inbound.Id] = map[string]bool{}
+				}
+				removed[entry.inbound.Id][entry.email()] = true
+				clients, _ := settings[target.Id]["clients"].([]any)
+				settings[target.Id]["clients"] = append(clients, any(entry.client))
+				trafficUpdates["inbound_id"] = target.Id
+				if wasActive {
+					ops = append(ops,
+						s.userOp(true, entry.inbound, settings[entry.inbound.Id], entry.client),
+						s.userOp(false, target, settings[target.Id], entry.client))
+				}
+			case BulkActionDelete:
+				if removed[entry.inbound.Id] == nil {
+					removed[entry.inbound.Id] = map[string]bool{}
+				}
+				removed[entry.inbound.Id][entry.email()] = true
+				if err := s.inboundService.DelClientIPs(tx, entry.email()); err != nil {
+					return err
+				}
+				if err := s.inboundService.DelClientStat(tx, entry.email()); err != nil {
+					return err
+				}
+				if wasActive {
+					ops = append(ops, s.userOp(true, entry.inbound, settings[entry.inbound.Id], entry.client))
+				}
+			}
+
+			// Clients disabled for running out of traffic or time are enabled again like
+			// after editing them, the next check disables them if they are still invalid
+			switch req.Action {
+			case BulkActionExtend, BulkActionAddQuota, BulkActionResetTraffic:
+				if enable, _ := entry.client["enable"].(bool); enable && entry.traffic != nil && !entry.traffic.Enable {
+					trafficUpdates["enable"] = true
+					ops = append(ops, s.userOp(false, entry.inbound, settings[entry.inbound.Id], entry.client))
+				}
+			}
+			entry.client["updated_at"] = nowMs
+
+			if len(trafficUpdates) > 0 && entry.traffic != nil {
+				if err := tx.Model(xray.ClientTraffic{}).Where("id = ?", entry.traffic.Id).Updates(trafficUpdates).Error; err != nil {
+					return err
+				}
+			}
+		}
+
+		for inboundId, emails := range removed {
+			kept := slices.DeleteFunc(settings[inboundId]["clients"].([]any), func(c any) bool {
+				client, _ := c.(map[string]any)
+				email, _ := client["email"].(string)
+				return emails[email]
+			})
+			if len(kept) == 0 {
+				return common.NewErrorf("no client would remain in inbound %d", inboundId)
+			}
+			settings[inboundId]["clients"] = kept
+		}
+		touched := map[int]bool{}
+		for _, entry := range matched {
+			touched[entry.inbound.Id] = true
+		}
+		if target != nil {
+			touched[target.Id] = true
+		}
+		for inboundId := range touched {
+			newSettings, err := json.MarshalIndent(settings[inboundId], "", "  ")
+			if err != nil {
+				return err
+			}
+			if err := tx.Model(model.Inbound{}).Where("id = ?", inboundId).Update("settings", string(newSettings)).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	logger.Infof("Bulk action %s applied to %d client(s)", req.Action, len(matched))
+	return result, s.syncXray(ops), nil
+}
+
+func (s *ClientBulkService) matches(filter *ClientFilter, entry *bulkClient, now time.Time) bool {
+	if filter.Group != "" {
+		if group, _ := entry.client["group"].(string); group != filter.Group {
+			return false
+		}
+	}
+	if len(filter.Emails) > 0 && !slices.Contains(filter.Emails, entry.email()) {
+		return false
+	}
+	if filter.Comment != "" {
+		comment, _ := entry.client["comment"].(string)
+		if !strings.Contains(strings.ToLower(comment), strings.ToLower(filter.Comment)) {
+			return false
+		}
+	}
+	traffic := entry.traffic
+	if filter.Expired && (traffic == nil || traffic.ExpiryTime <= 0 || traffic.ExpiryTime > now.UnixMilli()) {
+		return false
+	}
+	if filter.Depleted && (traffic == nil || traffic.Total <= 0 || traffic.Up+traffic.Down < traffic.Total) {
+		return false
+	}
+	if filter.InactiveDays > 0 {
+		since := now.AddDate(0, 0, -filter.InactiveDays).UnixMilli()
+		if traffic != nil && traffic.LastOnline >= since {
+			return false
+		}
+	}
+	return true
+}
+
+// userOp builds the Xray API call that adds a client to or removes it from an inbound.
+func (s *ClientBulkService) userOp(remove bool, inbound *model.Inbound, settings map[string]any, client map[string]any) xrayUserOp {
+	user := map[string]any{"email": client["email"], "cipher": ""}
+	if inbound.Protocol == model.Shadowsocks {
+		user["cipher"], _ = settings["method"].(string)
+	}
+	for _, key := range []string{"id", "security", "flow", "password"} {
+		user[key], _ = client[key].(string)
+	}
+	return xrayUserOp{remove: remove, protocol: string(inbound.Protocol), tag: inbound.Tag, user: user}
+}
+
+// syncXray applies the user changes of a bulk action through one Xray API connection and
+// reports whether Xray needs a restart to pick up the ones that failed.
+func (s *ClientBulkService) syncXray(ops []xrayUserOp) bool {
+	if p == nil || len(ops) == 0 {
+		return false
+	}
+	if err := s.xrayApi.Init(p.GetAPIPort()); err != nil {
+		return true
+	}
+	defer s.xrayApi.Close()
+	needRestart := false
+	for _, op := range ops {
+		email, _ := op.user["email"].(string)
+		if op.remove {
+			err := s.xrayApi.RemoveUser(op.tag, email)
+			if err != nil && !strings.Contains(err.Error(), fmt.Sprintf("User %s not found.", email)) {
+				logger.Debug("Error in deleting client by api:", err)
+				needRestart = true
+			}
+			continue
+		}
+		if err := s.xrayApi.AddUser(op.protocol, op.tag, op.user); err != nil {
+			logger.Debug("Error in adding client by api:", err)
+			needRestart = true
+		}
+	}
+	return needRestart
+}
+
+// clientInt64 converts a number decoded from client settings JSON.
+func clientInt64(v any) int64 {
+	switch n := v.(type) {
+	case float64:
+		return int64(n)
+	case int64:
+		return n
+	case int:
+		return int64(n)
+	}
+	return 0
+}
@@ -0,0 +1,129 @@
+package service
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/database"
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+	"github.com/mhsanaei/3x-ui/v2/xray"
+)
+
+func TestClientBulkActions(t *testing.T) {
+	setupServiceTestDB(t)
+	setupTestLogger(t)
+	svc := &ClientBulkService{}
+	db := database.GetDB()
+
+	source := &model.Inbound{Tag: "inbound-bulk-1", Port: 20006, Protocol: model.VLESS, Settings: `{"clients":[
+		{"id":"id-a","email":"a","enable":true,"group":"g1","comment":"Promo A","totalGB":100},
+		{"id":"id-b","email":"b","enable":true,"group":"g1"},
+		{"id":"id-c","email":"c","enable":true,"totalGB":100},
+		{"id":"id-d","email":"d","enable":true}]}`}
+	dest := &model.Inbound{Tag: "inbound-bulk-2", Port: 20007, Protocol: model.VLESS, Settings: `{"clients":[{"id":"id-z","email":"z","enable":true}]}`}
+	trojan := &model.Inbound{Tag: "inbound-bulk-3", Port: 20008, Protocol: model.Trojan, Settings: `{"clients":[{"password":"pw","email":"t","enable":true}]}`}
+	createTestInbounds(t, source, dest, trojan)
+	now := time.Now()
+	past := now.Add(-time.Hour).UnixMilli()
+	createTestClientTraffics(t,
+		&xray.ClientTraffic{InboundId: source.Id, Email: "a", Enable: true, Up: 10, Down: 10, Total: 100, LastOnline: now.UnixMilli()},
+		&xray.ClientTraffic{InboundId: source.Id, Email: "b", Enable: true, ExpiryTime: past},
+		&xray.ClientTraffic{InboundId: source.Id, Email: "c", Up: 60, Down: 60, Total: 100},
+		&xray.ClientTraffic{InboundId: source.Id, Email: "d", Enable: true},
+		&xray.ClientTraffic{InboundId: dest.Id, Email: "z", Enable: true, LastOnline: now.UnixMilli()},
+		&xray.ClientTraffic{InboundId: trojan.Id, Email: "t", Enable: true, LastOnline: now.UnixMilli()},
+	)
+	run := func(req BulkClientRequest) *BulkClientResult {
+		t.Helper()
+		result, _, err := svc.RunBulkAction(&req)
+		if err != nil {
+			t.Fatalf("bulk action %s failed: %v", req.Action, err)
+		}
+		return result
+	}
+	clients := func(inbound *model.Inbound) map[string]model.Client {
+		t.Helper()
+		stored, err := svc.inboundService.GetInbound(inbound.Id)
+		if err != nil {
+			t.Fatalf("GetInbound failed: %v", err)
+		}
+		list, err := svc.inboundService.GetClients(stored)
+		if err != nil {
+			t.Fatalf("GetClients failed: %v", err)
+		}
+		byEmail := map[string]model.Client{}
+		for _, client := range list {
+			byEmail[client.Email] = client
+		}
+		return byEmail
+	}
+
+	for _, req := range []BulkClientRequest{
+		{Action: BulkActionDisable},
+		{Action: "archive", Filter: ClientFilter{Group: "g1"}},
+		{Action: BulkActionExtend, Filter: ClientFilter{Group: "g1"}},
+		{Action: BulkActionMove, Filter: ClientFilter{Group: "g1"}, InboundId: 999},
+		{Action: BulkActionMove, Filter: ClientFilter{Group: "g1"}, InboundId: trojan.Id},
+	} {
+		if _, _, err := svc.RunBulkAction(&req); err == nil {
+			t.Fatalf("expected bulk request %+v to be rejected", req)
+		}
+	}
+
+	// A dry run only lists the clients
+	result := run(BulkClientRequest{Action: BulkActionDisable, Filter: ClientFilter{Group: "g1"}, DryRun: true})
+	if result.Count != 2 || !slices.Equal(result.Emails, []string{"a", "b"}) || !getTestClientTraffic(t, "a").Enable {
+		t.Fatalf("unexpected dry run: %+v", result)
+	}
+	run(BulkClientRequest{Action: BulkActionDisable, Filter: ClientFilter{Group: "g1"}})
+	if getTestClientTraffic(t, "a").Enable || clients(source)["b"].Enable || !clients(source)["c"].Enable {
+		t.Fatal("expected only the group to be disabled")
+	}
+
+	// Disabled clients stay disabled when their expiry is extended
+	result = run(BulkClientRequest{Action: BulkActionExtend, Filter: ClientFilter{Expired: true}, Days: 10})
+	if b := getTestClientTraffic(t, "b"); result.Count != 1 || b.ExpiryTime < now.AddDate(0, 0, 10).UnixMilli() || b.Enable {
+		t.Fatalf("unexpected extended client: %+v", b)
+	}
+
+	// Depleted clients get their quota raised and are enabled again
+	result = run(BulkClientRequest{Action: BulkActionAddQuota, Filter: ClientFilter{Depleted: true}, Bytes: 50})
+	if c := getTestClientTraffic(t, "c"); result.Count != 1 || c.Total != 150 || !c.Enable || clients(source)["c"].TotalGB != 150 {
+		t.Fatalf("unexpected client after adding quota: %+v", c)
+	}
+
+	run(BulkClientRequest{Action: BulkActionResetTraffic, Filter: ClientFilter{Comment: "promo"}})
+	if a := getTestClientTraffic(t, "a"); a.Up != 0 || a.Down != 0 || getTestClientTraffic(t, "c").Up != 60 {
+		t.Fatalf("unexpected client after reset: %+v", a)
+	}
+
+	result = run(BulkClientRequest{Action: BulkActionSetGroup, Filter: ClientFilter{InactiveDays: 30}, Group: "idle"})
+	if !slices.Equal(result.Emails, []string{"b", "c", "d"}) {
+		t.Fatalf("unexpected inactive clients: %v", result.Emails)
+	}
+	groups, err := svc.GetClientGroups()
+	if err != nil || len(groups) != 2 || groups[0].Name != "g1" || groups[0].Count != 1 || groups[1].Name != "idle" || groups[1].Count != 3 {
+		t.Fatalf("unexpected groups: %+v %v", groups, err)
+	}
+
+	run(BulkClientRequest{Action: BulkActionMove, Filter: ClientFilter{Emails: []string{"a", "b"}}, InboundId: dest.Id})
+	if moved := clients(dest); len(moved) != 3 || moved["a"].Group != "g1" || len(clients(source)) != 2 || getTestClientTraffic(t, "b").InboundId != dest.Id {
+		t.Fatalf("unexpected clients after move: %+v", moved)
+	}
+
+	// Emptying an inbound rolls the whole action back
+	if _, _, err := svc.RunBulkAction(&BulkClientRequest{Action: BulkActionDelete, Filter: ClientFilter{InboundId: dest.Id}}); err == nil {
+		t.Fatal("expected deleting every client of an inbound to fail")
+	}
+	getTestClientTraffic(t, "a")
+	run(BulkClientRequest{Action: BulkActionDelete, Filter: ClientFilter{InboundId: dest.Id, Group: "g1"}})
+	if remaining := clients(dest); len(remaining) != 2 || remaining["a"].Email != "" {
+		t.Fatalf("unexpected clients after delete: %+v", remaining)
+	}
+	var count int64
+	db.Model(xray.ClientTraffic{}).Where("email = ?", "a").Count(&count)
+	if count != 0 {
+		t.Fatal("expected the traffic of deleted clients to be removed")
+	}
+}
@@ -0,0 +1,318 @@
+package service
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/database"
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+	"github.com/mhsanaei/3x-ui/v2/logger"
+	"github.com/mhsanaei/3x-ui/v2/util/common"
+	"github.com/mhsanaei/3x-ui/v2/xray"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Resolutions of traffic history.
+const (
+	TrafficResolutionAuto  = "auto"
+	TrafficResolutionHour  = "hour"
+	TrafficResolutionDay   = "day"
+	TrafficResolutionMonth = "month"
+)
+
+// trafficMonthlyRetention is how long monthly traffic history is kept.
+const trafficMonthlyRetention = 5 * 365 * 24 * time.Hour
+
+// ClientTrafficHistoryService records client traffic in hourly buckets, rolls them up into daily
+// and monthly ones and answers usage queries over them.
+type ClientTrafficHistoryService struct {
+	settingService SettingService
+}
+
+// ClientTrafficHistory is the usage of one or more clients over a range at one resolution.
+type ClientTrafficHistory struct {
+	Email      string                       `json:"email,omitempty"`
+	SubId      string                       `json:"subId,omitempty"`
+	Resolution string                       `json:"resolution"`
+	From       int64                        `json:"from"`
+	To         int64                        `json:"to"`
+	Up         int64                        `json:"up"`   // Uploaded bytes over the whole range
+	Down       int64                        `json:"down"` // Downloaded bytes over the whole range
+	Points     []*model.ClientTrafficBucket `json:"points"`
+}
+
+// trafficHistoryTable is a table of traffic buckets and the columns identifying whose traffic they hold.
+type trafficHistoryTable struct {
+	name string
+	keys []string
+}
+
+var (
+	clientTrafficTable = trafficHistoryTable{name: "client_traffic_buckets", keys: []string{"email"}}
+	tagTrafficTable    = trafficHistoryTable{name: "traffic_buckets", keys: []string{"kind", "tag"}}
+)
+
+// trafficRollupQuery sums the buckets of one period into a single bucket of a coarser resolution.
+// It is formatted with the table name and its key columns. Periods are computed in Go, where the
+// panel time zone and its daylight saving changes are known.
+const trafficRollupQuery = `
+	SELECT %[2]s, ? AS resolution, ? AS bucket_start, SUM(up) AS up, SUM(down) AS down
+	FROM %[1]s
+	WHERE resolution = ? AND bucket_start >= ? AND bucket_start < ?
+	GROUP BY %[2]s`
+
+// RecordTraffic adds the traffic collected from Xray to the hourly buckets of its clients.
+func (s *ClientTrafficHistoryService) RecordTraffic(traffics []*xray.ClientTraffic, now time.Time) error {
+	bucketStart := now.Truncate(time.Hour).Unix()
+	buckets := make([]*model.ClientTrafficBucket, 0, len(traffics))
+	for _, traffic := range traffics {
+		if traffic.Email == "" || traffic.Up+traffic.Down <= 0 {
+			continue
+		}
+		buckets = append(buckets, &model.ClientTrafficBucket{
+			Email:       traffic.Email,
+			Resolution:  TrafficResolutionHour,
+			BucketStart: bucketStart,
+			Up:          traffic.Up,
+			Down:        traffic.Down,
+		})
+	}
+	return recordTrafficBuckets(clientTrafficTable, buckets)
+}
+
+// RollupTrafficHistory sums hourly client buckets into daily ones and daily buckets into monthly
+// ones, then deletes buckets past their retention. The latest two buckets of each resolution are
+// summed again on every run, so the current day and month stay up to date. Days and months start
+// at midnight in the panel time zone.
+func (s *ClientTrafficHistoryService) RollupTrafficHistory(now time.Time) error {
+	loc, err := s.settingService.GetTimeLocation()
+	if err != nil {
+		return err
+	}
+	return rollupTrafficTable[model.ClientTrafficBucket](clientTrafficTable, now.In(loc), trafficRetention(&s.settingService))
+}
+
+// recordTrafficBuckets adds hourly buckets to the ones already stored for the same hour.
+func recordTrafficBuckets[T any](table trafficHistoryTable, buckets []*T) error {
+	if len(buckets) == 0 {
+		return nil
+	}
+	return database.GetDB().Clauses(clause.OnConflict{
+		Columns: bucketColumns(table),
+		DoUpdates: clause.Assignments(map[string]any{
+			"up":   gorm.Expr(table.name + ".up + excluded.up"),
+			"down": gorm.Expr(table.name + ".down + excluded.down"),
+		}),
+	}).CreateInBatches(buckets, 500).Error
+}
+
+// trafficRetention returns how long buckets of each resolution are kept.
+func trafficRetention(settingService *SettingService) map[string]time.Duration {
+	hourlyDays, err := settingService.GetTrafficHourlyRetention()
+	if err != nil || hourlyDays < 2 {
+		hourlyDays = 7
+	}
+	dailyDays, err := settingService.GetTrafficDailyRetention()
+	if err != nil || dailyDays < 62 {
+		dailyDays = 180
+	}
+	return map[string]time.Duration{
+		TrafficResolutionHour:  time.Duration(hourlyDays) * 24 * time.Hour,
+		TrafficResolutionDay:   time.Duration(dailyDays) * 24 * time.Hour,
+		TrafficResolutionMonth: trafficMonthlyRetention,
+	}
+}
+
+// rollupTrafficTable rolls up the buckets of a table. Days and months are those of the location of now.
+func rollupTrafficTable[T any](table trafficHistoryTable, now time.Time, retention map[string]time.Duration) error {
+	loc := now.Location()
+	since, err := rollupStart(table, TrafficResolutionDay, TrafficResolutionHour)
+	if err != nil {
+		return err
+	}
+	if since > 0 {
+		start := time.Unix(since, 0).In(loc)
+		start = time.Date(start.Year(), start.Month(), start.Day()-1, 0, 0, 0, 0, loc)
+		err := rollupTrafficBuckets[T](table, TrafficResolutionDay, TrafficResolutionHour, start, now, func(t time.Time) time.Time {
+			return t.AddDate(0, 0, 1)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	since, err = rollupStart(table, TrafficResolutionMonth, TrafficResolutionDay)
+	if err != nil {
+		return err
+	}
+	if since > 0 {
+		start := time.Unix(since, 0).In(loc)
+		start = time.Date(start.Year(), start.Month()-1, 1, 0, 0, 0, 0, loc)
+		err := rollupTrafficBuckets[T](table, TrafficResolutionMonth, TrafficResolutionDay, start, now, func(t time.Time) time.Time {
+			return t.AddDate(0, 1, 0)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	// Retention is longer than the two buckets summed again above, so nothing is dropped
+	// before it has been rolled up
+	db := database.GetDB()
+	for resolution, maxAge := range retention {
+		err := db.Table(table.name).Where("resolution = ? AND bucket_start < ?", resolution, now.Add(-maxAge).Unix()).
+			Delete(new(T)).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rollupStart returns the start of the latest bucket of a resolution, or the oldest bucket of its
+// source resolution when it has none yet.
+func rollupStart(table trafficHistoryTable, resolution, source string) (int64, error) {
+	db := database.GetDB()
+	var start *int64
+	err := db.Table(table.name).Where("resolution = ?", resolution).Select("MAX(bucket_start)").Scan(&start).Error
+	if err != nil {
+		return 0, err
+	}
+	if start != nil {
+		return *start, nil
+	}
+	err = db.Table(table.name).Where("resolution = ?", source).Select("MIN(bucket_start)").Scan(&start).Error
+	if err != nil || start == nil {
+		return 0, err
+	}
+	return *start, nil
+}
+
+// rollupTrafficBuckets sums source buckets into buckets of resolution for every period from start
+// up to the one holding now. next returns the start of the period following the one starting at t.
+func rollupTrafficBuckets[T any](table trafficHistoryTable, resolution, source string, start, now time.Time, next func(t time.Time) time.Time) error {
+	db := database.GetDB()
+	query := fmt.Sprintf(trafficRollupQuery, table.name, strings.Join(table.keys, ", "))
+	var rows []*T
+	for ; !start.After(now); start = next(start) {
+		var period []*T
+		err := db.Raw(query, resolution, start.Unix(), source, start.Unix(), next(start).Unix()).Scan(&period).Error
+		if err != nil {
+			return err
+		}
+		rows = append(rows, period...)
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+	err := db.Clauses(clause.OnConflict{
+		Columns:   bucketColumns(table),
+		DoUpdates: clause.AssignmentColumns([]string{"up", "down"}),
+	}).CreateInBatches(rows, 500).Error
+	if err != nil {
+		return err
+	}
+	logger.Debugf("Rolled up %d bucket(s) of %s", len(rows), table.name)
+	return nil
+}
+
+// bucketColumns returns the columns of the unique index of a bucket table.
+func bucketColumns(table trafficHistoryTable) []clause.Column {
+	columns := make([]clause.Column, 0, len(table.keys)+2)
+	for _, name := range slices.Concat(table.keys, []string{"resolution", "bucket_start"}) {
+		columns = append(columns, clause.Column{Name: name})
+	}
+	return columns
+}
+
+// GetTrafficHistory returns the usage of a client between from and to (unix seconds).
+// The auto resolution picks hourly buckets for ranges up to two days within the hourly
+// retention, daily buckets up to three months and monthly buckets beyond.
+func (s *ClientTrafficHistoryService) GetTrafficHistory(email string, from, to int64, resolution string) (*ClientTrafficHistory, error) {
+	history, err := s.getHistory([]string{email}, from, to, resolution)
+	if err != nil {
+		return nil, err
+	}
+	history.Email = email
+	return history, nil
+}
+
+// GetSubTrafficHistory returns the combined usage of the clients of a subscription between
+// from and to (unix seconds), resolved like GetTrafficHistory.
+func (s *ClientTrafficHistoryService) GetSubTrafficHistory(subId string, from, to int64, resolution string) (*ClientTrafficHistory, error) {
+	var emails []string
+	err := database.GetDB().Raw(`
+		SELECT DISTINCT JSON_EXTRACT(client.value, '$.email')
+		FROM inbounds, JSON_EACH(JSON_EXTRACT(inbounds.settings, '$.clients')) AS client
+		WHERE JSON_EXTRACT(client.value, '$.subId') = ?`, subId).Scan(&emails).Error
+	if err != nil {
+		return nil, err
+	}
+	history, err := s.getHistory(emails, from, to, resolution)
+	if err != nil {
+		return nil, err
+	}
+	history.SubId = subId
+	return history, nil
+}
+
+func (s *ClientTrafficHistoryService) getHistory(emails []string, from, to int64, resolution string) (*ClientTrafficHistory, error) {
+	if to <= 0 {
+		to = time.Now().Unix()
+	}
+	if from <= 0 {
+		from = to - 24*3600
+	}
+	if from >= to {
+		return nil, common.NewError("range start must be before its end")
+	}
+	switch resolution {
+	case "", TrafficResolutionAuto:
+		resolution = s.autoResolution(from, to)
+	case TrafficResolutionHour, TrafficResolutionDay, TrafficResolutionMonth:
+	default:
+		return nil, common.NewError("unknown resolution:", resolution)
+	}
+
+	history := &ClientTrafficHistory{Resolution: resolution, From: from, To: to, Points: []*model.ClientTrafficBucket{}}
+	if len(emails) == 0 {
+		return history, nil
+	}
+	err := database.GetDB().Model(&model.ClientTrafficBucket{}).
+		Select("bucket_start, SUM(up) AS up, SUM(down) AS down").
+		Where("email IN ? AND resolution = ? AND bucket_start >= ? AND bucket_start < ?", emails, resolution, from, to).
+		Group("bucket_start").Order("bucket_start asc").Scan(&history.Points).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, point := range history.Points {
+		point.Resolution = resolution
+		if len(emails) == 1 {
+			point.Email = emails[0]
+		}
+		history.Up += point.Up
+		history.Down += point.Down
+	}
+	return history, nil
+}
+
+func (s *ClientTrafficHistoryService) autoResolution(from, to int64) string {
+	hourlyDays, err := s.settingService.GetTrafficHourlyRetention()
+	if err != nil {
+		hourlyDays = 7
+	}
+	span := time.Duration(to-from) * time.Second
+	hourlySince := time.Now().Add(-time.Duration(hourlyDays) * 24 * time.Hour).Unix()
+	switch {
+	case span <= 48*time.Hour && from >= hourlySince:
+		return TrafficResolutionHour
+	case span <= 92*24*time.Hour:
+		return TrafficResolutionDay
+	default:
+		return TrafficResolutionMonth
+	}
+}
@@ -0,0 +1,148 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/database"
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+	"github.com/mhsanaei/3x-ui/v2/xray"
+)
+
+func TestClientTrafficHistory(t *testing.T) {
+	setupServiceTestDB(t)
+	setupTestLogger(t)
+	svc := &ClientTrafficHistoryService{}
+	db := database.GetDB()
+	// Days below are UTC days
+	if err := (&SettingService{}).saveSetting("timeLocation", "UTC"); err != nil {
+		t.Fatalf("saveSetting failed: %v", err)
+	}
+
+	inbound := &model.Inbound{
+		Tag:      "inbound-history",
+		Port:     20001,
+		Protocol: model.VLESS,
+		Settings: `{"clients":[{"email":"a","subId":"sub1"},{"email":"b","subId":"sub1"}]}`,
+	}
+	createTestInbounds(t, inbound)
+
+	now := time.Now().UTC()
+	day := now.Truncate(24*time.Hour).AddDate(0, 0, -3)
+	record := func(at time.Time, email string, up, down int64) {
+		t.Helper()
+		err := svc.RecordTraffic([]*xray.ClientTraffic{{Email: email, Up: up, Down: down}, {Email: "idle"}}, at)
+		if err != nil {
+			t.Fatalf("RecordTraffic failed: %v", err)
+		}
+	}
+	// Samples of the same hour add up, the one of ten days ago outlives its hourly retention
+	record(day.Add(10*time.Hour), "a", 100, 1000)
+	record(day.Add(10*time.Hour+30*time.Minute), "a", 50, 500)
+	record(day.Add(11*time.Hour), "a", 10, 10)
+	record(day.Add(24*time.Hour+5*time.Hour), "b", 1, 2)
+	record(day.AddDate(0, 0, -7), "a", 7, 7)
+
+	for i := 0; i < 2; i++ {
+		if err := svc.RollupTrafficHistory(now); err != nil {
+			t.Fatalf("RollupTrafficHistory failed: %v", err)
+		}
+	}
+
+	hourly, err := svc.GetTrafficHistory("a", day.Unix(), day.Add(24*time.Hour).Unix(), TrafficResolutionHour)
+	if err != nil {
+		t.Fatalf("GetTrafficHistory failed: %v", err)
+	}
+	if len(hourly.Points) != 2 || hourly.Points[0].Up != 150 || hourly.Points[0].Down != 1500 {
+		t.Fatalf("unexpected hourly history: %+v", hourly.Points)
+	}
+	if hourly.Up != 160 || hourly.Down != 1510 {
+		t.Fatalf("unexpected hourly totals: %d %d", hourly.Up, hourly.Down)
+	}
+
+	daily, err := svc.GetSubTrafficHistory("sub1", day.AddDate(0, 0, -30).Unix(), now.Unix(), TrafficResolutionDay)
+	if err != nil {
+		t.Fatalf("GetSubTrafficHistory failed: %v", err)
+	}
+	if len(daily.Points) != 3 || daily.Points[1].Up != 160 || daily.Points[2].Down != 2 {
+		t.Fatalf("unexpected daily history: %+v", daily.Points)
+	}
+	if daily.Up != 168 || daily.Down != 1519 {
+		t.Fatalf("unexpected daily totals: %d %d", daily.Up, daily.Down)
+	}
+
+	monthly, err := svc.GetSubTrafficHistory("sub1", now.AddDate(-1, 0, 0).Unix(), now.Unix(), "")
+	if err != nil {
+		t.Fatalf("GetSubTrafficHistory failed: %v", err)
+	}
+	if monthly.Resolution != TrafficResolutionMonth || monthly.Up != 168 || monthly.Down != 1519 {
+		t.Fatalf("unexpected monthly history: %s %d %d", monthly.Resolution, monthly.Up, monthly.Down)
+	}
+
+	var expired int64
+	db.Model(&model.ClientTrafficBucket{}).Where("resolution = ? AND bucket_start < ?", TrafficResolutionHour, day.AddDate(0, 0, -5).Unix()).Count(&expired)
+	if expired != 0 {
+		t.Fatalf("expected hourly buckets past their retention to be pruned, got %d", expired)
+	}
+	if _, err := svc.GetTrafficHistory("a", now.Unix(), day.Unix(), ""); err == nil {
+		t.Fatalf("expected an inverted range to be rejected")
+	}
+
+	// History follows renamed clients and goes with deleted ones
+	inboundSvc := &InboundService{}
+	if err := inboundSvc.UpdateClientStat(db, "b", &model.Client{Email: "c"}); err != nil {
+		t.Fatalf("UpdateClientStat failed: %v", err)
+	}
+	if history, _ := svc.GetTrafficHistory("c", day.Unix(), now.Unix(), TrafficResolutionDay); history.Up != 1 {
+		t.Fatalf("expected the history of b to move to c, got %+v", history.Points)
+	}
+	if err := inboundSvc.DelClientStat(db, "a"); err != nil {
+		t.Fatalf("DelClientStat failed: %v", err)
+	}
+	var left int64
+	db.Model(&model.ClientTrafficBucket{}).Where("email = ?", "a").Count(&left)
+	if left != 0 {
+		t.Fatalf("expected the history of a to be deleted, got %d buckets", left)
+	}
+}
+
+func TestClientTrafficHistoryTimeLocation(t *testing.T) {
+	setupServiceTestDB(t)
+	setupTestLogger(t)
+	svc := &ClientTrafficHistoryService{}
+	if err := (&SettingService{}).saveSetting("timeLocation", "Asia/Tokyo"); err != nil {
+		t.Fatalf("saveSetting failed: %v", err)
+	}
+	loc, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Skipf("time zone data is not available: %v", err)
+	}
+
+	// Both samples fall on the same Tokyo day but on different UTC days
+	now := time.Now().In(loc)
+	day := time.Date(now.Year(), now.Month(), now.Day()-1, 0, 0, 0, 0, loc)
+	for _, at := range []time.Time{day.Add(time.Hour), day.Add(23 * time.Hour)} {
+		if err := svc.RecordTraffic([]*xray.ClientTraffic{{Email: "a", Up: 1, Down: 2}}, at); err != nil {
+			t.Fatalf("RecordTraffic failed: %v", err)
+		}
+	}
+	if err := svc.RollupTrafficHistory(now); err != nil {
+		t.Fatalf("RollupTrafficHistory failed: %v", err)
+	}
+
+	daily, err := svc.GetTrafficHistory("a", day.AddDate(0, 0, -1).Unix(), now.Unix(), TrafficResolutionDay)
+	if err != nil {
+		t.Fatalf("GetTrafficHistory failed: %v", err)
+	}
+	if len(daily.Points) != 1 || daily.Points[0].BucketStart != day.Unix() || daily.Points[0].Up != 2 {
+		t.Fatalf("expected one daily bucket starting at Tokyo midnight, got %+v", daily.Points)
+	}
+	monthly, err := svc.GetTrafficHistory("a", day.AddDate(0, -1, 0).Unix(), now.Unix(), TrafficResolutionMonth)
+	if err != nil {
+		t.Fatalf("GetTrafficHistory failed: %v", err)
+	}
+	month := time.Date(day.Year(), day.Month(), 1, 0, 0, 0, 0, loc)
+	if len(monthly.Points) != 1 || monthly.Points[0].BucketStart != month.Unix() || monthly.Points[0].Down != 4 {
+		t.Fatalf("expected one monthly bucket starting on the first of the Tokyo month, got %+v", monthly.Points)
+	}
+}
@@ -0,0 +1,239 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/database"
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+	"github.com/mhsanaei/3x-ui/v2/logger"
+	"github.com/mhsanaei/3x-ui/v2/util/common"
+	"github.com/mhsanaei/3x-ui/v2/xray"
+
+	"github.com/robfig/cron/v3"
+	"gorm.io/gorm"
+)
+
+// Client traffic reset schedules.
+const (
+	ResetScheduleDaily   = "daily"
+	ResetScheduleWeekly  = "weekly"
+	ResetScheduleMonthly = "monthly"
+	ResetScheduleCron    = "cron"
+)
+
+// ClientTrafficResetService resets the traffic counters of clients on their own schedules,
+// independently of the periodic reset of their inbound.
+type ClientTrafficResetService struct {
+	settingService SettingService
+	xrayApi        xray.XrayAPI
+}
+
+// monthlySchedule fires at midnight on a day of every month, or on the last day of months
+// shorter than that.
+type monthlySchedule struct {
+	day int
+	loc *time.Location
+}
+
+// Next returns the first billing day midnight after t.
+func (m monthlySchedule) Next(t time.Time) time.Time {
+	t = t.In(m.loc)
+	for i := 0; ; i++ {
+		first := time.Date(t.Year(), t.Month()+time.Month(i), 1, 0, 0, 0, 0, m.loc)
+		daysInMonth := first.AddDate(0, 1, -1).Day()
+		next := first.AddDate(0, 0, min(m.day, daysInMonth)-1)
+		if next.After(t) {
+			return next
+		}
+	}
+}
+
+// CheckResetSchedule validates the traffic reset schedule of a client.
+func CheckResetSchedule(client *model.Client) error {
+	_, _, err := clientResetSchedule(client, time.UTC)
+	return err
+}
+
+// clientResetSchedule returns the reset schedule of a client in the panel time location and a
+// normalized spec of it. Monthly resets without a billing day fall on the day the client was
+// created. A client without a schedule gets a nil schedule.
+func clientResetSchedule(client *model.Client, loc *time.Location) (cron.Schedule, string, error) {
+	switch client.ResetSchedule {
+	case "":
+		return nil, "", nil
+	case ResetScheduleDaily:
+		schedule, err := cron.ParseStandard("CRON_TZ=" + loc.String() + " 0 0 * * *")
+		return schedule, ResetScheduleDaily, err
+	case ResetScheduleWeekly:
+		if client.ResetDay < 0 || client.ResetDay > 6 {
+			return nil, "", common.NewError("reset weekday must be between 0 and 6:", client.ResetDay)
+		}
+		schedule, err := cron.ParseStandard(fmt.Sprintf("CRON_TZ=%s 0 0 * * %d", loc.String(), client.ResetDay))
+		return schedule, ResetScheduleWeekly + ":" + strconv.Itoa(client.ResetDay), err
+	case ResetScheduleMonthly:
+		if client.ResetDay < 0 || client.ResetDay > 31 {
+			return nil, "", common.NewError("reset day of month must be between 0 and 31:", client.ResetDay)
+		}
+		day := client.ResetDay
+		if day == 0 {
+			day = 1
+			if client.CreatedAt > 0 {
+				day = time.UnixMilli(client.CreatedAt).In(loc).Day()
+			}
+		}
+		return monthlySchedule{day: day, loc: loc}, ResetScheduleMonthly + ":" + strconv.Itoa(day), nil
+	case ResetScheduleCron:
+		schedule, err := cron.ParseStandard("CRON_TZ=" + loc.String() + " " + client.ResetCron)
+		if err != nil {
+			return nil, "", common.NewErrorf("invalid reset cron %q: %v", client.ResetCron, err)
+		}
+		return schedule, ResetScheduleCron + ":" + client.ResetCron, nil
+	default:
+		return nil, "", common.NewError("unknown reset schedule:", client.ResetSchedule)
+	}
+}
+
+// resetQueryBatch bounds the number of emails looked up at once, below the SQLite variable limit.
+const resetQueryBatch = 500
+
+// scheduledClient is a client with a reset schedule and the inbound it belongs to.
+type scheduledClient struct {
+	inbound  *model.Inbound
+	client   model.Client
+	schedule cron.Schedule
+	spec     string
+}
+
+// ResetScheduledClientTraffics resets the up and down counters of clients whose reset is due,
+// keeping their all-time traffic, and re-enables clients that were disabled for running out of
+// traffic unless they have expired. The next reset is computed again whenever a client's schedule changes. It returns
+// whether Xray needs a restart and how many clients were reset.
+func (s *ClientTrafficResetService) ResetScheduledClientTraffics(now time.Time) (bool, int, error) {
+	loc, err := s.settingService.GetTimeLocation()
+	if err != nil {
+		return false, 0, err
+	}
+
+	db := database.GetDB()
+	var inbounds []*model.Inbound
+	if err := db.Model(model.Inbound{}).Find(&inbounds).Error; err != nil {
+		return false, 0, err
+	}
+	inboundService := InboundService{}
+	scheduled := map[string]*scheduledClient{}
+	for _, inbound := range inbounds {
+		clients, err := inboundService.GetClients(inbound)
+		if err != nil {
+			continue
+		}
+		for _, client := range clients {
+			schedule, spec, err := clientResetSchedule(&client, loc)
+			if err != nil {
+				logger.Warning("Invalid traffic reset schedule of client", client.Email, ":", err)
+				continue
+			}
+			if schedule == nil || client.Email == "" {
+				continue
+			}
+			scheduled[client.Email] = &scheduledClient{inbound: inbound, client: client, schedule: schedule, spec: spec}
+		}
+	}
+
+	// Clients that had a schedule at the last run, then the ones whose schedule is new
+	var traffics []*xray.ClientTraffic
+	if err := db.Model(xray.ClientTraffic{}).Where("reset_spec <> ''").Find(&traffics).Error; err != nil {
+		return false, 0, err
+	}
+	known := make(map[string]bool, len(traffics))
+	for _, traffic := range traffics {
+		known[traffic.Email] = true
+	}
+	var emails []string
+	for email := range scheduled {
+		if !known[email] {
+			emails = append(emails, email)
+		}
+	}
+	for batch := range slices.Chunk(emails, resetQueryBatch) {
+		var added []*xray.ClientTraffic
+		if err := db.Model(xray.ClientTraffic{}).Where("email IN ?", batch).Find(&added).Error; err != nil {
+			return false, 0, err
+		}
+		traffics = append(traffics, added...)
+	}
+
+	nowMs := now.UnixMilli()
+	resetCount := 0
+	var clientsToAdd []*scheduledClient
+	err = db.Transaction(func(tx *gorm.DB) error {
+		for _, traffic := range traffics {
+			// The counters read above may be stale by now, so only the columns a case owns are written
+			var updates map[string]any
+			entry, ok := scheduled[traffic.Email]
+			switch {
+			case !ok:
+				// The schedule was removed
+				updates = map[string]any{"reset_spec": "", "next_traffic_reset": 0}
+			case traffic.ResetSpec != entry.spec || traffic.NextTrafficReset <= 0:
+				updates = map[string]any{"reset_spec": entry.spec, "next_traffic_reset": entry.schedule.Next(now).UnixMilli()}
+			case nowMs >= traffic.NextTrafficReset:
+				updates = map[string]any{
+					"up":                 0,
+					"down":               0,
+					"last_traffic_reset": nowMs,
+					"next_traffic_reset": entry.schedule.Next(now).UnixMilli(),
+				}
+				// Clients that expired stay disabled, disableInvalidClients would only take them out again
+				expired := traffic.ExpiryTime > 0 && traffic.ExpiryTime <= nowMs
+				if !traffic.Enable && entry.client.Enable && !expired {
+					updates["enable"] = true
+					clientsToAdd = append(clientsToAdd, entry)
+				}
+				resetCount++
+			default:
+				continue
+			}
+			if err := tx.Model(xray.ClientTraffic{}).Where("id = ?", traffic.Id).Updates(updates).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return false, 0, err
+	}
+
+	needRestart := false
+	if p != nil && len(clientsToAdd) > 0 {
+		if err := s.xrayApi.Init(p.GetAPIPort()); err != nil {
+			return true, resetCount, nil
+		}
+		for _, entry := range clientsToAdd {
+			cipher := ""
+			if entry.inbound.Protocol == model.Shadowsocks {
+				var settings map[string]any
+				if err := json.Unmarshal([]byte(entry.inbound.Settings), &settings); err == nil {
+					cipher, _ = settings["method"].(string)
+				}
+			}
+			err := s.xrayApi.AddUser(string(entry.inbound.Protocol), entry.inbound.Tag, map[string]any{
+				"email":    entry.client.Email,
+				"id":       entry.client.ID,
+				"security": entry.client.Security,
+				"flow":     entry.client.Flow,
+				"password": entry.client.Password,
+				"cipher":   cipher,
+			})
+			if err != nil {
+				logger.Debug("Error in enabling client by api:", err)
+				needRestart = true
+			}
+		}
+		s.xrayApi.Close()
+	}
+	return needRestart, resetCount, nil
+}
@@ -0,0 +1,124 @@
+package service
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/database"
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+	"github.com/mhsanaei/3x-ui/v2/xray"
+)
+
+func TestClientTrafficResetSchedules(t *testing.T) {
+	setupServiceTestDB(t)
+	setupTestLogger(t)
+	svc := &ClientTrafficResetService{}
+	db := database.GetDB()
+
+	// Billing days past the end of a month fall on its last day
+	monthly := monthlySchedule{day: 31, loc: time.UTC}
+	if next := monthly.Next(time.Date(2026, 2, 10, 12, 0, 0, 0, time.UTC)); !next.Equal(time.Date(2026, 2, 28, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("unexpected monthly reset in February: %v", next)
+	}
+	if next := monthly.Next(time.Date(2026, 2, 28, 0, 0, 0, 0, time.UTC)); !next.Equal(time.Date(2026, 3, 31, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("unexpected monthly reset after February: %v", next)
+	}
+	for _, client := range []model.Client{
+		{ResetSchedule: "yearly"},
+		{ResetSchedule: ResetScheduleWeekly, ResetDay: 7},
+		{ResetSchedule: ResetScheduleMonthly, ResetDay: 32},
+		{ResetSchedule: ResetScheduleCron, ResetCron: "every minute"},
+	} {
+		if err := CheckResetSchedule(&client); err == nil {
+			t.Fatalf("expected schedule %+v to be rejected", client)
+		}
+	}
+
+	loc, err := svc.settingService.GetTimeLocation()
+	if err != nil {
+		t.Fatalf("GetTimeLocation failed: %v", err)
+	}
+	createdAt := time.Date(2026, 1, 15, 12, 0, 0, 0, loc).UnixMilli()
+	clients := func(scheduleA string) string {
+		return fmt.Sprintf(`{"clients":[
+			{"email":"a","enable":true,"resetSchedule":%q,"created_at":%d},
+			{"email":"b","enable":true,"resetSchedule":"cron","resetCron":"*/5 * * * *"},
+			{"email":"c","enable":true},
+			{"email":"d","enable":true,"resetSchedule":"monthly","created_at":%d}]}`, scheduleA, createdAt, createdAt)
+	}
+	inbound := &model.Inbound{Tag: "inbound-reset", Port: 20003, Protocol: model.VLESS, Settings: clients(ResetScheduleMonthly)}
+	createTestInbounds(t, inbound)
+	createTestClientTraffics(t,
+		&xray.ClientTraffic{InboundId: inbound.Id, Email: "a", Up: 10, Down: 20, AllTime: 100},
+		&xray.ClientTraffic{InboundId: inbound.Id, Email: "b", Enable: true, Up: 1, Down: 1, AllTime: 2},
+		&xray.ClientTraffic{InboundId: inbound.Id, Email: "c", Enable: true, Up: 5, Down: 5, AllTime: 10},
+		&xray.ClientTraffic{InboundId: inbound.Id, Email: "d", Up: 10, Down: 20, AllTime: 100, ExpiryTime: time.Now().Add(-time.Hour).UnixMilli()},
+	)
+
+	// The first run only schedules the next resets
+	now := time.Now()
+	if _, count, err := svc.ResetScheduledClientTraffics(now); err != nil || count != 0 {
+		t.Fatalf("unexpected first run: %d %v", count, err)
+	}
+	a := getTestClientTraffic(t, "a")
+	next := time.UnixMilli(a.NextTrafficReset).In(loc)
+	if a.ResetSpec != "monthly:15" || next.Day() != 15 || !next.After(now) || a.Up != 10 {
+		t.Fatalf("unexpected scheduled client: %+v", a)
+	}
+
+	resetAt := next.Add(time.Minute)
+	if _, count, err := svc.ResetScheduledClientTraffics(resetAt); err != nil || count != 3 {
+		t.Fatalf("unexpected reset run: %d %v", count, err)
+	}
+	a = getTestClientTraffic(t, "a")
+	if a.Up != 0 || a.Down != 0 || a.AllTime != 100 || !a.Enable {
+		t.Fatalf("unexpected reset client: %+v", a)
+	}
+	if a.LastTrafficReset != resetAt.UnixMilli() || a.NextTrafficReset != next.AddDate(0, 1, 0).UnixMilli() {
+		t.Fatalf("unexpected reset times: %+v", a)
+	}
+	if c := getTestClientTraffic(t, "c"); c.Up != 5 || c.LastTrafficReset != 0 {
+		t.Fatalf("unscheduled client was reset: %+v", c)
+	}
+	if d := getTestClientTraffic(t, "d"); d.Up != 0 || d.LastTrafficReset != resetAt.UnixMilli() || d.Enable {
+		t.Fatalf("expected the expired client to be reset and stay disabled: %+v", d)
+	}
+
+	// Dropping a schedule clears the next reset
+	if err := db.Model(inbound).Update("settings", clients("")).Error; err != nil {
+		t.Fatalf("failed to update inbound: %v", err)
+	}
+	if _, _, err := svc.ResetScheduledClientTraffics(resetAt); err != nil {
+		t.Fatalf("ResetScheduledClientTraffics failed: %v", err)
+	}
+	if a = getTestClientTraffic(t, "a"); a.ResetSpec != "" || a.NextTrafficReset != 0 || a.LastTrafficReset != resetAt.UnixMilli() {
+		t.Fatalf("unexpected unscheduled client: %+v", a)
+	}
+
+	// More scheduled clients than SQLite accepts variables in one query
+	const many = 33000
+	manyClients := make([]string, 0, many)
+	manyTraffics := make([]*xray.ClientTraffic, 0, many)
+	for i := range many {
+		email := fmt.Sprintf("many-%d", i)
+		manyClients = append(manyClients, fmt.Sprintf(`{"email":%q,"enable":true,"resetSchedule":"daily"}`, email))
+		manyTraffics = append(manyTraffics, &xray.ClientTraffic{Email: email, Enable: true})
+	}
+	manyInbound := &model.Inbound{Tag: "inbound-reset-many", Port: 20004, Protocol: model.VLESS,
+		Settings: `{"clients":[` + strings.Join(manyClients, ",") + `]}`}
+	createTestInbounds(t, manyInbound)
+	for _, traffic := range manyTraffics {
+		traffic.InboundId = manyInbound.Id
+	}
+	createTestClientTraffics(t, manyTraffics...)
+	if _, _, err := svc.ResetScheduledClientTraffics(resetAt); err != nil {
+		t.Fatalf("ResetScheduledClientTraffics failed: %v", err)
+	}
+	var scheduled int64
+	db.Model(xray.ClientTraffic{}).Where("reset_spec = ?", ResetScheduleDaily).Count(&scheduled)
+	if scheduled != many {
+		t.Fatalf("expected %d scheduled clients, got %d", many, scheduled)
+	}
+}
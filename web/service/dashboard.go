@@ -2,6 +2,7 @@
 package service
 
 import (
+	"context"
 	"time"
 
 	"github.com/mhsanaei/3x-ui/v2/database/model"
@@ -35,9 +36,17 @@ type DashboardData struct {
 	AggregatedStats AggregatedStats    `json:"aggregatedStats"`
 	Nodes           []*model.Node      `json:"nodes"`
 	NodesStats      []*model.NodeStats `json:"nodesStats"`
+	NodesUptime     []*NodeUptime      `json:"nodesUptime"`
+	PollStates      []NodePollState    `json:"pollStates"`
 	LastUpdate      int64              `json:"lastUpdate"`
 }
 
+// NodeMapEntry is a node shown on the map together with its availability over the last 24 hours.
+type NodeMapEntry struct {
+	*model.Node
+	Uptime *NodeUptimeWindow `json:"uptime"`
+}
+
 // DashboardService provides business logic for dashboard data aggregation.
 type DashboardService struct {
 	nodeService NodeService
@@ -155,58 +164,68 @@ func (s *DashboardService) GetDashboardData() (*DashboardData, error) {
 		return nil, err
 	}
 
+	uptime, err := nodeService.GetAllNodesUptime([]string{"24h", "7d"}, false)
+	if err != nil {
+		uptime = []*NodeUptime{}
+	}
+
 	return &DashboardData{
 		AggregatedStats: *aggregatedStats,
 		Nodes:           nodes,
 		NodesStats:      stats,
+		NodesUptime:     uptime,
+		PollStates:      nodeService.GetNodePollStates(),
 		LastUpdate:      time.Now().Unix(),
 	}, nil
 }
 
-// GetNodesForMap retrieves nodes with coordinates for map display.
-func (s *DashboardService) GetNodesForMap() ([]*model.Node, error) {
+// GetNodesForMap retrieves nodes with coordinates for map display, each with its 24h availability.
+func (s *DashboardService) GetNodesForMap() ([]*NodeMapEntry, error) {
 	nodeService := NodeService{}
-	return nodeService.GetNodesWithCoordinates()
+	nodes, err := nodeService.GetNodesWithCoordinates()
+	if err != nil {
+		return nil, err
+	}
+	rolledUntil, err := nextUptimeRollupHour()
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]*NodeMapEntry, 0, len(nodes))
+	for _, node := range nodes {
+		entry := &NodeMapEntry{Node: node}
+		if report, err := nodeService.nodeUptime(node, []string{"24h"}, false, rolledUntil); err == nil {
+			entry.Uptime = report.Window("24h")
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
 }
 
-// SyncAllNodesStats synchronizes statistics from all enabled nodes.
-func (s *DashboardService) SyncAllNodesStats() error {
+// SyncAllNodesStats synchronizes statistics from all enabled nodes in parallel.
+// Nodes backing off after failed status checks are skipped unless force is set.
+func (s *DashboardService) SyncAllNodesStats(ctx context.Context, force bool) error {
 	nodeService := NodeService{}
 	nodes, err := nodeService.GetEnabledNodes()
 	if err != nil {
 		return err
 	}
 
-	var lastError error
-	for _, node := range nodes {
-		err := nodeService.SyncNodeStats(node.Id)
-		if err != nil {
-			lastError = err
-			// Continue syncing other nodes even if one fails
-			continue
-		}
-	}
-
-	return lastError
+	return pollNodes(ctx, nodes, force, func(ctx context.Context, node *model.Node) error {
+		return nodeService.SyncNodeStats(ctx, node.Id)
+	})
 }
 
-// CheckAllNodesStatus checks the status of all enabled nodes.
-func (s *DashboardService) CheckAllNodesStatus() error {
+// CheckAllNodesStatus checks the status of all enabled nodes in parallel.
+// Nodes backing off after failed checks are skipped unless force is set.
+func (s *DashboardService) CheckAllNodesStatus(ctx context.Context, force bool) error {
 	nodeService := NodeService{}
 	nodes, err := nodeService.GetEnabledNodes()
 	if err != nil {
 		return err
 	}
 
-	var lastError error
-	for _, node := range nodes {
-		_, err := nodeService.CheckNodeStatus(node)
-		if err != nil {
-			lastError = err
-			// Continue checking other nodes even if one fails
-			continue
-		}
-	}
-
-	return lastError
+	return pollNodes(ctx, nodes, force, func(ctx context.Context, node *model.Node) error {
+		_, err := nodeService.CheckNodeStatus(ctx, node)
+		return err
+	})
 }
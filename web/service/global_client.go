@@ -0,0 +1,372 @@
+package service
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/database"
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+	"github.com/mhsanaei/3x-ui/v2/logger"
+	"github.com/mhsanaei/3x-ui/v2/util/common"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Provisioning actions reported for a global client on a node.
+const (
+	ProvisionCreated = "created"
+	ProvisionUpdated = "updated"
+	ProvisionDeleted = "deleted"
+	ProvisionSkipped = "skipped"
+)
+
+// NodeProvisionResult describes what happened to a global client on one node.
+type NodeProvisionResult struct {
+	NodeId    int    `json:"nodeId"`
+	NodeName  string `json:"nodeName"`
+	InboundId int    `json:"inboundId"`
+	Action    string `json:"action"`
+	Error     string `json:"error,omitempty"`
+}
+
+// GlobalClientService manages client identities that are provisioned on every node of a multi-subscription.
+type GlobalClientService struct {
+	nodeService NodeService
+}
+
+// GetGlobalClient returns the global client attached to a multi-subscription.
+func (s *GlobalClientService) GetGlobalClient(multiSubId int) (*model.GlobalClient, error) {
+	db := database.GetDB()
+	var gc model.GlobalClient
+	err := db.Where("multi_sub_id = ?", multiSubId).First(&gc).Error
+	if err != nil {
+		return nil, err
+	}
+	return &gc, nil
+}
+
+// GetNodeInbounds parses the node to inbound mapping of a global client.
+func (s *GlobalClientService) GetNodeInbounds(gc *model.GlobalClient) (map[int]int, error) {
+	result := map[int]int{}
+	if gc.NodeInbounds == "" {
+		return result, nil
+	}
+	var raw map[string]int
+	if err := json.Unmarshal([]byte(gc.NodeInbounds), &raw); err != nil {
+		return nil, common.NewError("invalid nodeInbounds JSON format")
+	}
+	for key, inboundId := range raw {
+		nodeId, err := strconv.Atoi(key)
+		if err != nil || nodeId <= 0 || inboundId <= 0 {
+			return nil, common.NewError("invalid nodeInbounds JSON format")
+		}
+		result[nodeId] = inboundId
+	}
+	return result, nil
+}
+
+// SaveGlobalClient creates or updates the global client of a multi-subscription and
+// provisions it on every mapped node. Nodes dropped from the mapping lose the client.
+func (s *GlobalClientService) SaveGlobalClient(gc *model.GlobalClient) ([]NodeProvisionResult, error) {
+	db := database.GetDB()
+
+	if gc.Email == "" {
+		return nil, common.NewError("client email is required")
+	}
+	var ms model.MultiSubscription
+	if err := db.First(&ms, gc.MultiSubId).Error; err != nil {
+		return nil, common.NewErrorf("multi-subscription with id %d does not exist", gc.MultiSubId)
+	}
+	mapping, err := s.GetNodeInbounds(gc)
+	if err != nil {
+		return nil, err
+	}
+	multiSubService := MultiSubscriptionService{}
+	nodeIds, err := multiSubService.GetNodeIds(&ms)
+	if err != nil {
+		return nil, err
+	}
+	listed := make(map[int]bool, len(nodeIds))
+	for _, nodeId := range nodeIds {
+		listed[nodeId] = true
+	}
+	for nodeId := range mapping {
+		if !listed[nodeId] {
+			return nil, common.NewErrorf("node with id %d is not part of the multi-subscription", nodeId)
+		}
+	}
+
+	var count int64
+	err = db.Model(&model.GlobalClient{}).Where("email = ? AND multi_sub_id <> ?", gc.Email, gc.MultiSubId).Count(&count).Error
+	if err != nil {
+		return nil, err
+	}
+	if count > 0 {
+		return nil, common.NewError("Duplicate email:", gc.Email)
+	}
+
+	if gc.UUID == "" {
+		gc.UUID = uuid.NewString()
+	}
+	if gc.Password == "" {
+		// A base64 key of 32 bytes also serves Shadowsocks 2022 ciphers, which need one
+		gc.Password = randomClientKey()
+	}
+
+	var results []NodeProvisionResult
+	existing, err := s.GetGlobalClient(gc.MultiSubId)
+	switch {
+	case err == nil:
+		gc.Id = existing.Id
+		gc.CreatedAt = existing.CreatedAt
+		gc.Up = existing.Up
+		gc.Down = existing.Down
+		// Remove the old identity from nodes and inbounds that are no longer mapped
+		oldMapping, _ := s.GetNodeInbounds(existing)
+		for _, nodeId := range sortedNodeIds(oldMapping) {
+			if mapping[nodeId] == oldMapping[nodeId] {
+				continue
+			}
+			results = append(results, s.removeFromNode(nodeId, oldMapping[nodeId], existing))
+		}
+	case err == gorm.ErrRecordNotFound:
+		gc.Id = 0
+		gc.Up = 0
+		gc.Down = 0
+	default:
+		return nil, err
+	}
+	// A raised quota or a later expiry enables a depleted client again
+	gc.Depleted = gc.IsDepleted(time.Now().Unix() * 1000)
+
+	gc.UpdatedAt = time.Now().Unix()
+	if err := db.Save(gc).Error; err != nil {
+		return nil, err
+	}
+
+	provisioned, err := s.ProvisionGlobalClient(gc)
+	results = append(results, provisioned...)
+	if err != nil && provisioned == nil {
+		return results, err
+	}
+	return results, provisionError(results)
+}
+
+// SetEnable enables or disables the global client on every mapped node.
+func (s *GlobalClientService) SetEnable(multiSubId int, enable bool) ([]NodeProvisionResult, error) {
+	gc, err := s.GetGlobalClient(multiSubId)
+	if err != nil {
+		return nil, err
+	}
+	gc.Enable = enable
+	gc.UpdatedAt = time.Now().Unix()
+	if err := database.GetDB().Model(gc).Updates(map[string]any{
+		"enable":     gc.Enable,
+		"updated_at": gc.UpdatedAt,
+	}).Error; err != nil {
+		return nil, err
+	}
+	return s.ProvisionGlobalClient(gc)
+}
+
+// DeleteGlobalClient removes the global client from every mapped node and from the database.
+func (s *GlobalClientService) DeleteGlobalClient(multiSubId int) ([]NodeProvisionResult, error) {
+	gc, err := s.GetGlobalClient(multiSubId)
+	if err != nil {
+		return nil, err
+	}
+	mapping, _ := s.GetNodeInbounds(gc)
+	var results []NodeProvisionResult
+	for _, nodeId := range sortedNodeIds(mapping) {
+		results = append(results, s.removeFromNode(nodeId, mapping[nodeId], gc))
+	}
+	db := database.GetDB()
+	db.Where("global_client_id = ?", gc.Id).Delete(&model.GlobalClientTraffic{})
+	if err := db.Delete(gc).Error; err != nil {
+		return results, err
+	}
+	return results, provisionError(results)
+}
+
+// ProvisionGlobalClient creates or updates the global client on every mapped node.
+func (s *GlobalClientService) ProvisionGlobalClient(gc *model.GlobalClient) ([]NodeProvisionResult, error) {
+	var ms model.MultiSubscription
+	if err := database.GetDB().First(&ms, gc.MultiSubId).Error; err != nil {
+		return nil, err
+	}
+	mapping, err := s.GetNodeInbounds(gc)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]NodeProvisionResult, 0, len(mapping))
+	for _, nodeId := range sortedNodeIds(mapping) {
+		result := NodeProvisionResult{NodeId: nodeId, InboundId: mapping[nodeId]}
+		node, err := s.nodeService.GetNode(nodeId)
+		if err == nil {
+			result.NodeName = node.Name
+			result.Action, err = s.ProvisionOnNode(gc, ms.SubId, node, mapping[nodeId])
+		}
+		if err != nil {
+			logger.Warningf("Failed to provision client %s on node %d: %v", gc.Email, nodeId, err)
+			result.Action = ProvisionSkipped
+			result.Error = err.Error()
+		}
+		results = append(results, result)
+	}
+	return results, provisionError(results)
+}
+
+// ProvisionOnNode makes the client on the node's inbound match the global client.
+func (s *GlobalClientService) ProvisionOnNode(gc *model.GlobalClient, subId string, node *model.Node, inboundId int) (string, error) {
+	nodeClient := NewNodeClient(node)
+	inbound, err := nodeClient.GetInbound(inboundId)
+	if err != nil {
+		return "", err
+	}
+	client := gc.ToClient(inbound.Protocol, inboundMethod(inbound.Settings), subId)
+	nodeSubCache.Invalidate(node.Id, subId)
+	clientKey, found := findRemoteClient(inbound, gc.Email)
+	if !found {
+		return ProvisionCreated, nodeClient.AddClients(inboundId, []model.Client{client})
+	}
+	return ProvisionUpdated, nodeClient.UpdateClient(inboundId, clientKey, client)
+}
+
+// SyncMultiSubscription re-provisions the global client after its multi-subscription changed.
+// Nodes that were removed from the multi-subscription lose the client and their mapping.
+func (s *GlobalClientService) SyncMultiSubscription(ms *model.MultiSubscription) {
+	gc, err := s.GetGlobalClient(ms.Id)
+	if err != nil {
+		return
+	}
+	mapping, err := s.GetNodeInbounds(gc)
+	if err != nil {
+		return
+	}
+	multiSubService := MultiSubscriptionService{}
+	nodeIds, _ := multiSubService.GetNodeIds(ms)
+	listed := make(map[int]bool, len(nodeIds))
+	for _, nodeId := range nodeIds {
+		listed[nodeId] = true
+	}
+	pruned := false
+	for _, nodeId := range sortedNodeIds(mapping) {
+		if listed[nodeId] {
+			continue
+		}
+		if result := s.removeFromNode(nodeId, mapping[nodeId], gc); result.Error == "" {
+			delete(mapping, nodeId)
+			pruned = true
+		}
+	}
+	if pruned {
+		raw := make(map[string]int, len(mapping))
+		for nodeId, inboundId := range mapping {
+			raw[strconv.Itoa(nodeId)] = inboundId
+		}
+		data, _ := json.Marshal(raw)
+		gc.NodeInbounds = string(data)
+		database.GetDB().Model(gc).Update("node_inbounds", gc.NodeInbounds)
+	}
+	if _, err := s.ProvisionGlobalClient(gc); err != nil {
+		logger.Warningf("Failed to sync client %s of multi-subscription %s: %v", gc.Email, ms.Name, err)
+	}
+}
+
+func (s *GlobalClientService) removeFromNode(nodeId, inboundId int, gc *model.GlobalClient) NodeProvisionResult {
+	result := NodeProvisionResult{NodeId: nodeId, InboundId: inboundId, Action: ProvisionSkipped}
+	node, err := s.nodeService.GetNode(nodeId)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.NodeName = node.Name
+	nodeClient := NewNodeClient(node)
+	inbound, err := nodeClient.GetInbound(inboundId)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	clientKey, found := findRemoteClient(inbound, gc.Email)
+	if !found {
+		return result
+	}
+	if err := nodeClient.DelClient(inboundId, clientKey); err != nil {
+		logger.Warningf("Failed to remove client %s from node %s: %v", gc.Email, node.Name, err)
+		result.Error = err.Error()
+		return result
+	}
+	result.Action = ProvisionDeleted
+	return result
+}
+
+// findRemoteClient looks up a client by email in a node inbound and returns the key
+// the node uses to address it: password for Trojan, email for Shadowsocks, ID otherwise.
+func findRemoteClient(inbound *model.Inbound, email string) (string, bool) {
+	var settings struct {
+		Clients []model.Client `json:"clients"`
+	}
+	if err := json.Unmarshal([]byte(inbound.Settings), &settings); err != nil {
+		return "", false
+	}
+	for _, client := range settings.Clients {
+		if client.Email != email {
+			continue
+		}
+		switch inbound.Protocol {
+		case model.Trojan:
+			return client.Password, true
+		case model.Shadowsocks:
+			return client.Email, true
+		default:
+			return client.ID, true
+		}
+	}
+	return "", false
+}
+
+// inboundMethod returns the cipher of Shadowsocks inbound settings.
+func inboundMethod(settings string) string {
+	var parsed struct {
+		Method string `json:"method"`
+	}
+	json.Unmarshal([]byte(settings), &parsed)
+	return parsed.Method
+}
+
+// randomClientKey returns a random 32-byte key in base64, like the client form generates for
+// Shadowsocks clients.
+func randomClientKey() string {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic("crypto/rand failed: " + err.Error())
+	}
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+func sortedNodeIds(mapping map[int]int) []int {
+	nodeIds := make([]int, 0, len(mapping))
+	for nodeId := range mapping {
+		nodeIds = append(nodeIds, nodeId)
+	}
+	sort.Ints(nodeIds)
+	return nodeIds
+}
+
+func provisionError(results []NodeProvisionResult) error {
+	failed := 0
+	for _, result := range results {
+		if result.Error != "" {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return common.NewErrorf("failed to provision client on %d node(s)", failed)
+	}
+	return nil
+}
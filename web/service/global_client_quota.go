@@ -0,0 +1,226 @@
+package service
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/database"
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+	"github.com/mhsanaei/3x-ui/v2/logger"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// remoteClientState is what a node reports about one client.
+type remoteClientState struct {
+	up      int64
+	down    int64
+	enabled bool // client enable flag in the inbound settings
+	found   bool // whether the inbound holds the client at all
+}
+
+// SyncGlobalClientTraffics pulls client traffic from every mapped node, stores it per node and
+// refreshes the combined usage of each global client. Unreachable nodes keep their last known usage.
+// It returns, for every global client, the nodes whose enable flag differs from the desired one.
+func (s *GlobalClientService) SyncGlobalClientTraffics() ([]*model.GlobalClient, map[int][]int, error) {
+	db := database.GetDB()
+	var clients []*model.GlobalClient
+	if err := db.Find(&clients).Error; err != nil {
+		return nil, nil, err
+	}
+
+	// Fetch every node once, no matter how many global clients it serves
+	nodeInbounds := map[int]map[int]*model.Inbound{}
+	for _, gc := range clients {
+		mapping, err := s.GetNodeInbounds(gc)
+		if err != nil {
+			continue
+		}
+		for nodeId := range mapping {
+			if _, ok := nodeInbounds[nodeId]; ok {
+				continue
+			}
+			nodeInbounds[nodeId] = nil
+			node, err := s.nodeService.GetNode(nodeId)
+			if err != nil || !node.Enable {
+				continue
+			}
+			inbounds, err := NewNodeClient(node).GetInbounds()
+			if err != nil {
+				logger.Debugf("Failed to get client traffics from node %s: %v", node.Name, err)
+				continue
+			}
+			byId := make(map[int]*model.Inbound, len(inbounds))
+			for _, inbound := range inbounds {
+				byId[inbound.Id] = inbound
+			}
+			nodeInbounds[nodeId] = byId
+		}
+	}
+
+	outOfSync := map[int][]int{}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		for _, gc := range clients {
+			mapping, err := s.GetNodeInbounds(gc)
+			if err != nil {
+				continue
+			}
+			desired := gc.Enable && !gc.IsDepleted(time.Now().Unix()*1000)
+			for _, nodeId := range sortedNodeIds(mapping) {
+				inbound := nodeInbounds[nodeId][mapping[nodeId]]
+				if inbound == nil {
+					continue
+				}
+				state := remoteClient(inbound, gc.Email)
+				if !state.found || state.enabled != desired {
+					outOfSync[gc.Id] = append(outOfSync[gc.Id], nodeId)
+				}
+				if !state.found {
+					continue
+				}
+				err = tx.Clauses(clause.OnConflict{
+					Columns:   []clause.Column{{Name: "global_client_id"}, {Name: "node_id"}},
+					DoUpdates: clause.AssignmentColumns([]string{"up", "down", "updated_at"}),
+				}).Create(&model.GlobalClientTraffic{
+					GlobalClientId: gc.Id,
+					NodeId:         nodeId,
+					Up:             state.up,
+					Down:           state.down,
+				}).Error
+				if err != nil {
+					return err
+				}
+			}
+
+			var total struct {
+				Up   int64
+				Down int64
+			}
+			err = tx.Model(&model.GlobalClientTraffic{}).
+				Select("COALESCE(SUM(up), 0) AS up, COALESCE(SUM(down), 0) AS down").
+				Where("global_client_id = ?", gc.Id).
+				Scan(&total).Error
+			if err != nil {
+				return err
+			}
+			gc.Up = total.Up
+			gc.Down = total.Down
+			err = tx.Model(&model.GlobalClient{}).Where("id = ?", gc.Id).
+				UpdateColumns(map[string]any{"up": gc.Up, "down": gc.Down}).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return clients, outOfSync, err
+}
+
+// DisableInvalidGlobalClients enforces quotas across nodes, like disableInvalidClients does for
+// local clients. A client whose combined traffic or expiry is exhausted is disabled on every node,
+// and enabled again once its traffic is reset, its quota is raised or its expiry is extended.
+// It returns the number of clients whose state changed.
+func (s *GlobalClientService) DisableInvalidGlobalClients() (int64, error) {
+	clients, outOfSync, err := s.SyncGlobalClientTraffics()
+	if err != nil {
+		return 0, err
+	}
+
+	db := database.GetDB()
+	now := time.Now().Unix() * 1000
+	var count int64
+	for _, gc := range clients {
+		depleted := gc.IsDepleted(now)
+		if depleted != gc.Depleted {
+			gc.Depleted = depleted
+			if err := db.Model(&model.GlobalClient{}).Where("id = ?", gc.Id).UpdateColumn("depleted", depleted).Error; err != nil {
+				return count, err
+			}
+			if depleted {
+				logger.Info("Client disabled by cluster quota:", gc.Email)
+			} else {
+				logger.Info("Client enabled by cluster quota:", gc.Email)
+			}
+			count++
+		} else if len(outOfSync[gc.Id]) == 0 {
+			continue
+		}
+		if _, err := s.ProvisionGlobalClient(gc); err != nil {
+			logger.Debugf("Failed to apply cluster quota state of %s: %v", gc.Email, err)
+		}
+	}
+	return count, nil
+}
+
+// ResetGlobalClientTraffic resets the client traffic on every mapped node and enables the client
+// again unless it has expired.
+func (s *GlobalClientService) ResetGlobalClientTraffic(multiSubId int) ([]NodeProvisionResult, error) {
+	gc, err := s.GetGlobalClient(multiSubId)
+	if err != nil {
+		return nil, err
+	}
+	mapping, err := s.GetNodeInbounds(gc)
+	if err != nil {
+		return nil, err
+	}
+
+	db := database.GetDB()
+	var results []NodeProvisionResult
+	for _, nodeId := range sortedNodeIds(mapping) {
+		result := NodeProvisionResult{NodeId: nodeId, InboundId: mapping[nodeId], Action: ProvisionUpdated}
+		node, err := s.nodeService.GetNode(nodeId)
+		if err == nil {
+			result.NodeName = node.Name
+			err = NewNodeClient(node).ResetClientTraffic(mapping[nodeId], gc.Email)
+		}
+		if err != nil {
+			result.Action = ProvisionSkipped
+			result.Error = err.Error()
+		}
+		results = append(results, result)
+	}
+	if err := provisionError(results); err != nil {
+		return results, err
+	}
+
+	// Usage left on nodes that are no longer mapped is dropped as well
+	db.Where("global_client_id = ?", gc.Id).Delete(&model.GlobalClientTraffic{})
+	gc.Up = 0
+	gc.Down = 0
+	gc.Depleted = gc.IsDepleted(time.Now().Unix() * 1000)
+	err = db.Model(&model.GlobalClient{}).Where("id = ?", gc.Id).UpdateColumns(map[string]any{
+		"up":       gc.Up,
+		"down":     gc.Down,
+		"depleted": gc.Depleted,
+	}).Error
+	if err != nil {
+		return results, err
+	}
+	return s.ProvisionGlobalClient(gc)
+}
+
+// remoteClient extracts the traffic and enable flag of a client from a node inbound.
+func remoteClient(inbound *model.Inbound, email string) remoteClientState {
+	state := remoteClientState{}
+	var settings struct {
+		Clients []model.Client `json:"clients"`
+	}
+	if err := json.Unmarshal([]byte(inbound.Settings), &settings); err == nil {
+		for _, client := range settings.Clients {
+			if client.Email == email {
+				state.found = true
+				state.enabled = client.Enable
+				break
+			}
+		}
+	}
+	for _, traffic := range inbound.ClientStats {
+		if traffic.Email == email {
+			state.up = traffic.Up
+			state.down = traffic.Down
+			break
+		}
+	}
+	return state
+}
@@ -0,0 +1,59 @@
+package service
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/mhsanaei/3x-ui/v2/database"
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+	"github.com/mhsanaei/3x-ui/v2/logger"
+	"github.com/mhsanaei/3x-ui/v2/xray"
+
+	"github.com/op/go-logging"
+)
+
+// setupServiceTestDB opens a fresh database for a test and closes it when the test ends.
+func setupServiceTestDB(t *testing.T) {
+	t.Helper()
+	_ = database.CloseDB()
+	tdb := filepath.Join(t.TempDir(), "test.db")
+	if err := database.InitDB(tdb); err != nil {
+		t.Fatalf("failed to init test db: %v", err)
+	}
+	t.Cleanup(func() { _ = database.CloseDB() })
+}
+
+// setupTestLogger sends the logs of services under test to a temporary folder.
+func setupTestLogger(t *testing.T) {
+	t.Helper()
+	t.Setenv("XUI_LOG_FOLDER", t.TempDir())
+	logger.InitLogger(logging.ERROR)
+}
+
+// createTestInbounds stores inbounds, failing the test on error.
+func createTestInbounds(t *testing.T, inbounds ...*model.Inbound) {
+	t.Helper()
+	for _, inbound := range inbounds {
+		if err := database.GetDB().Create(inbound).Error; err != nil {
+			t.Fatalf("failed to create inbound: %v", err)
+		}
+	}
+}
+
+// createTestClientTraffics stores client traffics, failing the test on error.
+func createTestClientTraffics(t *testing.T, traffics ...*xray.ClientTraffic) {
+	t.Helper()
+	if err := database.GetDB().CreateInBatches(traffics, 100).Error; err != nil {
+		t.Fatalf("failed to create client traffics: %v", err)
+	}
+}
+
+// getTestClientTraffic loads the traffic of a client, failing the test when it is missing.
+func getTestClientTraffic(t *testing.T, email string) *xray.ClientTraffic {
+	t.Helper()
+	var traffic xray.ClientTraffic
+	if err := database.GetDB().Where("email = ?", email).First(&traffic).Error; err != nil {
+		t.Fatalf("failed to load client traffic of %s: %v", email, err)
+	}
+	return &traffic
+}
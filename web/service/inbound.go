@@ -87,6 +87,78 @@ func (s *InboundService) GetAllInbounds() ([]*model.Inbound, error) {
 	return inbounds, nil
 }
 
+// GetInboundsByClient retrieves the inbounds that have a client with the given subscription ID
+// and/or email. Each inbound only keeps the matching clients in its settings and their
+// statistics, so other users' credentials are not exposed. Emails are compared case-insensitively.
+func (s *InboundService) GetInboundsByClient(subId string, email string) ([]*model.Inbound, error) {
+	if subId == "" && email == "" {
+		return nil, common.NewError("subId or email is required")
+	}
+	var conditions []string
+	var args []any
+	if subId != "" {
+		conditions = append(conditions, "JSON_EXTRACT(client.value, '$.subId') = ?")
+		args = append(args, subId)
+	}
+	if email != "" {
+		conditions = append(conditions, "LOWER(JSON_EXTRACT(client.value, '$.email')) = LOWER(?)")
+		args = append(args, email)
+	}
+
+	db := database.GetDB()
+	var inbounds []*model.Inbound
+	err := db.Model(model.Inbound{}).Preload("ClientStats").Where(`id in (
+		SELECT DISTINCT inbounds.id
+		FROM inbounds,
+			JSON_EACH(JSON_EXTRACT(inbounds.settings, '$.clients')) AS client
+		WHERE `+strings.Join(conditions, " AND ")+`
+	)`, args...).Find(&inbounds).Error
+	if err != nil && err != gorm.ErrRecordNotFound {
+		return nil, err
+	}
+
+	for _, inbound := range inbounds {
+		var settings map[string]any
+		if err := json.Unmarshal([]byte(inbound.Settings), &settings); err != nil {
+			return nil, err
+		}
+		clients, _ := settings["clients"].([]any)
+		matched := make([]any, 0, 1)
+		emails := map[string]model.Client{}
+		for _, c := range clients {
+			clientMap, ok := c.(map[string]any)
+			if !ok {
+				continue
+			}
+			clientSubId, _ := clientMap["subId"].(string)
+			clientEmail, _ := clientMap["email"].(string)
+			if (subId != "" && clientSubId != subId) || (email != "" && !strings.EqualFold(clientEmail, email)) {
+				continue
+			}
+			matched = append(matched, clientMap)
+			clientId, _ := clientMap["id"].(string)
+			emails[strings.ToLower(clientEmail)] = model.Client{ID: clientId, SubID: clientSubId}
+		}
+		settings["clients"] = matched
+		filtered, err := json.MarshalIndent(settings, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		inbound.Settings = string(filtered)
+
+		stats := make([]xray.ClientTraffic, 0, len(emails))
+		for _, stat := range inbound.ClientStats {
+			if c, ok := emails[strings.ToLower(stat.Email)]; ok {
+				stat.UUID = c.ID
+				stat.SubId = c.SubID
+				stats = append(stats, stat)
+			}
+		}
+		inbound.ClientStats = stats
+	}
+	return inbounds, nil
+}
+
 func (s *InboundService) GetInboundsByTrafficReset(period string) ([]*model.Inbound, error) {
 	db := database.GetDB()
 	var inbounds []*model.Inbound
@@ -342,8 +414,13 @@ func (s *InboundService) DelInbound(id int) (bool, error) {
 		logger.Debug("No enabled inbound founded to removing by api", tag)
 	}
 
-	// Delete client traffics of inbounds
-	err := db.Where("inbound_id = ?", id).Delete(xray.ClientTraffic{}).Error
+	// Delete client traffics of inbounds along with their history
+	err := db.Where("email IN (?)", db.Model(xray.ClientTraffic{}).Select("email").Where("inbound_id = ?", id)).
+		Delete(model.ClientTrafficBucket{}).Error
+	if err != nil {
+		return false, err
+	}
+	err = db.Where("inbound_id = ?", id).Delete(xray.ClientTraffic{}).Error
 	if err != nil {
 		return false, err
 	}
@@ -611,6 +688,9 @@ func (s *InboundService) AddInboundClient(data *model.Inbound) (bool, error) {
 				return false, common.NewError("empty client ID")
 			}
 		}
+		if err := CheckResetSchedule(&client); err != nil {
+			return false, err
+		}
 	}
 
 	var oldSettings map[string]any
@@ -816,6 +896,9 @@ func (s *InboundService) UpdateInboundClient(data *model.Inbound, clientId strin
 	if newClientId == "" || clientIndex == -1 {
 		return false, common.NewError("empty client ID")
 	}
+	if err := CheckResetSchedule(&clients[0]); err != nil {
+		return false, err
+	}
 
 	if len(clients[0].Email) > 0 && clients[0].Email != oldEmail {
 		existEmail, err := s.checkEmailsExistForClients(clients)
@@ -1348,6 +1431,12 @@ func (s *InboundService) UpdateClientStat(tx *gorm.DB, email string, client *mod
 			"reset":       client.Reset,
 		})
 	err := result.Error
+	if err == nil && client.Email != email {
+		err = tx.Model(model.ClientTrafficBucket{}).Where("email = ?", email).Update("email", client.Email).Error
+	}
+	if err == nil && client.Email != email {
+		err = tx.Model(model.ClientPlanHistory{}).Where("email = ?", email).Update("email", client.Email).Error
+	}
 	return err
 }
 
@@ -1356,6 +1445,9 @@ func (s *InboundService) UpdateClientIPs(tx *gorm.DB, oldEmail string, newEmail
 }
 
 func (s *InboundService) DelClientStat(tx *gorm.DB, email string) error {
+	if err := tx.Where("email = ?", email).Delete(model.ClientTrafficBucket{}).Error; err != nil {
+		return err
+	}
 	return tx.Where("email = ?", email).Delete(xray.ClientTraffic{}).Error
 }
 
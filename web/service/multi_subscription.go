@@ -108,12 +108,24 @@ func (s *MultiSubscriptionService) UpdateMultiSubscription(ms *model.MultiSubscr
 
 	ms.UpdatedAt = time.Now().Unix()
 
-	return db.Save(ms).Error
+	if err := db.Save(ms).Error; err != nil {
+		return err
+	}
+
+	// Keep the global client in line with the new subId and node list
+	globalClientService := GlobalClientService{}
+	globalClientService.SyncMultiSubscription(ms)
+	return nil
 }
 
-// DeleteMultiSubscription deletes a multi-subscription.
+// DeleteMultiSubscription deletes a multi-subscription together with its global client.
 func (s *MultiSubscriptionService) DeleteMultiSubscription(id int) error {
 	db := database.GetDB()
+	globalClientService := GlobalClientService{}
+	if _, err := globalClientService.DeleteGlobalClient(id); err != nil && err != gorm.ErrRecordNotFound {
+		logger.Warningf("Failed to remove global client of multi-subscription %d: %v", id, err)
+		db.Where("multi_sub_id = ?", id).Delete(&model.GlobalClient{})
+	}
 	return db.Delete(&model.MultiSubscription{}, id).Error
 }
 
@@ -1,26 +1,21 @@
 package service
 
 import (
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
-	"path/filepath"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 
-	"github.com/mhsanaei/3x-ui/v2/database"
 	"github.com/mhsanaei/3x-ui/v2/database/model"
+	"github.com/mhsanaei/3x-ui/v2/xray"
 )
 
-func setupMultiSubTestDB(t *testing.T) {
-	t.Helper()
-	_ = database.CloseDB()
-	tdb := filepath.Join(t.TempDir(), "multi.db")
-	if err := database.InitDB(tdb); err != nil {
-		t.Fatalf("failed to init test db: %v", err)
-	}
-	t.Cleanup(func() { _ = database.CloseDB() })
-}
-
 func TestMultiSubscriptionServiceValidation(t *testing.T) {
-	setupMultiSubTestDB(t)
+	setupServiceTestDB(t)
 	nodeSvc := &NodeService{}
 	multiSvc := &MultiSubscriptionService{nodeService: *nodeSvc}
 
@@ -60,7 +55,7 @@ func TestMultiSubscriptionServiceValidation(t *testing.T) {
 }
 
 func TestMultiSubscriptionServiceCRUD(t *testing.T) {
-	setupMultiSubTestDB(t)
+	setupServiceTestDB(t)
 	nodeSvc := &NodeService{}
 	multiSvc := &MultiSubscriptionService{nodeService: *nodeSvc}
 
@@ -140,3 +135,355 @@ func TestMultiSubscriptionServiceCRUD(t *testing.T) {
 		t.Fatalf("expected error when fetching deleted multi-subscription")
 	}
 }
+
+// fakeInboundNode serves a single inbound through the external API and records client changes.
+type fakeInboundNode struct {
+	mu      sync.Mutex
+	inbound model.Inbound
+	clients []model.Client
+	up      int64
+	down    int64
+	calls   []string
+}
+
+func (f *fakeInboundNode) handle(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	path := strings.TrimPrefix(r.URL.Path, "/api/external/inbounds/")
+	f.calls = append(f.calls, path)
+	var data model.Inbound
+	if r.Method == http.MethodPost {
+		json.NewDecoder(r.Body).Decode(&data)
+	}
+	var settings struct {
+		Clients []model.Client `json:"clients"`
+	}
+	json.Unmarshal([]byte(data.Settings), &settings)
+
+	inbound := f.inbound
+	inboundSettings := map[string]any{}
+	json.Unmarshal([]byte(f.inbound.Settings), &inboundSettings)
+	inboundSettings["clients"] = f.clients
+	raw, _ := json.Marshal(inboundSettings)
+	inbound.Settings = string(raw)
+	for _, client := range f.clients {
+		inbound.ClientStats = append(inbound.ClientStats, xray.ClientTraffic{Email: client.Email, Up: f.up, Down: f.down})
+	}
+
+	switch {
+	case path == fmt.Sprintf("get/%d", f.inbound.Id):
+		json.NewEncoder(w).Encode(map[string]any{"success": true, "obj": inbound})
+		return
+	case path == "list":
+		json.NewEncoder(w).Encode(map[string]any{"success": true, "obj": []model.Inbound{inbound}})
+		return
+	case strings.Contains(path, "/resetClientTraffic/"):
+		f.up, f.down = 0, 0
+	case path == fmt.Sprintf("update/%d", f.inbound.Id):
+		data.ClientStats = nil
+		f.inbound = data
+		f.clients = settings.Clients
+	case path == "addClient":
+		f.clients = append(f.clients, settings.Clients...)
+	case strings.HasPrefix(path, "updateClient/"):
+		for i := range f.clients {
+			if f.clients[i].Email == settings.Clients[0].Email {
+				f.clients[i] = settings.Clients[0]
+			}
+		}
+	case strings.Contains(path, "/delClient/"):
+		f.clients = nil
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]any{"success": true})
+}
+
+func TestGlobalClientProvisioning(t *testing.T) {
+	setupServiceTestDB(t)
+	nodeSvc := &NodeService{}
+	multiSvc := &MultiSubscriptionService{}
+	gcSvc := &GlobalClientService{}
+
+	vless := &fakeInboundNode{inbound: model.Inbound{Id: 5, Protocol: model.VLESS}}
+	trojan := &fakeInboundNode{
+		inbound: model.Inbound{Id: 6, Protocol: model.Trojan},
+		clients: []model.Client{{Password: "old", Email: "alice", Enable: true}},
+	}
+	nodeA := newFakeNode(t, vless.handle)
+	nodeB := newFakeNode(t, trojan.handle)
+	for _, node := range []*model.Node{nodeA, nodeB} {
+		if err := nodeSvc.AddNode(node); err != nil {
+			t.Fatalf("failed to add node: %v", err)
+		}
+	}
+
+	ms := &model.MultiSubscription{Name: "combo", SubId: "alice-sub", NodeIds: fmt.Sprintf("[%d,%d]", nodeA.Id, nodeB.Id)}
+	if err := multiSvc.AddMultiSubscription(ms); err != nil {
+		t.Fatalf("AddMultiSubscription failed: %v", err)
+	}
+
+	unknown := &model.GlobalClient{MultiSubId: ms.Id, Email: "alice", NodeInbounds: `{"999":1}`}
+	if _, err := gcSvc.SaveGlobalClient(unknown); err == nil {
+		t.Fatalf("expected error for node outside the multi-subscription")
+	}
+
+	gc := &model.GlobalClient{
+		MultiSubId:   ms.Id,
+		Email:        "alice",
+		TotalGB:      1 << 30,
+		Enable:       true,
+		NodeInbounds: fmt.Sprintf(`{"%d":5,"%d":6}`, nodeA.Id, nodeB.Id),
+	}
+	results, err := gcSvc.SaveGlobalClient(gc)
+	if err != nil {
+		t.Fatalf("SaveGlobalClient failed: %v (%+v)", err, results)
+	}
+	if len(results) != 2 || results[0].Action != ProvisionCreated || results[1].Action != ProvisionUpdated {
+		t.Fatalf("unexpected provision results: %+v", results)
+	}
+	if len(vless.clients) != 1 || vless.clients[0].ID != gc.UUID || vless.clients[0].SubID != "alice-sub" {
+		t.Fatalf("unexpected vless client: %+v", vless.clients)
+	}
+	if trojan.calls[len(trojan.calls)-1] != "updateClient/old" || trojan.clients[0].Password != gc.Password {
+		t.Fatalf("expected trojan client to be updated by its old password, calls=%v clients=%+v", trojan.calls, trojan.clients)
+	}
+
+	if _, err := gcSvc.SetEnable(ms.Id, false); err != nil {
+		t.Fatalf("SetEnable failed: %v", err)
+	}
+	if vless.clients[0].Enable || trojan.clients[0].Enable {
+		t.Fatalf("expected client to be disabled on every node")
+	}
+
+	// Dropping a node from the multi-subscription removes the client there
+	ms.NodeIds = fmt.Sprintf("[%d]", nodeA.Id)
+	if err := multiSvc.UpdateMultiSubscription(ms); err != nil {
+		t.Fatalf("UpdateMultiSubscription failed: %v", err)
+	}
+	if len(trojan.clients) != 0 {
+		t.Fatalf("expected client to be removed from dropped node")
+	}
+	stored, err := gcSvc.GetGlobalClient(ms.Id)
+	if err != nil {
+		t.Fatalf("GetGlobalClient failed: %v", err)
+	}
+	if stored.NodeInbounds != fmt.Sprintf(`{"%d":5}`, nodeA.Id) {
+		t.Fatalf("expected dropped node to be pruned from mapping, got %s", stored.NodeInbounds)
+	}
+
+	if err := multiSvc.DeleteMultiSubscription(ms.Id); err != nil {
+		t.Fatalf("DeleteMultiSubscription failed: %v", err)
+	}
+	if len(vless.clients) != 0 {
+		t.Fatalf("expected client to be removed when the multi-subscription is deleted")
+	}
+	if _, err := gcSvc.GetGlobalClient(ms.Id); err == nil {
+		t.Fatalf("expected global client to be deleted")
+	}
+}
+
+func TestGlobalClientShadowsocksKeys(t *testing.T) {
+	setupServiceTestDB(t)
+	nodeSvc := &NodeService{}
+	multiSvc := &MultiSubscriptionService{}
+	gcSvc := &GlobalClientService{}
+
+	aes128 := &fakeInboundNode{inbound: model.Inbound{Id: 1, Protocol: model.Shadowsocks, Settings: `{"method":"2022-blake3-aes-128-gcm"}`}}
+	aes256 := &fakeInboundNode{inbound: model.Inbound{Id: 2, Protocol: model.Shadowsocks, Settings: `{"method":"2022-blake3-aes-256-gcm"}`}}
+	legacy := &fakeInboundNode{inbound: model.Inbound{Id: 3, Protocol: model.Shadowsocks, Settings: `{"method":"chacha20-ietf-poly1305"}`}}
+	var nodeIds []int
+	mapping := map[string]int{}
+	for _, fake := range []*fakeInboundNode{aes128, aes256, legacy} {
+		node := newFakeNode(t, fake.handle)
+		if err := nodeSvc.AddNode(node); err != nil {
+			t.Fatalf("failed to add node: %v", err)
+		}
+		nodeIds = append(nodeIds, node.Id)
+		mapping[strconv.Itoa(node.Id)] = fake.inbound.Id
+	}
+	rawIds, _ := json.Marshal(nodeIds)
+	rawMapping, _ := json.Marshal(mapping)
+	ms := &model.MultiSubscription{Name: "ss", NodeIds: string(rawIds)}
+	if err := multiSvc.AddMultiSubscription(ms); err != nil {
+		t.Fatalf("AddMultiSubscription failed: %v", err)
+	}
+
+	keySize := func(password string) int {
+		key, err := base64.StdEncoding.DecodeString(password)
+		if err != nil {
+			return 0
+		}
+		return len(key)
+	}
+
+	// A generated password is a 32-byte key, cut to the key length of each cipher
+	gc := &model.GlobalClient{MultiSubId: ms.Id, Email: "dave", Enable: true, NodeInbounds: string(rawMapping)}
+	if _, err := gcSvc.SaveGlobalClient(gc); err != nil {
+		t.Fatalf("SaveGlobalClient failed: %v", err)
+	}
+	if keySize(gc.Password) != 32 {
+		t.Fatalf("expected a generated 32-byte key, got %q", gc.Password)
+	}
+	key128, key256 := aes128.clients[0].Password, aes256.clients[0].Password
+	if keySize(key128) != 16 || key256 != gc.Password || legacy.clients[0].Password != gc.Password {
+		t.Fatalf("unexpected shadowsocks keys: %q %q %q", key128, key256, legacy.clients[0].Password)
+	}
+
+	// Passwords that are not keys are turned into keys of the cipher length
+	gc.Password = "secret"
+	if _, err := gcSvc.SaveGlobalClient(gc); err != nil {
+		t.Fatalf("SaveGlobalClient failed: %v", err)
+	}
+	if keySize(aes128.clients[0].Password) != 16 || keySize(aes256.clients[0].Password) != 32 || legacy.clients[0].Password != "secret" {
+		t.Fatalf("unexpected derived keys: %+v %+v %+v", aes128.clients, aes256.clients, legacy.clients)
+	}
+}
+
+func TestGlobalClientQuotaEnforcement(t *testing.T) {
+	setupServiceTestDB(t)
+	nodeSvc := &NodeService{}
+	multiSvc := &MultiSubscriptionService{}
+	gcSvc := &GlobalClientService{}
+
+	nodeA := &fakeInboundNode{inbound: model.Inbound{Id: 1, Protocol: model.VLESS}}
+	nodeB := &fakeInboundNode{inbound: model.Inbound{Id: 2, Protocol: model.VMESS}}
+	a := newFakeNode(t, nodeA.handle)
+	b := newFakeNode(t, nodeB.handle)
+	for _, node := range []*model.Node{a, b} {
+		if err := nodeSvc.AddNode(node); err != nil {
+			t.Fatalf("failed to add node: %v", err)
+		}
+	}
+	ms := &model.MultiSubscription{Name: "quota", NodeIds: fmt.Sprintf("[%d,%d]", a.Id, b.Id)}
+	if err := multiSvc.AddMultiSubscription(ms); err != nil {
+		t.Fatalf("AddMultiSubscription failed: %v", err)
+	}
+	gc := &model.GlobalClient{
+		MultiSubId:   ms.Id,
+		Email:        "bob",
+		TotalGB:      100,
+		Enable:       true,
+		NodeInbounds: fmt.Sprintf(`{"%d":1,"%d":2}`, a.Id, b.Id),
+	}
+	if _, err := gcSvc.SaveGlobalClient(gc); err != nil {
+		t.Fatalf("SaveGlobalClient failed: %v", err)
+	}
+
+	// Each node alone stays under the quota, together they exceed it
+	nodeA.up, nodeA.down = 30, 30
+	nodeB.up, nodeB.down = 20, 25
+	count, err := gcSvc.DisableInvalidGlobalClients()
+	if err != nil {
+		t.Fatalf("DisableInvalidGlobalClients failed: %v", err)
+	}
+	stored, _ := gcSvc.GetGlobalClient(ms.Id)
+	if count != 1 || !stored.Depleted || stored.Up != 50 || stored.Down != 55 {
+		t.Fatalf("expected client to be depleted with combined usage, got count=%d %+v", count, stored)
+	}
+	if nodeA.clients[0].Enable || nodeB.clients[0].Enable {
+		t.Fatalf("expected client to be disabled on every node")
+	}
+
+	// Nothing changes while the client stays depleted
+	if count, _ := gcSvc.DisableInvalidGlobalClients(); count != 0 {
+		t.Fatalf("expected no state change, got %d", count)
+	}
+
+	if _, err := gcSvc.ResetGlobalClientTraffic(ms.Id); err != nil {
+		t.Fatalf("ResetGlobalClientTraffic failed: %v", err)
+	}
+	stored, _ = gcSvc.GetGlobalClient(ms.Id)
+	if stored.Depleted || stored.Up != 0 || stored.Down != 0 {
+		t.Fatalf("expected reset to clear usage, got %+v", stored)
+	}
+	if !nodeA.clients[0].Enable || !nodeB.clients[0].Enable {
+		t.Fatalf("expected client to be enabled again after reset")
+	}
+	if count, _ := gcSvc.DisableInvalidGlobalClients(); count != 0 {
+		t.Fatalf("expected client to stay enabled after reset, got %d changes", count)
+	}
+}
+
+func TestNodeReconcileKeepsGlobalClients(t *testing.T) {
+	setupServiceTestDB(t)
+	nodeSvc := &NodeService{}
+	multiSvc := &MultiSubscriptionService{}
+	gcSvc := &GlobalClientService{}
+	reconcileSvc := &NodeReconcileService{}
+
+	fake := &fakeInboundNode{
+		inbound: model.Inbound{Id: 1, Port: 443, Protocol: model.VLESS, Remark: "edge", Enable: true},
+		clients: []model.Client{{ID: "uuid", Email: "local", Enable: true}},
+	}
+	node := newFakeNode(t, fake.handle)
+	node.Managed = true
+	if err := nodeSvc.AddNode(node); err != nil {
+		t.Fatalf("failed to add node: %v", err)
+	}
+	spec := &model.NodeInboundSpec{NodeId: node.Id, Port: 443, Protocol: model.VLESS, Remark: "edge", Enable: true,
+		Settings: `{"clients":[{"id":"uuid","email":"local","enable":true}]}`}
+	if err := reconcileSvc.SaveSpec(spec); err != nil {
+		t.Fatalf("SaveSpec failed: %v", err)
+	}
+	ms := &model.MultiSubscription{Name: "reconcile", SubId: "carol-sub", NodeIds: fmt.Sprintf("[%d]", node.Id)}
+	if err := multiSvc.AddMultiSubscription(ms); err != nil {
+		t.Fatalf("AddMultiSubscription failed: %v", err)
+	}
+	gc := &model.GlobalClient{
+		MultiSubId:   ms.Id,
+		Email:        "carol",
+		TotalGB:      100,
+		Enable:       true,
+		NodeInbounds: fmt.Sprintf(`{"%d":1}`, node.Id),
+	}
+	results, err := gcSvc.SaveGlobalClient(gc)
+	if err != nil || len(results) != 1 || results[0].Action != ProvisionCreated {
+		t.Fatalf("SaveGlobalClient failed: %v (%+v)", err, results)
+	}
+
+	hasCarol := func(enable bool) bool {
+		for _, client := range fake.clients {
+			if client.Email == "carol" && client.ID == gc.UUID && client.Enable == enable {
+				return true
+			}
+		}
+		return false
+	}
+
+	// A provisioned global client is not drift
+	report, err := reconcileSvc.ReconcileNode(node.Id)
+	if err != nil {
+		t.Fatalf("ReconcileNode failed: %v", err)
+	}
+	if !report.InSync || report.Applied != 0 || len(fake.clients) != 2 || !hasCarol(true) {
+		t.Fatalf("expected the global client to be kept, got %+v clients=%+v", report, fake.clients)
+	}
+
+	// Converging a changed spec keeps the global client on the inbound
+	spec.Remark = "edge-2"
+	if err := reconcileSvc.SaveSpec(spec); err != nil {
+		t.Fatalf("SaveSpec failed: %v", err)
+	}
+	report, err = reconcileSvc.ReconcileNode(node.Id)
+	if err != nil {
+		t.Fatalf("ReconcileNode failed: %v", err)
+	}
+	if !report.InSync || report.Applied != 1 || fake.inbound.Remark != "edge-2" || len(fake.clients) != 2 || !hasCarol(true) {
+		t.Fatalf("expected the inbound to be updated with the global client, got %+v inbound=%+v clients=%+v", report, fake.inbound, fake.clients)
+	}
+
+	// A client disabled by the cluster quota stays disabled
+	fake.up, fake.down = 60, 60
+	if count, err := gcSvc.DisableInvalidGlobalClients(); err != nil || count != 1 {
+		t.Fatalf("DisableInvalidGlobalClients failed: %d %v", count, err)
+	}
+	report, err = reconcileSvc.ReconcileNode(node.Id)
+	if err != nil {
+		t.Fatalf("ReconcileNode failed: %v", err)
+	}
+	if !report.InSync || report.Applied != 0 || !hasCarol(false) {
+		t.Fatalf("expected the depleted global client to be kept disabled, got %+v clients=%+v", report, fake.clients)
+	}
+}
@@ -2,15 +2,17 @@
 package service
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"strings"
 	"time"
 
 	"github.com/mhsanaei/3x-ui/v2/database"
 	"github.com/mhsanaei/3x-ui/v2/database/model"
 	"github.com/mhsanaei/3x-ui/v2/logger"
 	"github.com/mhsanaei/3x-ui/v2/util/common"
-
-	"gorm.io/gorm"
+	"github.com/mhsanaei/3x-ui/v2/util/random"
 )
 
 // NodeService provides business logic for managing remote 3x-ui nodes.
@@ -31,6 +33,13 @@ func (s *NodeService) AddNode(node *model.Node) error {
 		return common.NewError("node port must be greater than 0")
 	}
 
+	if err := validateNodeAuth(node); err != nil {
+		return err
+	}
+	if err := validateNodeEndpoints(node); err != nil {
+		return err
+	}
+
 	// Set defaults
 	if node.Protocol == "" {
 		node.Protocol = "https"
@@ -65,17 +74,101 @@ func (s *NodeService) UpdateNode(node *model.Node) error {
 		return common.NewError("node port must be greater than 0")
 	}
 
+	if err := validateNodeAuth(node); err != nil {
+		return err
+	}
+	if err := validateNodeEndpoints(node); err != nil {
+		return err
+	}
+
 	node.UpdatedAt = time.Now().Unix()
 
 	return db.Save(node).Error
 }
 
+// validateNodeAuth checks the authentication settings of a node and defaults the mode to key.
+func validateNodeAuth(node *model.Node) error {
+	switch node.AuthMode {
+	case "":
+		node.AuthMode = "key"
+	case "key", "hmac":
+	case "mtls":
+		if node.ClientCert == "" || node.ClientKey == "" {
+			return common.NewError("client certificate and key are required for mtls")
+		}
+		if _, err := tls.X509KeyPair([]byte(node.ClientCert), []byte(node.ClientKey)); err != nil {
+			return common.NewError("invalid client certificate:", err)
+		}
+	default:
+		return common.NewError("node auth mode must be key, hmac or mtls")
+	}
+	return nil
+}
+
+// validateNodeEndpoints checks the client-facing endpoints of a node and stores them compacted.
+func validateNodeEndpoints(node *model.Node) error {
+	endpoints, err := node.GetEndpoints()
+	if err != nil {
+		return common.NewError("node endpoints must be a JSON array:", err)
+	}
+	if len(endpoints) == 0 {
+		node.Endpoints = ""
+		return nil
+	}
+	for i := range endpoints {
+		ep := &endpoints[i]
+		ep.Address = strings.TrimSpace(ep.Address)
+		if ep.Port < 0 || ep.Port > 65535 {
+			return common.NewErrorf("node endpoint %d has an invalid port: %d", i+1, ep.Port)
+		}
+		if strings.ContainsAny(ep.Address, "/ ") {
+			return common.NewErrorf("node endpoint %d has an invalid address: %s", i+1, ep.Address)
+		}
+	}
+	data, err := json.Marshal(endpoints)
+	if err != nil {
+		return err
+	}
+	node.Endpoints = string(data)
+	return nil
+}
+
+// RotateNodeKey generates a new API key, installs it on the node and stores it on the master.
+// The node keeps accepting the old key for a grace period, so polling is not interrupted.
+func (s *NodeService) RotateNodeKey(nodeId int) error {
+	node, err := s.GetNode(nodeId)
+	if err != nil {
+		return err
+	}
+	key := random.Seq(48)
+	if err := NewNodeClient(node).RotateKey(key); err != nil {
+		return err
+	}
+	db := database.GetDB()
+	err = db.Model(node).Updates(map[string]any{
+		"api_key":    key,
+		"updated_at": time.Now().Unix(),
+	}).Error
+	if err != nil {
+		logger.Errorf("Node %s accepted a new API key but it could not be saved: %v", node.Name, err)
+		return err
+	}
+	logger.Infof("Rotated API key of node %s", node.Name)
+	return nil
+}
+
 // DeleteNode deletes a node from the database.
 func (s *NodeService) DeleteNode(id int) error {
 	db := database.GetDB()
 
-	// Also delete associated stats
+	// Also delete associated stats, status history and inbound specs
 	db.Where("node_id = ?", id).Delete(&model.NodeStats{})
+	db.Where("node_id = ?", id).Delete(&model.NodeStatsRollup{})
+	db.Where("node_id = ?", id).Delete(&model.NodeStatusEvent{})
+	db.Where("node_id = ?", id).Delete(&model.NodeUptimeRollup{})
+	db.Where("node_id = ?", id).Delete(&model.NodeInboundSpec{})
+	nodePolls.forget(id)
+	nodeSubCache.Invalidate(id, "")
 
 	return db.Delete(&model.Node{}, id).Error
 }
@@ -114,9 +207,18 @@ func (s *NodeService) GetEnabledNodes() ([]*model.Node, error) {
 }
 
 // CheckNodeStatus checks the status of a node and updates it in the database.
-func (s *NodeService) CheckNodeStatus(node *model.Node) (string, error) {
-	client := NewNodeClient(node)
+// Every check is also recorded as a NodeStatusEvent with its latency, so that
+// transitions and outages can be reported later. A check cut short by ctx is not recorded.
+func (s *NodeService) CheckNodeStatus(ctx context.Context, node *model.Node) (string, error) {
+	prevStatus := node.Status
+	client := NewNodeClient(node).WithContext(ctx)
+	started := time.Now()
 	status, err := client.CheckConnection()
+	latency := time.Since(started)
+	if ctx.Err() != nil {
+		return status, ctx.Err()
+	}
+	nodePolls.recordCheck(node.Id, latency, err)
 
 	if err != nil {
 		node.Status = model.NodeStatusOffline
@@ -132,17 +234,44 @@ func (s *NodeService) CheckNodeStatus(node *model.Node) (string, error) {
 		"lastCheck": node.LastCheck,
 	})
 
+	event := &model.NodeStatusEvent{
+		NodeId:     node.Id,
+		Status:     node.Status,
+		PrevStatus: prevStatus,
+		Transition: prevStatus != node.Status,
+		LatencyMs:  latency.Milliseconds(),
+		CheckedAt:  node.LastCheck,
+	}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	if event.Transition {
+		logger.Infof("Node %s changed status from %s to %s", node.Name, prevStatus, node.Status)
+	}
+	if dbErr := db.Create(event).Error; dbErr != nil {
+		logger.Warning("Failed to record node status event:", dbErr)
+	}
+
 	return status, err
 }
 
 // SyncNodeStats synchronizes statistics from a remote node.
-func (s *NodeService) SyncNodeStats(nodeId int) error {
+func (s *NodeService) SyncNodeStats(ctx context.Context, nodeId int) error {
+	started := time.Now()
+	err := s.syncNodeStats(ctx, nodeId)
+	if ctx.Err() == nil {
+		nodePolls.recordSync(nodeId, time.Since(started), err)
+	}
+	return err
+}
+
+func (s *NodeService) syncNodeStats(ctx context.Context, nodeId int) error {
 	node, err := s.GetNode(nodeId)
 	if err != nil {
 		return err
 	}
 
-	client := NewNodeClient(node)
+	client := NewNodeClient(node).WithContext(ctx)
 	status, err := client.GetStatus()
 	if err != nil {
 		return common.NewErrorf("failed to get node status: %v", err)
@@ -168,7 +297,7 @@ func (s *NodeService) SyncNodeStats(nodeId int) error {
 		}
 	}
 
-	// Create or update node stats
+	// Record node stats
 	db := database.GetDB()
 	nodeStats := &model.NodeStats{
 		NodeId:      nodeId,
@@ -186,31 +315,8 @@ func (s *NodeService) SyncNodeStats(nodeId int) error {
 		CollectedAt: time.Now().Unix(),
 	}
 
-	// Check if stats already exist for this node
-	var existingStats model.NodeStats
-	err = db.Where("node_id = ?", nodeId).Order("collected_at DESC").First(&existingStats).Error
-	if err == gorm.ErrRecordNotFound {
-		// Create new stats record
-		return db.Create(nodeStats).Error
-	} else if err != nil {
-		return err
-	}
-
-	// Update existing stats
-	existingStats.Cpu = nodeStats.Cpu
-	existingStats.Mem = nodeStats.Mem
-	existingStats.MemTotal = nodeStats.MemTotal
-	existingStats.Disk = nodeStats.Disk
-	existingStats.DiskTotal = nodeStats.DiskTotal
-	existingStats.NetUp = nodeStats.NetUp
-	existingStats.NetDown = nodeStats.NetDown
-	existingStats.Uptime = nodeStats.Uptime
-	existingStats.XrayStatus = nodeStats.XrayStatus
-	existingStats.Clients = nodeStats.Clients
-	existingStats.Inbounds = nodeStats.Inbounds
-	existingStats.CollectedAt = nodeStats.CollectedAt
-
-	return db.Save(&existingStats).Error
+	// Every sync is kept as a raw sample, RollupNodeStats aggregates and prunes them
+	return db.Create(nodeStats).Error
 }
 
 // GetNodeStats retrieves the latest statistics for a node.
@@ -280,3 +386,93 @@ func (s *NodeService) DetectNodeLocation(node *model.Node) (*model.Node, error)
 
 	return node, nil
 }
+
+// GetNodeInbounds retrieves all inbounds configured on a remote node.
+func (s *NodeService) GetNodeInbounds(nodeId int) ([]*model.Inbound, error) {
+	node, err := s.GetNode(nodeId)
+	if err != nil {
+		return nil, err
+	}
+	return NewNodeClient(node).GetInbounds()
+}
+
+// AddNodeInbound creates an inbound on a remote node.
+func (s *NodeService) AddNodeInbound(nodeId int, inbound *model.Inbound) (*model.Inbound, error) {
+	node, err := s.GetNode(nodeId)
+	if err != nil {
+		return nil, err
+	}
+	return NewNodeClient(node).AddInbound(inbound)
+}
+
+// UpdateNodeInbound updates an inbound on a remote node.
+func (s *NodeService) UpdateNodeInbound(nodeId int, inbound *model.Inbound) (*model.Inbound, error) {
+	node, err := s.GetNode(nodeId)
+	if err != nil {
+		return nil, err
+	}
+	return NewNodeClient(node).UpdateInbound(inbound)
+}
+
+// DelNodeInbound deletes an inbound from a remote node.
+func (s *NodeService) DelNodeInbound(nodeId int, inboundId int) error {
+	node, err := s.GetNode(nodeId)
+	if err != nil {
+		return err
+	}
+	return NewNodeClient(node).DelInbound(inboundId)
+}
+
+// AddNodeClients adds clients to an inbound on a remote node.
+func (s *NodeService) AddNodeClients(nodeId int, inboundId int, clients []model.Client) error {
+	node, err := s.GetNode(nodeId)
+	if err != nil {
+		return err
+	}
+	return NewNodeClient(node).AddClients(inboundId, clients)
+}
+
+// UpdateNodeClient updates a client of an inbound on a remote node.
+func (s *NodeService) UpdateNodeClient(nodeId int, inboundId int, clientId string, client model.Client) error {
+	node, err := s.GetNode(nodeId)
+	if err != nil {
+		return err
+	}
+	return NewNodeClient(node).UpdateClient(inboundId, clientId, client)
+}
+
+// DelNodeClient removes a client from an inbound on a remote node.
+func (s *NodeService) DelNodeClient(nodeId int, inboundId int, clientId string) error {
+	node, err := s.GetNode(nodeId)
+	if err != nil {
+		return err
+	}
+	return NewNodeClient(node).DelClient(inboundId, clientId)
+}
+
+// ResetNodeClientTraffic resets traffic counters of a client on a remote node.
+func (s *NodeService) ResetNodeClientTraffic(nodeId int, inboundId int, email string) error {
+	node, err := s.GetNode(nodeId)
+	if err != nil {
+		return err
+	}
+	return NewNodeClient(node).ResetClientTraffic(inboundId, email)
+}
+
+// ResetNodeAllClientTraffics resets traffic counters of all clients of an inbound on a remote node.
+func (s *NodeService) ResetNodeAllClientTraffics(nodeId int, inboundId int) error {
+	node, err := s.GetNode(nodeId)
+	if err != nil {
+		return err
+	}
+	return NewNodeClient(node).ResetAllClientTraffics(inboundId)
+}
+
+// RestartNodeXray restarts xray on a remote node.
+func (s *NodeService) RestartNodeXray(nodeId int) error {
+	node, err := s.GetNode(nodeId)
+	if err != nil {
+		return err
+	}
+	return NewNodeClient(node).RestartXray()
+}
@@ -3,22 +3,30 @@ package service
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"strconv"
 	"time"
 
 	"github.com/mhsanaei/3x-ui/v2/database/model"
 	"github.com/mhsanaei/3x-ui/v2/logger"
 	"github.com/mhsanaei/3x-ui/v2/util/common"
+	"github.com/mhsanaei/3x-ui/v2/util/crypto"
+	"github.com/mhsanaei/3x-ui/v2/util/random"
 )
 
 // NodeClient provides HTTP client functionality for communicating with remote 3x-ui nodes.
 type NodeClient struct {
-	baseURL string
-	apiKey  string
-	client  *http.Client
+	baseURL  string
+	apiKey   string
+	authMode string
+	client   *http.Client
+	ctx      context.Context
 }
 
 // NewNodeClient creates a new NodeClient instance for communicating with a remote node.
@@ -29,48 +37,77 @@ func NewNodeClient(node *model.Node) *NodeClient {
 	}
 	baseURL := fmt.Sprintf("%s://%s:%d", protocol, node.Host, node.Port)
 
+	transport := &http.Transport{
+		MaxIdleConns:        10,
+		MaxIdleConnsPerHost: 5,
+		IdleConnTimeout:     30 * time.Second,
+	}
+	if node.AuthMode == "mtls" && node.ClientCert != "" && node.ClientKey != "" {
+		cert, err := tls.X509KeyPair([]byte(node.ClientCert), []byte(node.ClientKey))
+		if err != nil {
+			logger.Warningf("NodeClient [%s] invalid client certificate: %v", baseURL, err)
+		} else {
+			transport.TLSClientConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+		}
+	}
+
 	client := &http.Client{
-		Timeout: 10 * time.Second,
-		Transport: &http.Transport{
-			MaxIdleConns:        10,
-			MaxIdleConnsPerHost: 5,
-			IdleConnTimeout:     30 * time.Second,
-		},
+		Timeout:   10 * time.Second,
+		Transport: transport,
 	}
 
 	return &NodeClient{
-		baseURL: baseURL,
-		apiKey:  node.ApiKey,
-		client:  client,
+		baseURL:  baseURL,
+		apiKey:   node.ApiKey,
+		authMode: node.AuthMode,
+		client:   client,
+		ctx:      context.Background(),
 	}
 }
 
+// WithContext returns a copy of the client whose requests are cancelled with ctx.
+func (nc *NodeClient) WithContext(ctx context.Context) *NodeClient {
+	clone := *nc
+	clone.ctx = ctx
+	return &clone
+}
+
 // makeRequest performs an HTTP request to the node external API with authentication.
 func (nc *NodeClient) makeRequest(method, endpoint string, body interface{}) (*http.Response, error) {
 	url := fmt.Sprintf("%s%s", nc.baseURL, endpoint)
 	startTime := time.Now()
 
 	var reqBody io.Reader
-	var bodySize int
+	var jsonData []byte
 	if body != nil {
-		jsonData, err := json.Marshal(body)
+		var err error
+		jsonData, err = json.Marshal(body)
 		if err != nil {
 			logger.Errorf("NodeClient [%s] failed to marshal request body: %v", url, err)
 			return nil, common.NewError("failed to marshal request body:", err)
 		}
-		bodySize = len(jsonData)
 		reqBody = bytes.NewBuffer(jsonData)
 	}
+	bodySize := len(jsonData)
 
-	req, err := http.NewRequest(method, url, reqBody)
+	req, err := http.NewRequestWithContext(nc.ctx, method, url, reqBody)
 	if err != nil {
 		logger.Errorf("NodeClient [%s] failed to create request: %v", url, err)
 		return nil, common.NewError("failed to create request:", err)
 	}
 
-	// Add API key to header for external API
+	// Authenticate against the external API: a plain key in key mode, a signed request otherwise
 	if nc.apiKey != "" {
-		req.Header.Set("X-API-Key", nc.apiKey)
+		switch nc.authMode {
+		case "", "key":
+			req.Header.Set("X-API-Key", nc.apiKey)
+		default:
+			timestamp := time.Now().Unix()
+			nonce := random.Seq(32)
+			req.Header.Set(crypto.HeaderTimestamp, strconv.FormatInt(timestamp, 10))
+			req.Header.Set(crypto.HeaderNonce, nonce)
+			req.Header.Set(crypto.HeaderSignature, crypto.SignRequest(nc.apiKey, method, req.URL.RequestURI(), timestamp, nonce, jsonData))
+		}
 	}
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Accept", "application/json")
@@ -105,6 +142,45 @@ func (nc *NodeClient) makeRequest(method, endpoint string, body interface{}) (*h
 	return resp, nil
 }
 
+// nodeResponse mirrors the entity.Msg envelope returned by the node external API.
+type nodeResponse struct {
+	Success bool            `json:"success"`
+	Msg     string          `json:"msg"`
+	Obj     json.RawMessage `json:"obj"`
+}
+
+// call performs a request against the node external API and decodes the response envelope.
+// If out is not nil, the "obj" field of a successful response is decoded into it.
+func (nc *NodeClient) call(method, endpoint string, body any, out any) error {
+	resp, err := nc.makeRequest(method, endpoint, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		respBody, _ := io.ReadAll(resp.Body)
+		return common.NewErrorf("unexpected status code: %d, body: %s", resp.StatusCode, string(respBody))
+	}
+
+	var result nodeResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return common.NewError("failed to decode response:", err)
+	}
+	if !result.Success {
+		if result.Msg != "" {
+			return common.NewError("node returned error:", result.Msg)
+		}
+		return common.NewError("node returned error")
+	}
+	if out != nil && len(result.Obj) > 0 {
+		if err := json.Unmarshal(result.Obj, out); err != nil {
+			return common.NewError("failed to decode response object:", err)
+		}
+	}
+	return nil
+}
+
 // GetStatus retrieves the status of the remote node.
 func (nc *NodeClient) GetStatus() (*Status, error) {
 	resp, err := nc.makeRequest("GET", "/api/external/server/status", nil)
@@ -174,34 +250,144 @@ func (nc *NodeClient) GetInbounds() ([]*model.Inbound, error) {
 	return result.Obj, nil
 }
 
-// GetClientsBySubId retrieves inbounds that have a specific subscription ID from the remote node.
+// GetClientsBySubId retrieves the inbounds of the remote node that have a client with the
+// given subscription ID. The node only returns those clients and their statistics.
 func (nc *NodeClient) GetClientsBySubId(subId string) ([]*model.Inbound, error) {
-	inbounds, err := nc.GetInbounds()
-	if err != nil {
+	return nc.getInboundsByClient(url.Values{"subId": {subId}})
+}
+
+// GetClientsByEmail retrieves the inbounds of the remote node that have a client with the given email.
+func (nc *NodeClient) GetClientsByEmail(email string) ([]*model.Inbound, error) {
+	return nc.getInboundsByClient(url.Values{"email": {email}})
+}
+
+func (nc *NodeClient) getInboundsByClient(query url.Values) ([]*model.Inbound, error) {
+	var inbounds []*model.Inbound
+	if err := nc.call("GET", "/api/external/inbounds/clients?"+query.Encode(), nil, &inbounds); err != nil {
+		logger.Errorf("NodeClient GetInboundsByClient failed: %v", err)
 		return nil, err
 	}
+	return inbounds, nil
+}
 
-	var filteredInbounds []*model.Inbound
-	for _, inbound := range inbounds {
-		var settings map[string]interface{}
-		if err := json.Unmarshal([]byte(inbound.Settings), &settings); err != nil {
-			continue
-		}
-		clients, ok := settings["clients"].([]interface{})
-		if !ok {
-			continue
-		}
-		for _, client := range clients {
-			if clientMap, ok := client.(map[string]interface{}); ok {
-				if clientSubId, ok := clientMap["subId"].(string); ok && clientSubId == subId {
-					filteredInbounds = append(filteredInbounds, inbound)
-					break
-				}
-			}
-		}
+// GetInbound retrieves a single inbound by ID from the remote node.
+func (nc *NodeClient) GetInbound(id int) (*model.Inbound, error) {
+	var inbound model.Inbound
+	if err := nc.call("GET", fmt.Sprintf("/api/external/inbounds/get/%d", id), nil, &inbound); err != nil {
+		logger.Errorf("NodeClient GetInbound %d failed: %v", id, err)
+		return nil, err
+	}
+	return &inbound, nil
+}
+
+// AddInbound creates an inbound on the remote node and returns it as stored by the node.
+func (nc *NodeClient) AddInbound(inbound *model.Inbound) (*model.Inbound, error) {
+	var created model.Inbound
+	if err := nc.call("POST", "/api/external/inbounds/add", inbound, &created); err != nil {
+		logger.Errorf("NodeClient AddInbound failed: %v", err)
+		return nil, err
+	}
+	return &created, nil
+}
+
+// UpdateInbound updates an existing inbound on the remote node.
+func (nc *NodeClient) UpdateInbound(inbound *model.Inbound) (*model.Inbound, error) {
+	var updated model.Inbound
+	if err := nc.call("POST", fmt.Sprintf("/api/external/inbounds/update/%d", inbound.Id), inbound, &updated); err != nil {
+		logger.Errorf("NodeClient UpdateInbound %d failed: %v", inbound.Id, err)
+		return nil, err
+	}
+	return &updated, nil
+}
+
+// DelInbound deletes an inbound from the remote node.
+func (nc *NodeClient) DelInbound(id int) error {
+	if err := nc.call("POST", fmt.Sprintf("/api/external/inbounds/del/%d", id), nil, nil); err != nil {
+		logger.Errorf("NodeClient DelInbound %d failed: %v", id, err)
+		return err
+	}
+	return nil
+}
+
+// AddClients appends clients to an inbound on the remote node.
+func (nc *NodeClient) AddClients(inboundId int, clients []model.Client) error {
+	data, err := clientsPayload(inboundId, clients)
+	if err != nil {
+		return err
+	}
+	if err := nc.call("POST", "/api/external/inbounds/addClient", data, nil); err != nil {
+		logger.Errorf("NodeClient AddClients to inbound %d failed: %v", inboundId, err)
+		return err
+	}
+	return nil
+}
+
+// UpdateClient replaces the client identified by clientId (UUID, password or email,
+// depending on the inbound protocol) in an inbound on the remote node.
+func (nc *NodeClient) UpdateClient(inboundId int, clientId string, client model.Client) error {
+	data, err := clientsPayload(inboundId, []model.Client{client})
+	if err != nil {
+		return err
 	}
+	endpoint := "/api/external/inbounds/updateClient/" + url.PathEscape(clientId)
+	if err := nc.call("POST", endpoint, data, nil); err != nil {
+		logger.Errorf("NodeClient UpdateClient %s in inbound %d failed: %v", clientId, inboundId, err)
+		return err
+	}
+	return nil
+}
+
+// DelClient removes a client from an inbound on the remote node.
+func (nc *NodeClient) DelClient(inboundId int, clientId string) error {
+	endpoint := fmt.Sprintf("/api/external/inbounds/%d/delClient/%s", inboundId, url.PathEscape(clientId))
+	if err := nc.call("POST", endpoint, nil, nil); err != nil {
+		logger.Errorf("NodeClient DelClient %s in inbound %d failed: %v", clientId, inboundId, err)
+		return err
+	}
+	return nil
+}
+
+// ResetClientTraffic resets the traffic counters of a single client on the remote node.
+func (nc *NodeClient) ResetClientTraffic(inboundId int, email string) error {
+	endpoint := fmt.Sprintf("/api/external/inbounds/%d/resetClientTraffic/%s", inboundId, url.PathEscape(email))
+	if err := nc.call("POST", endpoint, nil, nil); err != nil {
+		logger.Errorf("NodeClient ResetClientTraffic %s in inbound %d failed: %v", email, inboundId, err)
+		return err
+	}
+	return nil
+}
+
+// ResetAllClientTraffics resets the traffic counters of all clients of an inbound on the remote node.
+func (nc *NodeClient) ResetAllClientTraffics(inboundId int) error {
+	if err := nc.call("POST", fmt.Sprintf("/api/external/inbounds/resetAllClientTraffics/%d", inboundId), nil, nil); err != nil {
+		logger.Errorf("NodeClient ResetAllClientTraffics for inbound %d failed: %v", inboundId, err)
+		return err
+	}
+	return nil
+}
+
+// RestartXray forces a restart of the xray process on the remote node.
+func (nc *NodeClient) RestartXray() error {
+	if err := nc.call("POST", "/api/external/xray/restart", nil, nil); err != nil {
+		logger.Errorf("NodeClient RestartXray failed: %v", err)
+		return err
+	}
+	return nil
+}
+
+// clientsPayload wraps clients into the inbound shape expected by the client endpoints.
+func clientsPayload(inboundId int, clients []model.Client) (*model.Inbound, error) {
+	settings, err := json.Marshal(map[string][]model.Client{"clients": clients})
+	if err != nil {
+		return nil, common.NewError("failed to marshal clients:", err)
+	}
+	return &model.Inbound{Id: inboundId, Settings: string(settings)}, nil
+}
 
-	return filteredInbounds, nil
+// RotateKey asks the node to replace its external API key. The node keeps accepting the
+// old key for a short grace period, so requests already in flight still succeed.
+func (nc *NodeClient) RotateKey(key string) error {
+	return nc.call("POST", "/api/external/auth/rotate", map[string]string{"key": key}, nil)
 }
 
 // CheckConnection checks if the node is accessible and returns its status.
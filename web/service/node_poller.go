@@ -0,0 +1,180 @@
+package service
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+	"github.com/mhsanaei/3x-ui/v2/logger"
+)
+
+const (
+	// nodePollBaseBackoff is how long polling pauses after the first failed status check of a node.
+	nodePollBaseBackoff = 30 * time.Second
+	// nodePollMaxBackoff caps the pause between status checks of an unreachable node.
+	nodePollMaxBackoff = 10 * time.Minute
+	// defaultNodePollWorkers is used when the worker setting is missing or invalid.
+	defaultNodePollWorkers = 8
+)
+
+// NodePollState describes the latest polls of a node.
+type NodePollState struct {
+	NodeId      int    `json:"nodeId"`
+	LastCheck   int64  `json:"lastCheck"`   // Last status check timestamp
+	CheckMs     int64  `json:"checkMs"`     // Duration of the last status check
+	LastSync    int64  `json:"lastSync"`    // Last stats sync timestamp
+	SyncMs      int64  `json:"syncMs"`      // Duration of the last stats sync
+	LastError   string `json:"lastError"`   // Error of the last failed poll, cleared by a successful check
+	LastErrorAt int64  `json:"lastErrorAt"` // When LastError happened
+	Failures    int    `json:"failures"`    // Consecutive failed status checks
+	NextAttempt int64  `json:"nextAttempt"` // Scheduled polls are skipped until then, 0 when not backing off
+}
+
+// nodePollTracker keeps the poll state of every node in memory. Consecutive failed status
+// checks push the next scheduled poll of the node back exponentially.
+type nodePollTracker struct {
+	mu     sync.Mutex
+	states map[int]*NodePollState
+	now    func() time.Time
+}
+
+var nodePolls = &nodePollTracker{
+	states: make(map[int]*NodePollState),
+	now:    time.Now,
+}
+
+func (t *nodePollTracker) state(nodeId int) *NodePollState {
+	st, ok := t.states[nodeId]
+	if !ok {
+		st = &NodePollState{NodeId: nodeId}
+		t.states[nodeId] = st
+	}
+	return st
+}
+
+// due reports whether a scheduled poll of the node should run now.
+func (t *nodePollTracker) due(nodeId int) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	st, ok := t.states[nodeId]
+	return !ok || st.NextAttempt == 0 || t.now().Unix() >= st.NextAttempt
+}
+
+// recordCheck stores the outcome of a status check and updates the backoff of the node.
+func (t *nodePollTracker) recordCheck(nodeId int, duration time.Duration, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.now()
+	st := t.state(nodeId)
+	st.LastCheck = now.Unix()
+	st.CheckMs = duration.Milliseconds()
+	if err == nil {
+		st.Failures = 0
+		st.NextAttempt = 0
+		st.LastError = ""
+		st.LastErrorAt = 0
+		return
+	}
+	st.Failures++
+	st.LastError = err.Error()
+	st.LastErrorAt = now.Unix()
+	backoff := nodePollMaxBackoff
+	if st.Failures <= 10 {
+		backoff = min(nodePollBaseBackoff<<(st.Failures-1), nodePollMaxBackoff)
+	}
+	st.NextAttempt = now.Add(backoff).Unix()
+}
+
+// recordSync stores the outcome of a stats sync. It does not change the backoff, which
+// follows reachability as seen by status checks.
+func (t *nodePollTracker) recordSync(nodeId int, duration time.Duration, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.now()
+	st := t.state(nodeId)
+	st.LastSync = now.Unix()
+	st.SyncMs = duration.Milliseconds()
+	if err != nil {
+		st.LastError = err.Error()
+		st.LastErrorAt = now.Unix()
+	}
+}
+
+func (t *nodePollTracker) forget(nodeId int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.states, nodeId)
+}
+
+func (t *nodePollTracker) snapshot() []NodePollState {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	states := make([]NodePollState, 0, len(t.states))
+	for _, st := range t.states {
+		states = append(states, *st)
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].NodeId < states[j].NodeId })
+	return states
+}
+
+// GetNodePollStates returns the poll duration, last error and backoff of every polled node.
+func (s *NodeService) GetNodePollStates() []NodePollState {
+	return nodePolls.snapshot()
+}
+
+// pollNodes runs poll for every node on a bounded pool of workers. Unless force is set,
+// nodes that are backing off are skipped. Nodes not started before ctx is done are skipped
+// as well. It returns the last poll error, or the context error when the pass was cut short.
+func pollNodes(ctx context.Context, nodes []*model.Node, force bool, poll func(context.Context, *model.Node) error) error {
+	settingService := SettingService{}
+	workers, err := settingService.GetNodePollWorkers()
+	if err != nil || workers <= 0 {
+		workers = defaultNodePollWorkers
+	}
+
+	queue := make(chan *model.Node)
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		lastErr error
+	)
+	for i := 0; i < min(workers, len(nodes)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for node := range queue {
+				if err := poll(ctx, node); err != nil && ctx.Err() == nil {
+					mu.Lock()
+					lastErr = err
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+
+	stopped := false
+dispatch:
+	for _, node := range nodes {
+		if !force && !nodePolls.due(node.Id) {
+			continue
+		}
+		select {
+		case queue <- node:
+		case <-ctx.Done():
+			stopped = true
+			break dispatch
+		}
+	}
+	close(queue)
+	wg.Wait()
+
+	if stopped {
+		logger.Warning("Node poll pass stopped before every node was polled:", ctx.Err())
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return lastErr
+}
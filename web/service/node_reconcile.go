@@ -0,0 +1,499 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/database"
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+	"github.com/mhsanaei/3x-ui/v2/logger"
+	"github.com/mhsanaei/3x-ui/v2/util/common"
+)
+
+// Drift actions reported by the reconciler.
+const (
+	DriftCreate = "create"
+	DriftUpdate = "update"
+	DriftDelete = "delete"
+)
+
+// InboundDrift describes one difference between the declared and the actual inbounds of a node.
+type InboundDrift struct {
+	Action   string   `json:"action"`             // create, update or delete
+	Listen   string   `json:"listen"`             // Listen address of the inbound
+	Port     int      `json:"port"`               // Port of the inbound
+	Remark   string   `json:"remark"`             // Remark of the spec or the remote inbound
+	SpecId   int      `json:"specId,omitempty"`   // Spec ID, empty for undeclared inbounds
+	RemoteId int      `json:"remoteId,omitempty"` // Inbound ID on the node, empty for missing inbounds
+	Fields   []string `json:"fields,omitempty"`   // Fields that differ, set for updates
+}
+
+// NodeDriftReport is the result of comparing a node against its declared inbounds.
+type NodeDriftReport struct {
+	NodeId    int            `json:"nodeId"`
+	NodeName  string         `json:"nodeName"`
+	InSync    bool           `json:"inSync"`
+	Drift     []InboundDrift `json:"drift"`
+	Applied   int            `json:"applied"`         // Number of drift entries fixed by the last reconcile
+	Error     string         `json:"error,omitempty"` // Last error while diffing or converging
+	CheckedAt int64          `json:"checkedAt"`
+}
+
+var (
+	driftReports   = map[int]*NodeDriftReport{}
+	driftReportsMu sync.RWMutex
+)
+
+// NodeReconcileService converges managed nodes to their declared inbound specs.
+type NodeReconcileService struct {
+	nodeService NodeService
+}
+
+// nodeGlobalClient is a global client kept on a node inbound, with the subscription it belongs to.
+type nodeGlobalClient struct {
+	gc    *model.GlobalClient
+	subId string
+}
+
+// GetSpecs returns the inbound specs declared for a node.
+func (s *NodeReconcileService) GetSpecs(nodeId int) ([]*model.NodeInboundSpec, error) {
+	db := database.GetDB()
+	var specs []*model.NodeInboundSpec
+	err := db.Where("node_id = ?", nodeId).Order("port").Find(&specs).Error
+	if err != nil {
+		return nil, err
+	}
+	return specs, nil
+}
+
+// GetSpec returns a single inbound spec.
+func (s *NodeReconcileService) GetSpec(id int) (*model.NodeInboundSpec, error) {
+	db := database.GetDB()
+	var spec model.NodeInboundSpec
+	if err := db.First(&spec, id).Error; err != nil {
+		return nil, err
+	}
+	return &spec, nil
+}
+
+// SaveSpec creates or updates an inbound spec after validating it.
+func (s *NodeReconcileService) SaveSpec(spec *model.NodeInboundSpec) error {
+	if spec.NodeId <= 0 {
+		return common.NewError("node ID is required")
+	}
+	if spec.Port <= 0 || spec.Port > 65535 {
+		return common.NewError("spec port must be between 1 and 65535")
+	}
+	if spec.Protocol == "" {
+		return common.NewError("spec protocol is required")
+	}
+	for name, raw := range map[string]string{
+		"settings":       spec.Settings,
+		"streamSettings": spec.StreamSettings,
+		"sniffing":       spec.Sniffing,
+	} {
+		if raw != "" && !json.Valid([]byte(raw)) {
+			return common.NewErrorf("spec %s is not valid JSON", name)
+		}
+	}
+
+	db := database.GetDB()
+	var count int64
+	err := db.Model(&model.NodeInboundSpec{}).
+		Where("node_id = ? AND port = ? AND listen = ? AND id <> ?", spec.NodeId, spec.Port, spec.Listen, spec.Id).
+		Count(&count).Error
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return common.NewErrorf("a spec for %s already exists on this node", specKey(spec.Listen, spec.Port))
+	}
+
+	if spec.Id > 0 {
+		return db.Save(spec).Error
+	}
+	return db.Create(spec).Error
+}
+
+// DeleteSpec removes an inbound spec. The inbound is removed from the node on the next reconcile.
+func (s *NodeReconcileService) DeleteSpec(id int) error {
+	db := database.GetDB()
+	return db.Delete(&model.NodeInboundSpec{}, id).Error
+}
+
+// DiffNode compares the declared specs of a node with its actual inbounds.
+// Undeclared inbounds are reported for deletion only on managed nodes. Global clients
+// provisioned on an inbound count as declared by its spec.
+func (s *NodeReconcileService) DiffNode(node *model.Node) (*NodeDriftReport, []*model.Inbound, error) {
+	report := &NodeDriftReport{
+		NodeId:    node.Id,
+		NodeName:  node.Name,
+		Drift:     []InboundDrift{},
+		CheckedAt: time.Now().Unix(),
+	}
+
+	specs, err := s.GetSpecs(node.Id)
+	if err != nil {
+		return report, nil, err
+	}
+	remote, err := NewNodeClient(node).GetInbounds()
+	if err != nil {
+		return report, nil, err
+	}
+	globalClients, err := s.nodeGlobalClients(node.Id)
+	if err != nil {
+		return report, nil, err
+	}
+
+	remoteByKey := make(map[string]*model.Inbound, len(remote))
+	for _, inbound := range remote {
+		remoteByKey[specKey(inbound.Listen, inbound.Port)] = inbound
+	}
+
+	declared := make(map[string]bool, len(specs))
+	for _, spec := range specs {
+		key := specKey(spec.Listen, spec.Port)
+		declared[key] = true
+
+		inbound, ok := remoteByKey[key]
+		if !ok {
+			report.Drift = append(report.Drift, InboundDrift{
+				Action: DriftCreate,
+				Listen: spec.Listen,
+				Port:   spec.Port,
+				Remark: spec.Remark,
+				SpecId: spec.Id,
+			})
+			continue
+		}
+		if fields := diffInbound(withGlobalClients(spec, globalClients[inbound.Id]), inbound); len(fields) > 0 {
+			report.Drift = append(report.Drift, InboundDrift{
+				Action:   DriftUpdate,
+				Listen:   spec.Listen,
+				Port:     spec.Port,
+				Remark:   spec.Remark,
+				SpecId:   spec.Id,
+				RemoteId: inbound.Id,
+				Fields:   fields,
+			})
+		}
+	}
+
+	if node.Managed {
+		for _, inbound := range remote {
+			if declared[specKey(inbound.Listen, inbound.Port)] {
+				continue
+			}
+			report.Drift = append(report.Drift, InboundDrift{
+				Action:   DriftDelete,
+				Listen:   inbound.Listen,
+				Port:     inbound.Port,
+				Remark:   inbound.Remark,
+				RemoteId: inbound.Id,
+			})
+		}
+	}
+
+	report.InSync = len(report.Drift) == 0
+	return report, remote, nil
+}
+
+// CheckNodeDrift diffs a node without changing it and stores the report.
+func (s *NodeReconcileService) CheckNodeDrift(nodeId int) (*NodeDriftReport, error) {
+	node, err := s.nodeService.GetNode(nodeId)
+	if err != nil {
+		return nil, err
+	}
+	report, _, err := s.DiffNode(node)
+	if err != nil {
+		report.Error = err.Error()
+	}
+	storeDriftReport(report)
+	return report, err
+}
+
+// ReconcileNode converges a node to its declared specs and returns the drift left afterwards.
+func (s *NodeReconcileService) ReconcileNode(nodeId int) (*NodeDriftReport, error) {
+	node, err := s.nodeService.GetNode(nodeId)
+	if err != nil {
+		return nil, err
+	}
+	report, err := s.reconcile(node)
+	if err != nil {
+		report.Error = err.Error()
+	}
+	storeDriftReport(report)
+	return report, err
+}
+
+// ReconcileAllNodes converges every enabled managed node.
+func (s *NodeReconcileService) ReconcileAllNodes() {
+	db := database.GetDB()
+	var nodes []*model.Node
+	if err := db.Where("enable = ? AND managed = ?", true, true).Find(&nodes).Error; err != nil {
+		logger.Warning("Failed to load managed nodes:", err)
+		return
+	}
+	for _, node := range nodes {
+		report, err := s.reconcile(node)
+		if err != nil {
+			logger.Warningf("Failed to reconcile node %s: %v", node.Name, err)
+			report.Error = err.Error()
+		}
+		storeDriftReport(report)
+	}
+}
+
+// GetDriftReports returns the last drift report of every node that has been checked.
+func (s *NodeReconcileService) GetDriftReports() []*NodeDriftReport {
+	driftReportsMu.RLock()
+	defer driftReportsMu.RUnlock()
+	reports := make([]*NodeDriftReport, 0, len(driftReports))
+	for _, report := range driftReports {
+		reports = append(reports, report)
+	}
+	sort.Slice(reports, func(i, j int) bool {
+		return reports[i].NodeId < reports[j].NodeId
+	})
+	return reports
+}
+
+func (s *NodeReconcileService) reconcile(node *model.Node) (*NodeDriftReport, error) {
+	report, remote, err := s.DiffNode(node)
+	if err != nil || report.InSync {
+		return report, err
+	}
+
+	specs, err := s.GetSpecs(node.Id)
+	if err != nil {
+		return report, err
+	}
+	globalClients, err := s.nodeGlobalClients(node.Id)
+	if err != nil {
+		return report, err
+	}
+	specById := make(map[int]*model.NodeInboundSpec, len(specs))
+	for _, spec := range specs {
+		specById[spec.Id] = spec
+	}
+	remoteById := make(map[int]*model.Inbound, len(remote))
+	for _, inbound := range remote {
+		remoteById[inbound.Id] = inbound
+	}
+
+	client := NewNodeClient(node)
+	applied := 0
+	var lastErr error
+	for _, drift := range report.Drift {
+		switch drift.Action {
+		case DriftCreate:
+			_, err = client.AddInbound(specById[drift.SpecId].ToInbound())
+		case DriftUpdate:
+			// Start from the remote inbound so that traffic counters and expiry stay untouched
+			inbound := *remoteById[drift.RemoteId]
+			applySpec(&inbound, withGlobalClients(specById[drift.SpecId], globalClients[inbound.Id]))
+			_, err = client.UpdateInbound(&inbound)
+		case DriftDelete:
+			err = client.DelInbound(drift.RemoteId)
+		}
+		if err != nil {
+			logger.Warningf("Failed to %s inbound %s on node %s: %v", drift.Action, specKey(drift.Listen, drift.Port), node.Name, err)
+			lastErr = err
+			continue
+		}
+		applied++
+	}
+	if applied > 0 {
+		logger.Infof("Reconciled %d inbound(s) on node %s", applied, node.Name)
+	}
+
+	after, _, err := s.DiffNode(node)
+	after.Applied = applied
+	if err != nil {
+		return after, err
+	}
+	return after, lastErr
+}
+
+// nodeGlobalClients returns the global clients of the multi-subscriptions containing a node by
+// the ID of the node inbound they are provisioned on. They are managed by the global client
+// service and the cluster quota job, so reconciling keeps them next to the clients of the spec.
+func (s *NodeReconcileService) nodeGlobalClients(nodeId int) (map[int][]nodeGlobalClient, error) {
+	db := database.GetDB()
+	var gcs []*model.GlobalClient
+	if err := db.Find(&gcs).Error; err != nil {
+		return nil, err
+	}
+	globalClientService := GlobalClientService{}
+	multiSubService := MultiSubscriptionService{}
+	result := map[int][]nodeGlobalClient{}
+	for _, gc := range gcs {
+		mapping, err := globalClientService.GetNodeInbounds(gc)
+		if err != nil {
+			continue
+		}
+		inboundId, ok := mapping[nodeId]
+		if !ok {
+			continue
+		}
+		ms, err := multiSubService.GetMultiSubscription(gc.MultiSubId)
+		if err != nil {
+			continue
+		}
+		if nodeIds, _ := multiSubService.GetNodeIds(ms); !slices.Contains(nodeIds, nodeId) {
+			continue
+		}
+		result[inboundId] = append(result[inboundId], nodeGlobalClient{gc: gc, subId: ms.SubId})
+	}
+	return result, nil
+}
+
+// withGlobalClients returns the spec with the global clients of its inbound added to the
+// clients it declares. Clients the spec declares itself take precedence.
+func withGlobalClients(spec *model.NodeInboundSpec, clients []nodeGlobalClient) *model.NodeInboundSpec {
+	if len(clients) == 0 {
+		return spec
+	}
+	settings := map[string]any{}
+	if spec.Settings != "" {
+		if err := json.Unmarshal([]byte(spec.Settings), &settings); err != nil || settings == nil {
+			return spec
+		}
+	}
+	method, _ := settings["method"].(string)
+	declared, _ := settings["clients"].([]any)
+	emails := make(map[string]bool, len(declared))
+	for _, c := range declared {
+		if client, ok := c.(map[string]any); ok {
+			email, _ := client["email"].(string)
+			emails[email] = true
+		}
+	}
+	for _, c := range clients {
+		if emails[c.gc.Email] {
+			continue
+		}
+		var client map[string]any
+		raw, _ := json.Marshal(c.gc.ToClient(spec.Protocol, method, c.subId))
+		json.Unmarshal(raw, &client)
+		declared = append(declared, client)
+	}
+	settings["clients"] = declared
+	raw, err := json.Marshal(settings)
+	if err != nil {
+		return spec
+	}
+	desired := *spec
+	desired.Settings = string(raw)
+	return &desired
+}
+
+func storeDriftReport(report *NodeDriftReport) {
+	if report == nil {
+		return
+	}
+	driftReportsMu.Lock()
+	driftReports[report.NodeId] = report
+	driftReportsMu.Unlock()
+}
+
+func specKey(listen string, port int) string {
+	switch listen {
+	case "", "0.0.0.0", "::", "::0":
+		listen = ""
+	}
+	return fmt.Sprintf("%s:%d", listen, port)
+}
+
+func applySpec(inbound *model.Inbound, spec *model.NodeInboundSpec) {
+	inbound.Remark = spec.Remark
+	inbound.Enable = spec.Enable
+	inbound.Listen = spec.Listen
+	inbound.Port = spec.Port
+	inbound.Protocol = spec.Protocol
+	inbound.Settings = spec.Settings
+	inbound.StreamSettings = spec.StreamSettings
+	inbound.Sniffing = spec.Sniffing
+}
+
+// diffInbound returns the names of the fields where the remote inbound differs from the spec.
+func diffInbound(spec *model.NodeInboundSpec, inbound *model.Inbound) []string {
+	var fields []string
+	if spec.Remark != inbound.Remark {
+		fields = append(fields, "remark")
+	}
+	if spec.Enable != inbound.Enable {
+		fields = append(fields, "enable")
+	}
+	if spec.Protocol != inbound.Protocol {
+		fields = append(fields, "protocol")
+	}
+	if !reflect.DeepEqual(normalizeSettings(spec.Settings), normalizeSettings(inbound.Settings)) {
+		fields = append(fields, "settings")
+	}
+	if !reflect.DeepEqual(normalizeJSON(spec.StreamSettings), normalizeJSON(inbound.StreamSettings)) {
+		fields = append(fields, "streamSettings")
+	}
+	if !reflect.DeepEqual(normalizeJSON(spec.Sniffing), normalizeJSON(inbound.Sniffing)) {
+		fields = append(fields, "sniffing")
+	}
+	return fields
+}
+
+// normalizeJSON decodes a JSON document so that formatting and key order do not count as drift.
+func normalizeJSON(raw string) any {
+	if raw == "" {
+		return nil
+	}
+	var v any
+	if err := json.Unmarshal([]byte(raw), &v); err != nil {
+		return raw
+	}
+	return v
+}
+
+// normalizeSettings is normalizeJSON for protocol settings. The node stamps clients with
+// timestamps and writes every client field, so those and zero values are ignored.
+func normalizeSettings(raw string) any {
+	v := normalizeJSON(raw)
+	settings, ok := v.(map[string]any)
+	if !ok {
+		return v
+	}
+	clients, ok := settings["clients"].([]any)
+	if !ok {
+		return v
+	}
+	for _, c := range clients {
+		client, ok := c.(map[string]any)
+		if !ok {
+			continue
+		}
+		delete(client, "created_at")
+		delete(client, "updated_at")
+		for key, value := range client {
+			switch value := value.(type) {
+			case nil:
+				delete(client, key)
+			case string:
+				if value == "" {
+					delete(client, key)
+				}
+			case float64:
+				if value == 0 {
+					delete(client, key)
+				}
+			case bool:
+				if !value {
+					delete(client, key)
+				}
+			}
+		}
+	}
+	return settings
+}
@@ -1,23 +1,22 @@
 package service
 
 import (
-	"path/filepath"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/mhsanaei/3x-ui/v2/database"
 	"github.com/mhsanaei/3x-ui/v2/database/model"
+	"github.com/mhsanaei/3x-ui/v2/util/common"
 )
 
-func setupServiceTestDB(t *testing.T) {
-	t.Helper()
-	_ = database.CloseDB()
-	tdb := filepath.Join(t.TempDir(), "test.db")
-	if err := database.InitDB(tdb); err != nil {
-		t.Fatalf("failed to init test db: %v", err)
-	}
-	t.Cleanup(func() { _ = database.CloseDB() })
-}
-
 func TestNodeServiceValidation(t *testing.T) {
 	setupServiceTestDB(t)
 	svc := &NodeService{}
@@ -30,6 +29,23 @@ func TestNodeServiceValidation(t *testing.T) {
 	if err := svc.AddNode(node); err == nil {
 		t.Fatalf("expected error when port <= 0")
 	}
+
+	node = &model.Node{Name: "endpoints", Host: "127.0.0.1", Port: 2053, Endpoints: `{"address":"cdn.example.com"}`}
+	if err := svc.AddNode(node); err == nil {
+		t.Fatalf("expected error when endpoints are not an array")
+	}
+	node.Endpoints = `[{"address":"cdn.example.com","port":70000}]`
+	if err := svc.AddNode(node); err == nil {
+		t.Fatalf("expected error for an endpoint port out of range")
+	}
+	node.Endpoints = `[ {"address":" cdn.example.com ","sni":"front.example.com"} ]`
+	if err := svc.AddNode(node); err != nil {
+		t.Fatalf("AddNode failed: %v", err)
+	}
+	endpoints, err := node.GetEndpoints()
+	if err != nil || len(endpoints) != 1 || endpoints[0].Address != "cdn.example.com" || endpoints[0].Sni != "front.example.com" {
+		t.Fatalf("unexpected endpoints %+v (%v)", endpoints, err)
+	}
 }
 
 func TestNodeServiceCRUD(t *testing.T) {
@@ -101,3 +117,586 @@ func TestNodeServiceCRUD(t *testing.T) {
 		t.Fatalf("expected error when getting deleted node")
 	}
 }
+
+// newFakeNode starts an HTTP server answering like a node external API and returns a node pointing at it.
+func newFakeNode(t *testing.T, handler http.HandlerFunc) *model.Node {
+	t.Helper()
+	setupTestLogger(t)
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatalf("failed to parse test server url: %v", err)
+	}
+	port, _ := strconv.Atoi(u.Port())
+	return &model.Node{Name: "fake", Host: u.Hostname(), Port: port, Protocol: "http", ApiKey: "NODE_KEY"}
+}
+
+func TestNodeClientManageInbounds(t *testing.T) {
+	var calls []string
+	node := newFakeNode(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-API-Key") != "NODE_KEY" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		calls = append(calls, r.Method+" "+r.URL.Path)
+		switch r.URL.Path {
+		case "/api/external/inbounds/add":
+			var inbound model.Inbound
+			if err := json.NewDecoder(r.Body).Decode(&inbound); err != nil {
+				t.Errorf("failed to decode inbound: %v", err)
+			}
+			inbound.Id = 7
+			json.NewEncoder(w).Encode(map[string]any{"success": true, "obj": inbound})
+		case "/api/external/inbounds/addClient":
+			var data model.Inbound
+			json.NewDecoder(r.Body).Decode(&data)
+			if data.Id != 7 || !strings.Contains(data.Settings, "user@node") {
+				t.Errorf("unexpected addClient payload: %+v", data)
+			}
+			json.NewEncoder(w).Encode(map[string]any{"success": true})
+		case "/api/external/inbounds/7/delClient/user@node":
+			json.NewEncoder(w).Encode(map[string]any{"success": false, "msg": "client not found"})
+		default:
+			json.NewEncoder(w).Encode(map[string]any{"success": true})
+		}
+	})
+
+	client := NewNodeClient(node)
+	created, err := client.AddInbound(&model.Inbound{Port: 443, Protocol: model.VLESS, Settings: `{"clients":[]}`})
+	if err != nil {
+		t.Fatalf("AddInbound failed: %v", err)
+	}
+	if created.Id != 7 || created.Port != 443 {
+		t.Fatalf("unexpected inbound returned: %+v", created)
+	}
+
+	if err := client.AddClients(created.Id, []model.Client{{ID: "uuid", Email: "user@node", Enable: true}}); err != nil {
+		t.Fatalf("AddClients failed: %v", err)
+	}
+
+	err = client.DelClient(created.Id, "user@node")
+	if err == nil || !strings.Contains(err.Error(), "client not found") {
+		t.Fatalf("expected node error to be surfaced, got %v", err)
+	}
+
+	if err := client.RestartXray(); err != nil {
+		t.Fatalf("RestartXray failed: %v", err)
+	}
+
+	expected := []string{
+		"POST /api/external/inbounds/add",
+		"POST /api/external/inbounds/addClient",
+		"POST /api/external/inbounds/7/delClient/user@node",
+		"POST /api/external/xray/restart",
+	}
+	if strings.Join(calls, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("unexpected calls:\n%s", strings.Join(calls, "\n"))
+	}
+}
+
+func TestNodeReconcile(t *testing.T) {
+	setupServiceTestDB(t)
+
+	var mu sync.Mutex
+	nextId := 3
+	remote := map[int]*model.Inbound{
+		1: {Id: 1, Port: 443, Protocol: model.VLESS, Remark: "old", Enable: true, Up: 100,
+			Settings: `{"clients":[{"id":"uuid","email":"a@node","enable":true,"tgId":0,"created_at":1}]}`},
+		2: {Id: 2, Port: 9000, Protocol: model.VMESS, Remark: "manual", Enable: true},
+	}
+	node := newFakeNode(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		path := r.URL.Path
+		switch {
+		case path == "/api/external/inbounds/list":
+			list := []*model.Inbound{}
+			for id := 1; id < nextId; id++ {
+				if inbound, ok := remote[id]; ok {
+					list = append(list, inbound)
+				}
+			}
+			json.NewEncoder(w).Encode(map[string]any{"success": true, "obj": list})
+		case path == "/api/external/inbounds/add":
+			inbound := &model.Inbound{}
+			json.NewDecoder(r.Body).Decode(inbound)
+			inbound.Id = nextId
+			nextId++
+			remote[inbound.Id] = inbound
+			json.NewEncoder(w).Encode(map[string]any{"success": true, "obj": inbound})
+		case strings.HasPrefix(path, "/api/external/inbounds/update/"):
+			inbound := &model.Inbound{}
+			json.NewDecoder(r.Body).Decode(inbound)
+			if inbound.Up != 100 {
+				t.Errorf("update must keep remote traffic counters, got up=%d", inbound.Up)
+			}
+			remote[inbound.Id] = inbound
+			json.NewEncoder(w).Encode(map[string]any{"success": true, "obj": inbound})
+		case strings.HasPrefix(path, "/api/external/inbounds/del/"):
+			id, _ := strconv.Atoi(strings.TrimPrefix(path, "/api/external/inbounds/del/"))
+			delete(remote, id)
+			json.NewEncoder(w).Encode(map[string]any{"success": true, "obj": id})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+
+	nodeService := NodeService{}
+	if err := nodeService.AddNode(node); err != nil {
+		t.Fatalf("AddNode failed: %v", err)
+	}
+
+	svc := NodeReconcileService{}
+	specs := []*model.NodeInboundSpec{
+		{NodeId: node.Id, Port: 443, Protocol: model.VLESS, Remark: "new", Enable: true,
+			Settings: `{"clients":[{"email":"a@node","id":"uuid","enable":true}]}`},
+		{NodeId: node.Id, Port: 8443, Protocol: model.Trojan, Remark: "added", Enable: false},
+	}
+	for _, spec := range specs {
+		if err := svc.SaveSpec(spec); err != nil {
+			t.Fatalf("SaveSpec failed: %v", err)
+		}
+	}
+	if err := svc.SaveSpec(&model.NodeInboundSpec{NodeId: node.Id, Port: 443, Protocol: model.VLESS}); err == nil {
+		t.Fatalf("expected duplicate spec to be rejected")
+	}
+
+	// Unmanaged nodes never lose undeclared inbounds
+	report, err := svc.CheckNodeDrift(node.Id)
+	if err != nil {
+		t.Fatalf("CheckNodeDrift failed: %v", err)
+	}
+	actions := map[string]int{}
+	for _, drift := range report.Drift {
+		actions[drift.Action]++
+		if drift.Action == DriftUpdate && strings.Join(drift.Fields, ",") != "remark" {
+			t.Fatalf("expected only remark to drift, got %v", drift.Fields)
+		}
+	}
+	if report.InSync || actions[DriftCreate] != 1 || actions[DriftUpdate] != 1 || actions[DriftDelete] != 0 {
+		t.Fatalf("unexpected drift for unmanaged node: %+v", report.Drift)
+	}
+
+	node.Managed = true
+	if err := nodeService.UpdateNode(node); err != nil {
+		t.Fatalf("UpdateNode failed: %v", err)
+	}
+	report, err = svc.ReconcileNode(node.Id)
+	if err != nil {
+		t.Fatalf("ReconcileNode failed: %v", err)
+	}
+	if !report.InSync || report.Applied != 3 {
+		t.Fatalf("expected node to converge after 3 changes, got %+v", report)
+	}
+	if _, ok := remote[2]; ok {
+		t.Fatalf("undeclared inbound should be removed from a managed node")
+	}
+	if remote[1].Remark != "new" {
+		t.Fatalf("expected inbound to be updated in place, got %+v", remote[1])
+	}
+	// A spec saved as disabled is created disabled on the node
+	if stored, _ := svc.GetSpec(specs[1].Id); stored == nil || stored.Enable {
+		t.Fatalf("expected spec saved as disabled to be stored disabled, got %+v", stored)
+	}
+	if remote[3] == nil || remote[3].Remark != "added" || remote[3].Enable {
+		t.Fatalf("expected disabled inbound to be created on the node, got %+v", remote[3])
+	}
+
+	reports := svc.GetDriftReports()
+	if len(reports) != 1 || reports[0].NodeId != node.Id || !reports[0].InSync {
+		t.Fatalf("unexpected stored drift reports: %+v", reports)
+	}
+}
+
+func TestNodeStatusEventsAndUptime(t *testing.T) {
+	setupServiceTestDB(t)
+	up := true
+	node := newFakeNode(t, func(w http.ResponseWriter, r *http.Request) {
+		if !up {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"success":true,"obj":{"xray":{"state":"running"}}}`))
+	})
+	svc := &NodeService{}
+	if err := svc.AddNode(node); err != nil {
+		t.Fatalf("AddNode failed: %v", err)
+	}
+
+	for _, state := range []bool{true, true, false, true} {
+		up = state
+		svc.CheckNodeStatus(context.Background(), node)
+	}
+	events, err := svc.GetNodeStatusEvents(node.Id, false, 0)
+	if err != nil || len(events) != 4 {
+		t.Fatalf("expected 4 recorded checks, got %d (%v)", len(events), err)
+	}
+	transitions, _ := svc.GetNodeStatusEvents(node.Id, true, 0)
+	// offline (default) -> online, online -> offline, offline -> online
+	if len(transitions) != 3 || transitions[1].Status != model.NodeStatusOffline || transitions[1].Error == "" {
+		t.Fatalf("unexpected transitions: %+v", transitions)
+	}
+
+	// Replace the live checks with a synthetic history: 30 minutes online, 10 minutes
+	// offline, online since, checked every 30s. A 2-hour gap before it is not monitored.
+	// Status changes are flagged like CheckNodeStatus flags them.
+	database.GetDB().Where("node_id = ?", node.Id).Delete(&model.NodeStatusEvent{})
+	now := time.Now().Unix()
+	start := now - 3600
+	var history []model.NodeStatusEvent
+	history = append(history, model.NodeStatusEvent{NodeId: node.Id, Status: model.NodeStatusOnline, PrevStatus: model.NodeStatusOffline, Transition: true, LatencyMs: 20, CheckedAt: start - 2*3600})
+	for ts := start; ts < now; ts += 30 {
+		event := model.NodeStatusEvent{NodeId: node.Id, Status: model.NodeStatusOnline, LatencyMs: 20, CheckedAt: ts}
+		if ts >= start+1800 && ts < start+2400 {
+			event.Status = model.NodeStatusOffline
+			event.Error = "timeout"
+			event.LatencyMs = 5000
+		}
+		event.PrevStatus = history[len(history)-1].Status
+		event.Transition = event.PrevStatus != event.Status
+		history = append(history, event)
+	}
+	if err := database.GetDB().Create(&history).Error; err != nil {
+		t.Fatalf("failed to insert history: %v", err)
+	}
+
+	report, err := svc.GetNodeUptime(node.Id)
+	if err != nil {
+		t.Fatalf("GetNodeUptime failed: %v", err)
+	}
+	day := report.Window("24h")
+	if day == nil || day.Availability == nil {
+		t.Fatalf("expected a 24h window with data, got %+v", report.Windows)
+	}
+	// 120s of the isolated check plus the hour of 30s checks
+	if day.Monitored < 3600 || day.Monitored > 3600+120+30 {
+		t.Fatalf("unexpected monitored time %d", day.Monitored)
+	}
+	if day.Downtime != 600 {
+		t.Fatalf("expected 600s downtime, got %d", day.Downtime)
+	}
+	if *day.Availability < 83 || *day.Availability > 85 {
+		t.Fatalf("unexpected availability %.2f", *day.Availability)
+	}
+	if day.AvgLatencyMs != 20 {
+		t.Fatalf("expected failed checks to be left out of latency, got %.1f", day.AvgLatencyMs)
+	}
+	if day.Outages != 1 || len(report.Outages) != 1 {
+		t.Fatalf("expected one outage, got %d/%d", day.Outages, len(report.Outages))
+	}
+	outage := report.Outages[0]
+	if outage.Start != start+1800 || outage.End != start+2400 || outage.Duration != 600 || outage.Error != "timeout" {
+		t.Fatalf("unexpected outage %+v", outage)
+	}
+
+	// Once completed hours are rolled up the report reads them and stays the same
+	if err := svc.RollupNodeUptime(time.Now()); err != nil {
+		t.Fatalf("RollupNodeUptime failed: %v", err)
+	}
+	var rollups int64
+	database.GetDB().Model(&model.NodeUptimeRollup{}).Where("node_id = ?", node.Id).Count(&rollups)
+	if rollups < 2 {
+		t.Fatalf("expected the completed hours to be rolled up, got %d", rollups)
+	}
+	rolled, err := svc.GetNodeUptime(node.Id)
+	if err != nil {
+		t.Fatalf("GetNodeUptime failed: %v", err)
+	}
+	rolledDay := rolled.Window("24h")
+	// The last check keeps counting while time passes between the two reports
+	if rolledDay.Monitored < day.Monitored || rolledDay.Monitored > day.Monitored+5 || rolledDay.Downtime != day.Downtime || rolledDay.Checks != day.Checks ||
+		rolledDay.Failures != day.Failures || rolledDay.AvgLatencyMs != day.AvgLatencyMs || len(rolled.Outages) != 1 {
+		t.Fatalf("expected the rolled up report to match, got %+v, want %+v", rolledDay, day)
+	}
+
+	if n, err := svc.PruneNodeStatusEvents(90 * time.Minute); err != nil || n != 1 {
+		t.Fatalf("expected the old check to be pruned, got %d (%v)", n, err)
+	}
+}
+
+func TestNodeStatsRollupAndHistory(t *testing.T) {
+	setupServiceTestDB(t)
+	setupTestLogger(t)
+	svc := &NodeService{}
+	db := database.GetDB()
+
+	now := time.Now().UTC().Truncate(time.Hour).Add(30 * time.Minute)
+	day := now.Truncate(24*time.Hour).AddDate(0, 0, -3)
+	var samples []model.NodeStats
+	for h := 0; h < 24; h++ {
+		for k := 0; k < 3; k++ {
+			samples = append(samples, model.NodeStats{
+				NodeId:      1,
+				Cpu:         float64(h*10 + k),
+				Mem:         uint64(100 * (k + 1)),
+				CollectedAt: day.Add(time.Duration(h)*time.Hour + time.Duration(k)*20*time.Minute).Unix(),
+			})
+		}
+	}
+	// A sample of the current, incomplete hour is neither rolled up nor pruned
+	samples = append(samples, model.NodeStats{NodeId: 1, Cpu: 50, CollectedAt: now.Add(-10 * time.Minute).Unix()})
+	if err := db.Create(&samples).Error; err != nil {
+		t.Fatalf("failed to insert samples: %v", err)
+	}
+
+	if err := svc.RollupNodeStats(now); err != nil {
+		t.Fatalf("RollupNodeStats failed: %v", err)
+	}
+	// Running again must not duplicate buckets
+	if err := svc.RollupNodeStats(now); err != nil {
+		t.Fatalf("second RollupNodeStats failed: %v", err)
+	}
+
+	hourly, err := svc.GetNodeStatsHistory(1, day.Unix(), day.Add(24*time.Hour).Unix(), NodeStatsResolutionHour)
+	if err != nil {
+		t.Fatalf("GetNodeStatsHistory failed: %v", err)
+	}
+	if len(hourly.Points) != 24 {
+		t.Fatalf("expected 24 hourly points, got %d", len(hourly.Points))
+	}
+	p := hourly.Points[5]
+	if p.BucketStart != day.Add(5*time.Hour).Unix() || p.Samples != 3 || p.CpuMin != 50 || p.CpuMax != 52 || p.CpuAvg != 51 || p.MemAvg != 200 {
+		t.Fatalf("unexpected hourly point %+v", p)
+	}
+
+	daily, err := svc.GetNodeStatsHistory(1, day.Add(-time.Hour).Unix(), now.Unix(), NodeStatsResolutionDay)
+	if err != nil {
+		t.Fatalf("GetNodeStatsHistory failed: %v", err)
+	}
+	if len(daily.Points) != 1 {
+		t.Fatalf("expected one daily point, got %d", len(daily.Points))
+	}
+	d := daily.Points[0]
+	if d.Samples != 72 || d.CpuMin != 0 || d.CpuMax != 232 || d.CpuAvg != 116 {
+		t.Fatalf("unexpected daily point %+v", d)
+	}
+
+	var raw int64
+	db.Model(&model.NodeStats{}).Count(&raw)
+	if raw != 1 {
+		t.Fatalf("expected raw samples past retention to be pruned, %d left", raw)
+	}
+
+	recent, err := svc.GetNodeStatsHistory(1, now.Add(-time.Hour).Unix(), now.Unix(), NodeStatsResolutionAuto)
+	if err != nil || recent.Resolution != NodeStatsResolutionRaw || len(recent.Points) != 1 || recent.Points[0].CpuAvg != 50 {
+		t.Fatalf("expected the recent raw sample, got %+v (%v)", recent, err)
+	}
+	if _, err := svc.GetNodeStatsHistory(1, 0, 0, "minute"); err == nil {
+		t.Fatalf("expected an unknown resolution to be rejected")
+	}
+}
+
+func TestPollNodesParallelWithBackoff(t *testing.T) {
+	setupServiceTestDB(t)
+	nodePolls = &nodePollTracker{states: make(map[int]*NodePollState), now: time.Now}
+	svc := &NodeService{}
+	dashboard := &DashboardService{}
+
+	var mu sync.Mutex
+	deadCalls := 0
+	calls := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return deadCalls
+	}
+	healthy := func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte(`{"success":true,"obj":{"xray":{"state":"running"}}}`))
+	}
+	var nodes []*model.Node
+	for i := 0; i < 4; i++ {
+		node := newFakeNode(t, healthy)
+		node.Name = "healthy-" + strconv.Itoa(i)
+		node.Enable = true
+		nodes = append(nodes, node)
+	}
+	dead := newFakeNode(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		deadCalls++
+		mu.Unlock()
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	dead.Name = "dead"
+	dead.Enable = true
+	nodes = append(nodes, dead)
+	for _, node := range nodes {
+		if err := svc.AddNode(node); err != nil {
+			t.Fatalf("AddNode failed: %v", err)
+		}
+	}
+
+	started := time.Now()
+	if err := dashboard.CheckAllNodesStatus(context.Background(), false); err == nil {
+		t.Fatalf("expected the dead node to be reported")
+	}
+	if elapsed := time.Since(started); elapsed > 600*time.Millisecond {
+		t.Fatalf("nodes were not polled in parallel, pass took %v", elapsed)
+	}
+
+	states := map[int]NodePollState{}
+	for _, st := range svc.GetNodePollStates() {
+		states[st.NodeId] = st
+	}
+	if st := states[dead.Id]; st.Failures != 1 || st.LastError == "" || st.NextAttempt <= time.Now().Unix() {
+		t.Fatalf("expected the dead node to back off, got %+v", st)
+	}
+	if st := states[nodes[0].Id]; st.Failures != 0 || st.LastError != "" || st.CheckMs < 200 {
+		t.Fatalf("unexpected state of a healthy node %+v", st)
+	}
+
+	// A scheduled pass skips the node while it backs off, a forced one does not
+	dashboard.CheckAllNodesStatus(context.Background(), false)
+	if n := calls(); n != 1 {
+		t.Fatalf("expected the backing off node to be skipped, got %d calls", n)
+	}
+	dashboard.CheckAllNodesStatus(context.Background(), true)
+	if n := calls(); n != 2 {
+		t.Fatalf("expected a forced pass to poll the node, got %d calls", n)
+	}
+	for _, st := range svc.GetNodePollStates() {
+		if st.NodeId == dead.Id && st.Failures != 2 {
+			t.Fatalf("expected a second failure, got %+v", st)
+		}
+	}
+
+	// A cancelled pass returns promptly and does not record the checks it cut short
+	var before int64
+	database.GetDB().Model(&model.NodeStatusEvent{}).Where("node_id <> ?", dead.Id).Count(&before)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := dashboard.CheckAllNodesStatus(ctx, true); err != context.DeadlineExceeded {
+		t.Fatalf("expected the deadline to stop the pass, got %v", err)
+	}
+	var after int64
+	database.GetDB().Model(&model.NodeStatusEvent{}).Where("node_id <> ?", dead.Id).Count(&after)
+	if after != before {
+		t.Fatalf("cancelled checks must not be recorded, %d new events", after-before)
+	}
+}
+
+func TestNodeSubCacheServesStale(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	cache := &NodeSubCache{entries: make(map[nodeSubKey]*nodeSubEntry), now: func() time.Time { return now }}
+	ttl := time.Minute
+
+	var mu sync.Mutex
+	fetches := 0
+	var fail error
+	release := make(chan struct{})
+	close(release)
+	fetch := func(ctx context.Context) ([]*model.Inbound, error) {
+		mu.Lock()
+		fetches++
+		err := fail
+		wait := release
+		mu.Unlock()
+		<-wait
+		if err != nil {
+			return nil, err
+		}
+		return []*model.Inbound{{Remark: "node"}}, nil
+	}
+	count := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return fetches
+	}
+	waitIdle := func() {
+		for i := 0; i < 100; i++ {
+			cache.mu.Lock()
+			e := cache.entries[nodeSubKey{1, "sub"}]
+			idle := e == nil || e.inflight == nil
+			cache.mu.Unlock()
+			if idle {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("refresh did not finish")
+	}
+
+	// The first lookup waits for the node, the next ones are served from cache
+	snapshot := cache.Get(context.Background(), 1, "sub", ttl, fetch)
+	if len(snapshot.Inbounds) != 1 || snapshot.Stale || snapshot.Err != nil {
+		t.Fatalf("unexpected first snapshot %+v", snapshot)
+	}
+	cache.Get(context.Background(), 1, "sub", ttl, fetch)
+	if n := count(); n != 1 {
+		t.Fatalf("expected a fresh entry to be served from cache, got %d fetches", n)
+	}
+
+	// Once expired the entry is still served while a failing refresh runs in the background
+	mu.Lock()
+	fail = common.NewError("node unreachable")
+	mu.Unlock()
+	now = now.Add(2 * ttl)
+	snapshot = cache.Get(context.Background(), 1, "sub", ttl, fetch)
+	if len(snapshot.Inbounds) != 1 || snapshot.Stale {
+		t.Fatalf("expected the expired entry while refreshing, got %+v", snapshot)
+	}
+	waitIdle()
+	snapshot = cache.Get(context.Background(), 1, "sub", ttl, fetch)
+	if len(snapshot.Inbounds) != 1 || !snapshot.Stale || snapshot.Err == nil {
+		t.Fatalf("expected the last known good inbounds marked stale, got %+v", snapshot)
+	}
+	if n := count(); n != 2 {
+		t.Fatalf("a failed refresh must not be retried before the TTL, got %d fetches", n)
+	}
+	if peeked, ok := cache.Peek(1, "sub"); !ok || !peeked.Stale {
+		t.Fatalf("expected peek to return a stale entry, got %+v", peeked)
+	}
+
+	// A recovered node clears the stale marker
+	mu.Lock()
+	fail = nil
+	mu.Unlock()
+	now = now.Add(ttl)
+	cache.Get(context.Background(), 1, "sub", ttl, fetch)
+	waitIdle()
+	if snapshot = cache.Get(context.Background(), 1, "sub", ttl, fetch); snapshot.Stale || snapshot.Err != nil {
+		t.Fatalf("expected a fresh entry after recovery, got %+v", snapshot)
+	}
+
+	// A slow node is cut off by the request deadline but still fills the cache
+	mu.Lock()
+	release = make(chan struct{})
+	mu.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if snapshot = cache.Get(ctx, 2, "sub", ttl, fetch); snapshot.Err != context.DeadlineExceeded || snapshot.Inbounds != nil {
+		t.Fatalf("expected the deadline to cut the lookup short, got %+v", snapshot)
+	}
+	mu.Lock()
+	close(release)
+	mu.Unlock()
+	if snapshot = cache.Get(context.Background(), 2, "sub", ttl, fetch); len(snapshot.Inbounds) != 1 {
+		t.Fatalf("expected the slow lookup to fill the cache, got %+v", snapshot)
+	}
+
+	cache.Invalidate(0, "sub")
+	if _, ok := cache.Peek(1, "sub"); ok {
+		t.Fatalf("expected invalidated entries to be dropped")
+	}
+
+	// A lookup running while the entry is invalidated does not fill the cache
+	mu.Lock()
+	release = make(chan struct{})
+	mu.Unlock()
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	cache.Get(ctx, 1, "sub", ttl, fetch)
+	before := count()
+	cache.Invalidate(1, "")
+	mu.Lock()
+	close(release)
+	mu.Unlock()
+	time.Sleep(20 * time.Millisecond)
+	if _, ok := cache.Peek(1, "sub"); ok {
+		t.Fatalf("expected the result of an invalidated lookup to be thrown away")
+	}
+	cache.Get(context.Background(), 1, "sub", ttl, fetch)
+	if n := count(); n != before+1 {
+		t.Fatalf("expected a new lookup after invalidation, got %d fetches", n-before)
+	}
+}
@@ -0,0 +1,248 @@
+package service
+
+import (
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/database"
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+	"github.com/mhsanaei/3x-ui/v2/logger"
+	"github.com/mhsanaei/3x-ui/v2/util/common"
+
+	"gorm.io/gorm/clause"
+)
+
+// Resolutions of node statistics history.
+const (
+	NodeStatsResolutionAuto = "auto"
+	NodeStatsResolutionRaw  = "raw"
+	NodeStatsResolutionHour = "hour"
+	NodeStatsResolutionDay  = "day"
+)
+
+// nodeStatsDailyRetention is how long daily node statistics rollups are kept.
+const nodeStatsDailyRetention = 2 * 365 * 24 * time.Hour
+
+// NodeStatsHistory is a range of node statistics at one resolution. Raw samples are
+// returned in the same shape as rollups, with equal min, max and avg.
+type NodeStatsHistory struct {
+	NodeId     int                      `json:"nodeId"`
+	Resolution string                   `json:"resolution"`
+	From       int64                    `json:"from"`
+	To         int64                    `json:"to"`
+	Points     []*model.NodeStatsRollup `json:"points"`
+}
+
+// hourlyRollupQuery aggregates raw samples into hour buckets.
+const hourlyRollupQuery = `
+	SELECT node_id, (collected_at / 3600) * 3600 AS bucket_start, COUNT(*) AS samples,
+		MIN(cpu) AS cpu_min, MAX(cpu) AS cpu_max, AVG(cpu) AS cpu_avg,
+		MIN(mem) AS mem_min, MAX(mem) AS mem_max, AVG(mem) AS mem_avg, MAX(mem_total) AS mem_total,
+		MIN(disk) AS disk_min, MAX(disk) AS disk_max, AVG(disk) AS disk_avg, MAX(disk_total) AS disk_total,
+		MIN(net_up) AS net_up_min, MAX(net_up) AS net_up_max, AVG(net_up) AS net_up_avg,
+		MIN(net_down) AS net_down_min, MAX(net_down) AS net_down_max, AVG(net_down) AS net_down_avg,
+		MIN(clients) AS clients_min, MAX(clients) AS clients_max, AVG(clients) AS clients_avg
+	FROM node_stats
+	WHERE collected_at >= ? AND collected_at < ?
+	GROUP BY node_id, (collected_at / 3600) * 3600`
+
+// dailyRollupQuery aggregates hourly rollups into day buckets, weighting averages by sample count.
+const dailyRollupQuery = `
+	SELECT node_id, (bucket_start / 86400) * 86400 AS bucket_start, SUM(samples) AS samples,
+		MIN(cpu_min) AS cpu_min, MAX(cpu_max) AS cpu_max, SUM(cpu_avg * samples) / SUM(samples) AS cpu_avg,
+		MIN(mem_min) AS mem_min, MAX(mem_max) AS mem_max, SUM(mem_avg * samples) / SUM(samples) AS mem_avg, MAX(mem_total) AS mem_total,
+		MIN(disk_min) AS disk_min, MAX(disk_max) AS disk_max, SUM(disk_avg * samples) / SUM(samples) AS disk_avg, MAX(disk_total) AS disk_total,
+		MIN(net_up_min) AS net_up_min, MAX(net_up_max) AS net_up_max, SUM(net_up_avg * samples) / SUM(samples) AS net_up_avg,
+		MIN(net_down_min) AS net_down_min, MAX(net_down_max) AS net_down_max, SUM(net_down_avg * samples) / SUM(samples) AS net_down_avg,
+		MIN(clients_min) AS clients_min, MAX(clients_max) AS clients_max, SUM(clients_avg * samples) / SUM(samples) AS clients_avg
+	FROM node_stats_rollups
+	WHERE resolution = 'hour' AND bucket_start >= ? AND bucket_start < ?
+	GROUP BY node_id, (bucket_start / 86400) * 86400`
+
+// RollupNodeStats aggregates completed hours of raw samples into hourly rollups and completed
+// days of hourly rollups into daily ones, then deletes samples and rollups past their retention.
+// Buckets are aligned to UTC.
+func (s *NodeService) RollupNodeStats(now time.Time) error {
+	hour := now.Truncate(time.Hour).Unix()
+	day := now.Truncate(24 * time.Hour).Unix()
+
+	since, err := s.nextRollupBucket(NodeStatsResolutionHour, "node_stats", "collected_at", 3600)
+	if err != nil {
+		return err
+	}
+	if err := s.rollup(NodeStatsResolutionHour, hourlyRollupQuery, since, hour); err != nil {
+		return err
+	}
+
+	since, err = s.nextRollupBucket(NodeStatsResolutionDay, "node_stats_rollups", "bucket_start", 86400)
+	if err != nil {
+		return err
+	}
+	if err := s.rollup(NodeStatsResolutionDay, dailyRollupQuery, since, day); err != nil {
+		return err
+	}
+
+	settingService := SettingService{}
+	rawHours, err := settingService.GetNodeStatsRetention()
+	if err != nil || rawHours < 2 {
+		rawHours = 48
+	}
+	hourlyDays, err := settingService.GetNodeStatsHourlyRetention()
+	if err != nil || hourlyDays < 1 {
+		hourlyDays = 90
+	}
+
+	// Retention is at least one bucket longer than the rollup step, so nothing is dropped
+	// before it has been aggregated above
+	db := database.GetDB()
+	rawBefore := now.Add(-time.Duration(rawHours) * time.Hour).Unix()
+	if err := db.Where("collected_at < ?", rawBefore).Delete(&model.NodeStats{}).Error; err != nil {
+		return err
+	}
+	hourlyBefore := now.Add(-time.Duration(hourlyDays) * 24 * time.Hour).Unix()
+	if err := db.Where("resolution = ? AND bucket_start < ?", NodeStatsResolutionHour, hourlyBefore).Delete(&model.NodeStatsRollup{}).Error; err != nil {
+		return err
+	}
+	return db.Where("resolution = ? AND bucket_start < ?", NodeStatsResolutionDay, now.Add(-nodeStatsDailyRetention).Unix()).Delete(&model.NodeStatsRollup{}).Error
+}
+
+// nextRollupBucket returns the start of the first bucket that has not been rolled up yet:
+// the one after the latest rollup, or the bucket of the oldest source row.
+func (s *NodeService) nextRollupBucket(resolution, sourceTable, sourceColumn string, size int64) (int64, error) {
+	db := database.GetDB()
+	var last *int64
+	err := db.Model(&model.NodeStatsRollup{}).Where("resolution = ?", resolution).Select("MAX(bucket_start)").Scan(&last).Error
+	if err != nil {
+		return 0, err
+	}
+	if last != nil {
+		return *last + size, nil
+	}
+	var first *int64
+	query := db.Table(sourceTable).Select("MIN(" + sourceColumn + ")")
+	if sourceTable == "node_stats_rollups" {
+		query = query.Where("resolution = ?", NodeStatsResolutionHour)
+	}
+	if err := query.Scan(&first).Error; err != nil {
+		return 0, err
+	}
+	if first == nil {
+		return 0, nil
+	}
+	return *first - *first%size, nil
+}
+
+func (s *NodeService) rollup(resolution, query string, since, until int64) error {
+	if since >= until {
+		return nil
+	}
+	db := database.GetDB()
+	var rows []*model.NodeStatsRollup
+	if err := db.Raw(query, since, until).Scan(&rows).Error; err != nil {
+		return err
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+	for _, row := range rows {
+		row.Resolution = resolution
+	}
+	err := db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "node_id"}, {Name: "resolution"}, {Name: "bucket_start"}},
+		UpdateAll: true,
+	}).CreateInBatches(rows, 500).Error
+	if err != nil {
+		return err
+	}
+	logger.Debugf("Rolled up %d node stats bucket(s) per %s", len(rows), resolution)
+	return nil
+}
+
+// GetNodeStatsHistory returns the statistics of a node between from and to (unix seconds).
+// The auto resolution picks raw samples for ranges within the raw retention up to two days,
+// hourly rollups up to a month and daily rollups beyond.
+func (s *NodeService) GetNodeStatsHistory(nodeId int, from, to int64, resolution string) (*NodeStatsHistory, error) {
+	if to <= 0 {
+		to = time.Now().Unix()
+	}
+	if from <= 0 {
+		from = to - 24*3600
+	}
+	if from >= to {
+		return nil, common.NewError("range start must be before its end")
+	}
+	if resolution == "" || resolution == NodeStatsResolutionAuto {
+		resolution = s.autoStatsResolution(from, to)
+	}
+
+	history := &NodeStatsHistory{NodeId: nodeId, Resolution: resolution, From: from, To: to}
+	db := database.GetDB()
+	switch resolution {
+	case NodeStatsResolutionRaw:
+		var samples []*model.NodeStats
+		err := db.Where("node_id = ? AND collected_at >= ? AND collected_at < ?", nodeId, from, to).
+			Order("collected_at asc").Find(&samples).Error
+		if err != nil {
+			return nil, err
+		}
+		history.Points = make([]*model.NodeStatsRollup, 0, len(samples))
+		for _, sample := range samples {
+			history.Points = append(history.Points, rawStatsPoint(sample))
+		}
+	case NodeStatsResolutionHour, NodeStatsResolutionDay:
+		err := db.Where("node_id = ? AND resolution = ? AND bucket_start >= ? AND bucket_start < ?", nodeId, resolution, from, to).
+			Order("bucket_start asc").Find(&history.Points).Error
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, common.NewError("unknown resolution:", resolution)
+	}
+	return history, nil
+}
+
+func (s *NodeService) autoStatsResolution(from, to int64) string {
+	settingService := SettingService{}
+	rawHours, err := settingService.GetNodeStatsRetention()
+	if err != nil {
+		rawHours = 48
+	}
+	span := time.Duration(to-from) * time.Second
+	rawSince := time.Now().Add(-time.Duration(rawHours) * time.Hour).Unix()
+	switch {
+	case span <= 48*time.Hour && from >= rawSince:
+		return NodeStatsResolutionRaw
+	case span <= 31*24*time.Hour:
+		return NodeStatsResolutionHour
+	default:
+		return NodeStatsResolutionDay
+	}
+}
+
+func rawStatsPoint(sample *model.NodeStats) *model.NodeStatsRollup {
+	return &model.NodeStatsRollup{
+		NodeId:      sample.NodeId,
+		Resolution:  NodeStatsResolutionRaw,
+		BucketStart: sample.CollectedAt,
+		Samples:     1,
+		CpuMin:      sample.Cpu,
+		CpuMax:      sample.Cpu,
+		CpuAvg:      sample.Cpu,
+		MemMin:      float64(sample.Mem),
+		MemMax:      float64(sample.Mem),
+		MemAvg:      float64(sample.Mem),
+		MemTotal:    sample.MemTotal,
+		DiskMin:     float64(sample.Disk),
+		DiskMax:     float64(sample.Disk),
+		DiskAvg:     float64(sample.Disk),
+		DiskTotal:   sample.DiskTotal,
+		NetUpMin:    float64(sample.NetUp),
+		NetUpMax:    float64(sample.NetUp),
+		NetUpAvg:    float64(sample.NetUp),
+		NetDownMin:  float64(sample.NetDown),
+		NetDownMax:  float64(sample.NetDown),
+		NetDownAvg:  float64(sample.NetDown),
+		ClientsMin:  float64(sample.Clients),
+		ClientsMax:  float64(sample.Clients),
+		ClientsAvg:  float64(sample.Clients),
+	}
+}
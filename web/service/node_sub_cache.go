@@ -0,0 +1,169 @@
+package service
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+)
+
+const (
+	// nodeSubFetchTimeout bounds a single lookup on a node. Lookups outlive the request that
+	// started them, so a slow node still fills the cache for the next request.
+	nodeSubFetchTimeout = 20 * time.Second
+	// nodeSubIdleExpiry drops cached lookups that have not been read for this long.
+	nodeSubIdleExpiry = 24 * time.Hour
+)
+
+// NodeSubSnapshot is the result of a cached subscription lookup on a node.
+type NodeSubSnapshot struct {
+	Inbounds  []*model.Inbound
+	FetchedAt time.Time // Time of the last successful lookup, zero when there was none
+	Stale     bool      // The latest lookup failed, Inbounds are the last known good ones
+	Err       error     // Error of the latest lookup
+}
+
+type nodeSubKey struct {
+	nodeId int
+	subId  string
+}
+
+type nodeSubEntry struct {
+	inbounds    []*model.Inbound
+	fetchedAt   time.Time
+	lastAttempt time.Time
+	lastRead    time.Time
+	err         error
+	inflight    chan struct{} // closed when the running lookup finishes, nil when idle
+}
+
+// NodeSubCache caches the inbounds a node returns for a subscription ID. Expired entries
+// are served while a refresh runs in the background; when a node cannot be reached the
+// last known good result is served and marked stale.
+type NodeSubCache struct {
+	mu      sync.Mutex
+	entries map[nodeSubKey]*nodeSubEntry
+	now     func() time.Time
+}
+
+var nodeSubCache = &NodeSubCache{
+	entries: make(map[nodeSubKey]*nodeSubEntry),
+	now:     time.Now,
+}
+
+// GetNodeSubCache returns the process-wide cache of node subscription lookups.
+func GetNodeSubCache() *NodeSubCache {
+	return nodeSubCache
+}
+
+// Get returns the inbounds of node for subId. A fresh entry is returned at once. An expired
+// one is returned as is while fetch refreshes it in the background, at most once per ttl
+// after a failure. Without any cached result Get waits for fetch until ctx is done.
+func (c *NodeSubCache) Get(ctx context.Context, nodeId int, subId string, ttl time.Duration, fetch func(context.Context) ([]*model.Inbound, error)) NodeSubSnapshot {
+	key := nodeSubKey{nodeId, subId}
+	c.mu.Lock()
+	now := c.now()
+	c.evictIdle(now)
+	e, ok := c.entries[key]
+	if !ok {
+		e = &nodeSubEntry{}
+		c.entries[key] = e
+	}
+	e.lastRead = now
+
+	if !e.fetchedAt.IsZero() {
+		expired := now.Sub(e.fetchedAt) >= ttl
+		retry := e.err == nil || now.Sub(e.lastAttempt) >= ttl
+		if expired && retry && e.inflight == nil {
+			c.startFetch(e, fetch)
+		}
+		snapshot := e.snapshot()
+		c.mu.Unlock()
+		return snapshot
+	}
+
+	if e.inflight == nil {
+		c.startFetch(e, fetch)
+	}
+	done := e.inflight
+	c.mu.Unlock()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return NodeSubSnapshot{Err: ctx.Err()}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return e.snapshot()
+}
+
+// Peek returns the cached result without starting a lookup, marked stale. It is used for
+// nodes known to be down.
+func (c *NodeSubCache) Peek(nodeId int, subId string) (NodeSubSnapshot, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[nodeSubKey{nodeId, subId}]
+	if !ok || e.fetchedAt.IsZero() {
+		return NodeSubSnapshot{}, false
+	}
+	e.lastRead = c.now()
+	snapshot := e.snapshot()
+	snapshot.Stale = true
+	return snapshot, true
+}
+
+// Invalidate drops the cached lookups of a node for subId. A zero nodeId or an empty subId
+// matches every node or subscription. Lookups still running may have read the node before
+// the change, so their entries are dropped as well: the result only reaches the callers
+// already waiting for it and the next Get starts a new lookup.
+func (c *NodeSubCache) Invalidate(nodeId int, subId string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key := range c.entries {
+		if (nodeId == 0 || key.nodeId == nodeId) && (subId == "" || key.subId == subId) {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// startFetch runs fetch in the background. The caller must hold c.mu.
+func (c *NodeSubCache) startFetch(e *nodeSubEntry, fetch func(context.Context) ([]*model.Inbound, error)) {
+	done := make(chan struct{})
+	e.inflight = done
+	e.lastAttempt = c.now()
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), nodeSubFetchTimeout)
+		defer cancel()
+		inbounds, err := fetch(ctx)
+
+		c.mu.Lock()
+		if err == nil {
+			e.inbounds = inbounds
+			e.fetchedAt = c.now()
+		}
+		e.err = err
+		e.inflight = nil
+		c.mu.Unlock()
+		close(done)
+	}()
+}
+
+// evictIdle drops entries that were not read recently. The caller must hold c.mu.
+func (c *NodeSubCache) evictIdle(now time.Time) {
+	for key, e := range c.entries {
+		if e.inflight == nil && now.Sub(e.lastRead) > nodeSubIdleExpiry {
+			delete(c.entries, key)
+		}
+	}
+}
+
+func (e *nodeSubEntry) snapshot() NodeSubSnapshot {
+	return NodeSubSnapshot{
+		Inbounds:  e.inbounds,
+		FetchedAt: e.fetchedAt,
+		Stale:     e.err != nil && !e.fetchedAt.IsZero(),
+		Err:       e.err,
+	}
+}
@@ -0,0 +1,462 @@
+package service
+
+import (
+	"slices"
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/database"
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+	"github.com/mhsanaei/3x-ui/v2/logger"
+
+	"gorm.io/gorm/clause"
+)
+
+// nodeCheckMaxGap is the longest time a check result is assumed to hold. Periods without
+// checks beyond it (panel stopped, node disabled) are left out of availability instead of
+// being counted as up or down. A failed check holds longer, as unreachable nodes are
+// polled with backoff.
+const nodeCheckMaxGap = 2 * time.Minute
+
+// maxNodeOutages caps how many outage windows a report lists, newest first.
+const maxNodeOutages = 50
+
+// uptimePeriods are the windows reported by the uptime API.
+var uptimePeriods = []struct {
+	Name     string
+	Duration time.Duration
+}{
+	{"24h", 24 * time.Hour},
+	{"7d", 7 * 24 * time.Hour},
+	{"30d", 30 * 24 * time.Hour},
+}
+
+// NodeUptimeWindow is the availability of a node over one reporting period.
+type NodeUptimeWindow struct {
+	Period       string   `json:"period"`       // 24h, 7d or 30d
+	From         int64    `json:"from"`         // Window start timestamp
+	Availability *float64 `json:"availability"` // Percentage of monitored time the node was online, null without data
+	Monitored    int64    `json:"monitored"`    // Seconds covered by checks
+	Downtime     int64    `json:"downtime"`     // Seconds the node was offline or in error
+	Checks       int      `json:"checks"`       // Number of checks
+	Failures     int      `json:"failures"`     // Checks that did not find the node online
+	AvgLatencyMs float64  `json:"avgLatencyMs"` // Average round trip of checks that reached the node
+	Outages      int      `json:"outages"`      // Outages overlapping the window
+}
+
+// NodeOutage is a period during which a node was not online.
+type NodeOutage struct {
+	Start    int64            `json:"start"`    // First failed check
+	End      int64            `json:"end"`      // First check that found the node online again, 0 while ongoing
+	Duration int64            `json:"duration"` // Seconds, up to now for ongoing outages
+	Status   model.NodeStatus `json:"status"`   // Status that opened the outage
+	Error    string           `json:"error"`    // Error of the first failed check
+}
+
+// NodeUptime is the uptime/SLA report of a node.
+type NodeUptime struct {
+	NodeId    int                `json:"nodeId"`
+	Name      string             `json:"name"`
+	Status    model.NodeStatus   `json:"status"`
+	LastCheck int64              `json:"lastCheck"`
+	Windows   []NodeUptimeWindow `json:"windows"`
+	Outages   []NodeOutage       `json:"outages,omitempty"`
+}
+
+// Window returns the report window with the given period name, or nil.
+func (u *NodeUptime) Window(period string) *NodeUptimeWindow {
+	for i := range u.Windows {
+		if u.Windows[i].Period == period {
+			return &u.Windows[i]
+		}
+	}
+	return nil
+}
+
+// uptimeTotals sums the status checks of a node over a period.
+type uptimeTotals struct {
+	Monitored int64
+	Downtime  int64
+	Checks    int
+	Failures  int
+	LatencyMs int64
+	Reachable int
+}
+
+func (t *uptimeTotals) add(o uptimeTotals) {
+	t.Monitored += o.Monitored
+	t.Downtime += o.Downtime
+	t.Checks += o.Checks
+	t.Failures += o.Failures
+	t.LatencyMs += o.LatencyMs
+	t.Reachable += o.Reachable
+}
+
+// uptimeCalc accumulates status events in check order into hourly totals between from and to.
+type uptimeCalc struct {
+	from  int64
+	to    int64
+	hours map[int64]*uptimeTotals
+	last  *model.NodeStatusEvent
+}
+
+func newUptimeCalc(from, to int64) *uptimeCalc {
+	return &uptimeCalc{from: from, to: to, hours: make(map[int64]*uptimeTotals)}
+}
+
+func (c *uptimeCalc) hour(at int64) *uptimeTotals {
+	start := at - at%3600
+	t, ok := c.hours[start]
+	if !ok {
+		t = &uptimeTotals{}
+		c.hours[start] = t
+	}
+	return t
+}
+
+// span attributes the time between the previous check and until to the previous status.
+func (c *uptimeCalc) span(until int64) {
+	if c.last == nil {
+		return
+	}
+	maxGap := nodeCheckMaxGap
+	if c.last.Status != model.NodeStatusOnline {
+		maxGap += nodePollMaxBackoff
+	}
+	start := max(c.last.CheckedAt, c.from)
+	end := min(until, c.last.CheckedAt+int64(maxGap/time.Second), c.to)
+	for start < end {
+		next := min(end, start-start%3600+3600)
+		t := c.hour(start)
+		t.Monitored += next - start
+		if c.last.Status != model.NodeStatusOnline {
+			t.Downtime += next - start
+		}
+		start = next
+	}
+}
+
+// add feeds the next event. Events must be ordered by check time.
+func (c *uptimeCalc) add(event model.NodeStatusEvent) {
+	c.span(event.CheckedAt)
+	if event.CheckedAt >= c.from && event.CheckedAt < c.to {
+		t := c.hour(event.CheckedAt)
+		t.Checks++
+		if event.Status != model.NodeStatusOnline {
+			t.Failures++
+		}
+		if event.Error == "" {
+			t.LatencyMs += event.LatencyMs
+			t.Reachable++
+		}
+	}
+	c.last = &event
+}
+
+// nodeUptimeHours walks the status checks of a node between from and to into hourly totals.
+// The last check before from gives the status at its start.
+func nodeUptimeHours(nodeId int, from, to int64) (map[int64]*uptimeTotals, error) {
+	calc := newUptimeCalc(from, to)
+	if from >= to {
+		return calc.hours, nil
+	}
+	db := database.GetDB()
+	var seed model.NodeStatusEvent
+	err := db.Where("node_id = ? AND checked_at < ?", nodeId, from).
+		Order("checked_at desc").Limit(1).Find(&seed).Error
+	if err != nil {
+		return nil, err
+	}
+	if seed.Id > 0 {
+		calc.add(seed)
+	}
+
+	rows, err := db.Model(&model.NodeStatusEvent{}).
+		Select("status, latency_ms, error, checked_at").
+		Where("node_id = ? AND checked_at >= ? AND checked_at < ?", nodeId, from, to).
+		Order("checked_at asc, id asc").Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var event model.NodeStatusEvent
+		if err := rows.Scan(&event.Status, &event.LatencyMs, &event.Error, &event.CheckedAt); err != nil {
+			return nil, err
+		}
+		calc.add(event)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	calc.span(to)
+	return calc.hours, nil
+}
+
+// nodeUptimeRaw sums the status checks of a node between from and to.
+func nodeUptimeRaw(nodeId int, from, to int64) (uptimeTotals, error) {
+	var totals uptimeTotals
+	hours, err := nodeUptimeHours(nodeId, from, to)
+	if err != nil {
+		return totals, err
+	}
+	for _, t := range hours {
+		totals.add(*t)
+	}
+	return totals, nil
+}
+
+// nextUptimeRollupHour returns the start of the first hour that has not been rolled up yet:
+// the one after the latest rollup, or the hour of the oldest status check.
+func nextUptimeRollupHour() (int64, error) {
+	db := database.GetDB()
+	var last *int64
+	if err := db.Model(&model.NodeUptimeRollup{}).Select("MAX(bucket_start)").Scan(&last).Error; err != nil {
+		return 0, err
+	}
+	if last != nil {
+		return *last + 3600, nil
+	}
+	var first *int64
+	if err := db.Model(&model.NodeStatusEvent{}).Select("MIN(checked_at)").Scan(&first).Error; err != nil {
+		return 0, err
+	}
+	if first == nil {
+		return 0, nil
+	}
+	return *first - *first%3600, nil
+}
+
+// RollupNodeUptime sums the status checks of every node over completed hours into hourly
+// rollups, which uptime reports read instead of the checks, and deletes rollups past the
+// longest report window.
+func (s *NodeService) RollupNodeUptime(now time.Time) error {
+	until := now.Truncate(time.Hour).Unix()
+	since, err := nextUptimeRollupHour()
+	if err != nil {
+		return err
+	}
+	db := database.GetDB()
+	if since > 0 && since < until {
+		nodes, err := s.GetAllNodes()
+		if err != nil {
+			return err
+		}
+		var rows []*model.NodeUptimeRollup
+		for _, node := range nodes {
+			hours, err := nodeUptimeHours(node.Id, since, until)
+			if err != nil {
+				return err
+			}
+			for start, t := range hours {
+				rows = append(rows, &model.NodeUptimeRollup{
+					NodeId:      node.Id,
+					BucketStart: start,
+					Monitored:   t.Monitored,
+					Downtime:    t.Downtime,
+					Checks:      t.Checks,
+					Failures:    t.Failures,
+					LatencyMs:   t.LatencyMs,
+					Reachable:   t.Reachable,
+				})
+			}
+		}
+		if len(rows) > 0 {
+			err := db.Clauses(clause.OnConflict{
+				Columns:   []clause.Column{{Name: "node_id"}, {Name: "bucket_start"}},
+				UpdateAll: true,
+			}).CreateInBatches(rows, 500).Error
+			if err != nil {
+				return err
+			}
+			logger.Debugf("Rolled up %d node uptime hour(s)", len(rows))
+		}
+	}
+	longest := uptimePeriods[len(uptimePeriods)-1].Duration
+	return db.Where("bucket_start < ?", now.Add(-longest-time.Hour).Unix()).Delete(&model.NodeUptimeRollup{}).Error
+}
+
+// nodeUptimeTotals sums the status checks of a node between from and to. Hours rolled up
+// before rolledUntil are read from the rollups, only the rest is walked check by check.
+func nodeUptimeTotals(nodeId int, from, to, rolledUntil int64) (uptimeTotals, error) {
+	firstHour := (from + 3599) / 3600 * 3600
+	if rolledUntil <= firstHour {
+		return nodeUptimeRaw(nodeId, from, to)
+	}
+	totals, err := nodeUptimeRaw(nodeId, from, firstHour)
+	if err != nil {
+		return totals, err
+	}
+	var rolled uptimeTotals
+	err = database.GetDB().Model(&model.NodeUptimeRollup{}).
+		Select("COALESCE(SUM(monitored), 0) AS monitored, COALESCE(SUM(downtime), 0) AS downtime, "+
+			"COALESCE(SUM(checks), 0) AS checks, COALESCE(SUM(failures), 0) AS failures, "+
+			"COALESCE(SUM(latency_ms), 0) AS latency_ms, COALESCE(SUM(reachable), 0) AS reachable").
+		Where("node_id = ? AND bucket_start >= ? AND bucket_start < ?", nodeId, firstHour, rolledUntil).
+		Scan(&rolled).Error
+	if err != nil {
+		return totals, err
+	}
+	totals.add(rolled)
+	tail, err := nodeUptimeRaw(nodeId, rolledUntil, to)
+	if err != nil {
+		return totals, err
+	}
+	totals.add(tail)
+	return totals, nil
+}
+
+// nodeOutages returns the outages of a node that overlap the time since from, oldest first.
+// Only checks that changed the status can open or close an outage, so the walk is limited
+// to them and to the last check before from.
+func nodeOutages(nodeId int, from, now int64) ([]NodeOutage, error) {
+	db := database.GetDB()
+	var events []model.NodeStatusEvent
+	var seed model.NodeStatusEvent
+	err := db.Where("node_id = ? AND checked_at < ?", nodeId, from).
+		Order("checked_at desc").Limit(1).Find(&seed).Error
+	if err != nil {
+		return nil, err
+	}
+	if seed.Id > 0 {
+		events = append(events, seed)
+	}
+	var transitions []model.NodeStatusEvent
+	err = db.Where("node_id = ? AND checked_at >= ? AND transition = ?", nodeId, from, true).
+		Order("checked_at asc, id asc").Find(&transitions).Error
+	if err != nil {
+		return nil, err
+	}
+	events = append(events, transitions...)
+
+	var outages []NodeOutage
+	var open *NodeOutage
+	for _, event := range events {
+		online := event.Status == model.NodeStatusOnline
+		if !online && open == nil {
+			open = &NodeOutage{Start: event.CheckedAt, Status: event.Status, Error: event.Error}
+		} else if online && open != nil {
+			open.End = event.CheckedAt
+			open.Duration = open.End - open.Start
+			outages = append(outages, *open)
+			open = nil
+		}
+	}
+	if open != nil {
+		open.Duration = now - open.Start
+		outages = append(outages, *open)
+	}
+	return outages, nil
+}
+
+// GetNodeUptime returns the availability of a node over 24h, 7d and 30d together with its outages.
+func (s *NodeService) GetNodeUptime(nodeId int) (*NodeUptime, error) {
+	node, err := s.GetNode(nodeId)
+	if err != nil {
+		return nil, err
+	}
+	rolledUntil, err := nextUptimeRollupHour()
+	if err != nil {
+		return nil, err
+	}
+	return s.nodeUptime(node, []string{"24h", "7d", "30d"}, true, rolledUntil)
+}
+
+// GetAllNodesUptime returns the uptime report of every node for the given periods.
+// Outage windows are only included when withOutages is set.
+func (s *NodeService) GetAllNodesUptime(periods []string, withOutages bool) ([]*NodeUptime, error) {
+	nodes, err := s.GetAllNodes()
+	if err != nil {
+		return nil, err
+	}
+	rolledUntil, err := nextUptimeRollupHour()
+	if err != nil {
+		return nil, err
+	}
+	reports := make([]*NodeUptime, 0, len(nodes))
+	for _, node := range nodes {
+		report, err := s.nodeUptime(node, periods, withOutages, rolledUntil)
+		if err != nil {
+			return nil, err
+		}
+		reports = append(reports, report)
+	}
+	return reports, nil
+}
+
+// nodeUptime builds the uptime report of a node. Hours before rolledUntil are read from the
+// hourly rollups.
+func (s *NodeService) nodeUptime(node *model.Node, periods []string, withOutages bool, rolledUntil int64) (*NodeUptime, error) {
+	now := time.Now().Unix()
+	report := &NodeUptime{
+		NodeId:    node.Id,
+		Name:      node.Name,
+		Status:    node.Status,
+		LastCheck: node.LastCheck,
+	}
+	var totals []uptimeTotals
+	for _, p := range uptimePeriods {
+		if !slices.Contains(periods, p.Name) {
+			continue
+		}
+		from := now - int64(p.Duration/time.Second)
+		t, err := nodeUptimeTotals(node.Id, from, now, rolledUntil)
+		if err != nil {
+			return nil, err
+		}
+		report.Windows = append(report.Windows, NodeUptimeWindow{Period: p.Name, From: from})
+		totals = append(totals, t)
+	}
+	if len(report.Windows) == 0 {
+		return report, nil
+	}
+
+	outages, err := nodeOutages(node.Id, report.Windows[len(report.Windows)-1].From, now)
+	if err != nil {
+		return nil, err
+	}
+	for i := range report.Windows {
+		w, t := &report.Windows[i], totals[i]
+		w.Monitored, w.Downtime = t.Monitored, t.Downtime
+		w.Checks, w.Failures = t.Checks, t.Failures
+		if t.Monitored > 0 {
+			availability := float64(t.Monitored-t.Downtime) * 100 / float64(t.Monitored)
+			w.Availability = &availability
+		}
+		if t.Reachable > 0 {
+			w.AvgLatencyMs = float64(t.LatencyMs) / float64(t.Reachable)
+		}
+		for _, o := range outages {
+			if o.End == 0 || o.End > w.From {
+				w.Outages++
+			}
+		}
+	}
+	if withOutages {
+		report.Outages = make([]NodeOutage, 0, min(len(outages), maxNodeOutages))
+		for i := len(outages) - 1; i >= 0 && len(report.Outages) < maxNodeOutages; i-- {
+			report.Outages = append(report.Outages, outages[i])
+		}
+	}
+	return report, nil
+}
+
+// GetNodeStatusEvents returns the latest status checks of a node, newest first.
+// With transitionsOnly only checks that changed the status are returned.
+func (s *NodeService) GetNodeStatusEvents(nodeId int, transitionsOnly bool, limit int) ([]*model.NodeStatusEvent, error) {
+	if limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+	query := database.GetDB().Where("node_id = ?", nodeId)
+	if transitionsOnly {
+		query = query.Where("transition = ?", true)
+	}
+	var events []*model.NodeStatusEvent
+	err := query.Order("checked_at desc, id desc").Limit(limit).Find(&events).Error
+	return events, err
+}
+
+// PruneNodeStatusEvents deletes status events older than the given age.
+func (s *NodeService) PruneNodeStatusEvents(maxAge time.Duration) (int64, error) {
+	result := database.GetDB().Where("checked_at < ?", time.Now().Add(-maxAge).Unix()).Delete(&model.NodeStatusEvent{})
+	return result.RowsAffected, result.Error
+}
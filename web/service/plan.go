@@ -0,0 +1,248 @@
+package service
+
+import (
+	"encoding/json"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/database"
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+	"github.com/mhsanaei/3x-ui/v2/logger"
+	"github.com/mhsanaei/3x-ui/v2/util/common"
+	"github.com/mhsanaei/3x-ui/v2/xray"
+
+	"gorm.io/gorm"
+)
+
+// Actions recorded in the plan history of a client.
+const (
+	PlanActionApply = "apply"
+	PlanActionRenew = "renew"
+)
+
+// PlanService manages billing plans and applies them to clients.
+type PlanService struct {
+	inboundService InboundService
+	xrayApi        xray.XrayAPI
+}
+
+// GetPlans returns all plans.
+func (s *PlanService) GetPlans() ([]*model.Plan, error) {
+	var plans []*model.Plan
+	err := database.GetDB().Order("id asc").Find(&plans).Error
+	return plans, err
+}
+
+// GetPlan returns a plan by ID.
+func (s *PlanService) GetPlan(id int) (*model.Plan, error) {
+	var plan model.Plan
+	if err := database.GetDB().First(&plan, id).Error; err != nil {
+		return nil, err
+	}
+	return &plan, nil
+}
+
+// AddPlan creates a plan.
+func (s *PlanService) AddPlan(plan *model.Plan) error {
+	plan.Id = 0
+	if err := s.validatePlan(plan); err != nil {
+		return err
+	}
+	return database.GetDB().Create(plan).Error
+}
+
+// UpdatePlan changes a plan. Clients it was applied to keep their settings until it is renewed.
+func (s *PlanService) UpdatePlan(plan *model.Plan) error {
+	if _, err := s.GetPlan(plan.Id); err != nil {
+		return err
+	}
+	if err := s.validatePlan(plan); err != nil {
+		return err
+	}
+	return database.GetDB().Model(&model.Plan{Id: plan.Id}).Select("*").Omit("id", "created_at").Updates(plan).Error
+}
+
+// DeletePlan deletes a plan. The plan history of clients is kept.
+func (s *PlanService) DeletePlan(id int) error {
+	return database.GetDB().Delete(&model.Plan{}, id).Error
+}
+
+// GetPlanHistory returns the plan changes of a client, newest first.
+func (s *PlanService) GetPlanHistory(email string) ([]*model.ClientPlanHistory, error) {
+	var history []*model.ClientPlanHistory
+	err := database.GetDB().Where("email = ?", email).Order("id desc").Find(&history).Error
+	return history, err
+}
+
+// GetInboundIds returns the inbounds a plan may be applied in, empty for any.
+func (s *PlanService) GetInboundIds(plan *model.Plan) ([]int, error) {
+	if plan.InboundIds == "" {
+		return nil, nil
+	}
+	var inboundIds []int
+	if err := json.Unmarshal([]byte(plan.InboundIds), &inboundIds); err != nil {
+		return nil, common.NewError("invalid inboundIds JSON format")
+	}
+	return inboundIds, nil
+}
+
+func (s *PlanService) validatePlan(plan *model.Plan) error {
+	plan.Name = strings.TrimSpace(plan.Name)
+	if plan.Name == "" {
+		return common.NewError("plan name is required")
+	}
+	if plan.TotalGB < 0 || plan.Days < 0 || plan.LimitIP < 0 {
+		return common.NewError("plan quota, duration and IP limit must be >= 0")
+	}
+	err := CheckResetSchedule(&model.Client{ResetSchedule: plan.ResetSchedule, ResetDay: plan.ResetDay, ResetCron: plan.ResetCron})
+	if err != nil {
+		return err
+	}
+	inboundIds, err := s.GetInboundIds(plan)
+	if err != nil {
+		return err
+	}
+	for _, inboundId := range inboundIds {
+		if _, err := s.inboundService.GetInbound(inboundId); err != nil {
+			return common.NewErrorf("inbound with id %d does not exist", inboundId)
+		}
+	}
+	return nil
+}
+
+// ApplyPlan sets the quota, expiry, IP limit and reset schedule of a client from a plan, starting
+// now, and resets its traffic. It returns whether Xray needs a restart.
+func (s *PlanService) ApplyPlan(email string, planId int, actor string) (bool, error) {
+	plan, err := s.GetPlan(planId)
+	if err != nil {
+		return false, err
+	}
+	return s.applyPlan(email, plan, PlanActionApply, actor)
+}
+
+// RenewPlan applies the plan of a client again, extending its expiry from the current one when it
+// has not passed yet. It returns whether Xray needs a restart.
+func (s *PlanService) RenewPlan(email string, actor string) (bool, error) {
+	_, client, err := s.inboundService.GetClientByEmail(email)
+	if err != nil {
+		return false, err
+	}
+	if client.PlanId == 0 {
+		return false, common.NewError("client has no plan:", email)
+	}
+	plan, err := s.GetPlan(client.PlanId)
+	if err != nil {
+		return false, err
+	}
+	return s.applyPlan(email, plan, PlanActionRenew, actor)
+}
+
+func (s *PlanService) applyPlan(email string, plan *model.Plan, action string, actor string) (bool, error) {
+	traffic, inbound, err := s.inboundService.GetClientInboundByEmail(email)
+	if err != nil {
+		return false, err
+	}
+	if traffic == nil || inbound == nil {
+		return false, common.NewError("Inbound Not Found For Email:", email)
+	}
+	inboundIds, err := s.GetInboundIds(plan)
+	if err != nil {
+		return false, err
+	}
+	if len(inboundIds) > 0 && !slices.Contains(inboundIds, inbound.Id) {
+		return false, common.NewErrorf("plan %s is not available in inbound %s", plan.Name, inbound.Remark)
+	}
+
+	var settings map[string]any
+	if err := json.Unmarshal([]byte(inbound.Settings), &settings); err != nil {
+		return false, err
+	}
+	clients, _ := settings["clients"].([]any)
+	var clientMap map[string]any
+	for _, c := range clients {
+		if c, ok := c.(map[string]any); ok && c["email"] == email {
+			clientMap = c
+			break
+		}
+	}
+	if clientMap == nil {
+		return false, common.NewError("Client Not Found For Email:", email)
+	}
+	wasActive := traffic.Enable && clientMap["enable"] == true
+
+	now := time.Now()
+	expiryTime := int64(0)
+	if plan.Days > 0 {
+		start := now.UnixMilli()
+		if action == PlanActionRenew && traffic.ExpiryTime > start {
+			start = traffic.ExpiryTime
+		}
+		expiryTime = start + int64(plan.Days)*86400000
+	}
+	clientMap["totalGB"] = plan.TotalGB
+	clientMap["expiryTime"] = expiryTime
+	clientMap["limitIp"] = plan.LimitIP
+	clientMap["resetSchedule"] = plan.ResetSchedule
+	clientMap["resetDay"] = plan.ResetDay
+	clientMap["resetCron"] = plan.ResetCron
+	clientMap["planId"] = plan.Id
+	clientMap["enable"] = true
+	clientMap["updated_at"] = now.UnixMilli()
+	newSettings, err := json.MarshalIndent(settings, "", "  ")
+	if err != nil {
+		return false, err
+	}
+
+	err = database.GetDB().Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(model.Inbound{}).Where("id = ?", inbound.Id).Update("settings", string(newSettings)).Error; err != nil {
+			return err
+		}
+		err := tx.Model(xray.ClientTraffic{}).Where("email = ?", email).Updates(map[string]any{
+			"enable":      true,
+			"total":       plan.TotalGB,
+			"expiry_time": expiryTime,
+			"up":          0,
+			"down":        0,
+		}).Error
+		if err != nil {
+			return err
+		}
+		return tx.Create(&model.ClientPlanHistory{
+			Email:          email,
+			PlanId:         plan.Id,
+			PlanName:       plan.Name,
+			Action:         action,
+			PrevTotalGB:    traffic.Total,
+			PrevExpiryTime: traffic.ExpiryTime,
+			TotalGB:        plan.TotalGB,
+			ExpiryTime:     expiryTime,
+			Actor:          actor,
+		}).Error
+	})
+	if err != nil {
+		return false, err
+	}
+	logger.Infof("Plan %s %s for client %s by %s", plan.Name, action, email, actor)
+
+	if wasActive || p == nil {
+		return false, nil
+	}
+	if err := s.xrayApi.Init(p.GetAPIPort()); err != nil {
+		return true, nil
+	}
+	defer s.xrayApi.Close()
+	cipher, _ := settings["method"].(string)
+	if inbound.Protocol != model.Shadowsocks {
+		cipher = ""
+	}
+	client := map[string]any{"email": email, "cipher": cipher}
+	for _, key := range []string{"id", "security", "flow", "password"} {
+		client[key], _ = clientMap[key].(string)
+	}
+	if err := s.xrayApi.AddUser(string(inbound.Protocol), inbound.Tag, client); err != nil {
+		logger.Debug("Error in enabling client by api:", err)
+		return true, nil
+	}
+	return false, nil
+}
@@ -0,0 +1,102 @@
+package service
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+	"github.com/mhsanaei/3x-ui/v2/xray"
+)
+
+func TestPlans(t *testing.T) {
+	setupServiceTestDB(t)
+	setupTestLogger(t)
+	svc := &PlanService{}
+
+	inbound := &model.Inbound{
+		Tag:      "inbound-plan",
+		Port:     20004,
+		Protocol: model.VLESS,
+		Settings: `{"clients":[{"id":"id-a","email":"a","enable":true},{"id":"id-b","email":"b","enable":true}]}`,
+	}
+	other := &model.Inbound{Tag: "inbound-other", Port: 20005, Protocol: model.VLESS, Settings: `{"clients":[]}`}
+	createTestInbounds(t, inbound, other)
+	past := time.Now().Add(-time.Hour).UnixMilli()
+	createTestClientTraffics(t,
+		&xray.ClientTraffic{InboundId: inbound.Id, Email: "a", Up: 100, Down: 100, AllTime: 200, Total: 150, ExpiryTime: past},
+		&xray.ClientTraffic{InboundId: inbound.Id, Email: "b", Enable: true},
+	)
+
+	for _, plan := range []*model.Plan{
+		{Name: " "},
+		{Name: "negative", Days: -1},
+		{Name: "bad inbounds", InboundIds: "[1,"},
+		{Name: "missing inbound", InboundIds: "[999]"},
+		{Name: "bad reset", ResetSchedule: ResetScheduleCron, ResetCron: "never"},
+	} {
+		if err := svc.AddPlan(plan); err == nil {
+			t.Fatalf("expected plan %+v to be rejected", plan)
+		}
+	}
+	plan := &model.Plan{
+		Name:          "50 GB / 30 days",
+		TotalGB:       50 << 30,
+		Days:          30,
+		LimitIP:       2,
+		ResetSchedule: ResetScheduleMonthly,
+		InboundIds:    fmt.Sprintf("[%d]", inbound.Id),
+	}
+	otherPlan := &model.Plan{Name: "other", InboundIds: fmt.Sprintf("[%d]", other.Id)}
+	for _, pl := range []*model.Plan{plan, otherPlan} {
+		if err := svc.AddPlan(pl); err != nil {
+			t.Fatalf("AddPlan failed: %v", err)
+		}
+	}
+
+	if _, err := svc.ApplyPlan("a", otherPlan.Id, "test"); err == nil {
+		t.Fatal("expected a plan of another inbound to be rejected")
+	}
+	if _, err := svc.RenewPlan("b", "test"); err == nil {
+		t.Fatal("expected renewing a client without a plan to fail")
+	}
+
+	before := time.Now().UnixMilli()
+	if _, err := svc.ApplyPlan("a", plan.Id, "test"); err != nil {
+		t.Fatalf("ApplyPlan failed: %v", err)
+	}
+	traffic, client, err := svc.inboundService.GetClientByEmail("a")
+	if err != nil {
+		t.Fatalf("GetClientByEmail failed: %v", err)
+	}
+	expiry := traffic.ExpiryTime
+	if traffic.Up != 0 || traffic.Down != 0 || traffic.AllTime != 200 || !traffic.Enable || traffic.Total != plan.TotalGB ||
+		expiry < before+30*86400000 || expiry > time.Now().UnixMilli()+30*86400000 {
+		t.Fatalf("unexpected client traffic after apply: %+v", traffic)
+	}
+	if client.PlanId != plan.Id || client.LimitIP != 2 || client.TotalGB != plan.TotalGB || client.ExpiryTime != expiry ||
+		client.ResetSchedule != ResetScheduleMonthly || !client.Enable {
+		t.Fatalf("unexpected client after apply: %+v", client)
+	}
+
+	// Renewing before expiry extends the current period
+	if _, err := svc.RenewPlan("a", "test"); err != nil {
+		t.Fatalf("RenewPlan failed: %v", err)
+	}
+	traffic, _, _ = svc.inboundService.GetClientByEmail("a")
+	if traffic.ExpiryTime != expiry+30*86400000 {
+		t.Fatalf("unexpected expiry after renew: %d, want %d", traffic.ExpiryTime, expiry+30*86400000)
+	}
+
+	history, err := svc.GetPlanHistory("a")
+	if err != nil {
+		t.Fatalf("GetPlanHistory failed: %v", err)
+	}
+	if len(history) != 2 || history[0].Action != PlanActionRenew || history[1].Action != PlanActionApply {
+		t.Fatalf("unexpected plan history: %+v", history)
+	}
+	if history[1].PrevTotalGB != 150 || history[1].PrevExpiryTime != past || history[0].PrevExpiryTime != expiry ||
+		history[0].PlanName != plan.Name || history[0].Actor != "test" {
+		t.Fatalf("unexpected plan history entries: %+v %+v", history[0], history[1])
+	}
+}
@@ -0,0 +1,73 @@
+package service
+
+import (
+	"errors"
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/database"
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+	"github.com/mhsanaei/3x-ui/v2/util/common"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// rateLimitRetries bounds how often an update of a bucket changed by another panel process is retried.
+const rateLimitRetries = 5
+
+// RateLimitBucketUpdate computes the next state of a token bucket from its stored tokens and
+// last refill time. It returns the new tokens, refill time and the time the bucket is full again.
+type RateLimitBucketUpdate func(tokens float64, lastRefill time.Time) (float64, time.Time, time.Time)
+
+// RateLimitService stores rate limiter token buckets in the database, so that they survive
+// restarts and are shared by every panel process serving the same database.
+type RateLimitService struct{}
+
+// UpdateBucket applies update to the stored bucket in one atomic step. A missing bucket starts
+// with initial tokens. Updates made by another process in between are detected by the bucket
+// version, and update is then applied again to the newer state.
+func (s *RateLimitService) UpdateBucket(key string, initial float64, now time.Time, update RateLimitBucketUpdate) error {
+	db := database.GetDB()
+	for range rateLimitRetries {
+		var bucket model.RateLimitBucket
+		err := db.Where("bucket = ?", key).Take(&bucket).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			err = db.Clauses(clause.OnConflict{DoNothing: true}).Create(&model.RateLimitBucket{
+				Bucket:     key,
+				Tokens:     initial,
+				LastRefill: now.UnixMicro(),
+				FullAt:     now.UnixMilli(),
+			}).Error
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		tokens, lastRefill, fullAt := update(bucket.Tokens, time.UnixMicro(bucket.LastRefill))
+		result := db.Model(&model.RateLimitBucket{}).
+			Where("bucket = ? AND version = ?", key, bucket.Version).
+			Updates(map[string]any{
+				"tokens":      tokens,
+				"last_refill": lastRefill.UnixMicro(),
+				"full_at":     fullAt.UnixMilli(),
+				"version":     bucket.Version + 1,
+			})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 1 {
+			return nil
+		}
+	}
+	return common.NewError("rate limit bucket kept changing:", key)
+}
+
+// PruneBuckets removes the buckets that are full again by now. They hold no state worth keeping.
+func (s *RateLimitService) PruneBuckets(now time.Time) (int64, error) {
+	result := database.GetDB().Where("full_at <= ?", now.UnixMilli()).Delete(&model.RateLimitBucket{})
+	return result.RowsAffected, result.Error
+}
@@ -23,6 +23,17 @@ import (
 //go:embed config.json
 var xrayTemplateConfig string
 
+// defaultSubUserAgentRules maps well-known subscription clients to the format they read best.
+// Hiddify comes first as its User-Agent also names the Clash and sing-box cores it bundles.
+const defaultSubUserAgentRules = `[
+  {"family": "Hiddify", "pattern": "hiddify", "format": "links"},
+  {"family": "sing-box", "pattern": "sing-box|^sf[aimt]/", "format": "singbox"},
+  {"family": "Clash", "pattern": "clash|mihomo|stash", "format": "clash"},
+  {"family": "v2rayNG", "pattern": "v2rayng", "format": "links"},
+  {"family": "Streisand", "pattern": "streisand", "format": "links"},
+  {"family": "Shadowrocket", "pattern": "shadowrocket", "format": "links", "encoding": "base64"}
+]`
+
 var defaultValueMap = map[string]string{
 	"xrayTemplateConfig":          xrayTemplateConfig,
 	"webListen":                   "",
@@ -47,6 +58,7 @@ var defaultValueMap = map[string]string{
 	"tgBotBackup":                 "false",
 	"tgBotLoginNotify":            "true",
 	"tgCpu":                       "80",
+	"tgTopTalkers":                "0",
 	"tgLang":                      "en-US",
 	"twoFactorEnable":             "false",
 	"twoFactorToken":              "",
@@ -73,6 +85,32 @@ var defaultValueMap = map[string]string{
 	"warp":                        "",
 	"externalTrafficInformEnable": "false",
 	"externalTrafficInformURI":    "",
+	"externalApiAuthMode":         "key",
+	"externalApiClientCA":         "",
+	"externalApiPrevKey":          "",
+	"externalApiPrevKeyExpiry":    "0",
+	"externalApiRateLimit":        "60",
+	"externalApiIPRateLimit":      "120",
+	"externalApiRestartLimit":     "6",
+	"externalApiRotateLimit":      "3",
+	"trustedProxies":              "",
+	"loginRateLimit":              "10",
+	"subRateLimit":                "0",
+	"subNodeTimeout":              "5",
+	"subNodeCacheTTL":             "60",
+	"subClashEnable":              "false",
+	"subClashPath":                "/clash/",
+	"subClashURI":                 "",
+	"subSingboxEnable":            "false",
+	"subSingboxPath":              "/singbox/",
+	"subSingboxURI":               "",
+	"subUserAgentRules":           defaultSubUserAgentRules,
+	"subTokenRequired":            "false",
+	"nodeStatsRetention":          "48",
+	"nodeStatsHourlyRetention":    "90",
+	"nodePollWorkers":             "8",
+	"trafficHourlyRetention":      "7",
+	"trafficDailyRetention":       "180",
 	// LDAP defaults
 	"ldapEnable":            "false",
 	"ldapHost":              "",
@@ -342,6 +380,12 @@ func (s *SettingService) GetTgCpu() (int, error) {
 	return s.getInt("tgCpu")
 }
 
+// GetTgTopTalkers returns how many clients, inbounds and outbounds the scheduled report lists
+// by traffic over the last 24 hours, 0 to leave the section out.
+func (s *SettingService) GetTgTopTalkers() (int, error) {
+	return s.getInt("tgTopTalkers")
+}
+
 func (s *SettingService) GetTgLang() (string, error) {
 	return s.getString("tgLang")
 }
@@ -769,3 +813,170 @@ func (s *SettingService) GetExternalAPIKey() (string, error) {
 func (s *SettingService) SetExternalAPIKey(key string) error {
 	return s.setString("externalApiKey", key)
 }
+
+// GetExternalAPIAuthMode returns how the external API authenticates callers: "key" accepts
+// X-API-Key and signed requests, "hmac" only signed requests, "mtls" only verified client certificates.
+func (s *SettingService) GetExternalAPIAuthMode() (string, error) {
+	return s.getString("externalApiAuthMode")
+}
+
+func (s *SettingService) SetExternalAPIAuthMode(mode string) error {
+	return s.setString("externalApiAuthMode", mode)
+}
+
+// GetExternalAPIRateLimit returns how many external API requests per minute a caller may make.
+func (s *SettingService) GetExternalAPIRateLimit() (int, error) {
+	return s.getInt("externalApiRateLimit")
+}
+
+// GetExternalAPIIPRateLimit returns how many external API requests per minute a client address
+// may make before it is authenticated, 0 for no limit.
+func (s *SettingService) GetExternalAPIIPRateLimit() (int, error) {
+	return s.getInt("externalApiIPRateLimit")
+}
+
+// GetExternalAPIRestartLimit returns how many Xray restarts per minute a caller may request
+// through the external API, 0 for no limit.
+func (s *SettingService) GetExternalAPIRestartLimit() (int, error) {
+	return s.getInt("externalApiRestartLimit")
+}
+
+// GetExternalAPIRotateLimit returns how many key rotations per minute a caller may request
+// through the external API, 0 for no limit.
+func (s *SettingService) GetExternalAPIRotateLimit() (int, error) {
+	return s.getInt("externalApiRotateLimit")
+}
+
+// GetTrustedProxies returns the comma-separated addresses or CIDRs of reverse proxies whose
+// X-Forwarded-For and X-Real-IP headers are trusted.
+func (s *SettingService) GetTrustedProxies() (string, error) {
+	return s.getString("trustedProxies")
+}
+
+// GetLoginRateLimit returns how many login attempts per minute an address may make, 0 disables the limit.
+func (s *SettingService) GetLoginRateLimit() (int, error) {
+	return s.getInt("loginRateLimit")
+}
+
+// GetSubRateLimit returns how many subscription requests per minute an address may make, 0 disables the limit.
+func (s *SettingService) GetSubRateLimit() (int, error) {
+	return s.getInt("subRateLimit")
+}
+
+// GetSubNodeTimeout returns how many seconds a subscription request waits for its nodes in total.
+func (s *SettingService) GetSubNodeTimeout() (int, error) {
+	return s.getInt("subNodeTimeout")
+}
+
+// GetSubNodeCacheTTL returns for how many seconds node subscription lookups are served from cache.
+func (s *SettingService) GetSubNodeCacheTTL() (int, error) {
+	return s.getInt("subNodeCacheTTL")
+}
+
+// GetSubClashEnable reports whether the Clash/Mihomo YAML subscription endpoint is served.
+func (s *SettingService) GetSubClashEnable() (bool, error) {
+	return s.getBool("subClashEnable")
+}
+
+// GetSubClashPath returns the path of the Clash/Mihomo YAML subscription endpoint.
+func (s *SettingService) GetSubClashPath() (string, error) {
+	return s.getString("subClashPath")
+}
+
+// GetSubClashURI returns the public URI of the Clash/Mihomo YAML subscription endpoint.
+func (s *SettingService) GetSubClashURI() (string, error) {
+	return s.getString("subClashURI")
+}
+
+// GetSubSingboxEnable reports whether the sing-box subscription endpoint is served.
+func (s *SettingService) GetSubSingboxEnable() (bool, error) {
+	return s.getBool("subSingboxEnable")
+}
+
+// GetSubSingboxPath returns the path of the sing-box subscription endpoint.
+func (s *SettingService) GetSubSingboxPath() (string, error) {
+	return s.getString("subSingboxPath")
+}
+
+// GetSubSingboxURI returns the public URI of the sing-box subscription endpoint.
+func (s *SettingService) GetSubSingboxURI() (string, error) {
+	return s.getString("subSingboxURI")
+}
+
+// GetSubUserAgentRules returns the JSON rules that map subscription client User-Agents to an
+// output format, encoding and header set.
+func (s *SettingService) GetSubUserAgentRules() (string, error) {
+	return s.getString("subUserAgentRules")
+}
+
+// GetSubTokenRequired reports whether subscriptions that have tokens are only served through them.
+func (s *SettingService) GetSubTokenRequired() (bool, error) {
+	return s.getBool("subTokenRequired")
+}
+
+// GetNodeStatsRetention returns for how many hours raw node statistics samples are kept.
+func (s *SettingService) GetNodeStatsRetention() (int, error) {
+	return s.getInt("nodeStatsRetention")
+}
+
+// GetNodeStatsHourlyRetention returns for how many days hourly node statistics rollups are kept.
+func (s *SettingService) GetNodeStatsHourlyRetention() (int, error) {
+	return s.getInt("nodeStatsHourlyRetention")
+}
+
+// GetTrafficHourlyRetention returns for how many days hourly client traffic history is kept.
+func (s *SettingService) GetTrafficHourlyRetention() (int, error) {
+	return s.getInt("trafficHourlyRetention")
+}
+
+// GetTrafficDailyRetention returns for how many days daily client traffic history is kept.
+func (s *SettingService) GetTrafficDailyRetention() (int, error) {
+	return s.getInt("trafficDailyRetention")
+}
+
+// GetNodePollWorkers returns how many nodes are polled at the same time.
+func (s *SettingService) GetNodePollWorkers() (int, error) {
+	return s.getInt("nodePollWorkers")
+}
+
+// GetExternalAPIClientCA returns the path of the CA file used to verify node client certificates.
+func (s *SettingService) GetExternalAPIClientCA() (string, error) {
+	return s.getString("externalApiClientCA")
+}
+
+// GetExternalAPIKeys returns the current external API key followed by the previous one
+// while it is still inside its rotation grace period.
+func (s *SettingService) GetExternalAPIKeys() ([]string, error) {
+	current, err := s.GetExternalAPIKey()
+	if err != nil {
+		return nil, err
+	}
+	keys := []string{current}
+	prev, err := s.getString("externalApiPrevKey")
+	if err != nil || prev == "" {
+		return keys, nil
+	}
+	expiry, err := s.getInt("externalApiPrevKeyExpiry")
+	if err == nil && int64(expiry) > time.Now().Unix() {
+		keys = append(keys, prev)
+	}
+	return keys, nil
+}
+
+// RotateExternalAPIKey replaces the external API key. The old key stays valid for the grace
+// period so that requests already signed with it do not fail during the switch.
+func (s *SettingService) RotateExternalAPIKey(key string, grace time.Duration) error {
+	if len(key) < 32 {
+		return common.NewError("external API key must be at least 32 characters")
+	}
+	current, err := s.GetExternalAPIKey()
+	if err == nil && current != "" {
+		if err := s.setString("externalApiPrevKey", current); err != nil {
+			return err
+		}
+		if err := s.setInt("externalApiPrevKeyExpiry", int(time.Now().Add(grace).Unix())); err != nil {
+			return err
+		}
+	}
+	return s.SetExternalAPIKey(key)
+}
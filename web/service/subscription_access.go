@@ -0,0 +1,114 @@
+package service
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/database"
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+	"github.com/mhsanaei/3x-ui/v2/logger"
+)
+
+// subscriptionAccessMaxPending caps the fetches waiting to be written. Fetches beyond it are
+// dropped until the next flush.
+const subscriptionAccessMaxPending = 10000
+
+// subscriptionAccessQueue holds the fetches recorded since the last flush.
+var subscriptionAccessQueue struct {
+	sync.Mutex
+	pending []*model.SubscriptionAccess
+	dropped int
+}
+
+// SubscriptionAccessService records subscription fetches and summarizes them per subscription.
+type SubscriptionAccessService struct{}
+
+// SubscriptionStats summarizes the successful fetches of a subscription kept in the access log.
+// Many distinct addresses for one subscription usually mean its link has been shared.
+type SubscriptionStats struct {
+	SubId         string `json:"subId"`
+	FetchCount    int64  `json:"fetchCount"`
+	DistinctIPs   int64  `json:"distinctIps"`
+	LastFetch     int64  `json:"lastFetch"` // Timestamp in seconds, 0 if never fetched
+	LastIP        string `json:"lastIp"`
+	LastUserAgent string `json:"lastUserAgent"`
+	LastFamily    string `json:"lastFamily"`
+}
+
+// Record queues a subscription fetch for the next Flush, so serving a subscription never waits
+// for the database.
+func (s *SubscriptionAccessService) Record(access *model.SubscriptionAccess) {
+	q := &subscriptionAccessQueue
+	q.Lock()
+	defer q.Unlock()
+	if len(q.pending) >= subscriptionAccessMaxPending {
+		q.dropped++
+		return
+	}
+	if access.CreatedAt == 0 {
+		access.CreatedAt = time.Now().Unix()
+	}
+	q.pending = append(q.pending, access)
+}
+
+// Flush writes the queued fetches in batches. Failures are only logged.
+func (s *SubscriptionAccessService) Flush() {
+	q := &subscriptionAccessQueue
+	q.Lock()
+	pending, dropped := q.pending, q.dropped
+	q.pending, q.dropped = nil, 0
+	q.Unlock()
+
+	if dropped > 0 {
+		logger.Warningf("Dropped %d subscription access record(s) over the queue limit", dropped)
+	}
+	if len(pending) == 0 {
+		return
+	}
+	if err := database.GetDB().CreateInBatches(pending, 500).Error; err != nil {
+		logger.Warning("Failed to record subscription access:", err)
+	}
+}
+
+// GetAccessLog returns the latest fetches of a subscription, newest first.
+func (s *SubscriptionAccessService) GetAccessLog(subId string, limit int) ([]*model.SubscriptionAccess, error) {
+	if limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+	var records []*model.SubscriptionAccess
+	err := database.GetDB().Where("sub_id = ?", subId).Order("id desc").Limit(limit).Find(&records).Error
+	return records, err
+}
+
+// GetStats summarizes the successful fetches of a subscription.
+func (s *SubscriptionAccessService) GetStats(subId string) (*SubscriptionStats, error) {
+	db := database.GetDB()
+	stats := &SubscriptionStats{}
+	query := db.Model(&model.SubscriptionAccess{}).Where("sub_id = ? AND status = ?", subId, http.StatusOK)
+	err := query.Select("COUNT(*) AS fetch_count, COUNT(DISTINCT ip) AS distinct_ips").Scan(stats).Error
+	if err != nil {
+		return nil, err
+	}
+	stats.SubId = subId
+	if stats.FetchCount == 0 {
+		return stats, nil
+	}
+
+	var last model.SubscriptionAccess
+	err = db.Where("sub_id = ? AND status = ?", subId, http.StatusOK).Order("id desc").First(&last).Error
+	if err != nil {
+		return nil, err
+	}
+	stats.LastFetch = last.CreatedAt
+	stats.LastIP = last.IP
+	stats.LastUserAgent = last.UserAgent
+	stats.LastFamily = last.Family
+	return stats, nil
+}
+
+// PruneAccessLog deletes fetch records older than the given age.
+func (s *SubscriptionAccessService) PruneAccessLog(maxAge time.Duration) (int64, error) {
+	result := database.GetDB().Where("created_at < ?", time.Now().Add(-maxAge).Unix()).Delete(&model.SubscriptionAccess{})
+	return result.RowsAffected, result.Error
+}
@@ -0,0 +1,63 @@
+package service
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+)
+
+func TestSubscriptionAccessStats(t *testing.T) {
+	setupServiceTestDB(t)
+	svc := &SubscriptionAccessService{}
+
+	stats, err := svc.GetStats("leaked")
+	if err != nil {
+		t.Fatalf("GetStats failed: %v", err)
+	}
+	if stats.FetchCount != 0 || stats.LastFetch != 0 {
+		t.Fatalf("expected empty stats, got %+v", stats)
+	}
+
+	for _, access := range []*model.SubscriptionAccess{
+		{SubId: "leaked", IP: "10.0.0.1", UserAgent: "v2rayNG/1.8", Family: "v2rayNG", Format: "links", Status: http.StatusOK},
+		{SubId: "leaked", IP: "10.0.0.2", UserAgent: "clash-verge/1", Family: "Clash", Format: "clash", Status: http.StatusOK},
+		{SubId: "leaked", IP: "10.0.0.1", UserAgent: "v2rayNG/1.8", Family: "v2rayNG", Format: "links", Status: http.StatusOK},
+		{SubId: "leaked", IP: "10.0.0.3", UserAgent: "curl/8", Format: "links", Status: http.StatusBadRequest},
+		{SubId: "other", IP: "10.0.0.9", Format: "links", Status: http.StatusOK},
+	} {
+		svc.Record(access)
+	}
+	// Fetches are queued until flushed
+	if stats, _ := svc.GetStats("leaked"); stats.FetchCount != 0 {
+		t.Fatalf("expected fetches to wait for a flush, got %+v", stats)
+	}
+	svc.Flush()
+
+	stats, err = svc.GetStats("leaked")
+	if err != nil {
+		t.Fatalf("GetStats failed: %v", err)
+	}
+	if stats.SubId != "leaked" || stats.FetchCount != 3 || stats.DistinctIPs != 2 {
+		t.Fatalf("expected 3 fetches from 2 addresses, got %+v", stats)
+	}
+	if stats.LastFetch == 0 || stats.LastIP != "10.0.0.1" || stats.LastFamily != "v2rayNG" {
+		t.Fatalf("expected last successful fetch details, got %+v", stats)
+	}
+
+	records, err := svc.GetAccessLog("leaked", 2)
+	if err != nil {
+		t.Fatalf("GetAccessLog failed: %v", err)
+	}
+	if len(records) != 2 || records[0].Status != http.StatusBadRequest {
+		t.Fatalf("expected newest records first including failures, got %+v", records)
+	}
+
+	if _, err := svc.PruneAccessLog(-time.Hour); err != nil {
+		t.Fatalf("PruneAccessLog failed: %v", err)
+	}
+	if records, _ := svc.GetAccessLog("leaked", 0); len(records) != 0 {
+		t.Fatalf("expected every record to be pruned, got %d", len(records))
+	}
+}
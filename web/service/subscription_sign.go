@@ -0,0 +1,183 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/mhsanaei/3x-ui/v2/database"
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+	"github.com/mhsanaei/3x-ui/v2/util/common"
+	"github.com/mhsanaei/3x-ui/v2/util/crypto"
+)
+
+// Query parameters of a signed subscription URL.
+const (
+	SubSignExpiryParam    = "exp"
+	SubSignSignatureParam = "sig"
+)
+
+// SubscriptionSignService signs subscription URLs with the panel secret so they can be shared for
+// a limited time, and manages which subscriptions are only served through signed URLs.
+type SubscriptionSignService struct {
+	settingService           SettingService
+	subscriptionTokenService SubscriptionTokenService
+}
+
+// SignQuery returns the query parameters that sign a subscription URL built from id, a subId
+// or a subscription token, until expiresAt in seconds.
+func (s *SubscriptionSignService) SignQuery(id string, expiresAt int64) (string, error) {
+	secret, err := s.settingService.GetSecret()
+	if err != nil {
+		return "", err
+	}
+	query := url.Values{}
+	query.Set(SubSignExpiryParam, strconv.FormatInt(expiresAt, 10))
+	query.Set(SubSignSignatureParam, crypto.SignSubscription(secret, id, expiresAt))
+	return query.Encode(), nil
+}
+
+// Verify checks the expiry and signature parameters of a subscription URL built from id.
+// It returns the expiry of a valid signature.
+func (s *SubscriptionSignService) Verify(id string, expiry string, signature string) (int64, error) {
+	expiresAt, err := strconv.ParseInt(expiry, 10, 64)
+	if err != nil || signature == "" {
+		return 0, common.NewError("subscription URL signature is malformed")
+	}
+	if expiresAt <= time.Now().Unix() {
+		return 0, common.NewError("signed subscription URL has expired")
+	}
+	secret, err := s.settingService.GetSecret()
+	if err != nil {
+		return 0, err
+	}
+	if !crypto.VerifySubscriptionSignature(secret, id, expiresAt, signature) {
+		return 0, common.NewError("subscription URL signature is invalid")
+	}
+	return expiresAt, nil
+}
+
+// IsSignedOnly reports whether a subscription is only served through signed URLs.
+func (s *SubscriptionSignService) IsSignedOnly(subId string) (bool, error) {
+	var policy model.SubscriptionPolicy
+	err := database.GetDB().Where("sub_id = ?", subId).First(&policy).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return policy.SignedOnly, nil
+}
+
+// SetSignedOnly sets whether a subscription is only served through signed URLs.
+func (s *SubscriptionSignService) SetSignedOnly(subId string, signedOnly bool) error {
+	subId = strings.TrimSpace(subId)
+	if subId == "" {
+		return common.NewError("subscription policy needs a subId")
+	}
+	policy := &model.SubscriptionPolicy{SubId: subId, SignedOnly: signedOnly}
+	return database.GetDB().Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "sub_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"signed_only", "updated_at"}),
+	}).Create(policy).Error
+}
+
+// BuildURL returns the absolute URL of a subscription format for id, a subId or a subscription token.
+// The URI configured for the format comes first, then the subscription domain settings, which leave
+// out the standard port of the scheme, and finally scheme and hostWithPort of the request with path.
+// A positive expiresAt signs the URL until then.
+func (s *SubscriptionSignService) BuildURL(configuredURI, scheme, hostWithPort, path, id string, expiresAt int64) (string, error) {
+	if id == "" {
+		return "", nil
+	}
+	base := configuredURI
+	if base == "" {
+		if subDomain, err := s.settingService.GetSubDomain(); err == nil && subDomain != "" {
+			subPort, _ := s.settingService.GetSubPort()
+			subKeyFile, _ := s.settingService.GetSubKeyFile()
+			subCertFile, _ := s.settingService.GetSubCertFile()
+			tls := subKeyFile != "" && subCertFile != ""
+			scheme = "http"
+			if tls {
+				scheme = "https"
+			}
+			hostWithPort = subHostWithPort(subDomain, subPort, tls)
+		}
+		base = fmt.Sprintf("%s://%s%s", scheme, hostWithPort, path)
+	}
+	if !strings.HasSuffix(base, "/") {
+		base += "/"
+	}
+	subURL := base + id
+	if expiresAt <= 0 {
+		return subURL, nil
+	}
+	query, err := s.SignQuery(id, expiresAt)
+	if err != nil {
+		return "", err
+	}
+	return subURL + "?" + query, nil
+}
+
+// BuildURLs returns the absolute links and JSON URLs of a subscription, built like the subscription
+// server builds them for its info page. Without a subscription domain the panel domain or the host
+// name is used. The JSON URL is empty when the JSON subscription is disabled. Subscriptions with an
+// active token are linked through it. A positive expiresAt signs both URLs until then.
+func (s *SubscriptionSignService) BuildURLs(subId string, expiresAt int64) (string, string, error) {
+	id := subId
+	token, err := s.subscriptionTokenService.GetActiveToken(subId)
+	if err != nil {
+		return "", "", err
+	}
+	if token != nil {
+		id = token.Token
+	}
+
+	subPort, _ := s.settingService.GetSubPort()
+	subKeyFile, _ := s.settingService.GetSubKeyFile()
+	subCertFile, _ := s.settingService.GetSubCertFile()
+	tls := subKeyFile != "" && subCertFile != ""
+	scheme := "http"
+	if tls {
+		scheme = "https"
+	}
+	host := "localhost"
+	if d, err := s.settingService.GetWebDomain(); err == nil && d != "" {
+		host = d
+	} else if hostname != "" {
+		host = hostname
+	}
+	host = subHostWithPort(host, subPort, tls)
+
+	subPath, _ := s.settingService.GetSubPath()
+	subURI, _ := s.settingService.GetSubURI()
+	subURL, err := s.BuildURL(subURI, scheme, host, "/"+strings.TrimPrefix(subPath, "/"), id, expiresAt)
+	if err != nil {
+		return "", "", err
+	}
+	if subJsonEnable, _ := s.settingService.GetSubJsonEnable(); !subJsonEnable {
+		return subURL, "", nil
+	}
+	subJsonPath, _ := s.settingService.GetSubJsonPath()
+	subJsonURI, _ := s.settingService.GetSubJsonURI()
+	subJsonURL, err := s.BuildURL(subJsonURI, scheme, host, "/"+strings.TrimPrefix(subJsonPath, "/"), id, expiresAt)
+	if err != nil {
+		return "", "", err
+	}
+	return subURL, subJsonURL, nil
+}
+
+// subHostWithPort adds the subscription port to host unless it is the standard port of the scheme.
+func subHostWithPort(host string, port int, tls bool) string {
+	if (port == 443 && tls) || (port == 80 && !tls) {
+		return host
+	}
+	return fmt.Sprintf("%s:%d", host, port)
+}
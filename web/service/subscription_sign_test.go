@@ -0,0 +1,108 @@
+package service
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSubscriptionSignedURLs(t *testing.T) {
+	setupServiceTestDB(t)
+	svc := &SubscriptionSignService{}
+
+	expiresAt := time.Now().Add(time.Hour).Unix()
+	query, err := svc.SignQuery("sub1", expiresAt)
+	if err != nil {
+		t.Fatalf("SignQuery failed: %v", err)
+	}
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		t.Fatalf("ParseQuery failed: %v", err)
+	}
+	expiry, signature := values.Get(SubSignExpiryParam), values.Get(SubSignSignatureParam)
+	if got, err := svc.Verify("sub1", expiry, signature); err != nil || got != expiresAt {
+		t.Fatalf("expected a valid signature until %d, got %d %v", expiresAt, got, err)
+	}
+
+	// Signatures are bound to the subscription and the expiry
+	if _, err := svc.Verify("sub2", expiry, signature); err == nil {
+		t.Fatalf("expected a signature of another subscription to be rejected")
+	}
+	if _, err := svc.Verify("sub1", strconv.FormatInt(expiresAt+3600, 10), signature); err == nil {
+		t.Fatalf("expected a tampered expiry to be rejected")
+	}
+	if _, err := svc.Verify("sub1", "soon", signature); err == nil {
+		t.Fatalf("expected a malformed expiry to be rejected")
+	}
+	past := time.Now().Add(-time.Minute).Unix()
+	query, _ = svc.SignQuery("sub1", past)
+	values, _ = url.ParseQuery(query)
+	if _, err := svc.Verify("sub1", values.Get(SubSignExpiryParam), values.Get(SubSignSignatureParam)); err == nil {
+		t.Fatalf("expected an expired signature to be rejected")
+	}
+
+	// Panel and subscription server build URLs alike: request values, then the configured URI
+	if got, err := svc.BuildURL("", "https", "sub.example.com:2096", "/sub/", "sub1", 0); err != nil || got != "https://sub.example.com:2096/sub/sub1" {
+		t.Fatalf("unexpected URL from request values: %q %v", got, err)
+	}
+
+	// A subscription domain leaves out the standard port of its scheme
+	for _, tc := range []struct {
+		port string
+		tls  bool
+		want string
+	}{
+		{"443", true, "https://sub.example.com/sub/sub1"},
+		{"2096", true, "https://sub.example.com:2096/sub/sub1"},
+		{"80", false, "http://sub.example.com/sub/sub1"},
+		{"443", false, "http://sub.example.com:443/sub/sub1"},
+	} {
+		certFile := ""
+		if tc.tls {
+			certFile = "/etc/ssl/sub.pem"
+		}
+		for key, value := range map[string]string{"subDomain": "sub.example.com", "subPort": tc.port, "subCertFile": certFile, "subKeyFile": certFile} {
+			if err := svc.settingService.saveSetting(key, value); err != nil {
+				t.Fatalf("saveSetting failed: %v", err)
+			}
+		}
+		if got, err := svc.BuildURL("", "http", "panel.example.com:2053", "/sub/", "sub1", 0); err != nil || got != tc.want {
+			t.Fatalf("expected %q for port %s, got %q %v", tc.want, tc.port, got, err)
+		}
+	}
+	if err := svc.settingService.saveSetting("subDomain", ""); err != nil {
+		t.Fatalf("saveSetting failed: %v", err)
+	}
+	got, err := svc.BuildURL("https://cdn.example.com/s", "https", "sub.example.com:2096", "/sub/", "sub1", expiresAt)
+	if err != nil || !strings.HasPrefix(got, "https://cdn.example.com/s/sub1?") {
+		t.Fatalf("expected the configured URI to be signed, got %q %v", got, err)
+	}
+	values, _ = url.ParseQuery(strings.SplitN(got, "?", 2)[1])
+	if _, err := svc.Verify("sub1", values.Get(SubSignExpiryParam), values.Get(SubSignSignatureParam)); err != nil {
+		t.Fatalf("expected the built URL to carry a valid signature: %v", err)
+	}
+	if err := svc.settingService.saveSetting("subURI", "https://cdn.example.com/s/"); err != nil {
+		t.Fatalf("saveSetting failed: %v", err)
+	}
+	if subURL, _, err := svc.BuildURLs("sub1", 0); err != nil || subURL != "https://cdn.example.com/s/sub1" {
+		t.Fatalf("expected panel links to use the configured URI, got %q %v", subURL, err)
+	}
+
+	// Signed-only is off by default and can be toggled
+	if signedOnly, err := svc.IsSignedOnly("sub1"); err != nil || signedOnly {
+		t.Fatalf("expected sub1 not to be signed-only, got %v %v", signedOnly, err)
+	}
+	for _, want := range []bool{true, false, true} {
+		if err := svc.SetSignedOnly("sub1", want); err != nil {
+			t.Fatalf("SetSignedOnly failed: %v", err)
+		}
+		if signedOnly, err := svc.IsSignedOnly("sub1"); err != nil || signedOnly != want {
+			t.Fatalf("expected signed-only %v, got %v %v", want, signedOnly, err)
+		}
+	}
+	if err := svc.SetSignedOnly(" ", true); err == nil {
+		t.Fatalf("expected a policy without subId to be rejected")
+	}
+}
@@ -0,0 +1,229 @@
+package service
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/mhsanaei/3x-ui/v2/database"
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+	"github.com/mhsanaei/3x-ui/v2/util/common"
+	"github.com/mhsanaei/3x-ui/v2/util/random"
+)
+
+// subscriptionTokenLen is the length of generated subscription tokens.
+const subscriptionTokenLen = 32
+
+// SubscriptionTokenService manages the revocable tokens subscriptions are fetched through.
+type SubscriptionTokenService struct {
+	settingService SettingService
+}
+
+// GetTokens returns the tokens of a subscription, or of every subscription when subId is empty.
+func (s *SubscriptionTokenService) GetTokens(subId string) ([]*model.SubscriptionToken, error) {
+	query := database.GetDB().Model(&model.SubscriptionToken{})
+	if subId != "" {
+		query = query.Where("sub_id = ?", subId)
+	}
+	var tokens []*model.SubscriptionToken
+	err := query.Order("id asc").Find(&tokens).Error
+	return tokens, err
+}
+
+// GetToken returns a token by ID.
+func (s *SubscriptionTokenService) GetToken(id int) (*model.SubscriptionToken, error) {
+	var token model.SubscriptionToken
+	if err := database.GetDB().First(&token, id).Error; err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+// GetActiveToken returns the newest enabled and unexpired token of a subscription, or nil
+// when it has none.
+func (s *SubscriptionTokenService) GetActiveToken(subId string) (*model.SubscriptionToken, error) {
+	var token model.SubscriptionToken
+	err := database.GetDB().
+		Where("sub_id = ? AND enable = ? AND (expires_at = 0 OR expires_at > ?)", subId, true, time.Now().Unix()).
+		Order("id desc").First(&token).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+// AddToken creates a token with a freshly generated value for the subscription of the given token.
+func (s *SubscriptionTokenService) AddToken(token *model.SubscriptionToken) error {
+	token.Id = 0
+	if err := s.validateToken(token); err != nil {
+		return err
+	}
+	token.Token = random.Seq(subscriptionTokenLen)
+	token.RotatedAt = 0
+	return database.GetDB().Create(token).Error
+}
+
+// UpdateToken changes the remark, expiry, limits and state of a token. Its value and subscription are kept.
+func (s *SubscriptionTokenService) UpdateToken(token *model.SubscriptionToken) error {
+	stored, err := s.GetToken(token.Id)
+	if err != nil {
+		return err
+	}
+	token.SubId = stored.SubId
+	if err := s.validateToken(token); err != nil {
+		return err
+	}
+	return database.GetDB().Model(&model.SubscriptionToken{}).Where("id = ?", token.Id).Updates(map[string]any{
+		"remark":       token.Remark,
+		"expires_at":   token.ExpiresAt,
+		"ip_limit":     token.IPLimit,
+		"device_limit": token.DeviceLimit,
+		"enable":       token.Enable,
+		"updated_at":   time.Now().Unix(),
+	}).Error
+}
+
+// RotateToken replaces the value of a token, which invalidates URLs built from the old one.
+// The addresses and devices counted against its limits start over.
+func (s *SubscriptionTokenService) RotateToken(id int) (*model.SubscriptionToken, error) {
+	token, err := s.GetToken(id)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().Unix()
+	token.Token = random.Seq(subscriptionTokenLen)
+	token.RotatedAt = now
+	err = database.GetDB().Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&model.SubscriptionToken{}).Where("id = ?", id).Updates(map[string]any{
+			"token":      token.Token,
+			"rotated_at": now,
+			"updated_at": now,
+		}).Error
+		if err != nil {
+			return err
+		}
+		return tx.Where("token_id = ?", id).Delete(&model.SubscriptionTokenDevice{}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// RotateSubTokens rotates every token of a subscription, creating one when it has none, and
+// returns its active token.
+func (s *SubscriptionTokenService) RotateSubTokens(subId string) (*model.SubscriptionToken, error) {
+	tokens, err := s.GetTokens(subId)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		token := &model.SubscriptionToken{SubId: subId, Enable: true}
+		if err := s.AddToken(token); err != nil {
+			return nil, err
+		}
+		return token, nil
+	}
+	for _, token := range tokens {
+		if _, err := s.RotateToken(token.Id); err != nil {
+			return nil, err
+		}
+	}
+	return s.GetActiveToken(subId)
+}
+
+// DeleteToken removes a token along with the devices counted against its limits.
+func (s *SubscriptionTokenService) DeleteToken(id int) error {
+	return database.GetDB().Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("token_id = ?", id).Delete(&model.SubscriptionTokenDevice{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&model.SubscriptionToken{}, id).Error
+	})
+}
+
+// GetDevices returns the addresses and client applications that fetched a subscription through a token.
+func (s *SubscriptionTokenService) GetDevices(id int) ([]*model.SubscriptionTokenDevice, error) {
+	var devices []*model.SubscriptionTokenDevice
+	err := database.GetDB().Where("token_id = ?", id).Order("last_seen desc").Find(&devices).Error
+	return devices, err
+}
+
+// ResolveSubId maps the identifier of a subscription request to a subId. Tokens are checked for
+// their state, expiry and IP and device limits, and the requesting device is counted against them.
+// Any other identifier is taken as a subId, unless tokens are required and the subscription has some.
+// The returned subId is set whenever it is known, even when the request is refused.
+func (s *SubscriptionTokenService) ResolveSubId(value string, ip string, userAgent string) (string, error) {
+	db := database.GetDB()
+	var token model.SubscriptionToken
+	err := db.Where("token = ?", value).First(&token).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		required, err := s.settingService.GetSubTokenRequired()
+		if err != nil || !required {
+			return value, err
+		}
+		var count int64
+		if err := db.Model(&model.SubscriptionToken{}).Where("sub_id = ?", value).Count(&count).Error; err != nil {
+			return value, err
+		}
+		if count > 0 {
+			return value, common.NewError("subscription is only served through its tokens")
+		}
+		return value, nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now().Unix()
+	if !token.Enable {
+		return token.SubId, common.NewError("subscription token is disabled")
+	}
+	if token.IsExpired(now) {
+		return token.SubId, common.NewError("subscription token has expired")
+	}
+	return token.SubId, db.Transaction(func(tx *gorm.DB) error {
+		var devices []*model.SubscriptionTokenDevice
+		if err := tx.Where("token_id = ?", token.Id).Find(&devices).Error; err != nil {
+			return err
+		}
+		ips := make(map[string]bool)
+		userAgents := make(map[string]bool)
+		for _, device := range devices {
+			if device.IP == ip && device.UserAgent == userAgent {
+				return tx.Model(device).Update("last_seen", now).Error
+			}
+			ips[device.IP] = true
+			userAgents[device.UserAgent] = true
+		}
+		if token.IPLimit > 0 && !ips[ip] && len(ips) >= token.IPLimit {
+			return common.NewErrorf("subscription token IP limit of %d reached", token.IPLimit)
+		}
+		if token.DeviceLimit > 0 && !userAgents[userAgent] && len(userAgents) >= token.DeviceLimit {
+			return common.NewErrorf("subscription token device limit of %d reached", token.DeviceLimit)
+		}
+		return tx.Create(&model.SubscriptionTokenDevice{
+			TokenId:   token.Id,
+			IP:        ip,
+			UserAgent: userAgent,
+			LastSeen:  now,
+		}).Error
+	})
+}
+
+func (s *SubscriptionTokenService) validateToken(token *model.SubscriptionToken) error {
+	token.SubId = strings.TrimSpace(token.SubId)
+	token.Remark = strings.TrimSpace(token.Remark)
+	if token.SubId == "" {
+		return common.NewError("subscription token needs a subId")
+	}
+	if token.ExpiresAt < 0 || token.IPLimit < 0 || token.DeviceLimit < 0 {
+		return common.NewError("subscription token expiry and limits can not be negative")
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+)
+
+func TestSubscriptionTokens(t *testing.T) {
+	setupServiceTestDB(t)
+	svc := &SubscriptionTokenService{}
+
+	if err := svc.AddToken(&model.SubscriptionToken{}); err == nil {
+		t.Fatalf("expected a token without subId to be rejected")
+	}
+	token := &model.SubscriptionToken{SubId: "sub1", IPLimit: 2, DeviceLimit: 1, Enable: true}
+	if err := svc.AddToken(token); err != nil {
+		t.Fatalf("AddToken failed: %v", err)
+	}
+	if len(token.Token) != subscriptionTokenLen {
+		t.Fatalf("expected a generated token, got %q", token.Token)
+	}
+
+	// Tokens resolve to their subId; other identifiers are taken as subIds
+	if subId, err := svc.ResolveSubId(token.Token, "10.0.0.1", "v2rayNG"); err != nil || subId != "sub1" {
+		t.Fatalf("expected token to resolve to sub1, got %q %v", subId, err)
+	}
+	if subId, err := svc.ResolveSubId("sub1", "10.0.0.1", "v2rayNG"); err != nil || subId != "sub1" {
+		t.Fatalf("expected raw subId to be served while tokens are optional, got %q %v", subId, err)
+	}
+
+	// The same device from a second address is fine, a second device is not, neither is a third address
+	if _, err := svc.ResolveSubId(token.Token, "10.0.0.2", "v2rayNG"); err != nil {
+		t.Fatalf("expected a second address within the IP limit, got %v", err)
+	}
+	if _, err := svc.ResolveSubId(token.Token, "10.0.0.1", "Shadowrocket"); err == nil {
+		t.Fatalf("expected a second device to exceed the device limit")
+	}
+	if _, err := svc.ResolveSubId(token.Token, "10.0.0.3", "v2rayNG"); err == nil {
+		t.Fatalf("expected a third address to exceed the IP limit")
+	}
+	if devices, _ := svc.GetDevices(token.Id); len(devices) != 2 {
+		t.Fatalf("expected 2 counted devices, got %d", len(devices))
+	}
+
+	// Rotation invalidates the old value and starts the limits over
+	oldValue := token.Token
+	rotated, err := svc.RotateToken(token.Id)
+	if err != nil {
+		t.Fatalf("RotateToken failed: %v", err)
+	}
+	if rotated.Token == oldValue || rotated.RotatedAt == 0 {
+		t.Fatalf("expected a new token value, got %+v", rotated)
+	}
+	if subId, _ := svc.ResolveSubId(oldValue, "10.0.0.1", "v2rayNG"); subId != oldValue {
+		t.Fatalf("expected the old token to no longer resolve, got %q", subId)
+	}
+	if _, err := svc.ResolveSubId(rotated.Token, "10.0.0.3", "Shadowrocket"); err != nil {
+		t.Fatalf("expected limits to start over after rotation, got %v", err)
+	}
+
+	// Expired and disabled tokens are refused
+	rotated.ExpiresAt = time.Now().Add(-time.Minute).Unix()
+	rotated.Enable = true
+	if err := svc.UpdateToken(rotated); err != nil {
+		t.Fatalf("UpdateToken failed: %v", err)
+	}
+	if subId, err := svc.ResolveSubId(rotated.Token, "10.0.0.3", "Shadowrocket"); err == nil || subId != "sub1" {
+		t.Fatalf("expected expired token to be refused for sub1, got %q %v", subId, err)
+	}
+	if active, _ := svc.GetActiveToken("sub1"); active != nil {
+		t.Fatalf("expected no active token, got %+v", active)
+	}
+
+	// A token created as disabled stays disabled
+	disabled := &model.SubscriptionToken{SubId: "sub3", Enable: false}
+	if err := svc.AddToken(disabled); err != nil {
+		t.Fatalf("AddToken failed: %v", err)
+	}
+	if stored, _ := svc.GetToken(disabled.Id); stored == nil || stored.Enable {
+		t.Fatalf("expected token created as disabled to be stored disabled, got %+v", stored)
+	}
+	if _, err := svc.ResolveSubId(disabled.Token, "10.0.0.1", "v2rayNG"); err == nil {
+		t.Fatalf("expected disabled token to be refused")
+	}
+	if err := svc.DeleteToken(disabled.Id); err != nil {
+		t.Fatalf("DeleteToken failed: %v", err)
+	}
+
+	// Once tokens are required, a subscription that has tokens is not served by its subId
+	settingSvc := &SettingService{}
+	if err := settingSvc.saveSetting("subTokenRequired", "true"); err != nil {
+		t.Fatalf("saveSetting failed: %v", err)
+	}
+	if _, err := svc.ResolveSubId("sub1", "10.0.0.1", "v2rayNG"); err == nil {
+		t.Fatalf("expected raw subId to be refused once tokens are required")
+	}
+	if subId, err := svc.ResolveSubId("sub2", "10.0.0.1", "v2rayNG"); err != nil || subId != "sub2" {
+		t.Fatalf("expected subscription without tokens to be served, got %q %v", subId, err)
+	}
+
+	active, err := svc.RotateSubTokens("sub2")
+	if err != nil || active == nil || active.SubId != "sub2" {
+		t.Fatalf("expected RotateSubTokens to create a token, got %+v %v", active, err)
+	}
+	if err := svc.DeleteToken(token.Id); err != nil {
+		t.Fatalf("DeleteToken failed: %v", err)
+	}
+	if tokens, _ := svc.GetTokens(""); len(tokens) != 1 {
+		t.Fatalf("expected 1 token left, got %d", len(tokens))
+	}
+}
@@ -101,14 +101,22 @@ const (
 	EmptyTelegramUserID             = int64(0) // Default value for empty Telegram user ID
 )
 
+// signedSubLinkTTL is how long signed subscription links sent by the bot stay valid.
+const signedSubLinkTTL = 24 * time.Hour
+
 // Tgbot provides business logic for Telegram bot integration.
 // It handles bot commands, user interactions, and status reporting via Telegram.
 type Tgbot struct {
-	inboundService InboundService
-	settingService SettingService
-	serverService  ServerService
-	xrayService    XrayService
-	lastStatus     *Status
+	inboundService            InboundService
+	settingService            SettingService
+	serverService             ServerService
+	xrayService               XrayService
+	subscriptionAccessService SubscriptionAccessService
+	subscriptionTokenService  SubscriptionTokenService
+	subscriptionSignService   SubscriptionSignService
+	trafficReportService      TrafficReportService
+	planService               PlanService
+	lastStatus                *Status
 }
 
 // NewTgbot creates a new Tgbot instance.
@@ -1465,6 +1473,68 @@ func (t *Tgbot) answerCallback(callbackQuery *telego.CallbackQuery, isAdmin bool
 				} else {
 					t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.answers.errorOperation"))
 				}
+			case "rotate_sub_token":
+				inlineKeyboard := tu.InlineKeyboard(
+					tu.InlineKeyboardRow(
+						tu.InlineKeyboardButton(t.I18nBot("tgbot.buttons.cancel")).WithCallbackData(t.encodeQuery("client_cancel "+email)),
+					),
+					tu.InlineKeyboardRow(
+						tu.InlineKeyboardButton(t.I18nBot("tgbot.buttons.confirmRotateSubToken")).WithCallbackData(t.encodeQuery("rotate_sub_token_c "+email)),
+					),
+				)
+				t.editMessageCallbackTgBot(chatId, callbackQuery.Message.GetMessageID(), inlineKeyboard)
+			case "client_plan":
+				inlineKeyboard, err := t.clientPlanKeyboard(email)
+				if err != nil {
+					logger.Warning(err)
+					t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.answers.errorOperation"))
+					return
+				}
+				t.editMessageCallbackTgBot(chatId, callbackQuery.Message.GetMessageID(), inlineKeyboard)
+			case "apply_plan", "renew_plan":
+				actor := "tgbot:" + strconv.FormatInt(chatId, 10)
+				var needRestart bool
+				var err error
+				if dataArray[0] == "renew_plan" {
+					needRestart, err = t.planService.RenewPlan(email, actor)
+				} else if len(dataArray) == 3 {
+					var planId int
+					planId, err = strconv.Atoi(dataArray[2])
+					if err == nil {
+						needRestart, err = t.planService.ApplyPlan(email, planId, actor)
+					}
+				} else {
+					err = errors.New("no plan given")
+				}
+				if needRestart {
+					t.xrayService.SetToNeedRestart()
+				}
+				if err == nil {
+					t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.answers.planSuccess", "Email=="+email))
+				} else {
+					logger.Warning(err)
+					t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.answers.errorOperation"))
+				}
+				t.searchClient(chatId, email, callbackQuery.Message.GetMessageID())
+			case "client_signed_links":
+				t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.buttons.signedSubLink"))
+				t.sendClientSignedLinks(chatId, email)
+			case "rotate_sub_token_c":
+				_, client, err := t.inboundService.GetClientByEmail(email)
+				if err == nil && (client == nil || client.SubID == "") {
+					err = errors.New("client has no subscription")
+				}
+				if err == nil {
+					_, err = t.subscriptionTokenService.RotateSubTokens(client.SubID)
+				}
+				if err == nil {
+					t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.answers.rotateSubTokenSuccess", "Email=="+email))
+					t.searchClient(chatId, email, callbackQuery.Message.GetMessageID())
+					t.sendClientSubLinks(chatId, email)
+				} else {
+					logger.Warning(err)
+					t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.answers.errorOperation"))
+				}
 			case "get_clients":
 				inboundId := dataArray[1]
 				inboundIdInt, err := strconv.Atoi(inboundId)
@@ -2243,74 +2313,20 @@ func (t *Tgbot) SendMsgToTgbot(chatId int64, msg string, replyMarkup ...telego.R
 	}
 }
 
-// buildSubscriptionURLs builds the HTML sub page URL and JSON subscription URL for a client email
-func (t *Tgbot) buildSubscriptionURLs(email string) (string, string, error) {
+// buildSubscriptionURLs builds the HTML sub page URL and JSON subscription URL for a client email.
+// A positive expiresAt signs them until then.
+func (t *Tgbot) buildSubscriptionURLs(email string, expiresAt int64) (string, string, error) {
 	// Resolve subId from client email
-	traffic, client, err := t.inboundService.GetClientByEmail(email)
-	_ = traffic
+	_, client, err := t.inboundService.GetClientByEmail(email)
 	if err != nil || client == nil {
 		return "", "", errors.New("client not found")
 	}
-
-	// Gather settings to construct absolute URLs
-	subDomain, _ := t.settingService.GetSubDomain()
-	subPort, _ := t.settingService.GetSubPort()
-	subPath, _ := t.settingService.GetSubPath()
-	subJsonPath, _ := t.settingService.GetSubJsonPath()
-	subJsonEnable, _ := t.settingService.GetSubJsonEnable()
-	subKeyFile, _ := t.settingService.GetSubKeyFile()
-	subCertFile, _ := t.settingService.GetSubCertFile()
-
-	tls := (subKeyFile != "" && subCertFile != "")
-	scheme := "http"
-	if tls {
-		scheme = "https"
-	}
-
-	// Fallbacks
-	if subDomain == "" {
-		// try panel domain, otherwise OS hostname
-		if d, err := t.settingService.GetWebDomain(); err == nil && d != "" {
-			subDomain = d
-		} else if hostname != "" {
-			subDomain = hostname
-		} else {
-			subDomain = "localhost"
-		}
-	}
-
-	host := subDomain
-	if (subPort == 443 && tls) || (subPort == 80 && !tls) {
-		// standard ports: no port in host
-	} else {
-		host = fmt.Sprintf("%s:%d", subDomain, subPort)
-	}
-
-	// Ensure paths
-	if !strings.HasPrefix(subPath, "/") {
-		subPath = "/" + subPath
-	}
-	if !strings.HasSuffix(subPath, "/") {
-		subPath = subPath + "/"
-	}
-	if !strings.HasPrefix(subJsonPath, "/") {
-		subJsonPath = "/" + subJsonPath
-	}
-	if !strings.HasSuffix(subJsonPath, "/") {
-		subJsonPath = subJsonPath + "/"
-	}
-
-	subURL := fmt.Sprintf("%s://%s%s%s", scheme, host, subPath, client.SubID)
-	subJsonURL := fmt.Sprintf("%s://%s%s%s", scheme, host, subJsonPath, client.SubID)
-	if !subJsonEnable {
-		subJsonURL = ""
-	}
-	return subURL, subJsonURL, nil
+	return t.subscriptionSignService.BuildURLs(client.SubID, expiresAt)
 }
 
 // sendClientSubLinks sends the subscription links for the client to the chat.
 func (t *Tgbot) sendClientSubLinks(chatId int64, email string) {
-	subURL, subJsonURL, err := t.buildSubscriptionURLs(email)
+	subURL, subJsonURL, err := t.buildSubscriptionURLs(email, 0)
 	if err != nil {
 		t.SendMsgToTgbot(chatId, t.I18nBot("tgbot.answers.errorOperation")+"\r\n"+err.Error())
 		return
@@ -2330,10 +2346,26 @@ func (t *Tgbot) sendClientSubLinks(chatId int64, email string) {
 	t.SendMsgToTgbot(chatId, msg, inlineKeyboard)
 }
 
+// sendClientSignedLinks sends subscription links of the client that stop working after signedSubLinkTTL.
+func (t *Tgbot) sendClientSignedLinks(chatId int64, email string) {
+	expiresAt := time.Now().Add(signedSubLinkTTL)
+	subURL, subJsonURL, err := t.buildSubscriptionURLs(email, expiresAt.Unix())
+	if err != nil {
+		t.SendMsgToTgbot(chatId, t.I18nBot("tgbot.answers.errorOperation")+"\r\n"+err.Error())
+		return
+	}
+	msg := t.I18nBot("tgbot.messages.signedSubLink", "Time=="+expiresAt.Format("2006-01-02 15:04:05"))
+	msg += "\r\nSubscription URL:\r\n<code>" + subURL + "</code>"
+	if subJsonURL != "" {
+		msg += "\r\n\r\nJSON URL:\r\n<code>" + subJsonURL + "</code>"
+	}
+	t.SendMsgToTgbot(chatId, msg)
+}
+
 // sendClientIndividualLinks fetches the subscription content (individual links) and sends it to the user
 func (t *Tgbot) sendClientIndividualLinks(chatId int64, email string) {
 	// Build the HTML sub page URL; we'll call it with header Accept to get raw content
-	subURL, _, err := t.buildSubscriptionURLs(email)
+	subURL, _, err := t.buildSubscriptionURLs(email, 0)
 	if err != nil {
 		t.SendMsgToTgbot(chatId, t.I18nBot("tgbot.answers.errorOperation")+"\r\n"+err.Error())
 		return
@@ -2414,7 +2446,7 @@ func (t *Tgbot) sendClientIndividualLinks(chatId int64, email string) {
 
 // sendClientQRLinks generates QR images for subscription URL, JSON URL, and a few individual links, then sends them
 func (t *Tgbot) sendClientQRLinks(chatId int64, email string) {
-	subURL, subJsonURL, err := t.buildSubscriptionURLs(email)
+	subURL, subJsonURL, err := t.buildSubscriptionURLs(email, 0)
 	if err != nil {
 		t.SendMsgToTgbot(chatId, t.I18nBot("tgbot.answers.errorOperation")+"\r\n"+err.Error())
 		return
@@ -2533,6 +2565,12 @@ func (t *Tgbot) SendReport() {
 	info := t.sendServerUsage()
 	t.SendMsgToTgbotAdmins(info)
 
+	if topTalkers, err := t.settingService.GetTgTopTalkers(); err == nil && topTalkers > 0 {
+		if msg := t.topTalkersMsg(topTalkers); msg != "" {
+			t.SendMsgToTgbotAdmins(msg)
+		}
+	}
+
 	t.sendExhaustedToAdmins()
 	t.notifyExhausted()
 
@@ -2542,6 +2580,43 @@ func (t *Tgbot) SendReport() {
 	}
 }
 
+// topTalkersMsg formats the clients, inbounds and outbounds with the most traffic over the last
+// 24 hours, or returns an empty string when there is nothing to report.
+func (t *Tgbot) topTalkersMsg(limit int) string {
+	report, err := t.trafficReportService.GetTopTalkers(0, 0, limit)
+	if err != nil {
+		logger.Warning("Failed to get top talkers:", err)
+		return ""
+	}
+	if len(report.Clients)+len(report.Inbounds)+len(report.Outbounds) == 0 {
+		return ""
+	}
+	msg := t.I18nBot("tgbot.messages.topTalkers")
+	sections := []struct {
+		key    string
+		totals []*TrafficTotal
+	}{
+		{"tgbot.messages.topTalkersClients", report.Clients},
+		{"tgbot.messages.topTalkersInbounds", report.Inbounds},
+		{"tgbot.messages.topTalkersOutbounds", report.Outbounds},
+	}
+	for _, section := range sections {
+		if len(section.totals) == 0 {
+			continue
+		}
+		msg += t.I18nBot(section.key)
+		for i, total := range section.totals {
+			msg += t.I18nBot("tgbot.messages.topTalker",
+				"Rank=="+strconv.Itoa(i+1),
+				"Name=="+total.Name,
+				"Total=="+common.FormatTraffic(total.Total),
+				"Upload=="+common.FormatTraffic(total.Up),
+				"Download=="+common.FormatTraffic(total.Down))
+		}
+	}
+	return msg
+}
+
 // SendBackupToAdmins sends a database backup to admin chats.
 func (t *Tgbot) SendBackupToAdmins() {
 	if !t.IsRunning() {
@@ -2983,6 +3058,7 @@ func (t *Tgbot) clientInfoMsg(
 		output += t.I18nBot("tgbot.messages.upload", "Upload=="+common.FormatTraffic(traffic.Up))
 		output += t.I18nBot("tgbot.messages.download", "Download=="+common.FormatTraffic(traffic.Down))
 		output += t.I18nBot("tgbot.messages.total", "UpDown=="+common.FormatTraffic((traffic.Up+traffic.Down)), "Total=="+total)
+		output += t.subStatsMsg(traffic.Email)
 	}
 	if printRefreshed {
 		output += t.I18nBot("tgbot.messages.refreshedOn", "Time=="+time.Now().Format("2006-01-02 15:04:05"))
@@ -2991,6 +3067,25 @@ func (t *Tgbot) clientInfoMsg(
 	return output
 }
 
+// subStatsMsg formats how often and from how many addresses the subscription of a client was
+// fetched. It is empty for clients without a subscription.
+func (t *Tgbot) subStatsMsg(email string) string {
+	_, client, err := t.inboundService.GetClientByEmail(email)
+	if err != nil || client == nil || client.SubID == "" {
+		return ""
+	}
+	stats, err := t.subscriptionAccessService.GetStats(client.SubID)
+	if err != nil {
+		logger.Warning(err)
+		return ""
+	}
+	output := t.I18nBot("tgbot.messages.subFetches", "Count=="+strconv.FormatInt(stats.FetchCount, 10), "IPs=="+strconv.FormatInt(stats.DistinctIPs, 10))
+	if stats.LastFetch > 0 {
+		output += t.I18nBot("tgbot.messages.subLastFetch", "Time=="+time.Unix(stats.LastFetch, 0).Format("2006-01-02 15:04:05"))
+	}
+	return output
+}
+
 // getClientUsage retrieves and sends client usage information to the chat.
 func (t *Tgbot) getClientUsage(chatId int64, tgUserID int64, email ...string) {
 	traffics, err := t.inboundService.GetClientTrafficTgBot(tgUserID)
@@ -3142,6 +3237,7 @@ func (t *Tgbot) searchClient(chatId int64, email string, messageID ...int) {
 		),
 		tu.InlineKeyboardRow(
 			tu.InlineKeyboardButton(t.I18nBot("tgbot.buttons.resetExpire")).WithCallbackData(t.encodeQuery("reset_exp "+email)),
+			tu.InlineKeyboardButton(t.I18nBot("tgbot.buttons.plan")).WithCallbackData(t.encodeQuery("client_plan "+email)),
 		),
 		tu.InlineKeyboardRow(
 			tu.InlineKeyboardButton(t.I18nBot("tgbot.buttons.ipLog")).WithCallbackData(t.encodeQuery("ip_log "+email)),
@@ -3153,6 +3249,10 @@ func (t *Tgbot) searchClient(chatId int64, email string, messageID ...int) {
 		tu.InlineKeyboardRow(
 			tu.InlineKeyboardButton(t.I18nBot("tgbot.buttons.toggle")).WithCallbackData(t.encodeQuery("toggle_enable "+email)),
 		),
+		tu.InlineKeyboardRow(
+			tu.InlineKeyboardButton(t.I18nBot("tgbot.buttons.rotateSubToken")).WithCallbackData(t.encodeQuery("rotate_sub_token "+email)),
+			tu.InlineKeyboardButton(t.I18nBot("tgbot.buttons.signedSubLink")).WithCallbackData(t.encodeQuery("client_signed_links "+email)),
+		),
 	)
 	if len(messageID) > 0 {
 		t.editMessageTgBot(chatId, messageID[0], output, inlineKeyboard)
@@ -3161,6 +3261,35 @@ func (t *Tgbot) searchClient(chatId int64, email string, messageID ...int) {
 	}
 }
 
+// clientPlanKeyboard builds the keyboard to apply a plan to a client or renew its current one.
+func (t *Tgbot) clientPlanKeyboard(email string) (*telego.InlineKeyboardMarkup, error) {
+	_, client, err := t.inboundService.GetClientByEmail(email)
+	if err != nil {
+		return nil, err
+	}
+	plans, err := t.planService.GetPlans()
+	if err != nil {
+		return nil, err
+	}
+	rows := [][]telego.InlineKeyboardButton{
+		tu.InlineKeyboardRow(
+			tu.InlineKeyboardButton(t.I18nBot("tgbot.buttons.cancel")).WithCallbackData(t.encodeQuery("client_cancel " + email)),
+		),
+	}
+	for _, plan := range plans {
+		if plan.Id == client.PlanId {
+			rows = append(rows, tu.InlineKeyboardRow(
+				tu.InlineKeyboardButton(t.I18nBot("tgbot.buttons.renewPlan", "Plan=="+plan.Name)).WithCallbackData(t.encodeQuery("renew_plan "+email)),
+			))
+			continue
+		}
+		rows = append(rows, tu.InlineKeyboardRow(
+			tu.InlineKeyboardButton(t.I18nBot("tgbot.buttons.applyPlan", "Plan=="+plan.Name)).WithCallbackData(t.encodeQuery("apply_plan "+email+" "+strconv.Itoa(plan.Id))),
+		))
+	}
+	return tu.InlineKeyboard(rows...), nil
+}
+
 // addClient handles the process of adding a new client to an inbound.
 func (t *Tgbot) addClient(chatId int64, msg string, messageID ...int) {
 	inbound, err := t.inboundService.GetInbound(receiver_inbound_ID)
@@ -0,0 +1,174 @@
+package service
+
+import (
+	"encoding/csv"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/database"
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+	"github.com/mhsanaei/3x-ui/v2/util/common"
+	"github.com/mhsanaei/3x-ui/v2/xray"
+)
+
+// Kinds of tag traffic history.
+const (
+	TrafficKindInbound  = "inbound"
+	TrafficKindOutbound = "outbound"
+)
+
+// TrafficReportService records inbound and outbound traffic in hourly buckets, rolled up like
+// client traffic history, and reports who moved the most traffic over a window.
+type TrafficReportService struct {
+	settingService SettingService
+}
+
+// TrafficTotal is the traffic of a client, an inbound or an outbound over a report window.
+type TrafficTotal struct {
+	Name  string `json:"name"` // Client email or inbound/outbound tag
+	Up    int64  `json:"up"`
+	Down  int64  `json:"down"`
+	Total int64  `json:"total"`
+}
+
+// TrafficReport lists the clients, inbounds and outbounds with the most traffic over a window,
+// busiest first. The window is widened to whole buckets of the reported resolution.
+type TrafficReport struct {
+	From       int64           `json:"from"`
+	To         int64           `json:"to"`
+	Resolution string          `json:"resolution"`
+	Clients    []*TrafficTotal `json:"clients"`
+	Inbounds   []*TrafficTotal `json:"inbounds"`
+	Outbounds  []*TrafficTotal `json:"outbounds"`
+}
+
+// RecordTraffic adds the inbound and outbound traffic collected from Xray to the hourly buckets of their tags.
+func (s *TrafficReportService) RecordTraffic(traffics []*xray.Traffic, now time.Time) error {
+	bucketStart := now.Truncate(time.Hour).Unix()
+	buckets := make([]*model.TrafficBucket, 0, len(traffics))
+	for _, traffic := range traffics {
+		if traffic.Tag == "" || traffic.Up+traffic.Down <= 0 {
+			continue
+		}
+		kind := TrafficKindInbound
+		if traffic.IsOutbound {
+			kind = TrafficKindOutbound
+		} else if !traffic.IsInbound {
+			continue
+		}
+		buckets = append(buckets, &model.TrafficBucket{
+			Kind:        kind,
+			Tag:         traffic.Tag,
+			Resolution:  TrafficResolutionHour,
+			BucketStart: bucketStart,
+			Up:          traffic.Up,
+			Down:        traffic.Down,
+		})
+	}
+	return recordTrafficBuckets(tagTrafficTable, buckets)
+}
+
+// RollupTrafficHistory sums hourly inbound and outbound buckets into daily and monthly ones and
+// deletes buckets past their retention, like ClientTrafficHistoryService.RollupTrafficHistory.
+func (s *TrafficReportService) RollupTrafficHistory(now time.Time) error {
+	loc, err := s.settingService.GetTimeLocation()
+	if err != nil {
+		return err
+	}
+	return rollupTrafficTable[model.TrafficBucket](tagTrafficTable, now.In(loc), trafficRetention(&s.settingService))
+}
+
+// GetTopTalkers returns the limit clients, inbounds and outbounds with the most traffic between
+// from and to (unix seconds), the last 24 hours by default. The report uses the finest resolution
+// still kept for the start of the window.
+func (s *TrafficReportService) GetTopTalkers(from, to int64, limit int) (*TrafficReport, error) {
+	if to <= 0 {
+		to = time.Now().Unix()
+	}
+	if from <= 0 {
+		from = to - 24*3600
+	}
+	if from >= to {
+		return nil, common.NewError("range start must be before its end")
+	}
+	if limit <= 0 || limit > 100 {
+		limit = 10
+	}
+
+	loc, err := s.settingService.GetTimeLocation()
+	if err != nil {
+		return nil, err
+	}
+	report := &TrafficReport{To: to, Clients: []*TrafficTotal{}, Inbounds: []*TrafficTotal{}, Outbounds: []*TrafficTotal{}}
+	retention := trafficRetention(&s.settingService)
+	now := time.Now()
+	switch {
+	case from >= now.Add(-retention[TrafficResolutionHour]).Unix():
+		report.Resolution = TrafficResolutionHour
+		report.From = from - from%3600
+	case from >= now.Add(-retention[TrafficResolutionDay]).Unix():
+		start := time.Unix(from, 0).In(loc)
+		report.Resolution = TrafficResolutionDay
+		report.From = time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, loc).Unix()
+	default:
+		start := time.Unix(from, 0).In(loc)
+		report.Resolution = TrafficResolutionMonth
+		report.From = time.Date(start.Year(), start.Month(), 1, 0, 0, 0, 0, loc).Unix()
+	}
+
+	db := database.GetDB()
+	window := "resolution = ? AND bucket_start >= ? AND bucket_start < ?"
+	err = db.Model(&model.ClientTrafficBucket{}).
+		Select("email AS name, SUM(up) AS up, SUM(down) AS down, SUM(up + down) AS total").
+		Where(window, report.Resolution, report.From, report.To).
+		Group("email").Order("total desc").Limit(limit).Scan(&report.Clients).Error
+	if err != nil {
+		return nil, err
+	}
+	for kind, totals := range map[string]*[]*TrafficTotal{
+		TrafficKindInbound:  &report.Inbounds,
+		TrafficKindOutbound: &report.Outbounds,
+	} {
+		err := db.Model(&model.TrafficBucket{}).
+			Select("tag AS name, SUM(up) AS up, SUM(down) AS down, SUM(up + down) AS total").
+			Where("kind = ? AND "+window, kind, report.Resolution, report.From, report.To).
+			Group("tag").Order("total desc").Limit(limit).Scan(totals).Error
+		if err != nil {
+			return nil, err
+		}
+	}
+	return report, nil
+}
+
+// WriteReportCSV writes a report as CSV with one row per client, inbound and outbound.
+func (s *TrafficReportService) WriteReportCSV(w io.Writer, report *TrafficReport) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write([]string{"category", "name", "up", "down", "total"}); err != nil {
+		return err
+	}
+	sections := []struct {
+		category string
+		totals   []*TrafficTotal
+	}{
+		{"client", report.Clients},
+		{TrafficKindInbound, report.Inbounds},
+		{TrafficKindOutbound, report.Outbounds},
+	}
+	for _, section := range sections {
+		for _, total := range section.totals {
+			err := writer.Write([]string{
+				section.category,
+				total.Name,
+				strconv.FormatInt(total.Up, 10),
+				strconv.FormatInt(total.Down, 10),
+				strconv.FormatInt(total.Total, 10),
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
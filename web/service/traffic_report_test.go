@@ -0,0 +1,80 @@
+package service
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/xray"
+)
+
+func TestTrafficReport(t *testing.T) {
+	setupServiceTestDB(t)
+	setupTestLogger(t)
+	history := &ClientTrafficHistoryService{}
+	svc := &TrafficReportService{}
+
+	now := time.Now()
+	err := history.RecordTraffic([]*xray.ClientTraffic{
+		{Email: "small", Up: 1, Down: 1},
+		{Email: "big", Up: 100, Down: 900},
+		{Email: "medium", Up: 50, Down: 50},
+	}, now)
+	if err != nil {
+		t.Fatalf("RecordTraffic failed: %v", err)
+	}
+	traffics := []*xray.Traffic{
+		{IsInbound: true, Tag: "in-a", Up: 10, Down: 20},
+		{IsInbound: true, Tag: "in-b", Up: 300, Down: 400},
+		{IsOutbound: true, Tag: "direct", Up: 5, Down: 5},
+		{IsOutbound: true, Tag: "blocked"},
+	}
+	// Two collections within the same hour add up
+	for i := 0; i < 2; i++ {
+		if err := svc.RecordTraffic(traffics, now); err != nil {
+			t.Fatalf("RecordTraffic failed: %v", err)
+		}
+	}
+	// Traffic older than the window is left out
+	if err := svc.RecordTraffic([]*xray.Traffic{{IsInbound: true, Tag: "in-a", Up: 1 << 30}}, now.Add(-48*time.Hour)); err != nil {
+		t.Fatalf("RecordTraffic failed: %v", err)
+	}
+	if err := svc.RollupTrafficHistory(now); err != nil {
+		t.Fatalf("RollupTrafficHistory failed: %v", err)
+	}
+
+	report, err := svc.GetTopTalkers(0, 0, 2)
+	if err != nil {
+		t.Fatalf("GetTopTalkers failed: %v", err)
+	}
+	if report.Resolution != TrafficResolutionHour {
+		t.Fatalf("expected an hourly report, got %s", report.Resolution)
+	}
+	if len(report.Clients) != 2 || report.Clients[0].Name != "big" || report.Clients[0].Total != 1000 || report.Clients[1].Name != "medium" {
+		t.Fatalf("unexpected top clients: %+v", report.Clients)
+	}
+	if len(report.Inbounds) != 2 || report.Inbounds[0].Name != "in-b" || report.Inbounds[0].Total != 1400 || report.Inbounds[1].Total != 60 {
+		t.Fatalf("unexpected top inbounds: %+v", report.Inbounds)
+	}
+	if len(report.Outbounds) != 1 || report.Outbounds[0].Name != "direct" || report.Outbounds[0].Up != 10 {
+		t.Fatalf("unexpected top outbounds: %+v", report.Outbounds)
+	}
+
+	var csv strings.Builder
+	if err := svc.WriteReportCSV(&csv, report); err != nil {
+		t.Fatalf("WriteReportCSV failed: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(csv.String()), "\n")
+	if len(lines) != 6 || lines[0] != "category,name,up,down,total" || lines[1] != "client,big,100,900,1000" || lines[5] != "outbound,direct,10,10,20" {
+		t.Fatalf("unexpected CSV report:\n%s", csv.String())
+	}
+
+	// Windows past the hourly retention use daily totals
+	report, err = svc.GetTopTalkers(now.AddDate(0, 0, -30).Unix(), 0, 0)
+	if err != nil {
+		t.Fatalf("GetTopTalkers failed: %v", err)
+	}
+	if report.Resolution != TrafficResolutionDay || len(report.Inbounds) != 2 || report.Inbounds[0].Name != "in-a" {
+		t.Fatalf("unexpected daily report: %s %+v", report.Resolution, report.Inbounds)
+	}
+}
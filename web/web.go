@@ -5,6 +5,7 @@ package web
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"embed"
 	"html/template"
 	"io"
@@ -510,6 +511,8 @@ func (s *Server) startTask() {
 		// Statistics every 10 seconds, start the delay for 5 seconds for the first time, and staggered with the time to restart xray
 		s.cron.AddJob("@every 10s", job.NewXrayTrafficJob())
 	}()
+	// Roll client, inbound and outbound traffic history up into daily and monthly totals every hour
+	s.cron.AddJob("@hourly", job.NewTrafficHistoryRollupJob())
 
 	// check client ips from log file every 10 sec
 	s.cron.AddJob("@every 10s", job.NewCheckClientIpJob())
@@ -524,6 +527,8 @@ func (s *Server) startTask() {
 	s.cron.AddJob("@weekly", job.NewPeriodicTrafficResetJob("weekly"))
 	// Run once a month, midnight, first of month
 	s.cron.AddJob("@monthly", job.NewPeriodicTrafficResetJob("monthly"))
+	// Client traffic reset schedules are checked every minute
+	s.cron.AddJob("@every 1m", job.NewClientTrafficResetJob())
 
 	// LDAP sync scheduling
 	if ldapEnabled, _ := s.settingService.GetLdapEnable(); ldapEnabled {
@@ -538,9 +543,23 @@ func (s *Server) startTask() {
 
 	// Nodes: periodic status checks and stats sync
 	// Check status every 30s
-	s.cron.AddJob("@every 30s", job.NewNodeStatusJob())
+	s.cron.AddJob("@every 30s", job.NewNodeStatusJob(s.ctx))
+	// Drop node status history past the uptime report range daily
+	s.cron.AddJob("@daily", job.NewNodeStatusEventJob())
 	// Sync stats every 2 minutes
-	s.cron.AddJob("@every 2m", job.NewNodeSyncJob())
+	s.cron.AddJob("@every 2m", job.NewNodeSyncJob(s.ctx))
+	// Roll node stats and status checks up into hourly and daily aggregates every hour
+	s.cron.AddJob("@hourly", job.NewNodeStatsRollupJob())
+	// Reconcile managed nodes against their inbound specs every 5 minutes
+	s.cron.AddJob("@every 5m", job.NewNodeReconcileJob())
+	// Enforce multi-subscription quotas across nodes every minute
+	s.cron.AddJob("@every 1m", job.NewGlobalClientQuotaJob())
+	// Drop external API key audit records past their retention daily
+	s.cron.AddJob("@daily", job.NewApiKeyAuditJob())
+	// Write queued subscription fetches to the access log every 10 seconds
+	s.cron.AddJob("@every 10s", job.NewSubscriptionAccessFlushJob())
+	// Drop subscription access records past their retention daily
+	s.cron.AddJob("@daily", job.NewSubscriptionAccessJob())
 
 	// Make a traffic condition every day, 8:30
 	var entry cron.EntryID
@@ -619,6 +638,18 @@ func (s *Server) Start() (err error) {
 			c := &tls.Config{
 				Certificates: []tls.Certificate{cert},
 			}
+			// Ask for client certificates so the external API can authenticate nodes over mTLS
+			if clientCA, _ := s.settingService.GetExternalAPIClientCA(); clientCA != "" {
+				if pem, err := os.ReadFile(clientCA); err == nil {
+					pool := x509.NewCertPool()
+					if pool.AppendCertsFromPEM(pem) {
+						c.ClientCAs = pool
+						c.ClientAuth = tls.VerifyClientCertIfGiven
+					}
+				} else {
+					logger.Warning("Error loading external API client CA:", err)
+				}
+			}
 			listener = network.NewAutoHttpsListener(listener)
 			listener = tls.NewListener(listener, c)
 			logger.Info("Web server running HTTPS on", listener.Addr())
@@ -16,4 +16,8 @@ type ClientTraffic struct {
 	Total      int64  `json:"total" form:"total"`
 	Reset      int    `json:"reset" form:"reset" gorm:"default:0"`
 	LastOnline int64  `json:"lastOnline" form:"lastOnline" gorm:"default:0"`
+
+	ResetSpec        string `json:"-"` // Client reset schedule that NextTrafficReset was computed for
+	LastTrafficReset int64  `json:"lastTrafficReset" form:"lastTrafficReset" gorm:"default:0"`
+	NextTrafficReset int64  `json:"nextTrafficReset" form:"nextTrafficReset" gorm:"default:0"`
 }